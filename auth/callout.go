@@ -0,0 +1,248 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+// Largest response of an auth service read over HTTP.
+const maxCalloutResponse = 1024 * 1024
+
+// Callout authenticates the clients with an external auth service. The
+// credentials, address and TLS peer certificates of a client are sent in
+// a CalloutRequest, on a subject of the server or to an HTTP endpoint,
+// and the CalloutResponse allows or denies the client with its account
+// and permissions. Decisions are cached, and clients are denied when the
+// auth service does not answer in time.
+type Callout struct {
+	local    server.Auth
+	users    map[string]bool
+	nkeys    map[string]bool
+	accounts map[string]bool
+	serverID string
+	send     func([]byte) ([]byte, error)
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	cache     map[string]calloutDecision
+	nextPrune time.Time
+}
+
+// CalloutRequest is sent to the auth service for a client.
+type CalloutRequest struct {
+	Server string      `json:"server_id"`
+	Host   string      `json:"host"`
+	User   string      `json:"user,omitempty"`
+	Pass   string      `json:"pass,omitempty"`
+	Token  string      `json:"auth_token,omitempty"`
+	Name   string      `json:"name,omitempty"`
+	TLS    *CalloutTLS `json:"tls,omitempty"`
+}
+
+// CalloutTLS describes the TLS connection of a client.
+type CalloutTLS struct {
+	Version     uint16 `json:"version"`
+	CipherSuite uint16 `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	// PEM encoded certificates of the client, its own first.
+	Certs []string `json:"certs,omitempty"`
+	// The certificates were verified by the server.
+	Verified bool `json:"verified"`
+}
+
+// CalloutResponse is the decision of the auth service for a client.
+type CalloutResponse struct {
+	Allow       bool                `json:"allow"`
+	Account     string              `json:"account,omitempty"`
+	Permissions *server.Permissions `json:"permissions,omitempty"`
+	// Why the client is denied, it is logged.
+	Error string `json:"error,omitempty"`
+}
+
+type calloutDecision struct {
+	resp    *CalloutResponse
+	expires time.Time
+}
+
+// NewCallout creates the auth callout configured in the options. The
+// local authentication, if any, is checked first: the users it knows
+// are never authenticated by the auth service.
+func NewCallout(s *server.Server, opts *server.Options, local server.Auth) *Callout {
+	ac := *opts.AuthCallout
+	if ac.Timeout == 0 {
+		ac.Timeout = server.DEFAULT_AUTH_CALLOUT_TIMEOUT
+	}
+	if ac.TTL == 0 {
+		ac.TTL = server.DEFAULT_AUTH_CALLOUT_TTL
+	}
+	co := &Callout{
+		local:    local,
+		users:    make(map[string]bool),
+		nkeys:    make(map[string]bool),
+		accounts: make(map[string]bool),
+		serverID: s.ID(),
+		ttl:      ac.TTL,
+		cache:    make(map[string]calloutDecision),
+	}
+	if opts.Username != "" {
+		co.users[opts.Username] = true
+	}
+	for _, u := range opts.Users {
+		if u.Nkey != "" {
+			co.nkeys[u.Nkey] = true
+		} else {
+			co.users[u.Username] = true
+		}
+	}
+	for _, a := range opts.Accounts {
+		co.accounts[a.Name] = true
+	}
+	if ac.URL != "" {
+		co.send = httpSender(ac.URL, ac.Timeout)
+	} else {
+		subject := ac.Subject
+		if subject == "" {
+			subject = server.DEFAULT_AUTH_CALLOUT_SUBJECT
+		}
+		co.send = func(req []byte) ([]byte, error) {
+			return s.Request(subject, req, ac.Timeout)
+		}
+	}
+	return co
+}
+
+// httpSender posts the requests to the HTTP endpoint of the auth service.
+func httpSender(url string, timeout time.Duration) func([]byte) ([]byte, error) {
+	hc := &http.Client{Timeout: timeout}
+	return func(req []byte) ([]byte, error) {
+		resp, err := hc.Post(url, "application/json", bytes.NewReader(req))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %q", resp.Status)
+		}
+		return ioutil.ReadAll(io.LimitReader(resp.Body, maxCalloutResponse))
+	}
+}
+
+// Check authenticates the client with the local authentication, else
+// with the auth service.
+func (co *Callout) Check(c server.ClientAuth) bool {
+	if co.local != nil && co.local.Check(c) {
+		return true
+	}
+	opts := c.GetOpts()
+	if co.users[opts.Username] || co.nkeys[opts.Nkey] {
+		return false
+	}
+
+	req := co.newRequest(c)
+	b, err := json.Marshal(req)
+	if err != nil {
+		server.Errorf("Error marshalling auth callout request: %v", err)
+		return false
+	}
+	key := fmt.Sprintf("%x", sha256.Sum256(b))
+	resp := co.cached(key)
+	if resp == nil {
+		data, err := co.send(b)
+		if err != nil {
+			server.Errorf("Auth callout for %s failed: %v", req.Host, err)
+			return false
+		}
+		resp = &CalloutResponse{}
+		if err := json.Unmarshal(data, resp); err != nil {
+			server.Errorf("Invalid auth callout response for %s: %v", req.Host, err)
+			return false
+		}
+		co.store(key, resp)
+	}
+
+	if !resp.Allow {
+		server.Debugf("Auth callout denied %s: %s", req.Host, resp.Error)
+		return false
+	}
+	if resp.Account != "" && !co.accounts[resp.Account] {
+		server.Errorf("Auth callout for %s returned unknown account %q", req.Host, resp.Account)
+		return false
+	}
+	c.RegisterUser(&server.User{
+		Username:    opts.Username,
+		Account:     resp.Account,
+		Permissions: resp.Permissions,
+	})
+	return true
+}
+
+func (co *Callout) newRequest(c server.ClientAuth) *CalloutRequest {
+	opts := c.GetOpts()
+	req := &CalloutRequest{
+		Server: co.serverID,
+		User:   opts.Username,
+		Pass:   opts.Password,
+		Token:  opts.Authorization,
+		Name:   opts.Name,
+	}
+	if addr := c.RemoteAddress(); addr != nil {
+		// Without the port, so that the decision is cached for the host.
+		req.Host = addr.String()
+		if host, _, err := net.SplitHostPort(req.Host); err == nil {
+			req.Host = host
+		}
+	}
+	if state := c.GetTLSConnectionState(); state != nil {
+		t := &CalloutTLS{
+			Version:     state.Version,
+			CipherSuite: state.CipherSuite,
+			ServerName:  state.ServerName,
+			Verified:    len(state.VerifiedChains) > 0,
+		}
+		for _, cert := range state.PeerCertificates {
+			b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			t.Certs = append(t.Certs, string(b))
+		}
+		req.TLS = t
+	}
+	return req
+}
+
+// cached returns the decision for the request, if it has not expired.
+func (co *Callout) cached(key string) *CalloutResponse {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if d, ok := co.cache[key]; ok && time.Now().Before(d.expires) {
+		return d.resp
+	}
+	return nil
+}
+
+// store caches the decision for the request, and drops the expired ones.
+func (co *Callout) store(key string, resp *CalloutResponse) {
+	now := time.Now()
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if now.After(co.nextPrune) {
+		for k, d := range co.cache {
+			if now.After(d.expires) {
+				delete(co.cache, k)
+			}
+		}
+		co.nextPrune = now.Add(co.ttl)
+	}
+	co.cache[key] = calloutDecision{resp: resp, expires: now.Add(co.ttl)}
+}
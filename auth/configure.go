@@ -0,0 +1,65 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package auth
+
+import (
+	"github.com/glycerine/hnatsd/server"
+)
+
+// Configure sets the authentication methods of the clients, of the
+// additional listeners and of the routes from the options. It is the
+// AuthConfigurer of the server, called again on configuration reload.
+func Configure(s *server.Server, opts *server.Options) {
+	// Client
+	var clientAuth server.Auth
+	// Users mapped from the client certificates first
+	if opts.TLSMap {
+		clientAuth = NewTLSMap(opts.Users)
+	} else if opts.Users != nil {
+		clientAuth = NewUsers(opts.Users)
+	} else if opts.Username != "" {
+		clientAuth = &Plain{
+			Username: opts.Username,
+			Password: opts.Password,
+		}
+	} else if opts.Authorization != "" {
+		clientAuth = &Token{
+			Token: opts.Authorization,
+		}
+	}
+	// Clients with a JWT signed by a trusted operator
+	if opts.JWT != nil {
+		clientAuth = NewJWT(s, opts, clientAuth)
+	}
+	// The other clients are authenticated by the external auth service
+	if opts.AuthCallout != nil {
+		clientAuth = NewCallout(s, opts, clientAuth)
+	}
+	s.SetClientAuthMethod(clientAuth)
+
+	// Additional client listeners with their own authorization
+	for i, lo := range opts.Listeners {
+		var listenerAuth server.Auth
+		if lo.Users != nil {
+			listenerAuth = NewUsers(lo.Users)
+		} else if lo.Username != "" {
+			listenerAuth = &Plain{
+				Username: lo.Username,
+				Password: lo.Password,
+			}
+		}
+		s.SetListenerAuthMethod(i, listenerAuth)
+	}
+
+	// Routes
+	var routeAuth server.Auth
+	if opts.Cluster.TLSMap {
+		routeAuth = NewRouteTLSMap(opts.Cluster.Users)
+	} else if opts.Cluster.Username != "" {
+		routeAuth = &Plain{
+			Username: opts.Cluster.Username,
+			Password: opts.Cluster.Password,
+		}
+	}
+	s.SetRouteAuthMethod(routeAuth)
+}
@@ -0,0 +1,259 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+// Types of the claims of a JWT.
+const (
+	AccountClaim = "account"
+	UserClaim    = "user"
+)
+
+// jwtHeader is the header of the JWTs, signed with an Ed25519 key.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ed25519"}`))
+
+// Claims are the content of a JWT. An account JWT is signed by an
+// operator, a user JWT by an operator or by the key of an account.
+type Claims struct {
+	// Unique ID of the JWT, it can be revoked.
+	ID string `json:"jti,omitempty"`
+	// Public key of the signer.
+	Issuer string `json:"iss"`
+	// Public key of the account or of the user.
+	Subject   string `json:"sub"`
+	Name      string `json:"name,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Expires   int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Type      string `json:"type"`
+	// Configured account of the user, or the one an account JWT is for.
+	Account string `json:"account,omitempty"`
+	// Permissions and limits of the user, the ones of the account JWT
+	// apply to the users without.
+	Permissions *server.Permissions `json:"permissions,omitempty"`
+	Limits      *server.UserLimits  `json:"limits,omitempty"`
+}
+
+// valid returns an error if the claims are not valid at the time.
+func (cl *Claims) valid(now time.Time) error {
+	if cl.Expires != 0 && now.Unix() >= cl.Expires {
+		return errors.New("expired")
+	}
+	if cl.NotBefore != 0 && now.Unix() < cl.NotBefore {
+		return errors.New("not yet valid")
+	}
+	return nil
+}
+
+// EncodeJWT signs the claims with the key, which is their issuer.
+func EncodeJWT(cl *Claims, key ed25519.PrivateKey) (string, error) {
+	c := *cl
+	c.Issuer = base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	payload := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(b)
+	sig := ed25519.Sign(key, []byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// DecodeJWT returns the claims of the JWT, once verified that they are
+// signed by their issuer.
+func DecodeJWT(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	if parts[0] != jwtHeader {
+		return nil, errors.New("unsupported JWT header")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %v", err)
+	}
+	cl := &Claims{}
+	if err := json.Unmarshal(b, cl); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %v", err)
+	}
+	issuer, err := server.DecodeNkey(cl.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(issuer, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New("invalid JWT signature")
+	}
+	return cl, nil
+}
+
+// JWT authenticates the clients which send a user JWT in the CONNECT,
+// and the signature of the nonce with the key of the user, the subject
+// of the JWT. The JWT is signed by a trusted operator, or by an account
+// with a JWT signed by a trusted operator in the accounts directory.
+// Clients are disconnected when their JWT or the one of their account
+// expires or is revoked. The other clients are authenticated locally.
+type JWT struct {
+	s           *server.Server
+	local       server.Auth
+	operators   map[string]bool
+	accountsDir string
+	accounts    map[string]bool
+}
+
+// NewJWT creates the JWT authentication configured in the options.
+func NewJWT(s *server.Server, opts *server.Options, local server.Auth) *JWT {
+	j := &JWT{
+		s:           s,
+		local:       local,
+		operators:   make(map[string]bool),
+		accountsDir: opts.JWT.AccountsDir,
+		accounts:    make(map[string]bool),
+	}
+	for _, op := range opts.JWT.Operators {
+		j.operators[op] = true
+	}
+	for _, a := range opts.Accounts {
+		j.accounts[a.Name] = true
+	}
+	return j
+}
+
+// Check authenticates the client by its JWT, else with the local
+// authentication.
+func (j *JWT) Check(c server.ClientAuth) bool {
+	opts := c.GetOpts()
+	if opts.JWT == "" {
+		return j.local != nil && j.local.Check(c)
+	}
+	user, err := j.verify(opts.JWT, c.GetNonce(), opts.Sig)
+	if err != nil {
+		server.Debugf("Invalid JWT: %v", err)
+		return false
+	}
+	c.RegisterUser(user.user)
+	c.SetExpiration(user.expires)
+	return true
+}
+
+// jwtUser is the user of a verified JWT.
+type jwtUser struct {
+	user    *server.User
+	expires time.Time
+}
+
+// verify checks the JWT of the user, its chain of trust up to an
+// operator and the signature of the nonce.
+func (j *JWT) verify(token string, nonce []byte, sig string) (*jwtUser, error) {
+	now := time.Now()
+	uc, err := DecodeJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if uc.Type != UserClaim {
+		return nil, fmt.Errorf("%q is not a user JWT", uc.Subject)
+	}
+	if err := uc.valid(now); err != nil {
+		return nil, fmt.Errorf("user %q: %v", uc.Subject, err)
+	}
+
+	// The user JWT is signed by an operator or by an account.
+	var ac *Claims
+	if !j.operators[uc.Issuer] {
+		if ac, err = j.loadAccount(uc.Issuer); err != nil {
+			return nil, fmt.Errorf("user %q: %v", uc.Subject, err)
+		}
+		if err := ac.valid(now); err != nil {
+			return nil, fmt.Errorf("account %q: %v", ac.Subject, err)
+		}
+		if uc.Account != "" && uc.Account != ac.Account {
+			return nil, fmt.Errorf("user %q not in account %q", uc.Subject, ac.Account)
+		}
+	}
+	ids := []string{uc.Subject, uc.ID}
+	if ac != nil {
+		ids = append(ids, ac.Subject, ac.ID)
+	}
+	if j.s.IsRevoked(ids...) {
+		return nil, fmt.Errorf("user %q is revoked", uc.Subject)
+	}
+
+	// The client holds the key of the user.
+	key, err := server.DecodeNkey(uc.Subject)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || len(nonce) == 0 || !ed25519.Verify(key, nonce, sb) {
+		return nil, fmt.Errorf("user %q: invalid nonce signature", uc.Subject)
+	}
+
+	// The public key is the name, so that it can not be a local user.
+	user := &server.User{
+		Username:    uc.Subject,
+		Account:     uc.Account,
+		Permissions: uc.Permissions,
+		Limits:      uc.Limits,
+	}
+	expires := uc.Expires
+	if ac != nil {
+		user.Account = ac.Account
+		if user.Permissions == nil {
+			user.Permissions = ac.Permissions
+		}
+		if user.Limits == nil {
+			user.Limits = ac.Limits
+		}
+		if ac.Expires != 0 && (expires == 0 || ac.Expires < expires) {
+			expires = ac.Expires
+		}
+	}
+	if user.Account != "" && !j.accounts[user.Account] {
+		return nil, fmt.Errorf("user %q: unknown account %q", uc.Subject, user.Account)
+	}
+	ju := &jwtUser{user: user}
+	if expires != 0 {
+		ju.expires = time.Unix(expires, 0)
+	}
+	return ju, nil
+}
+
+// loadAccount returns the claims of the account JWT of the key, signed
+// by an operator.
+func (j *JWT) loadAccount(key string) (*Claims, error) {
+	// Also checks that the key is safe in a file name.
+	if _, err := server.DecodeNkey(key); err != nil {
+		return nil, err
+	}
+	if j.accountsDir == "" {
+		return nil, fmt.Errorf("issuer %q is not a trusted operator", key)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(j.accountsDir, key+".jwt"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown issuer %q", key)
+	}
+	ac, err := DecodeJWT(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("account %q: %v", key, err)
+	}
+	if ac.Type != AccountClaim || ac.Subject != key {
+		return nil, fmt.Errorf("%q is not the account JWT of %q", ac.Subject, key)
+	}
+	if !j.operators[ac.Issuer] {
+		return nil, fmt.Errorf("account %q: issuer %q is not a trusted operator", key, ac.Issuer)
+	}
+	return ac, nil
+}
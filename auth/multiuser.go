@@ -16,6 +16,10 @@ type MultiUser struct {
 func NewMultiUser(users []*server.User) *MultiUser {
 	m := &MultiUser{users: make(map[string]*server.User)}
 	for _, u := range users {
+		// Users with a public key have no password, see NkeyUser.
+		if u.Nkey != "" {
+			continue
+		}
 		m.users[u.Username] = u
 	}
 	return m
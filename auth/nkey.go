@@ -0,0 +1,84 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+// NkeyUser authenticates the users with a public key by their Ed25519
+// signature of the nonce sent in the INFO, and the other users by their
+// username and password.
+type NkeyUser struct {
+	nkeys     map[string]*nkeyEntry
+	passwords *MultiUser
+}
+
+type nkeyEntry struct {
+	user *server.User
+	key  ed25519.PublicKey
+}
+
+// NewNkeyUser creates the authentication of the users, the ones with an
+// invalid public key are ignored.
+func NewNkeyUser(users []*server.User) *NkeyUser {
+	m := &NkeyUser{
+		nkeys:     make(map[string]*nkeyEntry),
+		passwords: NewMultiUser(users),
+	}
+	for _, u := range users {
+		if u.Nkey == "" {
+			continue
+		}
+		key, err := server.DecodeNkey(u.Nkey)
+		if err != nil {
+			server.Errorf("Ignoring user: %v", err)
+			continue
+		}
+		m.nkeys[u.Nkey] = &nkeyEntry{user: u, key: key}
+	}
+	return m
+}
+
+// NewUsers creates the authentication of the users, by public key if
+// any of them has one, else by password.
+func NewUsers(users []*server.User) server.Auth {
+	for _, u := range users {
+		if u.Nkey != "" {
+			return NewNkeyUser(users)
+		}
+	}
+	return NewMultiUser(users)
+}
+
+// Check authenticates the client by the signature of its nonce if it
+// sends a public key, else by its username and password.
+func (m *NkeyUser) Check(c server.ClientAuth) bool {
+	opts := c.GetOpts()
+	if opts.Nkey == "" {
+		return m.passwords.Check(c)
+	}
+	entry, ok := m.nkeys[opts.Nkey]
+	if !ok {
+		return false
+	}
+	nonce := c.GetNonce()
+	if len(nonce) == 0 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(opts.Sig)
+	if err != nil {
+		// Also accept the padded encoding of some clients.
+		if sig, err = base64.URLEncoding.DecodeString(opts.Sig); err != nil {
+			return false
+		}
+	}
+	if !ed25519.Verify(entry.key, nonce, sig) {
+		return false
+	}
+	c.RegisterUser(entry.user)
+	return true
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package auth
+
+import (
+	"crypto/x509"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+// TLSMap authenticates the clients by their verified TLS certificate,
+// without a password: the user is the first identity of the certificate
+// that is a configured user name, among its email addresses, DNS names
+// and URIs, then its subject distinguished name, e.g. "CN=alice,O=Acme".
+type TLSMap struct {
+	users map[string]*server.User
+	// Routes are only authenticated, they have no permissions.
+	routes bool
+}
+
+// NewTLSMap creates the certificate mapping to the users for clients.
+func NewTLSMap(users []*server.User) *TLSMap {
+	m := &TLSMap{users: make(map[string]*server.User)}
+	for _, u := range users {
+		// Users with a public key are not identities of certificates.
+		if u.Nkey != "" {
+			continue
+		}
+		m.users[u.Username] = u
+	}
+	return m
+}
+
+// NewRouteTLSMap creates the certificate mapping for routes, the
+// identities of the peers are the names of the users.
+func NewRouteTLSMap(users []*server.User) *TLSMap {
+	m := NewTLSMap(users)
+	m.routes = true
+	return m
+}
+
+// Check authenticates the client by the identity of its certificate.
+func (m *TLSMap) Check(c server.ClientAuth) bool {
+	state := c.GetTLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return false
+	}
+	for _, id := range certIdentities(state.PeerCertificates[0]) {
+		user, ok := m.users[id]
+		if !ok {
+			continue
+		}
+		if !m.routes {
+			c.RegisterUser(user)
+		}
+		return true
+	}
+	return false
+}
+
+// certIdentities returns the identities of the certificate, in the
+// order they are mapped to users.
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	ids = append(ids, cert.EmailAddresses...)
+	ids = append(ids, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	return append(ids, cert.Subject.String())
+}
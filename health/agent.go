@@ -3,6 +3,7 @@ package health
 import (
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/glycerine/hnatsd/server"
@@ -13,7 +14,11 @@ import (
 // leader election from among the candidate
 // hnatsd instances in a cluster.
 type Agent struct {
-	opts  *server.Options
+	opts *server.Options
+
+	// mship is set by Start and read by the
+	// monitoring endpoints, protected by mu.
+	mu    sync.Mutex
 	mship *Membership
 }
 
@@ -58,12 +63,35 @@ func (h *Agent) Start(
 		CliConn:      cli,
 		Log:          logger,
 	}
-	h.mship = NewMembership(cfg)
-	go h.mship.Start()
+	mship := NewMembership(cfg)
+	h.mu.Lock()
+	h.mship = mship
+	h.mu.Unlock()
+	go mship.Start()
 	return srv, nil
 }
 
+func (h *Agent) membership() *Membership {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.mship
+}
+
+// Leader returns the ID of the elected leader and whether
+// this server is the leader. It implements server.LeaderReporter.
+func (h *Agent) Leader() (string, bool) {
+	mship := h.membership()
+	if mship == nil {
+		return "", false
+	}
+	lead := mship.elec.getLeader()
+	myLoc := mship.getMyLocWithZeroLease()
+	return lead.ID, lead.ID != "" && slocEqualIgnoreLease(&lead, &myLoc)
+}
+
 // Stop halts the background goroutine.
 func (h *Agent) Stop() {
-	h.mship.Stop()
+	if mship := h.membership(); mship != nil {
+		mship.Stop()
+	}
 }
@@ -12,7 +12,6 @@ import (
 
 	"github.com/glycerine/hnatsd/auth"
 	"github.com/glycerine/hnatsd/health"
-	"github.com/glycerine/hnatsd/logger"
 	"github.com/glycerine/hnatsd/server"
 )
 
@@ -25,7 +24,8 @@ Server Options:
     -P, --pid <file>                 File to store PID
     -m, --http_port <port>           Use port for http monitoring
     -ms,--https_port <port>          Use port for https monitoring
-    -c, --config <file>              Configuration file
+    -c, --config <file>              Configuration file (reloaded on SIGHUP)
+    -sl,--signal <signal>[=<pid>]    Send signal to hnatsd process (quit, reopen, ldm, reload, upgrade)
 
 Logging Options:
     -l, --log <file>                 File to redirect log output
@@ -80,6 +80,7 @@ func main() {
 	var debugAndTrace bool
 	var configFile string
 	var showTLSHelp bool
+	var signal string
 
 	// Parse flags
 	flag.IntVar(&opts.Port, "port", 0, "Port to listen on.")
@@ -103,6 +104,8 @@ func main() {
 	flag.IntVar(&opts.HTTPSPort, "https_port", 0, "HTTPS Port for /varz, /connz endpoints.")
 	flag.StringVar(&configFile, "c", "", "Configuration file.")
 	flag.StringVar(&configFile, "config", "", "Configuration file.")
+	flag.StringVar(&signal, "sl", "", "Send signal to hnatsd process (quit, reopen, ldm, reload, upgrade).")
+	flag.StringVar(&signal, "signal", "", "Send signal to hnatsd process (quit, reopen, ldm, reload, upgrade).")
 	flag.StringVar(&opts.PidFile, "P", "", "File to store process pid.")
 	flag.StringVar(&opts.PidFile, "pid", "", "File to store process pid.")
 	flag.StringVar(&opts.LogFile, "l", "", "File to store logging output.")
@@ -168,6 +171,15 @@ func main() {
 			server.PrintAndDie(err.Error())
 		}
 		opts = *server.MergeOptions(fileOpts, &opts)
+		opts.ConfigFile = configFile
+	}
+
+	// Signal a running server instead of starting one.
+	if signal != "" {
+		if err := server.ProcessSignal(signal, opts.PidFile); err != nil {
+			server.PrintAndDie(err.Error())
+		}
+		os.Exit(0)
 	}
 
 	// Remove any host/ip that points to itself in Route
@@ -194,66 +206,16 @@ func main() {
 	s := server.New(&opts)
 
 	// Configure the authentication mechanism
-	configureAuth(s, &opts)
+	auth.Configure(s, &opts)
+	s.SetAuthConfigurer(auth.Configure)
 
 	// Configure the logger based on the flags
-	configureLogger(s, &opts)
+	s.ConfigureLogger()
 
 	// Start things up. Block here until done.
 	s.Start()
 }
 
-func configureAuth(s *server.Server, opts *server.Options) {
-	// Client
-	// Check for multiple users first
-	if opts.Users != nil {
-		auth := auth.NewMultiUser(opts.Users)
-		s.SetClientAuthMethod(auth)
-	} else if opts.Username != "" {
-		auth := &auth.Plain{
-			Username: opts.Username,
-			Password: opts.Password,
-		}
-		s.SetClientAuthMethod(auth)
-	} else if opts.Authorization != "" {
-		auth := &auth.Token{
-			Token: opts.Authorization,
-		}
-		s.SetClientAuthMethod(auth)
-	}
-	// Routes
-	if opts.Cluster.Username != "" {
-		auth := &auth.Plain{
-			Username: opts.Cluster.Username,
-			Password: opts.Cluster.Password,
-		}
-		s.SetRouteAuthMethod(auth)
-	}
-}
-
-func configureLogger(s *server.Server, opts *server.Options) {
-	var log server.Logger
-
-	if opts.LogFile != "" {
-		log = logger.NewFileLogger(opts.LogFile, opts.Logtime, opts.Debug, opts.Trace, true, 0)
-	} else if opts.RemoteSyslog != "" {
-		log = logger.NewRemoteSysLogger(opts.RemoteSyslog, opts.Debug, opts.Trace)
-	} else if opts.Syslog {
-		log = logger.NewSysLogger(opts.Debug, opts.Trace)
-	} else {
-		colors := true
-		// Check to see if stderr is being redirected and if so turn off color
-		// Also turn off colors if we're running on Windows where os.Stderr.Stat() returns an invalid handle-error
-		stat, err := os.Stderr.Stat()
-		if err != nil || (stat.Mode()&os.ModeCharDevice) == 0 {
-			colors = false
-		}
-		log = logger.NewStdLogger(opts.Logtime, opts.Debug, opts.Trace, colors, true, 0)
-	}
-
-	s.SetLogger(log, opts.Debug, opts.Trace)
-}
-
 func configureTLS(opts *server.Options) {
 	// If no trigger flags, ignore the others
 	if !opts.TLS && !opts.TLSVerify {
@@ -223,7 +223,8 @@ func hnatsdMain(args []string) (*server.Server, *server.Options, error) {
 	s := server.New(&opts)
 
 	// Configure the authentication mechanism
-	configureAuth(s, &opts)
+	auth.Configure(s, &opts)
+	s.SetAuthConfigurer(auth.Configure)
 
 	// Configure the logger based on the flags
 	configureLogger(s, &opts)
@@ -231,34 +232,6 @@ func hnatsdMain(args []string) (*server.Server, *server.Options, error) {
 	return s, &opts, nil
 }
 
-func configureAuth(s *server.Server, opts *server.Options) {
-	// Client
-	// Check for multiple users first
-	if opts.Users != nil {
-		auth := auth.NewMultiUser(opts.Users)
-		s.SetClientAuthMethod(auth)
-	} else if opts.Username != "" {
-		auth := &auth.Plain{
-			Username: opts.Username,
-			Password: opts.Password,
-		}
-		s.SetClientAuthMethod(auth)
-	} else if opts.Authorization != "" {
-		auth := &auth.Token{
-			Token: opts.Authorization,
-		}
-		s.SetClientAuthMethod(auth)
-	}
-	// Routes
-	if opts.Cluster.Username != "" {
-		auth := &auth.Plain{
-			Username: opts.Cluster.Username,
-			Password: opts.Cluster.Password,
-		}
-		s.SetRouteAuthMethod(auth)
-	}
-}
-
 func configureLogger(s *server.Server, opts *server.Options) {
 	var log server.Logger
 
@@ -0,0 +1,258 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptOpts filters the connections accepted on a listener by the IP
+// address of their source. Denied addresses take precedence over the
+// allowed ones, and all addresses are allowed when none is listed.
+type AcceptOpts struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// New connections per second from a source IP, no limit when 0.
+	Rate float64 `json:"rate,omitempty"`
+	// New connections from a source IP accepted at once, before the rate
+	// applies. Defaults to the rate.
+	Burst int `json:"burst,omitempty"`
+}
+
+// Listeners the connections are filtered on.
+const (
+	acceptClient  = "client"
+	acceptCluster = "cluster"
+	acceptHTTP    = "http"
+)
+
+// How often the token buckets of the sources that did not connect
+// for a while are dropped.
+const bucketPruneInterval = time.Minute
+
+// RejectStats counts the connections rejected on a listener.
+type RejectStats struct {
+	Denied      int64 `json:"denied"`
+	RateLimited int64 `json:"rate_limited"`
+	Banned      int64 `json:"banned"`
+}
+
+// connGate applies the AcceptOpts of a listener.
+type connGate struct {
+	mu        sync.Mutex
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	nextPrune time.Time
+	// Source IPs banned until a time, kept across configurations.
+	bans map[string]time.Time
+
+	denied      int64
+	rateLimited int64
+	banned      int64
+}
+
+// tokenBucket limits the new connections from a source IP.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// parseNets parses CIDR blocks, or single IP addresses.
+func parseNets(addrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address or CIDR block %q", a)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// validateAccept checks the connection filters of the options.
+func validateAccept(opts *Options) error {
+	for name, ao := range map[string]*AcceptOpts{
+		acceptClient:  opts.ClientAccept,
+		acceptCluster: opts.ClusterAccept,
+		acceptHTTP:    opts.HTTPAccept,
+	} {
+		if ao == nil {
+			continue
+		}
+		if _, err := parseNets(ao.Allow); err != nil {
+			return fmt.Errorf("Invalid %s allow list: %v", name, err)
+		}
+		if _, err := parseNets(ao.Deny); err != nil {
+			return fmt.Errorf("Invalid %s deny list: %v", name, err)
+		}
+		if ao.Rate < 0 || ao.Burst < 0 {
+			return fmt.Errorf("Invalid %s connection rate %v, burst %d", name, ao.Rate, ao.Burst)
+		}
+	}
+	return nil
+}
+
+// configure replaces the filters of the gate. The counters are kept.
+func (g *connGate) configure(ao *AcceptOpts) {
+	var allow, deny []*net.IPNet
+	var rate, burst float64
+	if ao != nil {
+		allow, _ = parseNets(ao.Allow)
+		deny, _ = parseNets(ao.Deny)
+		rate = ao.Rate
+		burst = float64(ao.Burst)
+		if burst == 0 {
+			burst = math.Max(1, math.Ceil(rate))
+		}
+	}
+	g.mu.Lock()
+	g.allow, g.deny = allow, deny
+	g.rate, g.burst = rate, burst
+	g.buckets = make(map[string]*tokenBucket)
+	g.mu.Unlock()
+}
+
+// configureAccept sets the connection filters of the listeners.
+func (s *Server) configureAccept() {
+	opts := s.getOpts()
+	s.clientGate.configure(opts.ClientAccept)
+	s.clusterGate.configure(opts.ClusterAccept)
+	s.httpGate.configure(opts.HTTPAccept)
+}
+
+// admit returns true if a connection from the address is accepted.
+func (g *connGate) admit(addr net.Addr, now time.Time) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until, ok := g.bans[ip.String()]; ok {
+		if now.Before(until) {
+			g.banned++
+			return false
+		}
+		delete(g.bans, ip.String())
+	}
+	if containsIP(g.deny, ip) || (len(g.allow) > 0 && !containsIP(g.allow, ip)) {
+		g.denied++
+		return false
+	}
+	if g.rate == 0 {
+		return true
+	}
+	if now.After(g.nextPrune) {
+		for key, b := range g.buckets {
+			if b.refill(now, g.rate, g.burst) >= g.burst {
+				delete(g.buckets, key)
+			}
+		}
+		g.nextPrune = now.Add(bucketPruneInterval)
+	}
+	b := g.buckets[host]
+	if b == nil {
+		b = &tokenBucket{tokens: g.burst, last: now}
+		g.buckets[host] = b
+	}
+	if b.refill(now, g.rate, g.burst) < 1 {
+		g.rateLimited++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ban rejects the connections from the IP until the time.
+func (g *connGate) ban(ip string, until time.Time) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.bans == nil {
+		g.bans = make(map[string]time.Time)
+	}
+	for b, u := range g.bans {
+		if now.After(u) {
+			delete(g.bans, b)
+		}
+	}
+	g.bans[ip] = until
+}
+
+// refill adds the tokens earned since the last connection.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) float64 {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*rate)
+		b.last = now
+	}
+	return b.tokens
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stats returns the counts of the rejected connections.
+func (g *connGate) stats() RejectStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return RejectStats{Denied: g.denied, RateLimited: g.rateLimited, Banned: g.banned}
+}
+
+// rejectStats returns the counts of the rejected connections by listener.
+func (s *Server) rejectStats() map[string]RejectStats {
+	return map[string]RejectStats{
+		acceptClient:  s.clientGate.stats(),
+		acceptCluster: s.clusterGate.stats(),
+		acceptHTTP:    s.httpGate.stats(),
+	}
+}
+
+// gatedListener closes the connections rejected by its gate, so
+// that they never reach the server.
+type gatedListener struct {
+	net.Listener
+	name string
+	gate *connGate
+}
+
+// Accept returns the next accepted connection.
+func (l *gatedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.gate.admit(conn.RemoteAddr(), time.Now()) {
+			return conn, nil
+		}
+		Debugf("Rejected %s connection from %s", l.name, conn.RemoteAddr())
+		conn.Close()
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAcceptConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/accept.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := &AcceptOpts{
+		Allow: []string{"10.0.0.0/8", "192.168.1.10"},
+		Deny:  []string{"10.1.0.0/16"},
+		Rate:  0.5,
+		Burst: 10,
+	}
+	if !reflect.DeepEqual(opts.ClientAccept, expected) {
+		t.Fatalf("Unexpected client accept: %+v", opts.ClientAccept)
+	}
+	if !reflect.DeepEqual(opts.HTTPAccept, &AcceptOpts{Allow: []string{"127.0.0.1"}}) {
+		t.Fatalf("Unexpected http accept: %+v", opts.HTTPAccept)
+	}
+	if !reflect.DeepEqual(opts.ClusterAccept, &AcceptOpts{Rate: 2}) {
+		t.Fatalf("Unexpected cluster accept: %+v", opts.ClusterAccept)
+	}
+
+	for _, ao := range []*AcceptOpts{
+		{Allow: []string{"10.0.0.0/33"}},
+		{Deny: []string{"localhost"}},
+		{Rate: -1},
+	} {
+		if err := validateAccept(&Options{ClientAccept: ao}); err == nil {
+			t.Fatalf("Expected an error for %+v", ao)
+		}
+	}
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestConnGateAllowDeny(t *testing.T) {
+	var g connGate
+	g.configure(&AcceptOpts{
+		Allow: []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	now := time.Now()
+	cases := []struct {
+		ip       string
+		admitted bool
+	}{
+		{"10.2.3.4", true},
+		{"10.1.3.4", false},
+		{"192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"fd00::1", true},
+		{"fe80::1", false},
+	}
+	for _, c := range cases {
+		if admitted := g.admit(tcpAddr(c.ip), now); admitted != c.admitted {
+			t.Fatalf("Expected admitted to be %v for %s", c.admitted, c.ip)
+		}
+	}
+	if st := g.stats(); st.Denied != 3 || st.RateLimited != 0 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	// No filters, all are admitted.
+	g.configure(nil)
+	if !g.admit(tcpAddr("10.1.3.4"), now) {
+		t.Fatal("Expected the connection to be admitted")
+	}
+}
+
+func TestConnGateRate(t *testing.T) {
+	var g connGate
+	g.configure(&AcceptOpts{Rate: 2, Burst: 3})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !g.admit(tcpAddr("10.0.0.1"), now) {
+			t.Fatalf("Expected connection %d of the burst to be admitted", i)
+		}
+	}
+	if g.admit(tcpAddr("10.0.0.1"), now) {
+		t.Fatal("Expected the connection over the burst to be rejected")
+	}
+	// Other sources have their own bucket.
+	if !g.admit(tcpAddr("10.0.0.2"), now) {
+		t.Fatal("Expected a connection from another source to be admitted")
+	}
+	// Two connections per second are admitted after the burst.
+	now = now.Add(500 * time.Millisecond)
+	if !g.admit(tcpAddr("10.0.0.1"), now) {
+		t.Fatal("Expected the connection to be admitted after the refill")
+	}
+	if g.admit(tcpAddr("10.0.0.1"), now) {
+		t.Fatal("Expected the connection to be rejected")
+	}
+	if st := g.stats(); st.Denied != 0 || st.RateLimited != 2 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	// Idle sources are pruned.
+	now = now.Add(2 * bucketPruneInterval)
+	g.admit(tcpAddr("10.0.0.3"), now)
+	if n := len(g.buckets); n != 1 {
+		t.Fatalf("Expected idle buckets to be pruned, got %d", n)
+	}
+}
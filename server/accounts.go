@@ -0,0 +1,309 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// globalAccount is the name of the account used by
+// clients that are not bound to any account.
+const globalAccount = "$G"
+
+// How long a service import waits for a response
+// before the response mapping is dropped.
+const responseTTL = 2 * time.Minute
+
+// AccountOpts is the configuration of an account. Users are bound to an
+// account through their User.Account field.
+type AccountOpts struct {
+	Name    string    `json:"name"`
+	Exports []*Export `json:"exports,omitempty"`
+	Imports []*Import `json:"imports,omitempty"`
+}
+
+// Export makes subjects of an account available to other accounts.
+// A stream export shares the messages published on the subject, a
+// service export accepts requests on it and routes the responses
+// back to the requestor.
+type Export struct {
+	Subject string `json:"subject"`
+	Service bool   `json:"service,omitempty"`
+}
+
+// Import brings subjects exported by another account into this one.
+type Import struct {
+	Account string `json:"account"`
+	Subject string `json:"subject"`
+	Service bool   `json:"service,omitempty"`
+}
+
+// Account is an isolated subject space. Messages published by a client
+// are only delivered to subscribers in the same account, unless shared
+// through an export and import.
+type Account struct {
+	Name string
+	sl   *Sublist
+
+	mu        sync.Mutex
+	rsid      uint64
+	responses map[string]*subscription
+	nextPrune time.Time
+
+	departed          map[string]departedMember
+	nextDepartedPrune time.Time
+}
+
+// accountImport is set on the subscriptions used to bring
+// messages from the account holding the subscription into
+// another account.
+type accountImport struct {
+	to       *Account
+	service  bool
+	response bool
+	expires  time.Time
+}
+
+func newAccount(name string, sl *Sublist) *Account {
+	return &Account{
+		Name:      name,
+		sl:        sl,
+		responses: make(map[string]*subscription),
+		departed:  make(map[string]departedMember),
+	}
+}
+
+// isGlobal returns true for the account of unbound clients.
+func (a *Account) isGlobal() bool {
+	return a.Name == globalAccount
+}
+
+// validAccountName checks that the name can be carried in a route sid.
+func validAccountName(name string) bool {
+	return name != "" && name != globalAccount &&
+		!strings.ContainsAny(name, ": \t\r\n")
+}
+
+// validateAccounts checks that accounts are unique, that every import
+// refers to an existing account and is covered by one of its exports,
+// and that users and leaf node remotes are bound to existing accounts.
+func validateAccounts(opts *Options) error {
+	accounts := make(map[string]*AccountOpts, len(opts.Accounts))
+	for _, a := range opts.Accounts {
+		if !validAccountName(a.Name) {
+			return fmt.Errorf("Invalid account name %q", a.Name)
+		}
+		if accounts[a.Name] != nil {
+			return fmt.Errorf("Duplicate account %q", a.Name)
+		}
+		accounts[a.Name] = a
+	}
+	for _, a := range opts.Accounts {
+		for _, im := range a.Imports {
+			ea := accounts[im.Account]
+			if ea == nil {
+				return fmt.Errorf("Account %q imports from unknown account %q", a.Name, im.Account)
+			}
+			if ea == a {
+				return fmt.Errorf("Account %q can not import from itself", a.Name)
+			}
+			if !ea.exports(im.Subject, im.Service) {
+				return fmt.Errorf("Account %q imports %q which is not exported by account %q",
+					a.Name, im.Subject, im.Account)
+			}
+		}
+	}
+	for _, u := range opts.Users {
+		if u.Account != "" && accounts[u.Account] == nil {
+			return fmt.Errorf("User %q bound to unknown account %q", u.Username, u.Account)
+		}
+	}
+	for _, r := range opts.LeafNode.Remotes {
+		if r.Account != "" && accounts[r.Account] == nil {
+			return fmt.Errorf("Leaf node remote %q bound to unknown account %q", r.URL.Host, r.Account)
+		}
+	}
+	return nil
+}
+
+// exports returns true if the subject is covered by one
+// of the exports of the given kind.
+func (a *AccountOpts) exports(subject string, service bool) bool {
+	for _, e := range a.Exports {
+		if e.Service == service && subjectIsSubsetMatch(subject, e.Subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// configureAccounts creates the accounts and the subscriptions
+// used for their imports. Invalid imports are logged and skipped.
+func (s *Server) configureAccounts() {
+	s.gacc = newAccount(globalAccount, s.sl)
+	s.accounts = map[string]*Account{globalAccount: s.gacc}
+
+	opts := s.getOpts()
+	if err := validateAccounts(opts); err != nil {
+		Errorf("Error configuring accounts: %v", err)
+	}
+	for _, ao := range opts.Accounts {
+		if validAccountName(ao.Name) && s.accounts[ao.Name] == nil {
+			s.accounts[ao.Name] = newAccount(ao.Name, NewSublist())
+		}
+	}
+	for _, ao := range opts.Accounts {
+		acc := s.accounts[ao.Name]
+		for _, im := range ao.Imports {
+			ea := s.accounts[im.Account]
+			if acc == nil || ea == nil || ea == acc {
+				continue
+			}
+			sub := &subscription{subject: []byte(im.Subject), sid: []byte(im.Subject)}
+			if im.Service {
+				// Requests published in the importing account
+				// are sent to the exporting one.
+				sub.acc = acc
+				sub.im = &accountImport{to: ea, service: true}
+			} else {
+				// Messages published in the exporting account
+				// are delivered in the importing one.
+				sub.acc = ea
+				sub.im = &accountImport{to: acc}
+			}
+			if err := sub.acc.sl.Insert(sub); err != nil {
+				Errorf("Error adding import of %q to account %q: %v", im.Subject, ao.Name, err)
+			}
+		}
+	}
+}
+
+// lookupAccount returns the account with the given name, the global
+// account for an empty name. Accounts are not changed once the server
+// is created, so no locking is needed.
+func (s *Server) lookupAccount(name string) *Account {
+	if name == "" {
+		return s.gacc
+	}
+	return s.accounts[name]
+}
+
+// addResponse creates the subscription that brings the response to a
+// service request back from the exporting account to the requestor.
+// The subscription is removed after the first response, or after
+// responseTTL if no response is received.
+func (a *Account) addResponse(c *client, reply []byte, to *Account) *subscription {
+	now := time.Now()
+
+	a.mu.Lock()
+	if _, ok := a.responses[string(reply)]; ok {
+		a.mu.Unlock()
+		return nil
+	}
+	var expired []*subscription
+	if now.After(a.nextPrune) {
+		for r, sub := range a.responses {
+			if now.After(sub.im.expires) {
+				delete(a.responses, r)
+				expired = append(expired, sub)
+			}
+		}
+		a.nextPrune = now.Add(responseTTL)
+	}
+	a.rsid++
+	sub := &subscription{
+		client:  c,
+		acc:     a,
+		subject: append([]byte(nil), reply...),
+		sid:     []byte("_R_" + strconv.FormatUint(a.rsid, 10)),
+		im:      &accountImport{to: to, response: true, expires: now.Add(responseTTL)},
+	}
+	a.responses[string(reply)] = sub
+	a.mu.Unlock()
+
+	for _, esub := range expired {
+		a.sl.Remove(esub)
+		c.srv.broadcastUnSubscribe(esub)
+	}
+	if err := a.sl.Insert(sub); err != nil {
+		a.mu.Lock()
+		delete(a.responses, string(reply))
+		a.mu.Unlock()
+		return nil
+	}
+	return sub
+}
+
+// removeResponse removes a response subscription once used.
+// Returns false if it was already removed.
+func (a *Account) removeResponse(sub *subscription) bool {
+	a.mu.Lock()
+	if a.responses[string(sub.subject)] != sub {
+		a.mu.Unlock()
+		return false
+	}
+	delete(a.responses, string(sub.subject))
+	a.mu.Unlock()
+	a.sl.Remove(sub)
+	return true
+}
+
+// routeSidAccount splits the account name off a route sid. The sids of
+// subscriptions in the global account do not carry an account name.
+func routeSidAccount(rsid []byte) (string, []byte) {
+	if len(rsid) > 0 && rsid[0] == '$' {
+		if i := bytes.IndexByte(rsid, ':'); i > 0 {
+			return string(rsid[1:i]), rsid[i+1:]
+		}
+	}
+	return "", rsid
+}
+
+// accountForSid returns the account of a message or subscription with
+// the given sid. Routes carry the account in the sid, nil is returned
+// for an account unknown to this server.
+func (c *client) accountForSid(sid []byte) *Account {
+	if c.typ == ROUTER {
+		name, _ := routeSidAccount(sid)
+		return c.srv.lookupAccount(name)
+	}
+	if c.acc == nil {
+		return c.srv.gacc
+	}
+	return c.acc
+}
+
+// shouldImport returns true if the import subscription applies to the
+// message being processed. Imports are applied once, by the server the
+// message was published to, except for responses that are applied where
+// the request was imported.
+func shouldImport(sub *subscription, isRoute, isImport bool) bool {
+	if isImport {
+		return false
+	}
+	return sub.im.response || !isRoute
+}
+
+// processImport delivers the message being processed into
+// the account targeted by the import subscription.
+func (c *client) processImport(sub *subscription, msg []byte, isRoute bool) {
+	im := sub.im
+	if im.response {
+		if !sub.acc.removeResponse(sub) {
+			return
+		}
+		sub.client.srv.broadcastUnSubscribe(sub)
+	} else if im.service && len(c.pa.reply) > 0 {
+		// Route the response back to this account.
+		if rsub := im.to.addResponse(c, c.pa.reply, sub.acc); rsub != nil {
+			c.srv.broadcastSubscribe(rsub)
+		}
+	}
+	r := im.to.sl.Match(string(c.pa.subject))
+	c.processMsgResults(r, msg, isRoute, true)
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestAccountsConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/accounts.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := []*AccountOpts{
+		{
+			Name: "acme",
+			Exports: []*Export{
+				{Subject: "public.>"},
+				{Subject: "help.>", Service: true},
+			},
+		},
+		{
+			Name: "beta",
+			Imports: []*Import{
+				{Account: "acme", Subject: "public.>"},
+				{Account: "acme", Subject: "help.>", Service: true},
+			},
+		},
+		{Name: "gamma"},
+	}
+	if !reflect.DeepEqual(opts.Accounts, expected) {
+		t.Fatalf("Accounts not parsed correctly")
+	}
+	if len(opts.Users) != 3 {
+		t.Fatalf("Expected 3 users, got %d", len(opts.Users))
+	}
+	for i, name := range []string{"acme", "beta", "gamma"} {
+		if opts.Users[i].Account != name {
+			t.Fatalf("Expected user %q bound to %q, got %q",
+				opts.Users[i].Username, name, opts.Users[i].Account)
+		}
+	}
+}
+
+func TestValidateAccounts(t *testing.T) {
+	acme := &AccountOpts{Name: "acme", Exports: []*Export{{Subject: "public.>"}}}
+	for _, test := range []struct {
+		name string
+		opts *Options
+	}{
+		{"invalid name", &Options{Accounts: []*AccountOpts{{Name: "a:b"}}}},
+		{"global name", &Options{Accounts: []*AccountOpts{{Name: globalAccount}}}},
+		{"duplicate", &Options{Accounts: []*AccountOpts{acme, {Name: "acme"}}}},
+		{"unknown import", &Options{Accounts: []*AccountOpts{
+			{Name: "beta", Imports: []*Import{{Account: "none", Subject: "public.>"}}}}}},
+		{"not exported", &Options{Accounts: []*AccountOpts{acme,
+			{Name: "beta", Imports: []*Import{{Account: "acme", Subject: "private.>"}}}}}},
+		{"wrong kind", &Options{Accounts: []*AccountOpts{acme,
+			{Name: "beta", Imports: []*Import{{Account: "acme", Subject: "public.>", Service: true}}}}}},
+		{"unknown user account", &Options{Users: []*User{{Username: "bob", Account: "none"}}}},
+		{"unknown leaf node account", &Options{LeafNode: LeafNodeOpts{Remotes: []*RemoteLeafOpts{
+			{URL: &url.URL{Host: "127.0.0.1:7422"}, Account: "none"}}}}},
+	} {
+		if err := validateAccounts(test.opts); err == nil {
+			t.Fatalf("Expected an error for %s", test.name)
+		}
+	}
+
+	ok := &Options{Accounts: []*AccountOpts{acme,
+		{Name: "beta", Imports: []*Import{{Account: "acme", Subject: "public.news"}}}}}
+	if err := validateAccounts(ok); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestSubjectIsSubsetMatch(t *testing.T) {
+	for _, test := range []struct {
+		subject, test string
+		expected      bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"foo.bar", "foo.*", true},
+		{"foo.bar.baz", "foo.>", true},
+		{"foo.*", "foo.>", true},
+		{"foo.>", "foo.>", true},
+		{"foo.>", "foo.*", false},
+		{"foo.*", "foo.bar", false},
+		{"foo", "foo.>", false},
+		{"bar.baz", "foo.>", false},
+	} {
+		if got := subjectIsSubsetMatch(test.subject, test.test); got != test.expected {
+			t.Fatalf("subjectIsSubsetMatch(%q, %q) = %v, expected %v",
+				test.subject, test.test, got, test.expected)
+		}
+	}
+}
+
+func TestRouteSidAccount(t *testing.T) {
+	for _, test := range []struct {
+		rsid, account, rest string
+	}{
+		{"RSID:1:2", "", "RSID:1:2"},
+		{"$acme:RSID:1:2", "acme", "RSID:1:2"},
+		{"$acme:QRSID:1:2", "acme", "QRSID:1:2"},
+	} {
+		name, rest := routeSidAccount([]byte(test.rsid))
+		if name != test.account || string(rest) != test.rest {
+			t.Fatalf("Unexpected split of %q: %q, %q", test.rsid, name, rest)
+		}
+	}
+}
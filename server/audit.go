@@ -0,0 +1,226 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditOpts configures the audit log of the authorization failures and
+// permission violations, and the escalation on repeated violations from
+// a source IP: the connection is closed and the IP can be banned from
+// the client listeners for a while.
+type AuditOpts struct {
+	// File the events are appended to, one JSON object per line. They
+	// go to the server log if empty.
+	File string `json:"file,omitempty"`
+	// Violations from a source IP within the window after which the
+	// connection is closed, never if 0.
+	MaxViolations int           `json:"max_violations,omitempty"`
+	Window        time.Duration `json:"window,omitempty"`
+	// How long the source IP is banned once the connection is closed.
+	Ban time.Duration `json:"ban,omitempty"`
+}
+
+// Types of the audit events.
+const (
+	AuditAuthFailure        = "auth_failure"
+	AuditPublishViolation   = "publish_violation"
+	AuditSubscribeViolation = "subscribe_violation"
+	AuditEscalation         = "escalation"
+	AuditBan                = "ban"
+)
+
+// AuditEvent is a line of the audit log.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	CID     uint64    `json:"cid"`
+	User    string    `json:"user,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	// Until when the IP is banned.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// auditor writes the audit log and counts the recent violations by
+// source IP.
+type auditor struct {
+	opts      AuditOpts
+	mu        sync.Mutex
+	f         *os.File
+	recent    map[string][]time.Time
+	nextPrune time.Time
+}
+
+// validateAudit checks the audit options.
+func validateAudit(opts *Options) error {
+	ao := opts.Audit
+	if ao == nil {
+		return nil
+	}
+	if ao.MaxViolations < 0 || ao.Window < 0 || ao.Ban < 0 {
+		return fmt.Errorf("Invalid audit max_violations %d, window %v, ban %v",
+			ao.MaxViolations, ao.Window, ao.Ban)
+	}
+	if ao.Ban > 0 && ao.MaxViolations == 0 {
+		return fmt.Errorf("Audit ban requires max_violations")
+	}
+	return nil
+}
+
+// configureAudit opens the audit log of the options, and closes the
+// previous one.
+func (s *Server) configureAudit() {
+	var a *auditor
+	if ao := s.getOpts().Audit; ao != nil {
+		a = &auditor{opts: *ao, recent: make(map[string][]time.Time)}
+		if a.opts.Window == 0 {
+			a.opts.Window = DEFAULT_AUDIT_WINDOW
+		}
+		if ao.File != "" {
+			f, err := os.OpenFile(ao.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				Errorf("Error opening the audit log, using the server log: %v", err)
+			} else {
+				a.f = f
+			}
+		}
+	}
+	s.auditMu.Lock()
+	prev := s.audit
+	s.audit = a
+	s.auditMu.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+}
+
+// auditor returns the audit log, nil if disabled.
+func (s *Server) auditor() *auditor {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	return s.audit
+}
+
+// log writes the event to the audit log.
+func (a *auditor) log(ev *AuditEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		Errorf("Error marshalling the audit event: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		Noticef("Audit: %s", b)
+		return
+	}
+	a.f.Write(append(b, '\n'))
+}
+
+// violation counts a violation from the source, it returns true if the
+// source has too many within the window.
+func (a *auditor) violation(key string, now time.Time) bool {
+	if a.opts.MaxViolations == 0 {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.After(a.nextPrune) {
+		for k, ts := range a.recent {
+			if now.Sub(ts[len(ts)-1]) > a.opts.Window {
+				delete(a.recent, k)
+			}
+		}
+		a.nextPrune = now.Add(a.opts.Window)
+	}
+	// Drop the violations out of the window.
+	ts := a.recent[key]
+	i := 0
+	for i < len(ts) && now.Sub(ts[i]) > a.opts.Window {
+		i++
+	}
+	ts = append(ts[i:], now)
+	if len(ts) >= a.opts.MaxViolations {
+		delete(a.recent, key)
+		return true
+	}
+	a.recent[key] = ts
+	return false
+}
+
+func (a *auditor) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f != nil {
+		a.f.Close()
+		a.f = nil
+	}
+}
+
+// sourceIP returns the IP address the client connects from, empty for
+// unix sockets.
+func (c *client) sourceIP() string {
+	c.mu.Lock()
+	nc := c.nc
+	c.mu.Unlock()
+	if nc == nil || nc.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(nc.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// audit logs the violation of the client, and closes the connection of
+// a source with too many violations, banning its IP if configured.
+// Lock should not be held.
+func (c *client) audit(typ string, subject []byte) {
+	if c.srv == nil {
+		return
+	}
+	a := c.srv.auditor()
+	if a == nil {
+		return
+	}
+	now := time.Now().UTC()
+	ev := &AuditEvent{
+		Time:    now,
+		Type:    typ,
+		CID:     c.cid,
+		User:    c.opts.Username,
+		IP:      c.sourceIP(),
+		Subject: string(subject),
+	}
+	a.log(ev)
+
+	// Sources without an IP are counted by connection.
+	key := ev.IP
+	if key == "" {
+		key = fmt.Sprintf("cid:%d", c.cid)
+	}
+	if !a.violation(key, now) {
+		return
+	}
+	a.log(&AuditEvent{Time: now, Type: AuditEscalation, CID: c.cid, User: ev.User, IP: ev.IP})
+	if a.opts.Ban > 0 && ev.IP != "" && c.typ == CLIENT {
+		until := now.Add(a.opts.Ban)
+		c.srv.clientGate.ban(ev.IP, until)
+		a.log(&AuditEvent{Time: now, Type: AuditBan, CID: c.cid, IP: ev.IP, Until: &until})
+	}
+	c.Errorf("%s - Closing", ErrTooManyViolations)
+	c.sendErr(ErrTooManyViolations.Error())
+	c.closeConnection()
+}
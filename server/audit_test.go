@@ -0,0 +1,79 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/audit.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := &AuditOpts{
+		File:          "/tmp/hnatsd_audit.log",
+		MaxViolations: 5,
+		Window:        30 * time.Second,
+		Ban:           10 * time.Minute,
+	}
+	if !reflect.DeepEqual(opts.Audit, expected) {
+		t.Fatalf("Unexpected audit: %+v", opts.Audit)
+	}
+
+	for _, ao := range []*AuditOpts{
+		{MaxViolations: -1},
+		{Ban: time.Minute},
+	} {
+		if err := validateAudit(&Options{Audit: ao}); err == nil {
+			t.Fatalf("Expected an error for %+v", ao)
+		}
+	}
+}
+
+func TestAuditViolationWindow(t *testing.T) {
+	a := &auditor{
+		opts:   AuditOpts{MaxViolations: 3, Window: time.Minute},
+		recent: make(map[string][]time.Time),
+	}
+	now := time.Now()
+	if a.violation("10.0.0.1", now) || a.violation("10.0.0.1", now.Add(time.Second)) {
+		t.Fatal("Expected no escalation before 3 violations")
+	}
+	// Violations out of the window are not counted.
+	if a.violation("10.0.0.1", now.Add(2*time.Minute)) {
+		t.Fatal("Expected no escalation after the window")
+	}
+	if a.violation("10.0.0.2", now.Add(2*time.Minute)) {
+		t.Fatal("Expected the sources to be counted apart")
+	}
+	a.violation("10.0.0.1", now.Add(2*time.Minute))
+	if !a.violation("10.0.0.1", now.Add(2*time.Minute)) {
+		t.Fatal("Expected an escalation after 3 violations")
+	}
+}
+
+func TestConnGateBan(t *testing.T) {
+	g := &connGate{}
+	g.configure(nil)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4222}
+	now := time.Now()
+	g.ban("10.0.0.1", now.Add(time.Minute))
+	if g.admit(addr, now) {
+		t.Fatal("Expected the banned source to be rejected")
+	}
+	// Bans are kept across configurations, and expire.
+	g.configure(&AcceptOpts{Rate: 100})
+	if g.admit(addr, now.Add(30*time.Second)) {
+		t.Fatal("Expected the banned source to be rejected")
+	}
+	if !g.admit(addr, now.Add(2*time.Minute)) {
+		t.Fatal("Expected the ban to expire")
+	}
+	if s := g.stats(); s.Banned != 2 {
+		t.Fatalf("Expected 2 banned connections, got %+v", s)
+	}
+}
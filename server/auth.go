@@ -4,6 +4,10 @@ package server
 
 import (
 	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
 )
 
 // Auth is an interface for implementing authentication
@@ -20,4 +24,53 @@ type ClientAuth interface {
 	GetTLSConnectionState() *tls.ConnectionState
 	// Optionally map a user after auth.
 	RegisterUser(*User)
+	// Get the address of the client
+	RemoteAddress() net.Addr
+	// Get the nonce the client signs with its public key, nil if none
+	GetNonce() []byte
+	// Disconnect the client when its credentials expire, never if zero
+	SetExpiration(time.Time)
+}
+
+// AuthCalloutOpts configures the authentication of the clients by an
+// external auth service, asked on a subject of the server or at an
+// HTTP endpoint. The configured users are checked first.
+type AuthCalloutOpts struct {
+	// Subject the auth service answers on, a _SYS subject so that
+	// only the system user can answer.
+	Subject string `json:"subject,omitempty"`
+	// URL of the HTTP endpoint of the auth service.
+	URL string `json:"url,omitempty"`
+	// How long the auth service has to answer before the client is denied.
+	Timeout time.Duration `json:"timeout"`
+	// How long the decisions of the auth service are cached.
+	TTL time.Duration `json:"ttl"`
+}
+
+// validateAuthCallout checks the auth callout of the options.
+func validateAuthCallout(opts *Options) error {
+	ac := opts.AuthCallout
+	if ac == nil {
+		return nil
+	}
+	if ac.Subject != "" && ac.URL != "" {
+		return fmt.Errorf("Auth callout can not have both a subject and a url")
+	}
+	if ac.Timeout < 0 || ac.TTL < 0 {
+		return fmt.Errorf("Invalid auth callout timeout %v, ttl %v", ac.Timeout, ac.TTL)
+	}
+	if ac.URL != "" {
+		u, err := url.Parse(ac.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Invalid auth callout url %q", ac.URL)
+		}
+		return nil
+	}
+	if opts.SystemUser == "" {
+		return fmt.Errorf("Auth callout on a subject requires a system user")
+	}
+	if ac.Subject != "" && (!IsValidLiteralSubject(ac.Subject) || !isSysSubject([]byte(ac.Subject))) {
+		return fmt.Errorf("Auth callout subject %q must be a _SYS subject", ac.Subject)
+	}
+	return nil
 }
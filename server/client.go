@@ -3,12 +3,12 @@
 package server
 
 import (
-	"bufio"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,6 +23,10 @@ const (
 	// INTERNALCLI is an internal client.
 	// An example is the health-agent.
 	INTERNALCLI
+	// SYSTEM is the internal client publishing the system events.
+	SYSTEM
+	// LEAF is a leaf node link to a server of another cluster.
+	LEAF
 )
 
 const (
@@ -42,6 +46,10 @@ const (
 	// Scratch buffer size for the processMsg() calls.
 	msgScratchSize = 512
 	msgHeadProto   = "MSG "
+	hmsgHeadProto  = "HMSG "
+
+	// Status delivered in place of a request no one has interest in.
+	noRespondersHdr = "NATS/1.0 503\r\n\r\n"
 )
 
 // For controlling dynamic buffer sizes.
@@ -59,6 +67,11 @@ const (
 	connectReceived clientFlag = 1 << iota // The CONNECT proto has been received
 	firstPongSent                          // The first PONG has been sent
 	infoUpdated                            // The server's Info object has changed before first PONG was sent
+	accountChanged                         // The user was moved to another account by a configuration reload
+	pendingErrSent                         // The max pending error was sent since the last flush
+	connClosing                            // closeConnection has been called
+	slowConsumer                           // The outbound queue went over max pending, it is dropped
+	systemUser                             // The client is the system user and can receive _SYS messages
 )
 
 // set the flag (would be equivalent to set the boolean to true)
@@ -97,33 +110,46 @@ type client struct {
 	opts  clientOpts
 	start time.Time
 	nc    net.Conn
-	mpay  int
+	mpay  int32
 	ncs   string
-	bw    *bufio.Writer
+	out   outbound
 	srv   *Server
+	acc   *Account
 	subs  map[string]*subscription
 	perms *permissions
 	cache readCache
 	pcd   map[*client]struct{}
 	atmr  *time.Timer
 	ptmr  *time.Timer
+	etmr  *time.Timer // Disconnects the client when its credentials expire.
 	pout  int
-	wfc   int
 	msgb  [msgScratchSize]byte
+	hmsgb []byte
 	last  time.Time
 	parseState
 
-	route *route
-	debug bool
-	trace bool
+	route   *route
+	leaf    *leafNode
+	limits  *clientLimits
+	debug   bool
+	trace   bool
+	headers bool
+	ws      bool            // Connected through the websocket listener.
+	lsn     *clientListener // The additional endpoint the client connected to, nil for the main one.
+	nonce   []byte          // Signed by the client to authenticate with a public key.
 
 	flags clientFlag // Compact booleans into a single field. Size will be increased when needed.
 }
 
-type permissions struct {
-	sub    *Sublist
-	pub    *Sublist
-	pcache map[string]bool
+// outbound is the queue of data waiting to be written to the client
+// connection by its writeLoop. Protected by the client lock.
+type outbound struct {
+	nb       net.Buffers // Filled buffers, written with writev.
+	cur      []byte      // Buffer being filled.
+	pb       int64       // Bytes queued and not yet handed to the writer.
+	mp       int64       // Max pending bytes before being a slow consumer.
+	cv       *sync.Cond  // Signals the writeLoop and waiting flushers.
+	flushing bool        // A flush is in progress.
 }
 
 const (
@@ -153,7 +179,11 @@ func (c *client) GetOpts() *clientOpts {
 // GetTLSConnectionState returns the TLS ConnectionState if TLS is enabled, nil
 // otherwise. Implements the ClientAuth interface.
 func (c *client) GetTLSConnectionState() *tls.ConnectionState {
-	tc, ok := c.nc.(*tls.Conn)
+	nc := c.nc
+	if ws, ok := nc.(*wsConn); ok {
+		nc = ws.Conn
+	}
+	tc, ok := nc.(*tls.Conn)
 	if !ok {
 		return nil
 	}
@@ -161,13 +191,32 @@ func (c *client) GetTLSConnectionState() *tls.ConnectionState {
 	return &state
 }
 
+// GetNonce returns the nonce sent to the client in the INFO, nil if
+// none. Implements the ClientAuth interface.
+func (c *client) GetNonce() []byte {
+	return c.nonce
+}
+
+// RemoteAddress returns the address of the client. Implements the
+// ClientAuth interface.
+func (c *client) RemoteAddress() net.Addr {
+	if c.nc == nil {
+		return nil
+	}
+	return c.nc.RemoteAddr()
+}
+
 type subscription struct {
 	client  *client
+	acc     *Account
+	im      *accountImport
 	subject []byte
 	queue   []byte
 	sid     []byte
 	nm      int64
 	max     int64
+	policy  queuePolicy
+	qturn   *uint64 // round robin turns, shared by the queue group in the sublist
 }
 
 type clientOpts struct {
@@ -177,10 +226,15 @@ type clientOpts struct {
 	Authorization string `json:"auth_token"`
 	Username      string `json:"user"`
 	Password      string `json:"pass"`
+	Nkey          string `json:"nkey,omitempty"`
+	Sig           string `json:"sig,omitempty"`
+	JWT           string `json:"jwt,omitempty"`
 	Name          string `json:"name"`
 	Lang          string `json:"lang"`
 	Version       string `json:"version"`
 	Protocol      int    `json:"protocol"`
+	Headers       bool   `json:"headers"`
+	NoResponders  bool   `json:"no_responders"`
 }
 
 var defaultOpts = clientOpts{Verbose: true, Pedantic: true}
@@ -193,7 +247,8 @@ func init() {
 func (c *client) initClient() {
 	s := c.srv
 	c.cid = atomic.AddUint64(&s.gcid, 1)
-	c.bw = bufio.NewWriterSize(c.nc, startBufSize)
+	c.out.cv = sync.NewCond(&c.mu)
+	c.out.mp = s.getOpts().MaxPending
 	c.subs = make(map[string]*subscription)
 	c.debug = (atomic.LoadInt32(&debug) != 0)
 	c.trace = (atomic.LoadInt32(&trace) != 0)
@@ -212,6 +267,10 @@ func (c *client) initClient() {
 	if ip, ok := c.nc.(*net.TCPConn); ok {
 		addr := ip.RemoteAddr().(*net.TCPAddr)
 		conn = fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+	} else if ws, ok := c.nc.(*wsConn); ok {
+		conn = "ws:" + ws.RemoteAddr().String()
+	} else if uc, ok := c.nc.(*net.UnixConn); ok {
+		conn = "unix:" + uc.LocalAddr().String()
 	}
 
 	switch c.typ {
@@ -221,6 +280,10 @@ func (c *client) initClient() {
 		c.ncs = fmt.Sprintf("%s - rid:%d", conn, c.cid)
 	case INTERNALCLI:
 		c.ncs = fmt.Sprintf("internal:0 - hid:%d", c.cid)
+	case SYSTEM:
+		c.ncs = fmt.Sprintf("system:0 - sid:%d", c.cid)
+	case LEAF:
+		c.ncs = fmt.Sprintf("%s - lid:%d", conn, c.cid)
 	}
 }
 
@@ -228,31 +291,36 @@ func (c *client) initClient() {
 // with the authenticated user. This is used to map any permissions
 // into the client.
 func (c *client) RegisterUser(user *User) {
-	if user.Permissions == nil {
-		return
-	}
-
 	// Process Permissions and map into client connection structures.
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Pre-allocate all to simplify checks later.
-	c.perms = &permissions{}
-	c.perms.sub = NewSublist()
-	c.perms.pub = NewSublist()
-	c.perms.pcache = make(map[string]bool)
-
-	// Loop over publish permissions
-	for _, pubSubject := range user.Permissions.Publish {
-		sub := &subscription{subject: []byte(pubSubject)}
-		c.perms.pub.Insert(sub)
+	// Bind the client to the account of the user. A connected client
+	// can not be moved to another account, see reloadAuthorization.
+	if c.srv != nil {
+		acc := c.srv.lookupAccount(user.Account)
+		if c.acc == nil {
+			c.acc = acc
+		} else if c.acc != acc {
+			c.flags.set(accountChanged)
+		}
+		if sys := c.srv.getOpts().SystemUser; sys != "" && user.Username == sys {
+			c.flags.set(systemUser)
+		} else {
+			c.flags.clear(systemUser)
+		}
 	}
 
-	// Loop over subscribe permissions
-	for _, subSubject := range user.Permissions.Subscribe {
-		sub := &subscription{subject: []byte(subSubject)}
-		c.perms.sub.Insert(sub)
+	c.setLimits(user.Limits)
+
+	// Clear any previous permissions, this can be called again
+	// when the configuration is reloaded.
+	if user.Permissions == nil {
+		c.perms = nil
+		return
 	}
+
+	c.perms = newPermissions(user.Permissions)
 }
 
 func (c *client) readLoop() {
@@ -287,7 +355,8 @@ func (c *client) readLoop() {
 
 		if err := c.parse(b[:n]); err != nil {
 			// handled inline
-			if err != ErrMaxPayload && err != ErrAuthorization {
+			if err != ErrMaxPayload && err != ErrAuthorization &&
+				err != ErrMsgHeadersNotSupported {
 				c.Errorf("Error reading from client: %s", err.Error())
 				c.sendErr("Parser Error")
 				c.closeConnection()
@@ -301,49 +370,18 @@ func (c *client) readLoop() {
 		atomic.AddInt64(&s.inMsgs, int64(c.cache.inMsgs))
 		atomic.AddInt64(&s.inBytes, int64(c.cache.inBytes))
 
-		// Check pending clients for flush.
-		for cp := range c.pcd {
-			// Flush those in the set
-			cp.mu.Lock()
-			if cp.nc != nil {
-				// Gather the flush calls that happened before now.
-				// This is a signal into us about dynamic buffer allocation tuning.
-				wfc := cp.wfc
-				cp.wfc = 0
-
-				cp.nc.SetWriteDeadline(time.Now().Add(s.opts.WriteDeadline))
-				err := cp.bw.Flush()
-				cp.nc.SetWriteDeadline(time.Time{})
-				if err != nil {
-					c.Debugf("Error flushing: %v", err)
-					cp.mu.Unlock()
-					cp.closeConnection()
-					cp.mu.Lock()
-				} else {
-					// Update outbound last activity.
-					cp.last = last
-					// Check if we should tune the buffer.
-					sz := cp.bw.Available()
-					// Check for expansion opportunity.
-					if wfc > 2 && sz <= maxBufSize/2 {
-						cp.bw = bufio.NewWriterSize(cp.nc, sz*2)
-					}
-					// Check for shrinking opportunity.
-					if wfc == 0 && sz >= minBufSize*2 {
-						cp.bw = bufio.NewWriterSize(cp.nc, sz/2)
-					}
-				}
-			}
-			cp.mu.Unlock()
-			delete(c.pcd, cp)
-		}
-		// Check to see if we got closed, e.g. slow consumer
+		// Wake up the writeLoop of the clients we queued messages for.
+		c.flushClients()
+		// Check to see if we got closed
 		c.mu.Lock()
 		nc := c.nc
 		// Activity based on interest changes or data/msgs.
 		if c.cache.inMsgs > 0 || c.cache.subs > 0 {
 			c.last = last
 		}
+		// Pick up debug and trace changes from a configuration reload.
+		c.debug = (atomic.LoadInt32(&debug) != 0)
+		c.trace = (atomic.LoadInt32(&trace) != 0)
 		c.mu.Unlock()
 		if nc == nil {
 			return
@@ -400,8 +438,11 @@ func (c *client) processInfo(arg []byte) error {
 	if err := json.Unmarshal(arg, &info); err != nil {
 		return err
 	}
-	if c.typ == ROUTER {
+	switch c.typ {
+	case ROUTER:
 		c.processRouteInfo(&info)
+	case LEAF:
+		c.processLeafInfo(&info)
 	}
 	return nil
 }
@@ -414,6 +455,8 @@ func (c *client) processErr(errStr string) {
 		c.Errorf("Route Error %s", errStr)
 	case INTERNALCLI:
 		c.Errorf("InternalClient Error %s", errStr)
+	case LEAF:
+		c.Errorf("Leaf Node Error %s", errStr)
 	}
 	c.closeConnection()
 }
@@ -454,6 +497,12 @@ func (c *client) processConnect(arg []byte) error {
 	proto := c.opts.Protocol
 	verbose := c.opts.Verbose
 	lang := c.opts.Lang
+	noResponders := c.opts.NoResponders && !c.opts.Headers
+	// Clients and accepted leaf nodes negotiate headers through
+	// CONNECT, routes learn about them from the remote INFO.
+	if typ == CLIENT || typ == LEAF {
+		c.headers = c.opts.Headers
+	}
 	c.mu.Unlock()
 
 	if srv != nil {
@@ -472,6 +521,15 @@ func (c *client) processConnect(arg []byte) error {
 			c.authViolation()
 			return ErrAuthorization
 		}
+
+		// Clients not bound to an account by their
+		// user are in the global account.
+		c.mu.Lock()
+		if c.acc == nil {
+			c.acc = srv.gacc
+		}
+		c.sendClientEvent(EventClientConnect)
+		c.mu.Unlock()
 	}
 
 	// Check client protocol request if it exists.
@@ -479,6 +537,11 @@ func (c *client) processConnect(arg []byte) error {
 		c.sendErr(ErrBadClientProtocol.Error())
 		c.closeConnection()
 		return ErrBadClientProtocol
+	} else if typ == CLIENT && noResponders {
+		// The status is sent in the headers of the message.
+		c.sendErr(ErrNoRespondersRequiresHeaders.Error())
+		c.closeConnection()
+		return ErrNoRespondersRequiresHeaders
 	} else if typ == ROUTER && lang != "" {
 		// Way to detect clients that incorrectly connect to the route listen
 		// port. Client provide Lang in the CONNECT protocol while ROUTEs don't.
@@ -494,6 +557,14 @@ func (c *client) processConnect(arg []byte) error {
 		c.mu.Unlock()
 	}
 
+	// The leaf node is registered once authorized.
+	if typ == LEAF && srv != nil {
+		c.mu.Lock()
+		c.leaf.remoteID = c.opts.Name
+		c.mu.Unlock()
+		srv.addLeaf(c)
+	}
+
 	if verbose {
 		c.sendOK()
 	}
@@ -507,14 +578,37 @@ func (c *client) authTimeout() {
 }
 
 func (c *client) authViolation() {
-	if c.srv != nil && c.srv.opts.Users != nil {
+	c.rejectAuth()
+	c.audit(AuditAuthFailure, nil)
+	c.closeConnection()
+}
+
+// authWithdrawn closes the connection of a client no longer authorized
+// after a reload or a revocation. The client did nothing wrong, so it
+// is not audited and does not count against its source IP.
+func (c *client) authWithdrawn() {
+	c.rejectAuth()
+	c.closeConnection()
+}
+
+// rejectAuth logs the authorization error and sends it to the client.
+func (c *client) rejectAuth() {
+	if c.srv != nil && c.srv.getOpts().Users != nil {
 		c.Errorf("%s - User %q",
 			ErrAuthorization.Error(),
 			c.opts.Username)
 	} else {
 		c.Errorf(ErrAuthorization.Error())
 	}
+	c.mu.Lock()
+	c.sendClientEvent(EventClientAuthError)
+	c.mu.Unlock()
 	c.sendErr("Authorization Violation")
+}
+
+func (c *client) authExpired() {
+	c.Debugf("Authorization Expired")
+	c.sendErr(ErrAuthExpired.Error())
 	c.closeConnection()
 }
 
@@ -524,30 +618,146 @@ func (c *client) maxConnExceeded() {
 	c.closeConnection()
 }
 
-func (c *client) maxPayloadViolation(sz int) {
-	c.Errorf("%s: %d vs %d", ErrMaxPayload.Error(), sz, c.mpay)
+func (c *client) maxPayloadViolation(sz, max int) {
+	c.Errorf("%s: %d vs %d", ErrMaxPayload.Error(), sz, max)
 	c.sendErr("Maximum Payload Violation")
 	c.closeConnection()
 }
 
-// Assume the lock is held upon entry.
-func (c *client) sendProto(info []byte, doFlush bool) error {
-	var err error
-	if c.bw != nil && c.nc != nil {
-		deadlineSet := false
-		if doFlush || c.bw.Available() < len(info) {
-			c.nc.SetWriteDeadline(time.Now().Add(c.srv.opts.WriteDeadline))
-			deadlineSet = true
+// queueOutbound copies data to the outbound queue. Small writes
+// are coalesced into buffers of up to maxBufSize bytes.
+// Lock should be held.
+func (c *client) queueOutbound(data []byte) {
+	c.out.pb += int64(len(data))
+	if len(data) > cap(c.out.cur)-len(c.out.cur) {
+		if len(c.out.cur) > 0 {
+			c.out.nb = append(c.out.nb, c.out.cur)
+		}
+		sz := 2 * cap(c.out.cur)
+		if sz < startBufSize {
+			sz = startBufSize
+		} else if sz > maxBufSize {
+			sz = maxBufSize
+		}
+		if sz < len(data) {
+			sz = len(data)
+		}
+		c.out.cur = make([]byte, 0, sz)
+	}
+	c.out.cur = append(c.out.cur, data...)
+}
+
+// flushSignal wakes up the writeLoop. Lock should be held.
+func (c *client) flushSignal() {
+	if c.out.cv != nil {
+		c.out.cv.Broadcast()
+	}
+}
+
+// flushOutbound writes the queue to the connection. Only one flush runs
+// at a time, and the lock is released during the write so that
+// publishers are not blocked by a slow connection. Slow consumers are
+// detected on the size of the queue, see deliverMsg, a write timing out
+// is a write error. Returns false if the write failed.
+// Lock should be held.
+func (c *client) flushOutbound() bool {
+	for c.out.flushing {
+		c.out.cv.Wait()
+	}
+	if c.nc == nil || c.out.pb == 0 {
+		return true
+	}
+	if len(c.out.cur) > 0 {
+		c.out.nb = append(c.out.nb, c.out.cur)
+	}
+	nb, nc := c.out.nb, c.nc
+	c.out.nb, c.out.cur, c.out.pb = nil, nil, 0
+	c.out.flushing = true
+	wdl := c.srv.getOpts().WriteDeadline
+	c.mu.Unlock()
+
+	nc.SetWriteDeadline(time.Now().Add(wdl))
+	_, err := nb.WriteTo(nc)
+	nc.SetWriteDeadline(time.Time{})
+
+	c.mu.Lock()
+	c.out.flushing = false
+	c.out.cv.Broadcast()
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !c.flags.isSet(slowConsumer) {
+			c.Noticef("Write Deadline Exceeded")
+		} else {
+			c.Debugf("Error flushing: %v", err)
+		}
+		return false
+	}
+	c.flags.clear(pendingErrSent)
+	// Update outbound last activity.
+	c.last = time.Now()
+	return true
+}
+
+// writeLoop writes the outbound queue of the client until the
+// connection is closed.
+func (c *client) writeLoop() {
+	defer c.srv.grWG.Done()
+
+	c.mu.Lock()
+	for {
+		for c.nc != nil && c.out.pb == 0 &&
+			!c.flags.isSet(connClosing) && !c.flags.isSet(slowConsumer) {
+			c.out.cv.Wait()
 		}
-		_, err = c.bw.Write(info)
-		if err == nil && doFlush {
-			err = c.bw.Flush()
+		if c.nc == nil || c.flags.isSet(connClosing) {
+			c.mu.Unlock()
+			return
 		}
-		if deadlineSet {
-			c.nc.SetWriteDeadline(time.Time{})
+		if c.flags.isSet(slowConsumer) || !c.flushOutbound() {
+			c.mu.Unlock()
+			c.closeConnection()
+			return
 		}
 	}
-	return err
+}
+
+// flushClients wakes up the writeLoop of the clients
+// messages were queued for while processing inbound data.
+func (c *client) flushClients() {
+	for cp := range c.pcd {
+		cp.mu.Lock()
+		cp.flushSignal()
+		cp.mu.Unlock()
+		delete(c.pcd, cp)
+	}
+}
+
+// markSlowConsumer drops the queue of a client that can not keep up.
+// The writeLoop is woken up to close the connection, and a write in
+// progress is interrupted. Lock should be held.
+func (c *client) markSlowConsumer() {
+	c.flags.set(slowConsumer)
+	atomic.AddInt64(&c.srv.slowConsumers, 1)
+	c.Noticef("Slow Consumer Detected")
+	c.sendClientEvent(EventClientSlowConsumer)
+	c.out.nb, c.out.cur, c.out.pb = nil, nil, 0
+	if c.nc != nil {
+		c.nc.SetWriteDeadline(time.Now())
+	}
+	c.out.cv.Broadcast()
+}
+
+// Assume the lock is held upon entry.
+func (c *client) sendProto(info []byte, doFlush bool) {
+	if c.nc == nil {
+		return
+	}
+	c.queueOutbound(info)
+	// Write now if asked to, unless the writeLoop is already at it.
+	if doFlush && !c.out.flushing {
+		c.flushOutbound()
+	} else {
+		c.flushSignal()
+	}
 }
 
 // Assume the lock is held upon entry.
@@ -579,11 +789,7 @@ func (c *client) processPing() {
 		return
 	}
 	c.traceOutOp("PONG", nil)
-	err := c.sendProto([]byte("PONG\r\n"), true)
-	if err != nil {
-		c.clearConnection()
-		c.Debugf("Error on Flush, error %s", err.Error())
-	}
+	c.sendProto([]byte("PONG\r\n"), true)
 	srv := c.srv
 	sendUpdateINFO := false
 	// Check if this is the first PONG, if so...
@@ -604,7 +810,7 @@ func (c *client) processPing() {
 	if sendUpdateINFO {
 		srv.mu.Lock()
 		// Use the cached protocol
-		proto := srv.infoJSON
+		proto := srv.clientInfoJSON(c)
 		srv.mu.Unlock()
 
 		c.mu.Lock()
@@ -662,6 +868,66 @@ func (c *client) processMsgArgs(arg []byte) error {
 		return fmt.Errorf("processMsgArgs Bad or Missing Size: '%s'", arg)
 	}
 
+	// Common ones processed after check for arg length
+	c.pa.subject = args[0]
+	c.pa.sid = args[1]
+	c.pa.hdr = 0
+	c.pa.hdb = nil
+
+	return nil
+}
+
+// processHeaderMsgArgs handles the HMSG protocol sent by routes,
+// which carries the size of the headers ahead of the total size.
+func (c *client) processHeaderMsgArgs(arg []byte) error {
+	if c.trace {
+		c.traceInOp("HMSG", arg)
+	}
+
+	// Unroll splitArgs to avoid runtime/heap issues
+	a := [MAX_HMSG_ARGS][]byte{}
+	args := a[:0]
+	start := -1
+	for i, b := range arg {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			if start >= 0 {
+				args = append(args, arg[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		args = append(args, arg[start:])
+	}
+
+	switch len(args) {
+	case 4:
+		c.pa.reply = nil
+		c.pa.hdb = args[2]
+		c.pa.hdr = parseSize(args[2])
+		c.pa.szb = args[3]
+		c.pa.size = parseSize(args[3])
+	case 5:
+		c.pa.reply = args[2]
+		c.pa.hdb = args[3]
+		c.pa.hdr = parseSize(args[3])
+		c.pa.szb = args[4]
+		c.pa.size = parseSize(args[4])
+	default:
+		return fmt.Errorf("processHeaderMsgArgs Parse Error: '%s'", arg)
+	}
+	if c.pa.size < 0 {
+		return fmt.Errorf("processHeaderMsgArgs Bad or Missing Size: '%s'", arg)
+	}
+	if c.pa.hdr < 0 || c.pa.hdr > c.pa.size {
+		return fmt.Errorf("processHeaderMsgArgs Bad or Missing Header Size: '%s'", arg)
+	}
+
 	// Common ones processed after check for arg length
 	c.pa.subject = args[0]
 	c.pa.sid = args[1]
@@ -712,10 +978,83 @@ func (c *client) processPub(arg []byte) error {
 	if c.pa.size < 0 {
 		return fmt.Errorf("processPub Bad or Missing Size: '%s'", arg)
 	}
-	if c.mpay > 0 && c.pa.size > c.mpay {
-		c.maxPayloadViolation(c.pa.size)
+	c.pa.hdr = 0
+	c.pa.hdb = nil
+	if mpay := int(atomic.LoadInt32(&c.mpay)); mpay > 0 && c.pa.size > mpay {
+		c.maxPayloadViolation(c.pa.size, mpay)
+		return ErrMaxPayload
+	}
+	c.pa.dropped = !c.checkPublishLimits()
+
+	if c.opts.Pedantic && !IsValidLiteralSubject(string(c.pa.subject)) {
+		c.sendErr("Invalid Subject")
+	}
+	return nil
+}
+
+// processHeaderPub handles HPUB, a PUB whose message starts with
+// a block of headers. The header size is part of the total size.
+func (c *client) processHeaderPub(arg []byte) error {
+	if c.trace {
+		c.traceInOp("HPUB", arg)
+	}
+
+	if !c.headers {
+		c.sendErr("Message Headers Not Supported")
+		c.closeConnection()
+		return ErrMsgHeadersNotSupported
+	}
+
+	// Unroll splitArgs to avoid runtime/heap issues
+	a := [MAX_HPUB_ARGS][]byte{}
+	args := a[:0]
+	start := -1
+	for i, b := range arg {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			if start >= 0 {
+				args = append(args, arg[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		args = append(args, arg[start:])
+	}
+
+	switch len(args) {
+	case 3:
+		c.pa.subject = args[0]
+		c.pa.reply = nil
+		c.pa.hdb = args[1]
+		c.pa.hdr = parseSize(args[1])
+		c.pa.szb = args[2]
+		c.pa.size = parseSize(args[2])
+	case 4:
+		c.pa.subject = args[0]
+		c.pa.reply = args[1]
+		c.pa.hdb = args[2]
+		c.pa.hdr = parseSize(args[2])
+		c.pa.szb = args[3]
+		c.pa.size = parseSize(args[3])
+	default:
+		return fmt.Errorf("processHeaderPub Parse Error: '%s'", arg)
+	}
+	if c.pa.size < 0 {
+		return fmt.Errorf("processHeaderPub Bad or Missing Size: '%s'", arg)
+	}
+	if c.pa.hdr < 0 || c.pa.hdr > c.pa.size {
+		return fmt.Errorf("processHeaderPub Bad or Missing Header Size: '%s'", arg)
+	}
+	if mpay := int(atomic.LoadInt32(&c.mpay)); mpay > 0 && c.pa.size > mpay {
+		c.maxPayloadViolation(c.pa.size, mpay)
 		return ErrMaxPayload
 	}
+	c.pa.dropped = !c.checkPublishLimits()
 
 	if c.opts.Pedantic && !IsValidLiteralSubject(string(c.pa.subject)) {
 		c.sendErr("Invalid Subject")
@@ -764,7 +1103,7 @@ func (c *client) processSub(argo []byte) (err error) {
 		sub.sid = args[1]
 	case 3:
 		sub.subject = args[0]
-		sub.queue = args[1]
+		sub.queue, sub.policy = splitQueuePolicy(args[1])
 		sub.sid = args[2]
 	default:
 		return fmt.Errorf("processSub Parse Error: '%s'", arg)
@@ -778,28 +1117,46 @@ func (c *client) processSub(argo []byte) (err error) {
 		return nil
 	}
 
-	// Check permissions if applicable.
-	if c.perms != nil {
-		r := c.perms.sub.Match(string(sub.subject))
-		if len(r.psubs) == 0 {
-			c.mu.Unlock()
-			c.sendErr(fmt.Sprintf("Permissions Violation for Subscription to %q", sub.subject))
-			c.Errorf("Subscription Violation - User %q, Subject %q", c.opts.Username, sub.subject)
-			return nil
-		}
+	// Check limits and permissions if applicable.
+	if c.limits != nil && c.limits.MaxSubs > 0 && len(c.subs) >= c.limits.MaxSubs {
+		c.limits.subsDenied++
+		c.mu.Unlock()
+		c.sendErr(errMaxSubsExceeded)
+		c.Debugf("%s - User %q, Subject %q", errMaxSubsExceeded, c.opts.Username, sub.subject)
+		return nil
+	}
+	// Only the system user can subscribe to _SYS subjects.
+	if (c.typ == CLIENT || c.typ == LEAF) && !c.flags.isSet(systemUser) && isSysSubject(sub.subject) {
+		c.mu.Unlock()
+		c.subPermissionViolation(sub.subject)
+		return nil
+	}
+	if c.perms != nil && !c.perms.canSubscribe(sub.subject, sub.queue) {
+		c.mu.Unlock()
+		c.subPermissionViolation(sub.subject)
+		return nil
 	}
 
 	// We can have two SUB protocols coming from a route due to some
 	// race conditions. We should make sure that we process only one.
 	sid := string(sub.sid)
 	if c.subs[sid] == nil {
-		c.subs[sid] = sub
 		if c.srv != nil {
-			err = c.srv.sl.Insert(sub)
+			// Subscriptions from routes for accounts unknown
+			// to this server are ignored.
+			if sub.acc = c.accountForSid(sub.sid); sub.acc == nil {
+				c.mu.Unlock()
+				c.Debugf("Ignoring subscription %q for unknown account", sub.sid)
+				return nil
+			}
+		}
+		c.subs[sid] = sub
+		if sub.acc != nil {
+			err = sub.acc.sl.Insert(sub)
 			if err != nil {
 				delete(c.subs, sid)
 			} else {
-				shouldForward = c.typ != ROUTER
+				shouldForward = true
 			}
 		}
 	}
@@ -828,8 +1185,11 @@ func (c *client) unsubscribe(sub *subscription) {
 	}
 	c.traceOp("<-> %s", "DELSUB", sub.sid)
 	delete(c.subs, string(sub.sid))
-	if c.srv != nil {
-		c.srv.sl.Remove(sub)
+	if sub.acc != nil {
+		if sub.queue != nil {
+			sub.acc.addDeparted(sub)
+		}
+		sub.acc.sl.Remove(sub)
 	}
 }
 
@@ -867,7 +1227,7 @@ func (c *client) processUnsub(arg []byte) error {
 			sub.max = 0
 		}
 		unsub = true
-		shouldForward = c.typ != ROUTER && c.srv != nil
+		shouldForward = c.srv != nil
 	}
 	c.mu.Unlock()
 
@@ -884,7 +1244,39 @@ func (c *client) processUnsub(arg []byte) error {
 	return nil
 }
 
-func (c *client) msgHeader(mh []byte, sub *subscription) []byte {
+// msgHeader builds the protocol line used to deliver the current msg to sub
+// and returns it along with the part of msg to send. Messages carrying headers
+// go out as HMSG to connections that negotiated headers, everyone else gets a
+// plain MSG with the headers stripped off.
+func (c *client) msgHeader(mh []byte, sub *subscription, msg []byte) ([]byte, []byte) {
+	if c.pa.hdr > 0 {
+		if sub.client.supportsHeaders() {
+			hmh := append(c.hmsgb[:0], 'H')
+			hmh = append(hmh, mh...)
+			hmh = append(hmh, sub.sid...)
+			hmh = append(hmh, ' ')
+			if c.pa.reply != nil {
+				hmh = append(hmh, c.pa.reply...)
+				hmh = append(hmh, ' ')
+			}
+			hmh = append(hmh, c.pa.hdb...)
+			hmh = append(hmh, ' ')
+			hmh = append(hmh, c.pa.szb...)
+			hmh = append(hmh, "\r\n"...)
+			// Hold on to the buffer for the next delivery.
+			c.hmsgb = hmh
+			return hmh, msg
+		}
+		mh = append(mh, sub.sid...)
+		mh = append(mh, ' ')
+		if c.pa.reply != nil {
+			mh = append(mh, c.pa.reply...)
+			mh = append(mh, ' ')
+		}
+		mh = strconv.AppendInt(mh, int64(c.pa.size-c.pa.hdr), 10)
+		mh = append(mh, "\r\n"...)
+		return mh, msg[c.pa.hdr:]
+	}
 	mh = append(mh, sub.sid...)
 	mh = append(mh, ' ')
 	if c.pa.reply != nil {
@@ -893,7 +1285,14 @@ func (c *client) msgHeader(mh []byte, sub *subscription) []byte {
 	}
 	mh = append(mh, c.pa.szb...)
 	mh = append(mh, "\r\n"...)
-	return mh
+	return mh, msg
+}
+
+// supportsHeaders returns true if HMSG can be sent to this connection.
+func (c *client) supportsHeaders() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.headers
 }
 
 // Used to treat maps as efficient set
@@ -905,12 +1304,37 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) {
 		return
 	}
 	client := sub.client
+	// Requests to the server are answered by the eventsLoop.
+	if client.typ == SYSTEM {
+		c.queueSysRequest(sub, msg)
+		return
+	}
 	client.mu.Lock()
+	// Messages on _SYS subjects are only delivered to the system user.
+	if client.typ == CLIENT && !client.flags.isSet(systemUser) &&
+		isSysSubject(c.pa.subject) {
+		client.mu.Unlock()
+		return
+	}
+	if perms := client.perms; perms != nil {
+		// The subscription may have wildcards on denied subjects.
+		if !perms.canDeliver(c.pa.subject) {
+			if c.pa.traced {
+				c.traceDelivery(sub, dropPermissions)
+			}
+			client.mu.Unlock()
+			return
+		}
+		// The client can answer the request.
+		if perms.resp != nil && len(c.pa.reply) > 0 {
+			perms.addResponse(c.pa.reply)
+		}
+	}
 	sub.nm++
 	// Check if we should auto-unsubscribe.
 	if sub.max > 0 {
 		// For routing..
-		shouldForward := client.typ != ROUTER && client.srv != nil
+		shouldForward := client.srv != nil
 		// If we are at the exact number, unsubscribe but
 		// still process the message in hand, otherwise
 		// unsubscribe and drop message on the floor.
@@ -933,7 +1357,39 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) {
 		}
 	}
 
-	if client.nc == nil {
+	if client.nc == nil || client.flags.isSet(slowConsumer) {
+		if c.pa.traced && client.nc != nil {
+			c.traceDelivery(sub, dropSlowConsumer)
+		}
+		client.mu.Unlock()
+		return
+	}
+
+	size := int64(len(mh) + len(msg))
+
+	// Drop the message if the client has too many bytes waiting
+	// to be written. It is told once until the next flush.
+	if l := client.limits; l != nil && l.MaxPending > 0 &&
+		client.out.pb+size > int64(l.MaxPending) {
+		l.pendingDropped++
+		if client.flags.setIfNotSet(pendingErrSent) {
+			client.traceOutOp("-ERR", []byte(errMaxPendingExceeded))
+			client.sendProto([]byte(fmt.Sprintf("-ERR '%s'\r\n", errMaxPendingExceeded)), false)
+			c.pcd[client] = needFlush
+		}
+		if c.pa.traced {
+			c.traceDelivery(sub, dropMaxPending)
+		}
+		client.mu.Unlock()
+		return
+	}
+
+	// A client that does not keep up with its queue is a slow consumer.
+	if client.out.mp > 0 && client.out.pb+size > client.out.mp {
+		client.markSlowConsumer()
+		if c.pa.traced {
+			c.traceDelivery(sub, dropSlowConsumer)
+		}
 		client.mu.Unlock()
 		return
 	}
@@ -951,54 +1407,20 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) {
 	atomic.AddInt64(&c.srv.outMsgs, 1)
 	atomic.AddInt64(&c.srv.outBytes, msgSize)
 
-	// Check to see if our writes will cause a flush
-	// in the underlying bufio. If so limit time we
-	// will wait for flush to complete.
-
-	deadlineSet := false
-	if client.bw.Available() < (len(mh) + len(msg)) {
-		client.wfc++
-		client.nc.SetWriteDeadline(time.Now().Add(client.srv.opts.WriteDeadline))
-		deadlineSet = true
-	}
-
-	// Deliver to the client.
-	_, err := client.bw.Write(mh)
-	if err != nil {
-		goto writeErr
-	}
-
-	_, err = client.bw.Write(msg)
-	if err != nil {
-		goto writeErr
-	}
+	// Queue for the writeLoop of the client, it is woken up
+	// once the inbound buffer of this client is processed.
+	client.queueOutbound(mh)
+	client.queueOutbound(msg)
 
 	if c.trace {
 		client.traceOutOp(string(mh[:len(mh)-LEN_CR_LF]), nil)
 	}
-
-	// TODO(dlc) - Do we need this or can we just call always?
-	if deadlineSet {
-		client.nc.SetWriteDeadline(time.Time{})
+	if c.pa.traced {
+		c.traceDelivery(sub, "")
 	}
 
 	client.mu.Unlock()
 	c.pcd[client] = needFlush
-	return
-
-writeErr:
-	if deadlineSet {
-		client.nc.SetWriteDeadline(time.Time{})
-	}
-	client.mu.Unlock()
-
-	if ne, ok := err.(net.Error); ok && ne.Timeout() {
-		atomic.AddInt64(&client.srv.slowConsumers, 1)
-		client.Noticef("Slow Consumer Detected")
-		client.closeConnection()
-	} else {
-		c.Debugf("Error writing msg: %v", err)
-	}
 }
 
 // processMsg is called to process an inbound msg from a client.
@@ -1015,49 +1437,38 @@ func (c *client) processMsg(msg []byte) {
 		c.traceMsg(msg)
 	}
 
+	// Messages on the trace subjects are traced at each hop.
+	c.pa.traced = srv != nil && srv.isTraced(c.pa.subject)
+	if c.pa.traced {
+		c.traceHop(TraceIngress, "")
+	}
+
+	// Rate limits were checked by processPub.
+	if c.pa.dropped {
+		if c.pa.traced {
+			c.traceHop(TraceDrop, dropLimits)
+		}
+		return
+	}
+
 	// defintely
 
 	// Disallow publish to _SYS.>, these are reserved for internals.
-	if c.pa.subject[0] == '_' && len(c.pa.subject) > 4 &&
+	// Routes carry the system events of the other servers, and the
+	// system user can send requests to the servers. System events
+	// are not sent over leaf nodes.
+	if c.typ != ROUTER && c.pa.subject[0] == '_' && len(c.pa.subject) > 4 &&
 		c.pa.subject[1] == 'S' && c.pa.subject[2] == 'Y' &&
-		c.pa.subject[3] == 'S' && c.pa.subject[4] == '.' {
+		c.pa.subject[3] == 'S' && c.pa.subject[4] == '.' &&
+		!c.isSysRequest(c.pa.subject) {
 		c.pubPermissionViolation(c.pa.subject)
 		return
 	}
 
 	// Check if published subject is allowed if we have permissions in place.
-	if c.perms != nil {
-		allowed, ok := c.perms.pcache[string(c.pa.subject)]
-		if ok && !allowed {
-			c.pubPermissionViolation(c.pa.subject)
-			return
-		}
-		if !ok {
-			r := c.perms.pub.Match(string(c.pa.subject))
-			notAllowed := len(r.psubs) == 0
-			if notAllowed {
-				c.pubPermissionViolation(c.pa.subject)
-				c.perms.pcache[string(c.pa.subject)] = false
-			} else {
-				c.perms.pcache[string(c.pa.subject)] = true
-			}
-			// Prune if needed.
-			if len(c.perms.pcache) > maxPermCacheSize {
-				// Prune the permissions cache. Keeps us from unbounded growth.
-				r := 0
-				for subject := range c.perms.pcache {
-					delete(c.cache.results, subject)
-					r++
-					if r > pruneSize {
-						break
-					}
-				}
-			}
-			// Return here to allow the pruning code to run if needed.
-			if notAllowed {
-				return
-			}
-		}
+	if c.perms != nil && !c.canPublish(string(c.pa.subject)) {
+		c.pubPermissionViolation(c.pa.subject)
+		return
 	}
 
 	if c.opts.Verbose {
@@ -1069,38 +1480,70 @@ func (c *client) processMsg(msg []byte) {
 		return
 	}
 
+	// Subjects are mapped by the server the message is published to,
+	// routes and leaf nodes carry subjects that are already mapped.
+	if c.typ != ROUTER && c.typ != LEAF {
+		c.mapSubject()
+		if !c.pa.traced {
+			c.pa.traced = srv.isTraced(c.pa.subject)
+		}
+	}
+
+	// Messages from routes carry their account in the sid.
+	acc := c.accountForSid(c.pa.sid)
+	if acc == nil {
+		c.Debugf("Ignoring message for unknown account, sid %q", c.pa.sid)
+		return
+	}
+
 	var r *SublistResult
 	var ok bool
 
-	genid := atomic.LoadUint64(&srv.sl.genid)
+	// Results are cached for the account of the connection.
+	if acc == c.acc {
+		genid := atomic.LoadUint64(&acc.sl.genid)
 
-	if genid == c.cache.genid && c.cache.results != nil {
-		r, ok = c.cache.results[string(c.pa.subject)]
-	} else {
-		// reset
-		c.cache.results = make(map[string]*SublistResult)
-		c.cache.genid = genid
-	}
+		if genid == c.cache.genid && c.cache.results != nil {
+			r, ok = c.cache.results[string(c.pa.subject)]
+		} else {
+			// reset
+			c.cache.results = make(map[string]*SublistResult)
+			c.cache.genid = genid
+		}
 
-	if !ok {
-		subject := string(c.pa.subject)
-		r = srv.sl.Match(subject)
-		c.cache.results[subject] = r
-		if len(c.cache.results) > maxResultCacheSize {
-			// Prune the results cache. Keeps us from unbounded growth.
-			r := 0
-			for subject := range c.cache.results {
-				delete(c.cache.results, subject)
-				r++
-				if r > pruneSize {
-					break
+		if !ok {
+			subject := string(c.pa.subject)
+			r = acc.sl.Match(subject)
+			c.cache.results[subject] = r
+			if len(c.cache.results) > maxResultCacheSize {
+				// Prune the results cache. Keeps us from unbounded growth.
+				r := 0
+				for subject := range c.cache.results {
+					delete(c.cache.results, subject)
+					r++
+					if r > pruneSize {
+						break
+					}
 				}
 			}
 		}
+	} else {
+		r = acc.sl.Match(string(c.pa.subject))
+	}
+
+	if c.pa.traced {
+		c.traceMatch(r)
 	}
 
-	// Check for no interest, short circuit if so.
+	// Check for no interest, short circuit if so. Interest over routes
+	// and leaf nodes is in the sublist too.
 	if len(r.psubs) == 0 && len(r.qsubs) == 0 {
+		if c.pa.traced {
+			c.traceHop(TraceDrop, dropNoInterest)
+		}
+		if c.opts.NoResponders && len(c.pa.reply) > 0 {
+			c.sendNoResponders(acc)
+		}
 		return
 	}
 
@@ -1109,35 +1552,64 @@ func (c *client) processMsg(msg []byte) {
 		return
 	}
 
-	// Scratch buffer..
-	msgh := c.msgb[:len(msgHeadProto)]
-
-	// msg header
-	msgh = append(msgh, c.pa.subject...)
-	msgh = append(msgh, ' ')
-	si := len(msgh)
-
 	isRoute := c.typ == ROUTER
 
-	// If we are a route and we have a queue subscription, deliver direct
-	// since they are sent direct via L2 semantics. If the match is a queue
-	// subscription, we will return from here regardless if we find a sub.
-	if isRoute {
+	// If we are a route or leaf node and we have a queue subscription,
+	// deliver direct since they are sent direct via L2 semantics. If the
+	// match is a queue subscription, we will return from here regardless
+	// if we find a sub.
+	if isRoute || c.typ == LEAF {
 		if sub, ok := srv.routeSidQueueSubscriber(c.pa.sid); ok {
+			if sub == nil {
+				// The member left while the message was in flight.
+				sub = c.replacementQueueSub(acc, r)
+			}
 			if sub != nil {
-				mh := c.msgHeader(msgh[:si], sub)
-				c.deliverMsg(sub, mh, msg)
+				msgh := c.msgb[:len(msgHeadProto)]
+				msgh = append(msgh, c.pa.subject...)
+				msgh = append(msgh, ' ')
+				mh, dmsg := c.msgHeader(msgh, sub, msg)
+				c.deliverMsg(sub, mh, dmsg)
 			}
 			return
 		}
 	}
 
+	c.processMsgResults(r, msg, isRoute, false)
+}
+
+// processMsgResults delivers the message being processed to the matched
+// subscriptions of one account. isImport is set when the message is
+// delivered into an account through an import.
+func (c *client) processMsgResults(r *SublistResult, msg []byte, isRoute, isImport bool) {
+	srv := c.srv
+
+	// Scratch buffer..
+	msgh := c.msgb[:len(msgHeadProto)]
+
+	// msg header
+	msgh = append(msgh, c.pa.subject...)
+	msgh = append(msgh, ' ')
+	si := len(msgh)
+
 	// Used to only send normal subscriptions once across a given route.
 	var rmap map[string]struct{}
 
+	// Same for leaf nodes.
+	var lmap map[*client]struct{}
+
+	// Import subscriptions are processed after the local delivery.
+	var imports []*subscription
+
 	// Loop over all normal subscriptions that match.
 
 	for _, sub := range r.psubs {
+		if sub.im != nil {
+			if shouldImport(sub, isRoute, isImport) {
+				imports = append(imports, sub)
+			}
+			continue
+		}
 		// Check if this is a send to a ROUTER, make sure we only send it
 		// once. The other side will handle the appropriate re-processing
 		// and fan-out. Also enforce 1-Hop semantics, so no routing to another.
@@ -1166,34 +1638,93 @@ func (c *client) processMsg(msg []byte) {
 			rmap[sub.client.route.remoteID] = routeSeen
 			sub.client.mu.Unlock()
 		}
+		// Leaf nodes are multi-hop, so a message is sent to all of
+		// them, once, but never back to the leaf node it came from.
+		if sub.client.typ == LEAF {
+			if sub.client == c {
+				continue
+			}
+			if _, ok := lmap[sub.client]; ok {
+				continue
+			}
+			if lmap == nil {
+				lmap = make(map[*client]struct{})
+			}
+			lmap[sub.client] = routeSeen
+		}
 		// Normal delivery
-		mh := c.msgHeader(msgh[:si], sub)
-		c.deliverMsg(sub, mh, msg)
+		mh, dmsg := c.msgHeader(msgh[:si], sub, msg)
+		c.deliverMsg(sub, mh, dmsg)
 	}
 
-	// Now process any queue subs we have if not a route
-	if !isRoute {
-		// Check to see if we have our own rand yet. Global rand
-		// has contention with lots of clients, etc.
-		if c.cache.prand == nil {
-			c.cache.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
-		}
+	// Now process any queue subs we have if not a route or a leaf node,
+	// their queue subscriptions were picked by the origin server.
+	if !isRoute && c.typ != LEAF {
 		// Process queue subs
 		for i := 0; i < len(r.qsubs); i++ {
-			qsubs := r.qsubs[i]
-			index := c.cache.prand.Intn(len(qsubs))
-			sub := qsubs[index]
+			sub := c.pickQueueSub(r.qsubs[i])
 			if sub != nil {
-				mh := c.msgHeader(msgh[:si], sub)
-				c.deliverMsg(sub, mh, msg)
+				mh, dmsg := c.msgHeader(msgh[:si], sub, msg)
+				c.deliverMsg(sub, mh, dmsg)
 			}
 		}
 	}
+
+	for _, sub := range imports {
+		c.processImport(sub, msg, isRoute)
+	}
+}
+
+// sendNoResponders tells the publisher of a request that no one has
+// interest in it, with a status message delivered to its subscriptions
+// on the reply subject.
+func (c *client) sendNoResponders(acc *Account) {
+	// The status is a message on the reply subject, without a reply,
+	// and the permissions are checked on it.
+	subject, reply := c.pa.subject, c.pa.reply
+	c.pa.subject, c.pa.reply = reply, nil
+	defer func() { c.pa.subject, c.pa.reply = subject, reply }()
+
+	r := acc.sl.Match(string(reply))
+	msg := []byte(noRespondersHdr + CR_LF)
+	for _, sub := range r.psubs {
+		if sub.client != c {
+			continue
+		}
+		mh := []byte(fmt.Sprintf("%s%s %s %d %d\r\n", hmsgHeadProto, reply, sub.sid,
+			len(noRespondersHdr), len(noRespondersHdr)))
+		c.deliverMsg(sub, mh, msg)
+	}
+}
+
+// canPublish returns true if the client can publish to the subject, by
+// its permissions or as the response to a request it received.
+func (c *client) canPublish(subject string) bool {
+	perms := c.perms
+	if perms.canPublish(subject) {
+		return true
+	}
+	if perms.resp == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return perms.useResponse(subject)
 }
 
 func (c *client) pubPermissionViolation(subject []byte) {
+	if c.pa.traced {
+		c.traceHop(TraceDrop, dropPermissions)
+	}
 	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q", subject))
 	c.Errorf("Publish Violation - User %q, Subject %q", c.opts.Username, subject)
+	c.audit(AuditPublishViolation, subject)
+}
+
+func (c *client) subPermissionViolation(subject []byte) {
+	c.sendErr(fmt.Sprintf("Permissions Violation for Subscription to %q", subject))
+	c.Errorf("Subscription Violation - User %q, Subject %q", c.opts.Username, subject)
+	c.audit(AuditSubscribeViolation, subject)
 }
 
 func (c *client) processPingTimer() {
@@ -1201,7 +1732,9 @@ func (c *client) processPingTimer() {
 	defer c.mu.Unlock()
 	c.ptmr = nil
 	// Check if we are ready yet..
-	if _, ok := c.nc.(*net.TCPConn); !ok {
+	switch c.nc.(type) {
+	case *net.TCPConn, *net.UnixConn, *wsConn:
+	default:
 		return
 	}
 
@@ -1209,7 +1742,7 @@ func (c *client) processPingTimer() {
 
 	// Check for violation
 	c.pout++
-	if c.pout > c.srv.opts.MaxPingsOut {
+	if c.pout > c.srv.getOpts().MaxPingsOut {
 		c.Debugf("Stale Client Connection - Closing")
 		c.sendProto([]byte(fmt.Sprintf("-ERR '%s'\r\n", "Stale Connection")), true)
 		c.clearConnection()
@@ -1219,21 +1752,17 @@ func (c *client) processPingTimer() {
 	c.traceOutOp("PING", nil)
 
 	// Send PING
-	err := c.sendProto([]byte("PING\r\n"), true)
-	if err != nil {
-		c.Debugf("Error on Client Ping Flush, error %s", err)
-		c.clearConnection()
-	} else {
-		// Reset to fire again if all OK.
-		c.setPingTimer()
-	}
+	c.sendProto([]byte("PING\r\n"), true)
+
+	// Reset to fire again.
+	c.setPingTimer()
 }
 
 func (c *client) setPingTimer() {
 	if c.srv == nil {
 		return
 	}
-	d := c.srv.opts.PingInterval
+	d := c.srv.getOpts().PingInterval
 	c.ptmr = time.AfterFunc(d, c.processPingTimer)
 }
 
@@ -1268,20 +1797,46 @@ func (c *client) isAuthTimerSet() bool {
 	return isSet
 }
 
+// SetExpiration disconnects the client when its credentials expire at
+// the time, never if zero. Implements the ClientAuth interface.
+func (c *client) SetExpiration(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clearExpirationTimer()
+	if t.IsZero() {
+		return
+	}
+	c.etmr = time.AfterFunc(time.Until(t), c.authExpired)
+}
+
+// Lock should be held
+func (c *client) clearExpirationTimer() {
+	if c.etmr == nil {
+		return
+	}
+	c.etmr.Stop()
+	c.etmr = nil
+}
+
 // Lock should be held
 func (c *client) clearConnection() {
 	if c.nc == nil {
 		return
 	}
+	// Write what is still queued, e.g. a last -ERR, unless the
+	// client is a slow consumer whose queue was dropped.
+	if !c.flags.isSet(slowConsumer) {
+		c.flushOutbound()
+	}
+	c.out.nb, c.out.cur, c.out.pb = nil, nil, 0
 	// With TLS, Close() is sending an alert (that is doing a write).
 	// Need to set a deadline otherwise the server could block there
 	// if the peer is not reading from socket.
-	c.nc.SetWriteDeadline(time.Now().Add(c.srv.opts.WriteDeadline))
-	if c.bw != nil {
-		c.bw.Flush()
-	}
+	c.nc.SetWriteDeadline(time.Now().Add(c.srv.getOpts().WriteDeadline))
 	c.nc.Close()
 	c.nc.SetWriteDeadline(time.Time{})
+	// Let the writeLoop exit.
+	c.out.cv.Broadcast()
 }
 
 func (c *client) typeString() string {
@@ -1290,21 +1845,31 @@ func (c *client) typeString() string {
 		return "Client"
 	case ROUTER:
 		return "Router"
+	case LEAF:
+		return "Leaf Node"
 	}
 	return "Unknown Type"
 }
 
 func (c *client) closeConnection() {
 	c.mu.Lock()
-	if c.nc == nil {
+	// The lock is released while the queue is flushed,
+	// make sure we go through here only once.
+	if c.nc == nil || !c.flags.setIfNotSet(connClosing) {
 		c.mu.Unlock()
 		return
 	}
 
 	c.Debugf("%s connection closed", c.typeString())
 
+	// Only clients that were authorized are bound to an account.
+	if c.acc != nil {
+		c.sendClientEvent(EventClientDisconnect)
+	}
+
 	c.clearAuthTimer()
 	c.clearPingTimer()
+	c.clearExpirationTimer()
 	c.clearConnection()
 	c.nc = nil
 
@@ -1319,24 +1884,46 @@ func (c *client) closeConnection() {
 	if c.route != nil {
 		retryImplicit = c.route.retry
 	}
+	var leafRemote *RemoteLeafOpts
+	if c.leaf != nil {
+		leafRemote = c.leaf.remote
+	}
 
 	c.mu.Unlock()
 
 	if srv != nil {
+		// Queue group members are remembered before the client is
+		// unregistered, for the messages in flight to them.
+		for _, sub := range subs {
+			if sub.queue != nil && sub.acc != nil {
+				sub.acc.addDeparted(sub)
+			}
+		}
+
 		// Unregister
 		srv.removeClient(c)
 
 		// Remove clients subscriptions.
 		for _, sub := range subs {
-			srv.sl.Remove(sub)
-			// Forward on unsubscribes if we are not
-			// a router ourselves.
-			if c.typ != ROUTER {
-				srv.broadcastUnSubscribe(sub)
+			if sub.acc != nil {
+				sub.acc.sl.Remove(sub)
 			}
+			// Forward on unsubscribes, those of routes
+			// are only sent to the leaf nodes.
+			srv.broadcastUnSubscribe(sub)
 		}
 	}
 
+	// Reconnect to the hub of a leaf node.
+	if leafRemote != nil && srv != nil {
+		srv.mu.Lock()
+		if srv.running {
+			srv.startGoRoutine(func() { srv.connectToLeafRemote(leafRemote, true) })
+		}
+		srv.mu.Unlock()
+		return
+	}
+
 	// Check for a solicited route. If it was, start up a reconnect unless
 	// we are already connected to the other end.
 	if c.isSolicitedRoute() || retryImplicit {
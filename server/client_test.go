@@ -38,7 +38,7 @@ func (m *mockAuth) Check(c ClientAuth) bool {
 
 func createClientAsync(ch chan *client, s *Server, cli net.Conn) {
 	go func() {
-		c := s.createClient(cli)
+		c := s.createClient(cli, nil)
 		// Must be here to suppress +OK
 		c.opts.Verbose = false
 		ch <- c
@@ -367,7 +367,9 @@ func TestClientPubWithQueueSub(t *testing.T) {
 	go func() {
 		c.parse(op)
 		for cp := range c.pcd {
-			cp.bw.Flush()
+			cp.mu.Lock()
+			cp.flushOutbound()
+			cp.mu.Unlock()
 		}
 		c.nc.Close()
 	}()
@@ -416,7 +418,9 @@ func TestClientUnSub(t *testing.T) {
 	go func() {
 		c.parse(op)
 		for cp := range c.pcd {
-			cp.bw.Flush()
+			cp.mu.Lock()
+			cp.flushOutbound()
+			cp.mu.Unlock()
 		}
 		c.nc.Close()
 	}()
@@ -459,7 +463,9 @@ func TestClientUnSubMax(t *testing.T) {
 	go func() {
 		c.parse(op)
 		for cp := range c.pcd {
-			cp.bw.Flush()
+			cp.mu.Lock()
+			cp.flushOutbound()
+			cp.mu.Unlock()
 		}
 		c.nc.Close()
 	}()
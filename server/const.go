@@ -29,6 +29,9 @@ const (
 	// something different if > 1MB payloads are needed.
 	MAX_PAYLOAD_SIZE = (1024 * 1024 * 1030)
 
+	// MAX_PENDING_SIZE is the maximum outbound pending bytes per client.
+	MAX_PENDING_SIZE = (64 * 1024 * 1024)
+
 	// DEFAULT_MAX_CONNECTIONS is the default maximum connections allowed.
 	DEFAULT_MAX_CONNECTIONS = (64 * 1024)
 
@@ -71,6 +74,34 @@ const (
 	// DEFAULT_ROUTE_DIAL Route dial timeout.
 	DEFAULT_ROUTE_DIAL = 1 * time.Second
 
+	// DEFAULT_LAME_DUCK_DURATION is the time over which clients are
+	// closed in lame duck mode.
+	DEFAULT_LAME_DUCK_DURATION = 30 * time.Second
+
+	// DEFAULT_AUTH_CALLOUT_SUBJECT is the subject the auth service
+	// answers the requests of the auth callout on.
+	DEFAULT_AUTH_CALLOUT_SUBJECT = "_SYS.AUTH.CALLOUT"
+
+	// DEFAULT_AUTH_CALLOUT_TIMEOUT is how long the auth service has to
+	// answer before the client is denied.
+	DEFAULT_AUTH_CALLOUT_TIMEOUT = 2 * time.Second
+
+	// DEFAULT_AUTH_CALLOUT_TTL is how long the decisions of the auth
+	// service are cached.
+	DEFAULT_AUTH_CALLOUT_TTL = 30 * time.Second
+
+	// DEFAULT_ALLOW_RESPONSES_MAX_MSGS is how many responses a client
+	// can publish to the reply subject of a request it received.
+	DEFAULT_ALLOW_RESPONSES_MAX_MSGS = 1
+
+	// DEFAULT_ALLOW_RESPONSES_EXPIRATION is how long a client can
+	// publish to the reply subject of a request it received.
+	DEFAULT_ALLOW_RESPONSES_EXPIRATION = 2 * time.Minute
+
+	// DEFAULT_AUDIT_WINDOW is the window the violations from a source
+	// are counted within.
+	DEFAULT_AUDIT_WINDOW = time.Minute
+
 	// PROTO_SNIPPET_SIZE is the default size of proto to print on parse errors.
 	PROTO_SNIPPET_SIZE = 32
 
@@ -79,4 +110,10 @@ const (
 
 	// MAX_PUB_ARGS Maximum possible number of arguments from PUB proto.
 	MAX_PUB_ARGS = 3
+
+	// MAX_HMSG_ARGS Maximum possible number of arguments from HMSG proto.
+	MAX_HMSG_ARGS = 5
+
+	// MAX_HPUB_ARGS Maximum possible number of arguments from HPUB proto.
+	MAX_HPUB_ARGS = 4
 )
@@ -14,6 +14,14 @@ var (
 	// ErrAuthTimeout represents an error condition on failed authorization due to timeout.
 	ErrAuthTimeout = errors.New("Authorization Timeout")
 
+	// ErrAuthExpired represents an error condition on the expiration of
+	// the credentials of a client.
+	ErrAuthExpired = errors.New("User Authentication Expired")
+
+	// ErrTooManyViolations represents an error condition when a source
+	// has too many authorization or permission violations.
+	ErrTooManyViolations = errors.New("Too Many Violations")
+
 	// ErrMaxPayload represents an error condition when the payload is too big.
 	ErrMaxPayload = errors.New("Maximum Payload Exceeded")
 
@@ -30,6 +38,14 @@ var (
 	// server has been reached.
 	ErrTooManyConnections = errors.New("Maximum Connections Exceeded")
 
+	// ErrMsgHeadersNotSupported signals a client sent HPUB without
+	// negotiating headers in its CONNECT.
+	ErrMsgHeadersNotSupported = errors.New("Message Headers Not Supported")
+
+	// ErrNoRespondersRequiresHeaders signals a client asked for the
+	// no responders status without negotiating headers in its CONNECT.
+	ErrNoRespondersRequiresHeaders = errors.New("No Responders Requires Headers Support")
+
 	// ErrClientConnectedToRoutePort represents an error condition when a client
 	// attempted to connect to the route listen port.
 	ErrClientConnectedToRoutePort = errors.New("Attempted To Connect To Route Port")
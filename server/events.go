@@ -0,0 +1,192 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// System events are published by the server on subjects of the form
+// _SYS.SERVER.<server id>.<event type>. They are only enabled when a
+// system user is configured, and only the system user can receive them.
+const (
+	sysSubjectPrefix = "_SYS."
+	sysServerSubj    = "_SYS.SERVER.%s.%s"
+
+	// Number of events waiting to be published before new ones are dropped.
+	sysSendQueueLen = 4096
+
+	// Number of requests waiting to be answered before new ones are dropped.
+	sysRecvQueueLen = 256
+)
+
+// Types of the system events, they are also the last
+// tokens of the subjects the events are published on.
+const (
+	EventClientConnect      = "CLIENT.CONNECT"
+	EventClientDisconnect   = "CLIENT.DISCONNECT"
+	EventClientAuthError    = "CLIENT.AUTH_ERROR"
+	EventClientSlowConsumer = "CLIENT.SLOW_CONSUMER"
+	EventRouteConnect       = "ROUTE.CONNECT"
+	EventRouteDisconnect    = "ROUTE.DISCONNECT"
+)
+
+// ClientEvent is the payload of the CLIENT events.
+type ClientEvent struct {
+	Type   string    `json:"type"`
+	Server string    `json:"server_id"`
+	Time   time.Time `json:"time"`
+	Client ConnInfo  `json:"client"`
+}
+
+// RouteEvent is the payload of the ROUTE events.
+type RouteEvent struct {
+	Type   string    `json:"type"`
+	Server string    `json:"server_id"`
+	Time   time.Time `json:"time"`
+	Route  RouteInfo `json:"route"`
+}
+
+// sysEvents holds the internal client publishing the events, the
+// queue of events waiting to be published and the queue of requests
+// waiting to be answered.
+type sysEvents struct {
+	id      string
+	client  *client
+	sendq   chan *sysMsg
+	recvq   chan *sysMsg
+	mu      sync.Mutex
+	replies map[string]chan []byte // requests of the server waiting for a response
+}
+
+type sysMsg struct {
+	subject string
+	reply   string
+	data    []byte
+}
+
+// SysEventSubject returns the subject the server with
+// the given id publishes the events of the given type on.
+func SysEventSubject(serverID, typ string) string {
+	return fmt.Sprintf(sysServerSubj, serverID, typ)
+}
+
+// isSysSubject returns true for the subjects reserved for the system.
+func isSysSubject(subject []byte) bool {
+	return bytes.HasPrefix(subject, []byte(sysSubjectPrefix))
+}
+
+// initEvents creates the internal client used to publish the system
+// events, in the account of the system user. Lock should be held.
+func (s *Server) initEvents() {
+	opts := s.getOpts()
+	if opts.SystemUser == "" {
+		return
+	}
+	acc := s.gacc
+	for _, u := range opts.Users {
+		if u.Username == opts.SystemUser {
+			if a := s.lookupAccount(u.Account); a != nil {
+				acc = a
+			}
+			break
+		}
+	}
+	c := &client{srv: s, typ: SYSTEM, opts: clientOpts{Name: "system"}, acc: acc}
+	c.mu.Lock()
+	c.initClient()
+	c.mu.Unlock()
+	s.sys = &sysEvents{
+		id:      s.info.ID,
+		client:  c,
+		sendq:   make(chan *sysMsg, sysSendQueueLen),
+		recvq:   make(chan *sysMsg, sysRecvQueueLen),
+		replies: make(map[string]chan []byte),
+	}
+	s.addSysSubscriptions()
+}
+
+// eventsLoop publishes the queued events and answers the
+// requests until the server is shutdown.
+func (s *Server) eventsLoop() {
+	defer s.grWG.Done()
+
+	c := s.sys.client
+	for {
+		select {
+		case <-s.rcQuit:
+			return
+		case m := <-s.sys.sendq:
+			c.publishInternal(m.subject, m.reply, m.data)
+		case m := <-s.sys.recvq:
+			s.processSysRequest(m)
+		}
+	}
+}
+
+// publishInternal delivers a message published by the server itself
+// to the subscriptions of the client's account and to the routes.
+// Only called from the eventsLoop.
+func (c *client) publishInternal(subject, reply string, data []byte) {
+	c.pa.subject = []byte(subject)
+	c.pa.reply = nil
+	if reply != "" {
+		c.pa.reply = []byte(reply)
+	}
+	c.pa.sid = nil
+	c.pa.hdr = 0
+	c.pa.hdb = nil
+	c.pa.traced = false
+	c.pa.size = len(data)
+	c.pa.szb = []byte(strconv.Itoa(len(data)))
+
+	msg := append(data, CR_LF...)
+	r := c.acc.sl.Match(subject)
+	c.processMsgResults(r, msg, false, false)
+	c.flushClients()
+}
+
+// sendEvent queues the event to be published by the eventsLoop.
+// It never blocks, the event is dropped if the queue is full.
+func (s *Server) sendEvent(typ string, ev interface{}) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		Errorf("Error marshalling %s event: %v", typ, err)
+		return
+	}
+	select {
+	case s.sys.sendq <- &sysMsg{subject: SysEventSubject(s.sys.id, typ), data: b}:
+	default:
+		Debugf("System events queue is full, dropping %s event", typ)
+	}
+}
+
+// sendClientEvent publishes an event about the client.
+// Lock should be held.
+func (c *client) sendClientEvent(typ string) {
+	s := c.srv
+	if s == nil || s.sys == nil || c.typ != CLIENT {
+		return
+	}
+	ev := &ClientEvent{Type: typ, Server: s.sys.id, Time: time.Now().UTC()}
+	ev.Client.fill(c, ev.Time)
+	ev.Client.AuthorizedUser = c.opts.Username
+	s.sendEvent(typ, ev)
+}
+
+// sendRouteEvent publishes an event about the route.
+func (s *Server) sendRouteEvent(typ string, r *client) {
+	if s.sys == nil {
+		return
+	}
+	ev := &RouteEvent{Type: typ, Server: s.sys.id, Time: time.Now().UTC()}
+	r.mu.Lock()
+	ev.Route = *newRouteInfo(r)
+	r.mu.Unlock()
+	s.sendEvent(typ, ev)
+}
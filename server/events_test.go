@@ -0,0 +1,47 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestSystemUserConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/events.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.SystemUser != "admin" {
+		t.Fatalf("Expected system user %q, got %q", "admin", opts.SystemUser)
+	}
+	if hasUser(opts.Users, "bob") {
+		t.Fatal("Expected bob not to be a configured user")
+	}
+
+	s := New(opts)
+	if s.sys == nil || s.sys.client.typ != SYSTEM || s.sys.client.acc != s.gacc {
+		t.Fatal("Expected the system events to be enabled")
+	}
+	if s := New(&Options{}); s.sys != nil {
+		t.Fatal("Expected the system events to be disabled")
+	}
+}
+
+func TestIsSysSubject(t *testing.T) {
+	tests := []struct {
+		subject string
+		sys     bool
+	}{
+		{"_SYS.SERVER.id.CLIENT.CONNECT", true},
+		{"_SYS.>", true},
+		{"_SYS", false},
+		{"_SYSTEM.foo", false},
+		{"foo._SYS.bar", false},
+		{">", false},
+	}
+	for _, tt := range tests {
+		if got := isSysSubject([]byte(tt.subject)); got != tt.sys {
+			t.Fatalf("isSysSubject(%q) = %v, expected %v", tt.subject, got, tt.sys)
+		}
+	}
+}
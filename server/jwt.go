@@ -0,0 +1,176 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JWTOpts configures the authentication of the clients by a JWT signed
+// by a trusted operator, or by an account the operator signed the JWT
+// of. Users are provisioned by issuing JWTs, without changing the
+// configuration of the server. Keys are nkeys, see DecodeNkey.
+type JWTOpts struct {
+	// Public keys of the trusted operators.
+	Operators []string `json:"operators"`
+	// Directory of the account JWTs, named by the public key of the
+	// account with a .jwt extension.
+	AccountsDir string `json:"accounts_dir,omitempty"`
+	// Directory of the revocation lists, files with one revoked public
+	// key or JWT ID per line. The clients are disconnected when their
+	// JWT, or the one of their account, is revoked.
+	RevocationsDir string `json:"revocations_dir,omitempty"`
+}
+
+// How often the revocations directory is checked for changes.
+const revocationsInterval = 2 * time.Second
+
+// validateJWT checks the JWT authentication of the options.
+func validateJWT(opts *Options) error {
+	jo := opts.JWT
+	if jo == nil {
+		return nil
+	}
+	if len(jo.Operators) == 0 {
+		return fmt.Errorf("JWT authentication requires trusted operators")
+	}
+	for _, op := range jo.Operators {
+		if _, err := DecodeNkey(op); err != nil {
+			return fmt.Errorf("Invalid JWT operator: %v", err)
+		}
+	}
+	for _, dir := range []string{jo.AccountsDir, jo.RevocationsDir} {
+		if dir == "" {
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("JWT directory %q is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// IsRevoked returns true if any of the public keys or JWT IDs is in
+// the revocation lists.
+func (s *Server) IsRevoked(ids ...string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if id != "" && s.revoked[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// revocationsStamp identifies the content of the revocations directory
+// by the names, sizes and modification times of its files.
+func revocationsStamp(dir string) string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, fi := range fis {
+		fmt.Fprintf(&b, "%s:%d:%d;", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// loadRevocations reads the revocation lists, it returns true if they
+// changed since the last load.
+func (s *Server) loadRevocations() bool {
+	dir := s.revocationsDir()
+	stamp := revocationsStamp(dir)
+	s.mu.Lock()
+	changed := stamp != s.revokedStamp
+	s.mu.Unlock()
+	if !changed {
+		return false
+	}
+
+	revoked := make(map[string]bool)
+	if dir != "" {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for _, name := range files {
+			f, err := os.Open(name)
+			if err != nil {
+				Errorf("Error reading the revocation list %s: %v", name, err)
+				continue
+			}
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line != "" && !strings.HasPrefix(line, "#") {
+					revoked[line] = true
+				}
+			}
+			f.Close()
+		}
+	}
+	s.mu.Lock()
+	s.revoked, s.revokedStamp = revoked, stamp
+	s.mu.Unlock()
+	Debugf("Loaded %d revoked keys and JWT IDs", len(revoked))
+	return true
+}
+
+// revocationsDir returns the revocations directory of the options,
+// empty if not configured.
+func (s *Server) revocationsDir() string {
+	if jo := s.getOpts().JWT; jo != nil {
+		return jo.RevocationsDir
+	}
+	return ""
+}
+
+// startRevocationsLoop watches the revocations directory, if configured
+// and not watched yet. It is called on start and on reload.
+func (s *Server) startRevocationsLoop() {
+	if s.revocationsDir() == "" {
+		return
+	}
+	s.mu.Lock()
+	running := s.revokedLoop
+	s.revokedLoop = true
+	s.mu.Unlock()
+	if !running {
+		s.startGoRoutine(func() { s.revocationsLoop() })
+	}
+}
+
+// revocationsLoop reloads the revocation lists when they change, and
+// disconnects the clients revoked, until the server is shutdown or the
+// revocations directory is removed from the options.
+func (s *Server) revocationsLoop() {
+	defer s.grWG.Done()
+
+	t := time.NewTicker(revocationsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.rcQuit:
+			return
+		case <-t.C:
+			// Checked under the lock, so a reload enabling the
+			// directory again either sees the loop running or
+			// starts a new one.
+			s.mu.Lock()
+			if s.revocationsDir() == "" {
+				s.revokedLoop = false
+				s.mu.Unlock()
+				return
+			}
+			s.mu.Unlock()
+			if s.loadRevocations() {
+				s.recheckClientAuth()
+			}
+		}
+	}
+}
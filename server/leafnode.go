@@ -0,0 +1,399 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/glycerine/hnatsd/util"
+)
+
+// Leaf nodes link a server, the spoke, to a server of another cluster,
+// the hub, over a single connection. Unlike routes they do not require
+// a full mesh: the interest of each side, including the interest it
+// learned from its routes and other leaf nodes, is sent over the link,
+// and messages are forwarded across it in both directions. A leaf node
+// is bound to one account on each side, the hub authorizes it as one of
+// its users. Topologies must not have cycles.
+
+type leafNode struct {
+	remoteID string
+	remote   *RemoteLeafOpts // Set when we connected to the hub.
+}
+
+// leafSid returns the sid used for the subscription on leaf nodes. It
+// is a route sid without the account, the link is bound to an account.
+func leafSid(sub *subscription) string {
+	var qi string
+	if len(sub.queue) > 0 {
+		qi = "Q"
+	}
+	return fmt.Sprintf("%s%s:%d:%s", qi, RSID, sub.client.cid, sub.sid)
+}
+
+// startLeafNodes starts accepting leaf nodes if a listen port is
+// configured, and connects to the configured remotes.
+func (s *Server) startLeafNodes() {
+	opts := s.getOpts()
+	if opts.LeafNode.Port != 0 {
+		tlsReq := opts.LeafNode.TLSConfig != nil
+		info := Info{
+			ID:           s.info.ID,
+			Version:      s.info.Version,
+			Host:         opts.LeafNode.Host,
+			Port:         opts.LeafNode.Port,
+			AuthRequired: s.info.AuthRequired,
+			TLSRequired:  tlsReq,
+			SSLRequired:  tlsReq,
+			TLSVerify:    tlsReq,
+			MaxPayload:   s.info.MaxPayload,
+			Headers:      true,
+		}
+		b, _ := json.Marshal(info)
+		s.mu.Lock()
+		s.leafInfoJSON = []byte(fmt.Sprintf(InfoProto, b))
+		s.mu.Unlock()
+
+		ch := make(chan struct{})
+		go s.leafAcceptLoop(ch)
+		<-ch
+	}
+	for _, r := range opts.LeafNode.Remotes {
+		remote := r
+		s.startGoRoutine(func() { s.connectToLeafRemote(remote, false) })
+	}
+}
+
+func (s *Server) leafAcceptLoop(ch chan struct{}) {
+	opts := s.getOpts()
+	hp := net.JoinHostPort(opts.LeafNode.Host, strconv.Itoa(opts.LeafNode.Port))
+	Noticef("Listening for leaf node connections on %s", hp)
+	l, e := s.listen("tcp", hp)
+	if e != nil {
+		// We need to close this channel to avoid a deadlock
+		close(ch)
+		Fatalf("Error listening on leaf node port: %d - %v", opts.LeafNode.Port, e)
+		return
+	}
+
+	// Setup state that can enable shutdown
+	s.mu.Lock()
+	s.leafListener = l
+	s.mu.Unlock()
+
+	// Let them know we are up
+	close(ch)
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				Debugf("Temporary Leaf Node Accept Errorf(%v), sleeping %dms",
+					ne, tmpDelay/time.Millisecond)
+				time.Sleep(tmpDelay)
+				tmpDelay *= 2
+				if tmpDelay > ACCEPT_MAX_SLEEP {
+					tmpDelay = ACCEPT_MAX_SLEEP
+				}
+			} else if s.isRunning() {
+				Noticef("Accept error: %v", err)
+			}
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.createLeaf(conn, nil)
+			s.grWG.Done()
+		})
+	}
+	Debugf("Leaf node accept loop exiting..")
+	s.done <- true
+}
+
+// connectToLeafRemote connects to the hub until it succeeds or the
+// server is shutdown. Reconnects wait before the first attempt.
+func (s *Server) connectToLeafRemote(remote *RemoteLeafOpts, reconnect bool) {
+	defer s.grWG.Done()
+	if reconnect {
+		select {
+		case <-s.rcQuit:
+			return
+		case <-time.After(DEFAULT_ROUTE_RECONNECT):
+		}
+	}
+	for s.isRunning() {
+		Debugf("Trying to connect to leaf node remote on %s", remote.URL.Host)
+		conn, err := net.DialTimeout("tcp", remote.URL.Host, DEFAULT_ROUTE_DIAL)
+		if err != nil {
+			Debugf("Error trying to connect to leaf node remote: %v", err)
+			select {
+			case <-s.rcQuit:
+				return
+			case <-time.After(DEFAULT_ROUTE_CONNECT):
+				continue
+			}
+		}
+		s.createLeaf(conn, remote)
+		return
+	}
+}
+
+func (s *Server) createLeaf(conn net.Conn, remote *RemoteLeafOpts) *client {
+	didSolicit := remote != nil
+	c := &client{srv: s, nc: conn, opts: clientOpts{}, typ: LEAF, leaf: &leafNode{remote: remote}}
+
+	opts := s.getOpts()
+
+	// Grab server variables
+	s.mu.Lock()
+	infoJSON := s.leafInfoJSON
+	authRequired := s.info.AuthRequired
+	if didSolicit {
+		// The spoke side is bound to the account of the remote.
+		c.acc = s.lookupAccount(remote.Account)
+	}
+	s.mu.Unlock()
+	tlsRequired := opts.LeafNode.TLSConfig != nil
+
+	if didSolicit && c.acc == nil {
+		Errorf("Leaf node remote %q bound to unknown account %q", remote.URL.Host, remote.Account)
+		conn.Close()
+		return nil
+	}
+
+	// Grab lock
+	c.mu.Lock()
+
+	// Initialize
+	c.initClient()
+
+	c.Debugf("Leaf node connection created")
+
+	// Check for TLS
+	if tlsRequired {
+		tlsConfig := util.CloneTLSConfig(opts.LeafNode.TLSConfig)
+
+		// If we solicited, we will act like the client, otherwise the server.
+		if didSolicit {
+			c.Debugf("Starting TLS leaf node client handshake")
+			host, _, _ := net.SplitHostPort(remote.URL.Host)
+			tlsConfig.ServerName = host
+			c.nc = tls.Client(c.nc, tlsConfig)
+		} else {
+			c.Debugf("Starting TLS leaf node server handshake")
+			c.nc = tls.Server(c.nc, tlsConfig)
+		}
+
+		conn := c.nc.(*tls.Conn)
+
+		// Setup the timeout
+		ttl := secondsToDuration(opts.LeafNode.TLSTimeout)
+		time.AfterFunc(ttl, func() { tlsTimeout(c, conn) })
+		conn.SetReadDeadline(time.Now().Add(ttl))
+
+		c.mu.Unlock()
+		if err := conn.Handshake(); err != nil {
+			c.Debugf("TLS leaf node handshake error: %v", err)
+			c.sendErr("Secure Connection - TLS Required")
+			c.closeConnection()
+			return nil
+		}
+		// Reset the read deadline
+		conn.SetReadDeadline(time.Time{})
+
+		// Re-Grab lock
+		c.mu.Lock()
+
+		// Verify that the connection did not go away while we released the lock.
+		if c.nc == nil {
+			c.mu.Unlock()
+			return nil
+		}
+	}
+
+	// Set the Ping timer
+	c.setPingTimer()
+
+	// Leaf nodes are added to s.leafs once the hub has authorized
+	// them, until then they are closed on shutdown from here.
+	s.grMu.Lock()
+	s.grTmpClients[c.cid] = c
+	s.grMu.Unlock()
+
+	// Spin up the read and write loops.
+	s.startGoRoutine(func() { c.readLoop() })
+	s.startGoRoutine(func() { c.writeLoop() })
+
+	if didSolicit {
+		// The hub sends its INFO, we authenticate with the
+		// credentials of the remote URL.
+		c.sendLeafConnect(tlsRequired)
+		c.Debugf("Leaf node connect msg sent")
+	} else {
+		c.sendInfo(infoJSON)
+		if authRequired {
+			c.setAuthTimer(secondsToDuration(opts.AuthTimeout))
+		}
+	}
+
+	c.mu.Unlock()
+
+	return c
+}
+
+// Lock should be held entering here.
+func (c *client) sendLeafConnect(tlsRequired bool) {
+	var user, pass string
+	if userInfo := c.leaf.remote.URL.User; userInfo != nil {
+		user = userInfo.Username()
+		pass, _ = userInfo.Password()
+	}
+	cinfo := connectInfo{
+		User:    user,
+		Pass:    pass,
+		TLS:     tlsRequired,
+		Name:    c.srv.info.ID,
+		Headers: true,
+	}
+	b, err := json.Marshal(cinfo)
+	if err != nil {
+		c.Errorf("Error marshalling CONNECT to leaf node: %v\n", err)
+		return
+	}
+	c.sendProto([]byte(fmt.Sprintf(ConProto, b)), true)
+}
+
+// processLeafInfo registers the leaf node when the
+// spoke side receives the INFO of the hub.
+func (c *client) processLeafInfo(info *Info) {
+	c.mu.Lock()
+	if c.leaf == nil || c.leaf.remote == nil || c.nc == nil || c.leaf.remoteID != "" {
+		c.mu.Unlock()
+		return
+	}
+	s := c.srv
+	c.leaf.remoteID = info.ID
+	c.headers = info.Headers
+	c.mu.Unlock()
+
+	// Detect leaf node to self.
+	if info.ID == s.info.ID {
+		c.Debugf("Detected leaf node to self, closing")
+		c.closeConnection()
+		return
+	}
+	s.addLeaf(c)
+}
+
+// addLeaf registers the leaf node and sends it the interest of the
+// account it is bound to.
+func (s *Server) addLeaf(c *client) {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.grMu.Lock()
+	delete(s.grTmpClients, c.cid)
+	s.grMu.Unlock()
+	s.leafs[c.cid] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.Noticef("Leaf node connection to %q registered", c.leaf.remoteID)
+	c.mu.Unlock()
+
+	s.sendLocalSubsToLeaf(c)
+}
+
+// sendLeafInterest returns true if the subscription should be
+// sent to the leaf node. Lock should be held.
+func (c *client) sendLeafInterest(sub *subscription) bool {
+	return sub.client != c && sub.acc == c.acc && !isSysSubject(sub.subject)
+}
+
+// sendLocalSubsToLeaf sends the subscriptions of the clients, routes
+// and other leaf nodes in the account of the leaf node.
+func (s *Server) sendLocalSubsToLeaf(leaf *client) {
+	b := bytes.Buffer{}
+	leaf.mu.Lock()
+	acc := leaf.acc
+	leaf.mu.Unlock()
+
+	addSubs := func(client *client) {
+		if client == leaf {
+			return
+		}
+		client.mu.Lock()
+		subs := make([]*subscription, 0, len(client.subs))
+		for _, sub := range client.subs {
+			if sub.acc == acc && !isSysSubject(sub.subject) {
+				subs = append(subs, sub)
+			}
+		}
+		client.mu.Unlock()
+		for _, sub := range subs {
+			b.WriteString(fmt.Sprintf(subProto, sub.subject, sub.queueArg(), leafSid(sub)))
+		}
+	}
+	s.mu.Lock()
+	for _, client := range s.clients {
+		addSubs(client)
+	}
+	for _, route := range s.routes {
+		addSubs(route)
+	}
+	for _, l := range s.leafs {
+		addSubs(l)
+	}
+	s.mu.Unlock()
+
+	leaf.mu.Lock()
+	defer leaf.mu.Unlock()
+	leaf.sendProto(b.Bytes(), true)
+
+	leaf.Debugf("Leaf node sent local subscriptions")
+}
+
+// broadcastInterestToLeafs sends the SUB or UNSUB protocol built by
+// proto to the leaf nodes the subscription should be sent to.
+func (s *Server) broadcastInterestToLeafs(sub *subscription, proto func(rsid string) string) {
+	s.mu.Lock()
+	if len(s.leafs) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	leafs := make([]*client, 0, len(s.leafs))
+	for _, l := range s.leafs {
+		leafs = append(leafs, l)
+	}
+	s.mu.Unlock()
+
+	var p []byte
+	for _, l := range leafs {
+		l.mu.Lock()
+		if l.sendLeafInterest(sub) {
+			if p == nil {
+				p = []byte(proto(leafSid(sub)))
+			}
+			l.sendProto(p, true)
+			l.traceOutOp("", p[:len(p)-LEN_CR_LF])
+		}
+		l.mu.Unlock()
+	}
+}
+
+// NumLeafNodes will report the number of registered leaf nodes.
+func (s *Server) NumLeafNodes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.leafs)
+}
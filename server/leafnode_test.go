@@ -0,0 +1,43 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import "testing"
+
+func TestLeafNodeConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/leafnode.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	lo := opts.LeafNode
+	if lo.Host != "127.0.0.1" || lo.Port != 7422 {
+		t.Fatalf("Unexpected leaf node listen address: %s:%d", lo.Host, lo.Port)
+	}
+	if len(lo.Remotes) != 2 {
+		t.Fatalf("Expected 2 remotes, got %d", len(lo.Remotes))
+	}
+	if r := lo.Remotes[0]; r.URL.Host != "127.0.0.1:7423" || r.URL.User.Username() != "user" || r.Account != "" {
+		t.Fatalf("Unexpected remote: %+v", r)
+	}
+	if r := lo.Remotes[1]; r.URL.Host != "127.0.0.1:7424" || r.Account != "lab" {
+		t.Fatalf("Unexpected remote: %+v", r)
+	}
+}
+
+func TestLeafSid(t *testing.T) {
+	s := New(&Options{Accounts: []*AccountOpts{{Name: "lab"}}})
+	c := &client{cid: 12}
+	sub := &subscription{client: c, sid: []byte("1"), acc: s.gacc}
+	if sid := leafSid(sub); sid != "RSID:12:1" {
+		t.Fatalf("Unexpected leaf sid %q", sid)
+	}
+	sub.queue = []byte("workers")
+	sub.acc = s.lookupAccount("lab")
+	if sid := leafSid(sub); sid != "QRSID:12:1" {
+		t.Fatalf("Unexpected leaf sid %q", sid)
+	}
+	// Routes carry the account, leaf nodes are bound to one.
+	if sid := routeSid(sub); sid != "$lab:QRSID:12:1" {
+		t.Fatalf("Unexpected route sid %q", sid)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"time"
+)
+
+// Errors sent to clients exceeding their user limits.
+const (
+	errMaxSubsExceeded     = "Maximum Subscriptions Exceeded"
+	errMaxPendingExceeded  = "Maximum Pending Bytes Exceeded"
+	errMaxMsgRateExceeded  = "Maximum Message Rate Exceeded"
+	errMaxByteRateExceeded = "Maximum Byte Rate Exceeded"
+)
+
+// clientLimits holds the limits of a client connection, the state
+// of its publish rate buckets and the number of times each limit
+// was hit. Protected by the client lock.
+type clientLimits struct {
+	UserLimits
+
+	msgTokens  float64
+	byteTokens float64
+	last       time.Time
+
+	subsDenied      uint64
+	pendingDropped  uint64
+	msgRateDropped  uint64
+	byteRateDropped uint64
+}
+
+// LimitStats are the limits of a connection reported in /connz,
+// with the number of times each limit was hit.
+type LimitStats struct {
+	UserLimits
+	SubsDenied      uint64 `json:"subscriptions_denied"`
+	PendingDropped  uint64 `json:"pending_dropped"`
+	MsgRateDropped  uint64 `json:"msg_rate_dropped"`
+	ByteRateDropped uint64 `json:"byte_rate_dropped"`
+}
+
+// setLimits applies the user limits to the client, keeping the
+// counters and rate state across configuration reloads.
+// Lock should be held.
+func (c *client) setLimits(ul *UserLimits) {
+	if ul == nil || *ul == (UserLimits{}) {
+		c.limits = nil
+		return
+	}
+	if c.limits == nil {
+		c.limits = &clientLimits{
+			msgTokens:  float64(ul.MaxMsgsPerSec),
+			byteTokens: float64(ul.MaxBytesPerSec),
+			last:       time.Now(),
+		}
+	}
+	c.limits.UserLimits = *ul
+}
+
+// allowPublish refills the rate buckets and takes a message of the given
+// size out of them. Returns the error to send to the client if a rate is
+// exceeded. Buckets hold up to one second of traffic, the byte bucket up
+// to the message if larger, so that it is delayed rather than never
+// allowed.
+func (l *clientLimits) allowPublish(size int, now time.Time) string {
+	if l.MaxMsgsPerSec == 0 && l.MaxBytesPerSec == 0 {
+		return ""
+	}
+	// Both buckets are refilled before either is checked, so the
+	// time elapsed is not lost when a message is dropped.
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	if l.MaxMsgsPerSec > 0 {
+		l.msgTokens = refill(l.msgTokens, elapsed, l.MaxMsgsPerSec, float64(l.MaxMsgsPerSec))
+	}
+	if l.MaxBytesPerSec > 0 {
+		capacity := float64(l.MaxBytesPerSec)
+		if float64(size) > capacity {
+			capacity = float64(size)
+		}
+		l.byteTokens = refill(l.byteTokens, elapsed, l.MaxBytesPerSec, capacity)
+	}
+
+	if l.MaxMsgsPerSec > 0 && l.msgTokens < 1 {
+		l.msgRateDropped++
+		return errMaxMsgRateExceeded
+	}
+	if l.MaxBytesPerSec > 0 {
+		if l.byteTokens < float64(size) {
+			l.byteRateDropped++
+			return errMaxByteRateExceeded
+		}
+		l.byteTokens -= float64(size)
+	}
+	if l.MaxMsgsPerSec > 0 {
+		l.msgTokens--
+	}
+	return ""
+}
+
+func refill(tokens, elapsed float64, rate int64, capacity float64) float64 {
+	tokens += elapsed * float64(rate)
+	if tokens > capacity {
+		tokens = capacity
+	}
+	return tokens
+}
+
+// stats returns the limits and counters reported in /connz.
+func (l *clientLimits) stats() *LimitStats {
+	return &LimitStats{
+		UserLimits:      l.UserLimits,
+		SubsDenied:      l.subsDenied,
+		PendingDropped:  l.pendingDropped,
+		MsgRateDropped:  l.msgRateDropped,
+		ByteRateDropped: l.byteRateDropped,
+	}
+}
+
+// checkPublishLimits is called from processPub and processHeaderPub.
+// It returns false if the message must be dropped, after sending
+// the error to the client.
+func (c *client) checkPublishLimits() bool {
+	c.mu.Lock()
+	if c.limits == nil {
+		c.mu.Unlock()
+		return true
+	}
+	err := c.limits.allowPublish(c.pa.size, time.Now())
+	c.mu.Unlock()
+	if err != "" {
+		c.sendErr(err)
+		c.Debugf("%s - User %q, Subject %q", err, c.opts.Username, c.pa.subject)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUserLimitsConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/limits.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := []*UserLimits{
+		{MaxSubs: 10, MaxPending: 1024},
+		{MaxMsgsPerSec: 100, MaxBytesPerSec: 4096},
+		nil,
+	}
+	for i, u := range opts.Users {
+		if !reflect.DeepEqual(u.Limits, expected[i]) {
+			t.Fatalf("Unexpected limits for %q: %+v", u.Username, u.Limits)
+		}
+	}
+
+	if _, err := parseUserLimits(map[string]interface{}{"max_subs": int64(-1)}); err == nil {
+		t.Fatal("Expected an error for a negative limit")
+	}
+	if _, err := parseUserLimits(map[string]interface{}{"max_foo": int64(1)}); err == nil {
+		t.Fatal("Expected an error for an unknown limit")
+	}
+}
+
+func TestPublishRateLimits(t *testing.T) {
+	c := &client{}
+	c.setLimits(&UserLimits{MaxMsgsPerSec: 2, MaxBytesPerSec: 100})
+	l := c.limits
+	now := l.last
+
+	if err := l.allowPublish(10, now); err != "" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Too many bytes.
+	if err := l.allowPublish(95, now); err != errMaxByteRateExceeded {
+		t.Fatalf("Expected %q, got %q", errMaxByteRateExceeded, err)
+	}
+	if err := l.allowPublish(10, now); err != "" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Too many messages.
+	if err := l.allowPublish(10, now); err != errMaxMsgRateExceeded {
+		t.Fatalf("Expected %q, got %q", errMaxMsgRateExceeded, err)
+	}
+	// Half a second later, one message is allowed again.
+	now = now.Add(500 * time.Millisecond)
+	if err := l.allowPublish(10, now); err != "" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := l.allowPublish(10, now); err != errMaxMsgRateExceeded {
+		t.Fatalf("Expected %q, got %q", errMaxMsgRateExceeded, err)
+	}
+	if l.msgRateDropped != 2 || l.byteRateDropped != 1 {
+		t.Fatalf("Unexpected counters: %d, %d", l.msgRateDropped, l.byteRateDropped)
+	}
+
+	// Counters are kept when the limits are updated.
+	c.setLimits(&UserLimits{MaxMsgsPerSec: 10})
+	if c.limits != l || l.msgRateDropped != 2 {
+		t.Fatal("Expected counters to be kept")
+	}
+	c.setLimits(nil)
+	if c.limits != nil {
+		t.Fatal("Expected limits to be removed")
+	}
+}
+
+func TestPublishByteRateLargeMessage(t *testing.T) {
+	c := &client{}
+	c.setLimits(&UserLimits{MaxBytesPerSec: 100})
+	l := c.limits
+	now := l.last
+
+	// A message larger than a second of traffic waits for the tokens.
+	if err := l.allowPublish(250, now); err != errMaxByteRateExceeded {
+		t.Fatalf("Expected %q, got %q", errMaxByteRateExceeded, err)
+	}
+	now = now.Add(time.Second)
+	if err := l.allowPublish(250, now); err != errMaxByteRateExceeded {
+		t.Fatalf("Expected %q, got %q", errMaxByteRateExceeded, err)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if err := l.allowPublish(250, now); err != "" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The tokens are not kept over a second of traffic afterwards.
+	now = now.Add(10 * time.Second)
+	if err := l.allowPublish(100, now); err != "" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := l.allowPublish(1, now); err != errMaxByteRateExceeded {
+		t.Fatalf("Expected %q, got %q", errMaxByteRateExceeded, err)
+	}
+}
+
+func TestPublishRateLimitsRefillBoth(t *testing.T) {
+	c := &client{}
+	c.setLimits(&UserLimits{MaxMsgsPerSec: 1, MaxBytesPerSec: 100})
+	l := c.limits
+	now := l.last
+
+	if err := l.allowPublish(100, now); err != "" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Dropped on the message rate, the bytes refilled meanwhile are kept.
+	now = now.Add(500 * time.Millisecond)
+	if err := l.allowPublish(10, now); err != errMaxMsgRateExceeded {
+		t.Fatalf("Expected %q, got %q", errMaxMsgRateExceeded, err)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if err := l.allowPublish(100, now); err != "" {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ListenerOpts is an additional endpoint for client connections, on a
+// TCP address or a Unix domain socket. Its clients require TLS only if
+// it has its own TLS configuration, and they are authorized by its own
+// authorization settings if any, else by the ones of the server.
+type ListenerOpts struct {
+	Host        string      `json:"host,omitempty"`
+	Port        int         `json:"port,omitempty"`
+	Unix        string      `json:"unix,omitempty"`
+	Username    string      `json:"-"`
+	Password    string      `json:"-"`
+	Users       []*User     `json:"-"`
+	AuthTimeout float64     `json:"auth_timeout,omitempty"`
+	NoAuth      bool        `json:"no_auth,omitempty"`
+	TLSTimeout  float64     `json:"tls_timeout,omitempty"`
+	TLSConfig   *tls.Config `json:"-"`
+}
+
+// HasAuth returns true if the listener has its own authorization.
+func (lo *ListenerOpts) HasAuth() bool {
+	return lo.Username != "" || lo.Users != nil
+}
+
+// address returns the network and the address the listener listens on.
+func (lo *ListenerOpts) address() (string, string) {
+	if lo.Unix != "" {
+		return "unix", lo.Unix
+	}
+	return "tcp", net.JoinHostPort(lo.Host, strconv.Itoa(lo.Port))
+}
+
+// ListenerInfo describes a client endpoint in /varz.
+type ListenerInfo struct {
+	Addr             string `json:"addr"`
+	TLSRequired      bool   `json:"tls_required"`
+	AuthRequired     bool   `json:"auth_required"`
+	Connections      int    `json:"connections"`
+	TotalConnections uint64 `json:"total_connections"`
+}
+
+// clientListener accepts client connections on an additional endpoint.
+// The fields other than the listener are protected by the server lock.
+type clientListener struct {
+	opts     *ListenerOpts
+	addr     string
+	l        net.Listener
+	auth     Auth
+	info     Info
+	infoJSON []byte
+	total    uint64
+}
+
+// validateListeners checks the additional client endpoints.
+func validateListeners(opts *Options) error {
+	seen := make(map[string]bool, len(opts.Listeners))
+	for _, lo := range opts.Listeners {
+		if (lo.Unix == "") == (lo.Port == 0) {
+			return fmt.Errorf("A listener needs either a port or a unix socket")
+		}
+		if lo.NoAuth && lo.HasAuth() {
+			return fmt.Errorf("Listener with no_auth can not have an authorization")
+		}
+		if lo.Unix != "" && lo.TLSConfig != nil {
+			return fmt.Errorf("Unix socket listener %q can not have TLS", lo.Unix)
+		}
+		_, addr := lo.address()
+		if seen[addr] {
+			return fmt.Errorf("Duplicate listener %q", addr)
+		}
+		seen[addr] = true
+	}
+	return nil
+}
+
+// initListeners creates the additional client endpoints, they
+// listen once the server starts. Lock should be held.
+func (s *Server) initListeners() {
+	for _, lo := range s.getOpts().Listeners {
+		_, addr := lo.address()
+		s.listeners = append(s.listeners, &clientListener{opts: lo, addr: addr})
+	}
+}
+
+// SetListenerAuthMethod sets the authentication method for the clients
+// of the additional endpoint with the index in Options.Listeners. It is
+// only used if the endpoint has its own authorization.
+func (s *Server) SetListenerAuthMethod(i int, authMethod Auth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i < 0 || i >= len(s.listeners) {
+		return
+	}
+	s.listeners[i].auth = authMethod
+	s.generateServerInfoJSON()
+}
+
+// listenerAuthRequired returns true if the clients of the endpoint need to
+// authorize. Server lock should be held.
+func (s *Server) listenerAuthRequired(lsn *clientListener) bool {
+	if lsn.opts.NoAuth {
+		return false
+	}
+	return lsn.opts.HasAuth() || s.info.AuthRequired
+}
+
+// generateListenerInfoJSON generates the INFO protocols of the
+// additional endpoints. Lock should be held.
+func (s *Server) generateListenerInfoJSON() {
+	for _, lsn := range s.listeners {
+		info := s.info
+		info.AuthRequired = s.listenerAuthRequired(lsn)
+		info.TLSRequired = lsn.opts.TLSConfig != nil
+		info.SSLRequired = info.TLSRequired
+		info.TLSVerify = info.TLSRequired &&
+			lsn.opts.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert
+		if lsn.opts.Unix == "" {
+			info.Host = lsn.opts.Host
+			info.Port = lsn.opts.Port
+		}
+		b, err := json.Marshal(info)
+		if err != nil {
+			Fatalf("Error marshalling INFO JSON: %+v\n", err)
+			return
+		}
+		lsn.info = info
+		lsn.infoJSON = []byte(fmt.Sprintf("INFO %s %s", b, CR_LF))
+	}
+}
+
+// startListeners listens on the additional client endpoints.
+func (s *Server) startListeners() {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	for _, lsn := range listeners {
+		network, addr := lsn.opts.address()
+		Noticef("Listening for client connections on %s", addr)
+		l, err := s.listen(network, addr)
+		if err != nil {
+			Fatalf("Error listening on %s, %q", addr, err)
+			return
+		}
+		if lsn.opts.TLSConfig != nil {
+			Noticef("TLS required for client connections on %s", addr)
+		}
+		l = &gatedListener{Listener: l, name: acceptClient, gate: &s.clientGate}
+
+		s.mu.Lock()
+		if !s.running {
+			s.mu.Unlock()
+			l.Close()
+			return
+		}
+		lsn.l = l
+		s.mu.Unlock()
+
+		s.startGoRoutine(func() {
+			s.acceptClients(l, lsn)
+			s.done <- true
+			s.grWG.Done()
+		})
+	}
+}
+
+// clientAuth returns the authentication method of the client. Clients
+// of an endpoint with its own authorization fail if it is not set.
+func (s *Server) clientAuth(c *client) (Auth, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lsn := c.lsn
+	switch {
+	case lsn == nil:
+		return s.cAuth, true
+	case lsn.opts.NoAuth:
+		return nil, true
+	case lsn.opts.HasAuth():
+		return lsn.auth, lsn.auth != nil
+	}
+	return s.cAuth, true
+}
+
+// listenerInfos returns the client endpoints, the main one first.
+// Lock should be held.
+func (s *Server) listenerInfos() []ListenerInfo {
+	opts := s.getOpts()
+	main := ListenerInfo{
+		Addr:         net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)),
+		TLSRequired:  s.info.TLSRequired,
+		AuthRequired: s.info.AuthRequired,
+	}
+	infos := []ListenerInfo{main}
+	for _, lsn := range s.listeners {
+		infos = append(infos, ListenerInfo{
+			Addr:             lsn.addr,
+			TLSRequired:      lsn.opts.TLSConfig != nil,
+			AuthRequired:     s.listenerAuthRequired(lsn),
+			TotalConnections: lsn.total,
+		})
+	}
+	for _, c := range s.clients {
+		if c.typ != CLIENT {
+			continue
+		}
+		i := 0
+		for j, lsn := range s.listeners {
+			if c.lsn == lsn {
+				i = j + 1
+				break
+			}
+		}
+		infos[i].Connections++
+	}
+	infos[0].TotalConnections = s.totalClients
+	for _, info := range infos[1:] {
+		infos[0].TotalConnections -= info.TotalConnections
+	}
+	return infos
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestListenersConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/listeners.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if len(opts.Listeners) != 2 {
+		t.Fatalf("Expected 2 listeners, got %d", len(opts.Listeners))
+	}
+	tcp, unix := opts.Listeners[0], opts.Listeners[1]
+	if tcp.Host != "127.0.0.1" || tcp.Port != 4333 || tcp.Unix != "" {
+		t.Fatalf("Unexpected listener address: %+v", tcp)
+	}
+	if tcp.TLSConfig == nil || tcp.TLSTimeout != 2 {
+		t.Fatalf("Expected the listener to have TLS, got %+v", tcp)
+	}
+	if len(tcp.Users) != 2 || tcp.AuthTimeout != 3 || !tcp.HasAuth() {
+		t.Fatalf("Expected the listener to have 2 users, got %+v", tcp)
+	}
+	if unix.Unix != "/tmp/gnatsd.sock" || !unix.NoAuth || unix.HasAuth() || unix.TLSConfig != nil {
+		t.Fatalf("Unexpected unix listener: %+v", unix)
+	}
+
+	// Timeouts default to the ones of the server.
+	processOptions(opts)
+	if unix.TLSTimeout != opts.TLSTimeout || unix.AuthTimeout != opts.AuthTimeout {
+		t.Fatalf("Expected the default timeouts, got %+v", unix)
+	}
+
+	for _, lo := range []*ListenerOpts{
+		{},
+		{Port: 4333, Unix: "/tmp/gnatsd.sock"},
+		{Port: 4333, NoAuth: true, Username: "derek"},
+		{Unix: "/tmp/gnatsd.sock", TLSConfig: tcp.TLSConfig},
+	} {
+		if err := validateListeners(&Options{Listeners: []*ListenerOpts{lo}}); err == nil {
+			t.Fatalf("Expected an error for %+v", lo)
+		}
+	}
+	dup := &Options{Listeners: []*ListenerOpts{{Port: 4333}, {Port: 4333}}}
+	if err := validateListeners(dup); err == nil {
+		t.Fatal("Expected an error for duplicate listeners")
+	}
+}
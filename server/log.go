@@ -3,6 +3,7 @@
 package server
 
 import (
+	"os"
 	"sync"
 	"sync/atomic"
 
@@ -55,6 +56,33 @@ func (s *Server) SetLogger(logger Logger, debugFlag, traceFlag bool) {
 	log.Unlock()
 }
 
+// ConfigureLogger sets up the logger of the server based on its current
+// options. It is called again when the configuration is reloaded.
+func (s *Server) ConfigureLogger() {
+	var log Logger
+
+	opts := s.getOpts()
+
+	if opts.LogFile != "" {
+		log = logger.NewFileLogger(opts.LogFile, opts.Logtime, opts.Debug, opts.Trace, true, 0)
+	} else if opts.RemoteSyslog != "" {
+		log = logger.NewRemoteSysLogger(opts.RemoteSyslog, opts.Debug, opts.Trace)
+	} else if opts.Syslog {
+		log = logger.NewSysLogger(opts.Debug, opts.Trace)
+	} else {
+		colors := true
+		// Check to see if stderr is being redirected and if so turn off color
+		// Also turn off colors if we're running on Windows where os.Stderr.Stat() returns an invalid handle-error
+		stat, err := os.Stderr.Stat()
+		if err != nil || (stat.Mode()&os.ModeCharDevice) == 0 {
+			colors = false
+		}
+		log = logger.NewStdLogger(opts.Logtime, opts.Debug, opts.Trace, colors, true, 0)
+	}
+
+	s.SetLogger(log, opts.Debug, opts.Trace)
+}
+
 // If the logger is a file based logger, close and re-open the file.
 // This allows for file rotation by 'mv'ing the file then signalling
 // the process to trigger this function.
@@ -68,12 +96,12 @@ func (s *Server) ReOpenLogFile() {
 		Noticef("File log re-open ignored, no logger")
 		return
 	}
-	if s.opts.LogFile == "" {
+	if s.getOpts().LogFile == "" {
 		Noticef("File log re-open ignored, not a file logger")
 	} else {
-		fileLog := logger.NewFileLogger(s.opts.LogFile,
-			s.opts.Logtime, s.opts.Debug, s.opts.Trace, true, 0)
-		s.SetLogger(fileLog, s.opts.Debug, s.opts.Trace)
+		fileLog := logger.NewFileLogger(s.getOpts().LogFile,
+			s.getOpts().Logtime, s.getOpts().Debug, s.getOpts().Trace, true, 0)
+		s.SetLogger(fileLog, s.getOpts().Debug, s.getOpts().Trace)
 		Noticef("File log re-opened")
 	}
 }
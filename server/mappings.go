@@ -0,0 +1,239 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subject mappings rewrite the subject of the messages published by the
+// clients before they are matched against the subscriptions. The `*`
+// wildcards of the source are captured and referred to as $1, $2, ... in
+// the destination, and a trailing `>` in the destination is replaced by
+// the tokens matched by the trailing `>` of the source.
+
+// MapDestination is a destination of a subject mapping, the weight
+// is the percentage of the messages sent to it.
+type MapDestination struct {
+	Subject string `json:"destination"`
+	Weight  int    `json:"weight"`
+}
+
+// SubjectMapping rewrites the subjects matching the source to one of
+// the destinations. When the weights of the destinations add up to
+// less than 100, the remaining messages keep their subject.
+type SubjectMapping struct {
+	Source       string            `json:"source"`
+	Destinations []*MapDestination `json:"destinations"`
+}
+
+// subjectMapping is the compiled form of a SubjectMapping.
+type subjectMapping struct {
+	src   []string
+	fwc   bool // the source ends with a full wildcard
+	npwc  int  // number of partial wildcards in the source
+	dests []*mapDestination
+}
+
+type mapDestination struct {
+	parts  []mapPart
+	weight int
+}
+
+// mapPart is a token of a destination, either a literal or
+// the n-th capture of the source, -1 for the full wildcard.
+type mapPart struct {
+	literal string
+	capture int
+}
+
+// newSubjectMapping checks and compiles a mapping.
+func newSubjectMapping(sm *SubjectMapping) (*subjectMapping, error) {
+	if !IsValidSubject(sm.Source) {
+		return nil, fmt.Errorf("invalid source subject")
+	}
+	if isSysSubject([]byte(sm.Source)) {
+		return nil, fmt.Errorf("system subjects can not be mapped")
+	}
+	m := &subjectMapping{src: strings.Split(sm.Source, tsep)}
+	for _, t := range m.src {
+		switch t {
+		case string(pwc):
+			m.npwc++
+		case string(fwc):
+			m.fwc = true
+		}
+	}
+	if len(sm.Destinations) == 0 {
+		return nil, fmt.Errorf("no destination")
+	}
+	total := 0
+	for _, d := range sm.Destinations {
+		md, err := m.newDestination(d)
+		if err != nil {
+			return nil, err
+		}
+		total += md.weight
+		m.dests = append(m.dests, md)
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("weights add up to %d, more than 100", total)
+	}
+	return m, nil
+}
+
+// newDestination compiles a destination of the mapping.
+func (m *subjectMapping) newDestination(d *MapDestination) (*mapDestination, error) {
+	if d.Weight < 1 || d.Weight > 100 {
+		return nil, fmt.Errorf("weight of %q must be between 1 and 100", d.Subject)
+	}
+	if !IsValidSubject(d.Subject) || isSysSubject([]byte(d.Subject)) {
+		return nil, fmt.Errorf("invalid destination subject %q", d.Subject)
+	}
+	md := &mapDestination{weight: d.Weight}
+	for _, t := range strings.Split(d.Subject, tsep) {
+		p := mapPart{literal: t}
+		switch {
+		case t == string(pwc):
+			return nil, fmt.Errorf("destination %q can not have a '*' wildcard, use $1, $2, ...", d.Subject)
+		case t == string(fwc):
+			if !m.fwc {
+				return nil, fmt.Errorf("destination %q has a '>' wildcard but the source does not", d.Subject)
+			}
+			p.capture = -1
+		case t[0] == '$':
+			n, err := strconv.Atoi(t[1:])
+			if err != nil || n < 1 || n > m.npwc {
+				return nil, fmt.Errorf("destination %q refers to an unknown wildcard %q", d.Subject, t)
+			}
+			p.capture = n
+		}
+		md.parts = append(md.parts, p)
+	}
+	return md, nil
+}
+
+// match returns the tokens captured by the wildcards of the source, with
+// the tokens matched by the full wildcard last, joined together.
+func (m *subjectMapping) match(tokens []string) ([]string, bool) {
+	if len(tokens) < len(m.src) || (!m.fwc && len(tokens) != len(m.src)) {
+		return nil, false
+	}
+	var captures []string
+	for i, t := range m.src {
+		switch t {
+		case string(pwc):
+			captures = append(captures, tokens[i])
+		case string(fwc):
+			captures = append(captures, strings.Join(tokens[i:], tsep))
+		default:
+			if t != tokens[i] {
+				return nil, false
+			}
+		}
+	}
+	return captures, true
+}
+
+// transform builds the destination subject from the captured tokens.
+func (d *mapDestination) transform(captures []string) string {
+	tokens := make([]string, len(d.parts))
+	for i, p := range d.parts {
+		switch {
+		case p.capture > 0:
+			tokens[i] = captures[p.capture-1]
+		case p.capture < 0:
+			tokens[i] = captures[len(captures)-1]
+		default:
+			tokens[i] = p.literal
+		}
+	}
+	return strings.Join(tokens, tsep)
+}
+
+// pick returns the destination for the number drawn in [0, 100),
+// nil when the message keeps its subject.
+func (m *subjectMapping) pick(n int) *mapDestination {
+	for _, d := range m.dests {
+		if n < d.weight {
+			return d
+		}
+		n -= d.weight
+	}
+	return nil
+}
+
+// validateMappings checks the subject mappings of the options.
+func validateMappings(opts *Options) error {
+	sources := make(map[string]bool, len(opts.Mappings))
+	for _, sm := range opts.Mappings {
+		if sources[sm.Source] {
+			return fmt.Errorf("Duplicate subject mapping %q", sm.Source)
+		}
+		sources[sm.Source] = true
+		if _, err := newSubjectMapping(sm); err != nil {
+			return fmt.Errorf("Invalid subject mapping %q: %v", sm.Source, err)
+		}
+	}
+	return nil
+}
+
+// configureMappings compiles the subject mappings of the options. The
+// most specific sources are tried first: literal sources before the ones
+// with wildcards, and longer sources before shorter ones.
+func (s *Server) configureMappings() {
+	var mappings []*subjectMapping
+	for _, sm := range s.getOpts().Mappings {
+		m, err := newSubjectMapping(sm)
+		if err != nil {
+			Errorf("Error configuring subject mapping %q: %v", sm.Source, err)
+			continue
+		}
+		mappings = append(mappings, m)
+	}
+	sort.SliceStable(mappings, func(i, j int) bool {
+		a, b := mappings[i], mappings[j]
+		if a.fwc != b.fwc {
+			return !a.fwc
+		}
+		if a.npwc != b.npwc {
+			return a.npwc < b.npwc
+		}
+		return len(a.src) > len(b.src)
+	})
+	s.mappings.Store(mappings)
+}
+
+// mapSubject applies the first mapping matching the subject of the
+// message being processed. System subjects are never mapped.
+func (c *client) mapSubject() {
+	mappings, _ := c.srv.mappings.Load().([]*subjectMapping)
+	if len(mappings) == 0 || isSysSubject(c.pa.subject) {
+		return
+	}
+	tokens := strings.Split(string(c.pa.subject), tsep)
+	for _, m := range mappings {
+		captures, ok := m.match(tokens)
+		if !ok {
+			continue
+		}
+		if c.cache.prand == nil {
+			c.cache.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		d := m.pick(c.cache.prand.Intn(100))
+		if d == nil {
+			return
+		}
+		subject := d.transform(captures)
+		if c.trace {
+			c.Tracef("Mapped subject %q to %q", c.pa.subject, subject)
+		}
+		c.pa.subject = []byte(subject)
+		return
+	}
+}
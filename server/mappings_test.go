@@ -0,0 +1,137 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSubjectMappingConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/mappings.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := []*SubjectMapping{
+		{Source: "api.>", Destinations: []*MapDestination{
+			{Subject: "api.v1.>", Weight: 90},
+			{Subject: "api.v2.>", Weight: 10},
+		}},
+		{Source: "orders.*.*", Destinations: []*MapDestination{
+			{Subject: "orders.$2.$1", Weight: 100},
+		}},
+	}
+	if !reflect.DeepEqual(opts.Mappings, expected) {
+		t.Fatalf("Unexpected mappings: %+v", opts.Mappings)
+	}
+}
+
+func TestSubjectMappingTransform(t *testing.T) {
+	cases := []struct {
+		src, dest, subject, expected string
+	}{
+		{"foo", "bar", "foo", "bar"},
+		{"foo", "bar", "foo.baz", ""},
+		{"orders.*.*", "orders.$2.$1", "orders.42.new", "orders.new.42"},
+		{"orders.*.*", "orders.$2.$1", "orders.42", ""},
+		{"orders.*", "orders.$1.$1", "orders.42", "orders.42.42"},
+		{"api.>", "api.v2.>", "api.get.user", "api.v2.get.user"},
+		{"api.>", "api.v2.>", "api", ""},
+		{"*.>", "$1", "a.b.c", "a"},
+	}
+	for _, c := range cases {
+		m, err := newSubjectMapping(&SubjectMapping{Source: c.src,
+			Destinations: []*MapDestination{{Subject: c.dest, Weight: 100}}})
+		if err != nil {
+			t.Fatalf("Unexpected error for %q -> %q: %v", c.src, c.dest, err)
+		}
+		captures, ok := m.match(strings.Split(c.subject, tsep))
+		if !ok {
+			if c.expected != "" {
+				t.Fatalf("Expected %q to match %q", c.subject, c.src)
+			}
+			continue
+		}
+		if s := m.dests[0].transform(captures); s != c.expected {
+			t.Fatalf("Expected %q -> %q to map %q to %q, got %q", c.src, c.dest, c.subject, c.expected, s)
+		}
+	}
+}
+
+func TestSubjectMappingErrors(t *testing.T) {
+	cases := []struct {
+		src   string
+		dests []*MapDestination
+		err   string
+	}{
+		{"foo..bar", []*MapDestination{{"bar", 100}}, "invalid source"},
+		{"_SYS.>", []*MapDestination{{"bar", 100}}, "system subjects"},
+		{"foo", nil, "no destination"},
+		{"foo", []*MapDestination{{"bar", 0}}, "between 1 and 100"},
+		{"foo", []*MapDestination{{"_SYS.foo", 100}}, "invalid destination"},
+		{"foo.*", []*MapDestination{{"bar.*", 100}}, "'*' wildcard"},
+		{"foo.*", []*MapDestination{{"bar.>", 100}}, "'>' wildcard"},
+		{"foo.*", []*MapDestination{{"bar.$2", 100}}, "unknown wildcard"},
+		{"foo", []*MapDestination{{"bar", 60}, {"baz", 50}}, "more than 100"},
+	}
+	for _, c := range cases {
+		_, err := newSubjectMapping(&SubjectMapping{Source: c.src, Destinations: c.dests})
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("Expected error %q for %q, got %v", c.err, c.src, err)
+		}
+	}
+
+	opts := &Options{Mappings: []*SubjectMapping{
+		{Source: "foo", Destinations: []*MapDestination{{"bar", 100}}},
+		{Source: "foo", Destinations: []*MapDestination{{"baz", 100}}},
+	}}
+	if err := validateMappings(opts); err == nil || !strings.Contains(err.Error(), "Duplicate") {
+		t.Fatalf("Expected an error for a duplicate mapping, got %v", err)
+	}
+}
+
+func TestSubjectMappingWeights(t *testing.T) {
+	m, err := newSubjectMapping(&SubjectMapping{Source: "foo", Destinations: []*MapDestination{
+		{"v1", 70},
+		{"v2", 20},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	counts := make(map[string]int)
+	for n := 0; n < 100; n++ {
+		if d := m.pick(n); d != nil {
+			counts[d.transform(nil)]++
+		} else {
+			counts[""]++
+		}
+	}
+	// The remaining 10% keep their subject.
+	if counts["v1"] != 70 || counts["v2"] != 20 || counts[""] != 10 {
+		t.Fatalf("Unexpected split: %v", counts)
+	}
+}
+
+func TestSubjectMappingOrder(t *testing.T) {
+	s := New(&Options{Mappings: []*SubjectMapping{
+		{Source: ">", Destinations: []*MapDestination{{"all", 100}}},
+		{Source: "foo.*", Destinations: []*MapDestination{{"pwc", 100}}},
+		{Source: "foo.bar", Destinations: []*MapDestination{{"literal", 100}}},
+		{Source: "foo.*.baz", Destinations: []*MapDestination{{"longer", 100}}},
+	}})
+	c := &client{srv: s, typ: CLIENT}
+	for subject, expected := range map[string]string{
+		"foo.bar":     "literal",
+		"foo.baz":     "pwc",
+		"foo.bar.baz": "longer",
+		"foo.bar.x":   "all",
+		"_SYS.foo":    "_SYS.foo",
+	} {
+		c.pa.subject = []byte(subject)
+		c.mapSubject()
+		if string(c.pa.subject) != expected {
+			t.Fatalf("Expected %q to be mapped to %q, got %q", subject, expected, c.pa.subject)
+		}
+	}
+}
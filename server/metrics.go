@@ -0,0 +1,110 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// LeaderReporter is implemented by the internal clients taking part in
+// a leader election, such as the health agent, so that the election
+// state can be exported by the monitoring endpoints.
+type LeaderReporter interface {
+	// Leader returns the ID of the current leader, empty if none
+	// is elected, and whether this server is the leader.
+	Leader() (id string, isLeader bool)
+}
+
+// metric is a sample in the Prometheus text exposition format.
+type metric struct {
+	name   string
+	typ    string
+	help   string
+	labels string
+	value  float64
+}
+
+// HandleMetrics processes HTTP requests for the server metrics,
+// in the Prometheus text exposition format.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[MetricsPath]++
+	s.mu.Unlock()
+
+	v := s.Varz()
+	st := s.sublistStats()
+
+	metrics := []metric{
+		{"gnatsd_varz_info", "gauge", "Server information.",
+			labels("server_id", v.ID, "version", v.Version), 1},
+		{"gnatsd_varz_uptime_seconds", "gauge", "Time since the server was started.",
+			"", v.Now.Sub(v.Start).Seconds()},
+		{"gnatsd_varz_mem_bytes", "gauge", "Resident memory of the server.", "", float64(v.Mem)},
+		{"gnatsd_varz_cpu_percent", "gauge", "CPU usage of the server.", "", v.CPU},
+		{"gnatsd_varz_connections", "gauge", "Current client connections.", "", float64(v.Connections)},
+		{"gnatsd_varz_connections_total", "counter", "Client connections accepted.", "", float64(v.TotalConnections)},
+		{"gnatsd_varz_routes", "gauge", "Current routes.", "", float64(v.Routes)},
+		{"gnatsd_varz_remotes", "gauge", "Current remote servers.", "", float64(v.Remotes)},
+		{"gnatsd_varz_leafs", "gauge", "Current leaf node connections.", "", float64(v.Leafs)},
+		{"gnatsd_varz_subscriptions", "gauge", "Current subscriptions in all accounts.", "", float64(v.Subscriptions)},
+		{"gnatsd_varz_in_msgs_total", "counter", "Messages received.", "", float64(v.InMsgs)},
+		{"gnatsd_varz_out_msgs_total", "counter", "Messages sent.", "", float64(v.OutMsgs)},
+		{"gnatsd_varz_in_bytes_total", "counter", "Payload bytes received.", "", float64(v.InBytes)},
+		{"gnatsd_varz_out_bytes_total", "counter", "Payload bytes sent.", "", float64(v.OutBytes)},
+		{"gnatsd_varz_slow_consumers_total", "counter", "Connections closed as slow consumers.", "", float64(v.SlowConsumers)},
+		{"gnatsd_subsz_subscriptions", "gauge", "Subscriptions in the sublists of all accounts.", "", float64(st.NumSubs)},
+		{"gnatsd_subsz_cache_entries", "gauge", "Entries in the sublist cache.", "", float64(st.NumCache)},
+		{"gnatsd_subsz_inserts_total", "counter", "Sublist inserts.", "", float64(st.NumInserts)},
+		{"gnatsd_subsz_removes_total", "counter", "Sublist removes.", "", float64(st.NumRemoves)},
+		{"gnatsd_subsz_matches_total", "counter", "Sublist matches.", "", float64(st.NumMatches)},
+		{"gnatsd_subsz_cache_hit_ratio", "gauge", "Ratio of sublist matches served from the cache.", "", st.CacheHitRate},
+		{"gnatsd_subsz_max_fanout", "gauge", "Largest number of subscriptions matched in the cache.", "", float64(st.MaxFanout)},
+		{"gnatsd_subsz_avg_fanout", "gauge", "Average number of subscriptions matched in the cache.", "", st.AvgFanout},
+	}
+	if lr := s.leaderReporter(); lr != nil {
+		id, isLeader := lr.Leader()
+		leader := 0.0
+		if isLeader {
+			leader = 1
+		}
+		metrics = append(metrics,
+			metric{"gnatsd_health_leader", "gauge", "Set to 1 if this server is the elected leader.",
+				labels("leader_id", id), leader})
+	}
+
+	var b bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s%s %s\n",
+			m.name, m.help, m.name, m.typ, m.name, m.labels,
+			strconv.FormatFloat(m.value, 'g', -1, 64))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+// leaderReporter returns the first internal client taking
+// part in a leader election, nil if there is none.
+func (s *Server) leaderReporter() LeaderReporter {
+	s.icli.mu.Lock()
+	defer s.icli.mu.Unlock()
+	for _, ic := range s.icli.configured {
+		if lr, ok := ic.(LeaderReporter); ok {
+			return lr
+		}
+	}
+	return nil
+}
+
+// labels formats the name and value pairs as metric labels.
+func labels(kv ...string) string {
+	var l []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		l = append(l, fmt.Sprintf("%s=%q", kv[i], kv[i+1]))
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
@@ -36,26 +36,39 @@ type Connz struct {
 
 // ConnInfo has detailed information on a per connection basis.
 type ConnInfo struct {
-	Cid            uint64    `json:"cid"`
-	IP             string    `json:"ip"`
-	Port           int       `json:"port"`
-	Start          time.Time `json:"start"`
-	LastActivity   time.Time `json:"last_activity"`
-	Uptime         string    `json:"uptime"`
-	Idle           string    `json:"idle"`
-	Pending        int       `json:"pending_bytes"`
-	InMsgs         int64     `json:"in_msgs"`
-	OutMsgs        int64     `json:"out_msgs"`
-	InBytes        int64     `json:"in_bytes"`
-	OutBytes       int64     `json:"out_bytes"`
-	NumSubs        uint32    `json:"subscriptions"`
-	Name           string    `json:"name,omitempty"`
-	Lang           string    `json:"lang,omitempty"`
-	Version        string    `json:"version,omitempty"`
-	TLSVersion     string    `json:"tls_version,omitempty"`
-	TLSCipher      string    `json:"tls_cipher_suite,omitempty"`
-	AuthorizedUser string    `json:"authorized_user,omitempty"`
-	Subs           []string  `json:"subscriptions_list,omitempty"`
+	Cid            uint64      `json:"cid"`
+	IP             string      `json:"ip"`
+	Port           int         `json:"port"`
+	Start          time.Time   `json:"start"`
+	LastActivity   time.Time   `json:"last_activity"`
+	Uptime         string      `json:"uptime"`
+	Idle           string      `json:"idle"`
+	Pending        int         `json:"pending_bytes"`
+	InMsgs         int64       `json:"in_msgs"`
+	OutMsgs        int64       `json:"out_msgs"`
+	InBytes        int64       `json:"in_bytes"`
+	OutBytes       int64       `json:"out_bytes"`
+	NumSubs        uint32      `json:"subscriptions"`
+	Name           string      `json:"name,omitempty"`
+	Lang           string      `json:"lang,omitempty"`
+	Version        string      `json:"version,omitempty"`
+	TLSVersion     string      `json:"tls_version,omitempty"`
+	TLSCipher      string      `json:"tls_cipher_suite,omitempty"`
+	Websocket      bool        `json:"websocket,omitempty"`
+	AuthorizedUser string      `json:"authorized_user,omitempty"`
+	Account        string      `json:"account,omitempty"`
+	Limits         *LimitStats `json:"limits,omitempty"`
+	Subs           []string    `json:"subscriptions_list,omitempty"`
+	QueueSubs      []QueueSub  `json:"queue_subscriptions_list,omitempty"`
+}
+
+// QueueSub is the membership of a connection in a queue group.
+type QueueSub struct {
+	Subject   string `json:"subject"`
+	Queue     string `json:"queue"`
+	Sid       string `json:"sid"`
+	Policy    string `json:"policy"`
+	Delivered int64  `json:"delivered"`
 }
 
 // DefaultConnListSize is the default size of the connection list.
@@ -63,26 +76,62 @@ const DefaultConnListSize = 1024
 
 const defaultStackBufSize = 10000
 
+// ConnzOptions are the options of a connections request.
+type ConnzOptions struct {
+	Sort          SortOpt `json:"sort"`
+	Username      bool    `json:"auth"`
+	Subscriptions bool    `json:"subscriptions"`
+	Offset        int     `json:"offset"`
+	Limit         int     `json:"limit"`
+}
+
 // HandleConnz process HTTP requests for connection information.
 func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
-	sortOpt := SortOpt(r.URL.Query().Get("sort"))
+	auth, _ := strconv.Atoi(r.URL.Query().Get("auth"))
+	subs, _ := strconv.Atoi(r.URL.Query().Get("subs"))
+	opts := &ConnzOptions{
+		Sort:          SortOpt(r.URL.Query().Get("sort")),
+		Username:      auth == 1,
+		Subscriptions: subs == 1,
+	}
+	opts.Offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	opts.Limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+
+	s.mu.Lock()
+	s.httpReqStats[ConnzPath]++
+	s.mu.Unlock()
+
+	c, err := s.Connz(opts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		Errorf("Error marshalling response to /connz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// Connz returns the information about the client connections.
+func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
+	sortOpt := opts.Sort
 
 	// If no sort option given or sort is by uptime, then sort by cid
 	if sortOpt == "" || sortOpt == byUptime {
 		sortOpt = byCid
 	} else if !sortOpt.IsValid() {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("Invalid sorting option: %s", sortOpt)))
-		return
+		return nil, fmt.Errorf("Invalid sorting option: %s", sortOpt)
 	}
 
 	c := &Connz{}
 	c.Now = time.Now()
-
-	auth, _ := strconv.Atoi(r.URL.Query().Get("auth"))
-	subs, _ := strconv.Atoi(r.URL.Query().Get("subs"))
-	c.Offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
-	c.Limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+	c.Offset = opts.Offset
+	c.Limit = opts.Limit
 
 	if c.Limit == 0 {
 		c.Limit = DefaultConnListSize
@@ -90,8 +139,6 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 
 	// Walk the list
 	s.mu.Lock()
-	s.httpReqStats[ConnzPath]++
-	tlsRequired := s.info.TLSRequired
 
 	// number total of clients. The resulting ConnInfo array
 	// may be smaller if pagination is used.
@@ -108,7 +155,7 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 		case bySubs:
 			pairs[i] = Pair{Key: client, Val: int64(len(client.subs))}
 		case byPending:
-			pairs[i] = Pair{Key: client, Val: int64(client.bw.Buffered())}
+			pairs[i] = Pair{Key: client, Val: client.out.pb}
 		case byOutMsgs:
 			pairs[i] = Pair{Key: client, Val: client.outMsgs}
 		case byInMsgs:
@@ -165,23 +212,7 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 		// then overwrite the field used for the sort with what was stored
 		// in 'pair'.
 		ci := &c.Conns[i]
-
-		ci.Cid = client.cid
-		ci.Start = client.start
-		ci.LastActivity = client.last
-		ci.Uptime = myUptime(c.Now.Sub(client.start))
-		ci.Idle = myUptime(c.Now.Sub(client.last))
-		ci.OutMsgs = client.outMsgs
-		ci.OutBytes = client.outBytes
-		ci.NumSubs = uint32(len(client.subs))
-		ci.Pending = client.bw.Buffered()
-		ci.Name = client.opts.Name
-		ci.Lang = client.opts.Lang
-		ci.Version = client.opts.Version
-		// inMsgs and inBytes are updated outside of the client's lock, so
-		// we need to use atomic here.
-		ci.InMsgs = atomic.LoadInt64(&client.inMsgs)
-		ci.InBytes = atomic.LoadInt64(&client.inBytes)
+		ci.fill(client, c.Now)
 
 		// Now overwrite the field that was used as the sort key, so results
 		// still look sorted even if the value has changed since sort occurred.
@@ -205,46 +236,72 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 			ci.Idle = myUptime(time.Duration(sortValue))
 		}
 
-		// If the connection is gone, too bad, we won't set TLSVersion and TLSCipher.
-		if tlsRequired && client.nc != nil {
-			conn := client.nc.(*tls.Conn)
-			cs := conn.ConnectionState()
-			ci.TLSVersion = tlsVersion(cs.Version)
-			ci.TLSCipher = tlsCipher(cs.CipherSuite)
-		}
-
-		switch conn := client.nc.(type) {
-		case *net.TCPConn, *tls.Conn:
-			addr := conn.RemoteAddr().(*net.TCPAddr)
-			ci.Port = addr.Port
-			ci.IP = addr.IP.String()
-		}
-
 		// Fill in subscription data if requested.
-		if subs == 1 {
+		if opts.Subscriptions {
 			sublist := make([]*subscription, 0, len(client.subs))
 			for _, sub := range client.subs {
 				sublist = append(sublist, sub)
 			}
 			ci.Subs = castToSliceString(sublist)
+			ci.QueueSubs = s.queueSubs(sublist)
 		}
 
 		// Fill in user if auth requested.
-		if auth == 1 {
+		if opts.Username {
 			ci.AuthorizedUser = client.opts.Username
 		}
 
 		client.mu.Unlock()
 		i++
 	}
+	return c, nil
+}
 
-	b, err := json.MarshalIndent(c, "", "  ")
-	if err != nil {
-		Errorf("Error marshalling response to /connz request: %v", err)
+// fill sets the connection information from the client.
+// Lock of the client should be held.
+func (ci *ConnInfo) fill(client *client, now time.Time) {
+	ci.Cid = client.cid
+	ci.Start = client.start
+	ci.LastActivity = client.last
+	ci.Uptime = myUptime(now.Sub(client.start))
+	ci.Idle = myUptime(now.Sub(client.last))
+	ci.OutMsgs = client.outMsgs
+	ci.OutBytes = client.outBytes
+	ci.NumSubs = uint32(len(client.subs))
+	ci.Pending = int(client.out.pb)
+	ci.Name = client.opts.Name
+	ci.Lang = client.opts.Lang
+	ci.Version = client.opts.Version
+	if client.acc != nil && !client.acc.isGlobal() {
+		ci.Account = client.acc.Name
+	}
+	if client.limits != nil {
+		ci.Limits = client.limits.stats()
+	}
+	// inMsgs and inBytes are updated outside of the client's lock, so
+	// we need to use atomic here.
+	ci.InMsgs = atomic.LoadInt64(&client.inMsgs)
+	ci.InBytes = atomic.LoadInt64(&client.inBytes)
+
+	nc := client.nc
+	if ws, ok := nc.(*wsConn); ok {
+		ci.Websocket = true
+		nc = ws.Conn
 	}
 
-	// Handle response
-	ResponseHandler(w, r, b)
+	// If the connection is gone, too bad, we won't set TLSVersion and TLSCipher.
+	if conn, ok := nc.(*tls.Conn); ok {
+		cs := conn.ConnectionState()
+		ci.TLSVersion = tlsVersion(cs.Version)
+		ci.TLSCipher = tlsCipher(cs.CipherSuite)
+	}
+
+	switch conn := nc.(type) {
+	case *net.TCPConn, *tls.Conn:
+		addr := conn.RemoteAddr().(*net.TCPAddr)
+		ci.Port = addr.Port
+		ci.IP = addr.IP.String()
+	}
 }
 
 func castToSliceString(input []*subscription) []string {
@@ -255,6 +312,36 @@ func castToSliceString(input []*subscription) []string {
 	return output
 }
 
+// queueSubs returns the queue group memberships among the subscriptions,
+// sorted by subject and queue, with the messages delivered to each.
+// Lock of the client should be held.
+func (s *Server) queueSubs(subs []*subscription) []QueueSub {
+	var qs []QueueSub
+	for _, sub := range subs {
+		if sub.queue == nil {
+			continue
+		}
+		p := s.memberPolicy(sub)
+		if p == queueUnset {
+			p = queuePreferLocal
+		}
+		qs = append(qs, QueueSub{
+			Subject:   string(sub.subject),
+			Queue:     string(sub.queue),
+			Sid:       string(sub.sid),
+			Policy:    p.String(),
+			Delivered: sub.nm,
+		})
+	}
+	sort.Slice(qs, func(i, j int) bool {
+		if qs[i].Subject != qs[j].Subject {
+			return qs[i].Subject < qs[j].Subject
+		}
+		return qs[i].Queue < qs[j].Queue
+	})
+	return qs
+}
+
 // Subsz represents detail information on current connections.
 type Subsz struct {
 	*SublistStats
@@ -284,34 +371,42 @@ type RouteInfo struct {
 	Subs         []string `json:"subscriptions_list,omitempty"`
 }
 
+// RoutezOptions are the options of a routes request.
+type RoutezOptions struct {
+	Subscriptions bool `json:"subscriptions"`
+}
+
 // HandleRoutez process HTTP requests for route information.
 func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
+	subs, _ := strconv.Atoi(r.URL.Query().Get("subs"))
+
+	s.mu.Lock()
+	s.httpReqStats[RoutezPath]++
+	s.mu.Unlock()
+
+	rs := s.Routez(&RoutezOptions{Subscriptions: subs == 1})
+	b, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		Errorf("Error marshalling response to /routez request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// Routez returns the information about the routes.
+func (s *Server) Routez(opts *RoutezOptions) *Routez {
 	rs := &Routez{Routes: []*RouteInfo{}}
 	rs.Now = time.Now()
 
-	subs, _ := strconv.Atoi(r.URL.Query().Get("subs"))
-
 	// Walk the list
 	s.mu.Lock()
-
-	s.httpReqStats[RoutezPath]++
 	rs.NumRoutes = len(s.routes)
 
 	for _, r := range s.routes {
 		r.mu.Lock()
-		ri := &RouteInfo{
-			Rid:          r.cid,
-			RemoteID:     r.route.remoteID,
-			DidSolicit:   r.route.didSolicit,
-			IsConfigured: r.route.routeType == Explicit,
-			InMsgs:       atomic.LoadInt64(&r.inMsgs),
-			OutMsgs:      r.outMsgs,
-			InBytes:      atomic.LoadInt64(&r.inBytes),
-			OutBytes:     r.outBytes,
-			NumSubs:      uint32(len(r.subs)),
-		}
-
-		if subs == 1 {
+		ri := newRouteInfo(r)
+		if opts.Subscriptions {
 			sublist := make([]*subscription, 0, len(r.subs))
 			for _, sub := range r.subs {
 				sublist = append(sublist, sub)
@@ -319,23 +414,34 @@ func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
 			ri.Subs = castToSliceString(sublist)
 		}
 		r.mu.Unlock()
-
-		if ip, ok := r.nc.(*net.TCPConn); ok {
-			addr := ip.RemoteAddr().(*net.TCPAddr)
-			ri.Port = addr.Port
-			ri.IP = addr.IP.String()
-		}
 		rs.Routes = append(rs.Routes, ri)
 	}
 	s.mu.Unlock()
+	return rs
+}
 
-	b, err := json.MarshalIndent(rs, "", "  ")
-	if err != nil {
-		Errorf("Error marshalling response to /routez request: %v", err)
+// newRouteInfo returns the information about the route.
+// Lock of the route should be held.
+func newRouteInfo(r *client) *RouteInfo {
+	ri := &RouteInfo{
+		Rid:      r.cid,
+		InMsgs:   atomic.LoadInt64(&r.inMsgs),
+		OutMsgs:  r.outMsgs,
+		InBytes:  atomic.LoadInt64(&r.inBytes),
+		OutBytes: r.outBytes,
+		NumSubs:  uint32(len(r.subs)),
 	}
-
-	// Handle response
-	ResponseHandler(w, r, b)
+	if r.route != nil {
+		ri.RemoteID = r.route.remoteID
+		ri.DidSolicit = r.route.didSolicit
+		ri.IsConfigured = r.route.routeType == Explicit
+	}
+	if ip, ok := r.nc.(*net.TCPConn); ok {
+		addr := ip.RemoteAddr().(*net.TCPAddr)
+		ri.Port = addr.Port
+		ri.IP = addr.IP.String()
+	}
+	return ri
 }
 
 // HandleSubsz processes HTTP requests for subjects stats.
@@ -344,7 +450,7 @@ func (s *Server) HandleSubsz(w http.ResponseWriter, r *http.Request) {
 	s.httpReqStats[SubszPath]++
 	s.mu.Unlock()
 
-	st := &Subsz{s.sl.Stats()}
+	st := s.Subsz()
 	b, err := json.MarshalIndent(st, "", "  ")
 	if err != nil {
 		Errorf("Error marshalling response to /subscriptionsz request: %v", err)
@@ -354,6 +460,39 @@ func (s *Server) HandleSubsz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// Subsz returns the statistics of the subscriptions in all accounts.
+func (s *Server) Subsz() *Subsz {
+	return &Subsz{s.sublistStats()}
+}
+
+// sublistStats sums the statistics of the sublists of the accounts. The
+// ratios and the average fanout are weighted by the matches and the cache
+// entries of each sublist.
+func (s *Server) sublistStats() *SublistStats {
+	st := &SublistStats{}
+	var hits, fanout float64
+	for _, acc := range s.accounts {
+		as := acc.sl.Stats()
+		st.NumSubs += as.NumSubs
+		st.NumCache += as.NumCache
+		st.NumInserts += as.NumInserts
+		st.NumRemoves += as.NumRemoves
+		st.NumMatches += as.NumMatches
+		hits += as.CacheHitRate * float64(as.NumMatches)
+		fanout += as.AvgFanout * float64(as.NumCache)
+		if as.MaxFanout > st.MaxFanout {
+			st.MaxFanout = as.MaxFanout
+		}
+	}
+	if st.NumMatches > 0 {
+		st.CacheHitRate = hits / float64(st.NumMatches)
+	}
+	if st.NumCache > 0 {
+		st.AvgFanout = fanout / float64(st.NumCache)
+	}
+	return st
+}
+
 // HandleStacksz processes HTTP requests for getting stacks
 func (s *Server) HandleStacksz(w http.ResponseWriter, r *http.Request) {
 	// Do not get any lock here that would prevent getting the stacks
@@ -378,25 +517,28 @@ func (s *Server) HandleStacksz(w http.ResponseWriter, r *http.Request) {
 type Varz struct {
 	*Info
 	*Options
-	Port             int               `json:"port"`
-	MaxPayload       int               `json:"max_payload"`
-	Start            time.Time         `json:"start"`
-	Now              time.Time         `json:"now"`
-	Uptime           string            `json:"uptime"`
-	Mem              int64             `json:"mem"`
-	Cores            int               `json:"cores"`
-	CPU              float64           `json:"cpu"`
-	Connections      int               `json:"connections"`
-	TotalConnections uint64            `json:"total_connections"`
-	Routes           int               `json:"routes"`
-	Remotes          int               `json:"remotes"`
-	InMsgs           int64             `json:"in_msgs"`
-	OutMsgs          int64             `json:"out_msgs"`
-	InBytes          int64             `json:"in_bytes"`
-	OutBytes         int64             `json:"out_bytes"`
-	SlowConsumers    int64             `json:"slow_consumers"`
-	Subscriptions    uint32            `json:"subscriptions"`
-	HTTPReqStats     map[string]uint64 `json:"http_req_stats"`
+	Port             int                    `json:"port"`
+	MaxPayload       int                    `json:"max_payload"`
+	Start            time.Time              `json:"start"`
+	Now              time.Time              `json:"now"`
+	Uptime           string                 `json:"uptime"`
+	Mem              int64                  `json:"mem"`
+	Cores            int                    `json:"cores"`
+	CPU              float64                `json:"cpu"`
+	Connections      int                    `json:"connections"`
+	TotalConnections uint64                 `json:"total_connections"`
+	Routes           int                    `json:"routes"`
+	Remotes          int                    `json:"remotes"`
+	Leafs            int                    `json:"leafs"`
+	InMsgs           int64                  `json:"in_msgs"`
+	OutMsgs          int64                  `json:"out_msgs"`
+	InBytes          int64                  `json:"in_bytes"`
+	OutBytes         int64                  `json:"out_bytes"`
+	SlowConsumers    int64                  `json:"slow_consumers"`
+	Subscriptions    uint32                 `json:"subscriptions"`
+	HTTPReqStats     map[string]uint64      `json:"http_req_stats"`
+	Rejected         map[string]RejectStats `json:"rejected_connections"`
+	Listeners        []ListenerInfo         `json:"listeners"`
 }
 
 type usage struct {
@@ -453,6 +595,7 @@ func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
 	<a href=/connz>connz</a><br/>
 	<a href=/routez>routez</a><br/>
 	<a href=/subsz>subsz</a><br/>
+	<a href=/metrics>metrics</a><br/>
     <br/>
     <a href=http://nats.io/documentation/server/gnatsd-monitoring/>help</a>
   </body>
@@ -461,7 +604,23 @@ func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
 
 // HandleVarz will process HTTP requests for server information.
 func (s *Server) HandleVarz(w http.ResponseWriter, r *http.Request) {
-	v := &Varz{Info: &s.info, Options: s.opts, MaxPayload: s.opts.MaxPayload, Start: s.start}
+	s.mu.Lock()
+	s.httpReqStats[VarzPath]++
+	s.mu.Unlock()
+
+	v := s.Varz()
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		Errorf("Error marshalling response to /varz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// Varz returns the information about the server.
+func (s *Server) Varz() *Varz {
+	v := &Varz{Info: &s.info, Options: s.getOpts(), MaxPayload: s.getOpts().MaxPayload, Start: s.start}
 	v.Now = time.Now()
 	v.Uptime = myUptime(time.Since(s.start))
 	v.Port = v.Info.Port
@@ -473,29 +632,24 @@ func (s *Server) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	v.TotalConnections = s.totalClients
 	v.Routes = len(s.routes)
 	v.Remotes = len(s.remotes)
+	v.Leafs = len(s.leafs)
 	// atomic loads avoid data races with client.go:298,951
 	v.InMsgs = atomic.LoadInt64(&s.inMsgs)
 	v.InBytes = atomic.LoadInt64(&s.inBytes)
 	v.OutMsgs = atomic.LoadInt64(&s.outMsgs)
 	v.OutBytes = atomic.LoadInt64(&s.outBytes)
 	v.SlowConsumers = s.slowConsumers
-	v.Subscriptions = s.sl.Count()
-	s.httpReqStats[VarzPath]++
+	v.Rejected = s.rejectStats()
+	v.Listeners = s.listenerInfos()
+	v.Subscriptions = s.NumSubscriptions()
 	// Need a copy here since s.httpReqStas can change while doing
-	// the marshaling down below.
+	// the marshaling.
 	v.HTTPReqStats = make(map[string]uint64, len(s.httpReqStats))
 	for key, val := range s.httpReqStats {
 		v.HTTPReqStats[key] = val
 	}
 	s.mu.Unlock()
-
-	b, err := json.MarshalIndent(v, "", "  ")
-	if err != nil {
-		Errorf("Error marshalling response to /varz request: %v", err)
-	}
-
-	// Handle response
-	ResponseHandler(w, r, b)
+	return v
 }
 
 // Grab RSS and PCPU
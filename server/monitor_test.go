@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -1157,6 +1158,25 @@ func TestSubsz(t *testing.T) {
 	defer respj.Body.Close()
 }
 
+func TestSubszAccounts(t *testing.T) {
+	resetPreviousHTTPConnections()
+	opts := DefaultMonitorOptions
+	opts.Accounts = []*AccountOpts{{Name: "acme"}}
+	s := RunServer(&opts)
+	defer s.Shutdown()
+
+	acc := s.lookupAccount("acme")
+	acc.sl.Insert(&subscription{subject: []byte("foo"), sid: []byte("1")})
+	s.gacc.sl.Insert(&subscription{subject: []byte("bar"), sid: []byte("2")})
+	acc.sl.Match("foo")
+	acc.sl.Match("foo")
+
+	st := s.Subsz()
+	if st.NumSubs != 2 || st.NumInserts != 2 || st.NumMatches != 2 || st.CacheHitRate != 0.5 {
+		t.Fatalf("Expected the statistics of all accounts, got %+v", st.SublistStats)
+	}
+}
+
 // Tests handle root
 func TestHandleRoot(t *testing.T) {
 	s := runMonitorServer()
@@ -1301,6 +1321,64 @@ func TestStacksz(t *testing.T) {
 	defer respj.Body.Close()
 }
 
+// leaderCli is an internal client reporting a leader election.
+type leaderCli struct{}
+
+func (l *leaderCli) Name() string { return "leader" }
+func (l *leaderCli) Start(info Info, opts Options, logger Logger) (net.Conn, error) {
+	return nil, nil
+}
+func (l *leaderCli) Stop()                  {}
+func (l *leaderCli) Leader() (string, bool) { return "abc", true }
+
+func TestMetrics(t *testing.T) {
+	resetPreviousHTTPConnections()
+	opts := DefaultMonitorOptions
+	opts.InternalCli = []InternalClient{&leaderCli{}}
+	s := RunServer(&opts)
+	defer s.Shutdown()
+
+	nc := createClientConnSubscribeAndPublish(t)
+	defer nc.Close()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/metrics", MONITOR_PORT))
+	if err != nil {
+		t.Fatalf("Expected no error: Got %v\n", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected a 200 response, got %d\n", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("Expected text/plain response, got %s\n", ct)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Expected no error reading body: Got %v\n", err)
+	}
+
+	expected := []string{
+		"# TYPE gnatsd_varz_in_msgs_total counter\ngnatsd_varz_in_msgs_total 1\n",
+		"# TYPE gnatsd_varz_connections gauge\ngnatsd_varz_connections 1\n",
+		"gnatsd_varz_subscriptions 1\n",
+		"gnatsd_varz_slow_consumers_total 0\n",
+		fmt.Sprintf("gnatsd_varz_info{server_id=%q,version=%q} 1\n", s.ID(), VERSION),
+		"gnatsd_subsz_matches_total 1\n",
+		"gnatsd_health_leader{leader_id=\"abc\"} 1\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Fatalf("Expected %q in metrics, got:\n%s", e, body)
+		}
+	}
+	// Every sample is described.
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if !strings.HasPrefix(line, "# ") && len(strings.Fields(line)) != 2 {
+			t.Fatalf("Invalid sample %q", line)
+		}
+	}
+}
+
 func TestConcurrentMonitoring(t *testing.T) {
 	s := runMonitorServer()
 	defer s.Shutdown()
@@ -0,0 +1,240 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Messages whose subject matches one of the trace subjects are traced:
+// the server emits an event for each hop of the message, instead of
+// tracing every message as the -V flag does. The events are published
+// as system events when they are enabled, else they are logged.
+
+// EventMsgTrace is the type of the message trace events.
+const EventMsgTrace = "MSG.TRACE"
+
+// Hops of a traced message.
+const (
+	// The message is received from a client, route or leaf node.
+	TraceIngress = "ingress"
+	// The message is matched against the subscriptions.
+	TraceMatch = "match"
+	// The message is delivered to a client.
+	TraceDeliver = "deliver"
+	// The message is forwarded to a route.
+	TraceRoute = "route"
+	// The message is forwarded to a leaf node.
+	TraceLeaf = "leaf"
+	// The message is dropped, the reason tells why.
+	TraceDrop = "drop"
+)
+
+// Reasons a traced message is dropped.
+const (
+	dropPermissions  = "permissions"
+	dropNoInterest   = "no_interest"
+	dropSlowConsumer = "slow_consumer"
+	dropMaxPending   = "max_pending"
+	dropLimits       = "limits"
+)
+
+// MsgTraceEvent is the payload of the message trace events.
+type MsgTraceEvent struct {
+	Type    string    `json:"type"`
+	Server  string    `json:"server_id"`
+	Time    time.Time `json:"time"`
+	Hop     string    `json:"hop"`
+	Subject string    `json:"subject"`
+	Reply   string    `json:"reply,omitempty"`
+	Size    int       `json:"size"`
+	Cid     uint64    `json:"cid"`
+	Kind    string    `json:"kind"`
+	To      uint64    `json:"to_cid,omitempty"`
+	Sid     string    `json:"sid,omitempty"`
+	Route   string    `json:"route_id,omitempty"`
+	Subs    int       `json:"subscriptions,omitempty"`
+	Queues  int       `json:"queue_groups,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// TraceRequest adds and removes trace subjects, an empty
+// request returns the current ones.
+type TraceRequest struct {
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// TraceResponse is the response to a TraceRequest.
+type TraceResponse struct {
+	Server   string   `json:"server_id"`
+	Subjects []string `json:"subjects"`
+}
+
+// validateTraceSubject checks a subject to trace the messages of.
+func validateTraceSubject(subject string) error {
+	if !IsValidSubject(subject) {
+		return fmt.Errorf("Invalid trace subject %q", subject)
+	}
+	if isSysSubject([]byte(subject)) {
+		return fmt.Errorf("System subjects can not be traced: %q", subject)
+	}
+	return nil
+}
+
+// validateTraceSubjects checks the trace subjects of the options.
+func validateTraceSubjects(opts *Options) error {
+	for _, subject := range opts.TraceSubjects {
+		if err := validateTraceSubject(subject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configureMsgTraces sets the trace subjects of the options, the
+// ones added by requests are dropped.
+func (s *Server) configureMsgTraces() {
+	s.msgTracesMu.Lock()
+	s.msgTraces.Store(append([]string(nil), s.getOpts().TraceSubjects...))
+	s.msgTracesMu.Unlock()
+}
+
+// traceSubjects returns the subjects the messages of are traced.
+func (s *Server) traceSubjects() []string {
+	subjects, _ := s.msgTraces.Load().([]string)
+	return subjects
+}
+
+// updateMsgTraces adds and removes trace subjects.
+func (s *Server) updateMsgTraces(req *TraceRequest) error {
+	for _, subject := range req.Add {
+		if err := validateTraceSubject(subject); err != nil {
+			return err
+		}
+	}
+	s.msgTracesMu.Lock()
+	defer s.msgTracesMu.Unlock()
+	var subjects []string
+	for _, subject := range s.traceSubjects() {
+		if !hasSubject(req.Remove, subject) {
+			subjects = append(subjects, subject)
+		}
+	}
+	for _, subject := range req.Add {
+		if !hasSubject(subjects, subject) {
+			subjects = append(subjects, subject)
+		}
+	}
+	s.msgTraces.Store(subjects)
+	return nil
+}
+
+func hasSubject(subjects []string, subject string) bool {
+	for _, s := range subjects {
+		if s == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// isTraced returns true if the messages on the subject are traced.
+func (s *Server) isTraced(subject []byte) bool {
+	subjects := s.traceSubjects()
+	if len(subjects) == 0 || isSysSubject(subject) {
+		return false
+	}
+	for _, t := range subjects {
+		if matchLiteral(string(subject), t) {
+			return true
+		}
+	}
+	return false
+}
+
+// newTraceEvent returns the event of a hop of the message being processed.
+func (c *client) newTraceEvent(hop string) *MsgTraceEvent {
+	ev := &MsgTraceEvent{
+		Type:    EventMsgTrace,
+		Server:  c.srv.info.ID,
+		Time:    time.Now().UTC(),
+		Hop:     hop,
+		Subject: string(c.pa.subject),
+		Reply:   string(c.pa.reply),
+		Size:    c.pa.size,
+		Cid:     c.cid,
+		Kind:    traceKind(c),
+	}
+	if c.typ == ROUTER || c.typ == LEAF {
+		ev.Sid = string(c.pa.sid)
+	}
+	return ev
+}
+
+func traceKind(c *client) string {
+	switch c.typ {
+	case ROUTER:
+		return "route"
+	case LEAF:
+		return "leaf"
+	case SYSTEM:
+		return "system"
+	}
+	return "client"
+}
+
+// traceHop emits the event of a hop of the message being processed.
+func (c *client) traceHop(hop, reason string) {
+	ev := c.newTraceEvent(hop)
+	ev.Reason = reason
+	c.srv.sendTraceEvent(ev)
+}
+
+// traceDelivery emits the event of the delivery of the message being
+// processed to the subscription. Lock of the subscriber should be held.
+func (c *client) traceDelivery(sub *subscription, reason string) {
+	to := sub.client
+	hop := TraceDeliver
+	switch {
+	case reason != "":
+		hop = TraceDrop
+	case to.typ == ROUTER:
+		hop = TraceRoute
+	case to.typ == LEAF:
+		hop = TraceLeaf
+	}
+	ev := c.newTraceEvent(hop)
+	ev.To = to.cid
+	ev.Sid = string(sub.sid)
+	ev.Reason = reason
+	if to.typ == ROUTER && to.route != nil {
+		ev.Route = to.route.remoteID
+	}
+	c.srv.sendTraceEvent(ev)
+}
+
+// traceMatch emits the event of the match of the message being processed.
+func (c *client) traceMatch(r *SublistResult) {
+	ev := c.newTraceEvent(TraceMatch)
+	ev.Subs = len(r.psubs)
+	ev.Queues = len(r.qsubs)
+	c.srv.sendTraceEvent(ev)
+}
+
+// sendTraceEvent publishes the event as a system event if they are
+// enabled, else it is logged.
+func (s *Server) sendTraceEvent(ev *MsgTraceEvent) {
+	if s.sys != nil {
+		s.sendEvent(EventMsgTrace, ev)
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		Errorf("Error marshalling %s event: %v", EventMsgTrace, err)
+		return
+	}
+	Noticef("Trace %s", b)
+}
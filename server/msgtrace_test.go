@@ -0,0 +1,65 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMsgTraceConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/msgtrace.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := []string{"orders.>", "billing.*.failed"}
+	if !reflect.DeepEqual(opts.TraceSubjects, expected) {
+		t.Fatalf("Unexpected trace subjects: %+v", opts.TraceSubjects)
+	}
+
+	for _, subject := range []string{"_SYS.>", "foo..bar"} {
+		opts := &Options{TraceSubjects: []string{subject}}
+		if err := validateTraceSubjects(opts); err == nil {
+			t.Fatalf("Expected an error for trace subject %q", subject)
+		}
+	}
+}
+
+func TestMsgTraceSubjects(t *testing.T) {
+	s := New(&Options{TraceSubjects: []string{"orders.>"}})
+
+	cases := []struct {
+		subject string
+		traced  bool
+	}{
+		{"orders.new", true},
+		{"orders.42.new", true},
+		{"orders", false},
+		{"billing.42.failed", false},
+	}
+	for _, c := range cases {
+		if traced := s.isTraced([]byte(c.subject)); traced != c.traced {
+			t.Fatalf("Expected traced to be %v for %q", c.traced, c.subject)
+		}
+	}
+
+	err := s.updateMsgTraces(&TraceRequest{Add: []string{"billing.*.failed"}, Remove: []string{"orders.>"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.isTraced([]byte("orders.new")) || !s.isTraced([]byte("billing.42.failed")) {
+		t.Fatalf("Unexpected trace subjects: %+v", s.traceSubjects())
+	}
+	if err := s.updateMsgTraces(&TraceRequest{Add: []string{"_SYS.>"}}); err == nil {
+		t.Fatal("Expected an error tracing system subjects")
+	}
+	if subjects := s.traceSubjects(); !reflect.DeepEqual(subjects, []string{"billing.*.failed"}) {
+		t.Fatalf("Unexpected trace subjects: %+v", subjects)
+	}
+
+	// A reload drops the subjects added by requests.
+	s.configureMsgTraces()
+	if subjects := s.traceSubjects(); !reflect.DeepEqual(subjects, []string{"orders.>"}) {
+		t.Fatalf("Unexpected trace subjects: %+v", subjects)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Users with a public key, or nkey, authenticate without a secret: the
+// server sends a random nonce in the INFO of each client, and the client
+// sends its public key and its Ed25519 signature of the nonce in the
+// CONNECT. Keys and signatures are encoded in unpadded URL-safe base64.
+
+// Length of the random nonce before encoding.
+const nonceLen = 16
+
+// DecodeNkey returns the Ed25519 public key of an nkey.
+func DecodeNkey(nkey string) (ed25519.PublicKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(nkey)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid nkey %q", nkey)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// hasNkeys returns true if any of the users has a public key.
+func hasNkeys(users []*User) bool {
+	for _, u := range users {
+		if u.Nkey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// nonceRequired returns true if clients of the endpoint, or of the main
+// one if nil, may sign a nonce to authenticate, with a public key or a
+// JWT. Lock should be held.
+func (s *Server) nonceRequired(lsn *clientListener) bool {
+	opts := s.getOpts()
+	if lsn != nil {
+		if !s.listenerAuthRequired(lsn) {
+			return false
+		}
+		if lsn.opts.HasAuth() {
+			return hasNkeys(lsn.opts.Users)
+		}
+	}
+	return hasNkeys(opts.Users) || opts.JWT != nil
+}
+
+// generateNonce returns a new random nonce for a client to sign.
+func generateNonce() []byte {
+	var raw [nonceLen]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		Fatalf("Error generating a nonce: %v", err)
+	}
+	nonce := make([]byte, base64.RawURLEncoding.EncodedLen(nonceLen))
+	base64.RawURLEncoding.Encode(nonce, raw[:])
+	return nonce
+}
+
+// clientInfoWithNonce returns the INFO protocol with the nonce of the
+// client. Server lock should be held.
+func (s *Server) clientInfoWithNonce(c *client) []byte {
+	info := s.clientInfo(c)
+	info.Nonce = string(c.nonce)
+	b, err := json.Marshal(info)
+	if err != nil {
+		Fatalf("Error marshalling INFO JSON: %+v\n", err)
+		return nil
+	}
+	return []byte(fmt.Sprintf("INFO %s %s", b, CR_LF))
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,14 +22,31 @@ import (
 type User struct {
 	Username    string       `json:"user"`
 	Password    string       `json:"password"`
+	Nkey        string       `json:"nkey,omitempty"`
 	Permissions *Permissions `json:"permissions"`
+	Limits      *UserLimits  `json:"limits,omitempty"`
+	Account     string       `json:"account,omitempty"`
+}
+
+// UserLimits are the resource limits applied to each
+// connection of a user. Zero means no limit.
+type UserLimits struct {
+	MaxSubs        int   `json:"max_subscriptions,omitempty"`
+	MaxPending     int   `json:"max_pending,omitempty"`
+	MaxMsgsPerSec  int64 `json:"max_msgs_per_sec,omitempty"`
+	MaxBytesPerSec int64 `json:"max_bytes_per_sec,omitempty"`
 }
 
 // Authorization are the allowed subjects on a per
-// publish or subscribe basis.
+// publish or subscribe basis. The denied subjects are
+// checked after the allowed ones. A subscribe subject
+// can be restricted to a queue, e.g. "foo workers".
 type Permissions struct {
-	Publish   []string `json:"publish"`
-	Subscribe []string `json:"subscribe"`
+	Publish        []string            `json:"publish"`
+	Subscribe      []string            `json:"subscribe"`
+	PublishDeny    []string            `json:"publish_deny,omitempty"`
+	SubscribeDeny  []string            `json:"subscribe_deny,omitempty"`
+	AllowResponses *ResponsePermission `json:"allow_responses,omitempty"`
 }
 
 // Options for clusters.
@@ -43,6 +61,38 @@ type ClusterOpts struct {
 	ListenStr      string      `json:"-"`
 	NoAdvertise    bool        `json:"-"`
 	ConnectRetries int         `json:"-"`
+
+	// Routes are authenticated by the identity of their certificate,
+	// the users are the identities of the peers.
+	TLSMap bool    `json:"tls_map,omitempty"`
+	Users  []*User `json:"-"`
+}
+
+// Options for leaf nodes. A server accepts leaf node connections
+// from other servers on the listen address, and connects to the
+// remotes as a leaf node itself.
+type LeafNodeOpts struct {
+	Host       string            `json:"addr"`
+	Port       int               `json:"port"`
+	TLSTimeout float64           `json:"-"`
+	TLSConfig  *tls.Config       `json:"-"`
+	Remotes    []*RemoteLeafOpts `json:"-"`
+}
+
+// RemoteLeafOpts is a hub the server connects to as a leaf node. The
+// subscriptions and messages of the local account are exchanged
+// with the account the credentials in the URL are bound to.
+type RemoteLeafOpts struct {
+	URL     *url.URL
+	Account string
+}
+
+// Options for the websocket listener.
+type WebsocketOpts struct {
+	Host       string      `json:"addr"`
+	Port       int         `json:"port"`
+	TLSTimeout float64     `json:"-"`
+	TLSConfig  *tls.Config `json:"-"`
 }
 
 // Options block for gnatsd server.
@@ -67,7 +117,10 @@ type Options struct {
 	AuthTimeout    float64       `json:"auth_timeout"`
 	MaxControlLine int           `json:"max_control_line"`
 	MaxPayload     int           `json:"max_payload"`
+	MaxPending     int64         `json:"max_pending"`
 	Cluster        ClusterOpts   `json:"cluster"`
+	LeafNode       LeafNodeOpts  `json:"leafnodes"`
+	Websocket      WebsocketOpts `json:"websocket"`
 	ProfPort       int           `json:"-"`
 	PidFile        string        `json:"-"`
 	LogFile        string        `json:"-"`
@@ -83,6 +136,45 @@ type Options struct {
 	TLSCaCert      string        `json:"-"`
 	TLSConfig      *tls.Config   `json:"-"`
 	WriteDeadline  time.Duration `json:"-"`
+	ConfigFile     string        `json:"-"`
+
+	LameDuckDuration time.Duration `json:"lame_duck_duration"`
+
+	// SystemUser is the user allowed to subscribe to the _SYS
+	// subjects. Server events are published when it is set.
+	SystemUser string `json:"-"`
+
+	// TLSMap authenticates the clients by the identity of their verified
+	// certificate, mapped to the users.
+	TLSMap bool `json:"tls_map,omitempty"`
+
+	// AuthCallout authenticates the clients with an external auth service.
+	AuthCallout *AuthCalloutOpts `json:"auth_callout,omitempty"`
+
+	// JWT authenticates the clients by a JWT signed by a trusted operator.
+	JWT *JWTOpts `json:"jwt,omitempty"`
+
+	Accounts []*AccountOpts `json:"-"`
+
+	Mappings []*SubjectMapping `json:"mappings,omitempty"`
+
+	// QueuePolicies are the policies of the queue groups, by queue name.
+	QueuePolicies map[string]string `json:"queue_policies,omitempty"`
+
+	// TraceSubjects are the subjects the messages of are traced.
+	TraceSubjects []string `json:"trace_subjects,omitempty"`
+
+	// Filters of the connections accepted on the client, cluster
+	// and monitoring listeners.
+	ClientAccept  *AcceptOpts `json:"accept,omitempty"`
+	ClusterAccept *AcceptOpts `json:"cluster_accept,omitempty"`
+	HTTPAccept    *AcceptOpts `json:"http_accept,omitempty"`
+
+	// Audit log of the violations, and escalation on repeated ones.
+	Audit *AuditOpts `json:"audit,omitempty"`
+
+	// Listeners are the additional client endpoints.
+	Listeners []*ListenerOpts `json:"-"`
 
 	InternalCli []InternalClient `json:"-"`
 	HealthAgent bool             `json:"health_agent"`
@@ -100,6 +192,8 @@ type authorization struct {
 	users              []*User
 	timeout            float64
 	defaultPermissions *Permissions
+	callout            *AuthCalloutOpts
+	jwt                *JWTOpts
 }
 
 // TLSConfigOpts holds the parsed tls config information,
@@ -109,6 +203,7 @@ type TLSConfigOpts struct {
 	KeyFile          string
 	CaFile           string
 	Verify           bool
+	Map              bool
 	Timeout          float64
 	Ciphers          []uint16
 	CurvePreferences []tls.CurveID
@@ -153,6 +248,8 @@ func ProcessConfigFile(configFile string) (*Options, error) {
 		return nil, err
 	}
 
+	var accountUsers []*User
+
 	for k, v := range m {
 		switch strings.ToLower(k) {
 		case "listen":
@@ -181,6 +278,8 @@ func ProcessConfigFile(configFile string) (*Options, error) {
 			opts.Username = auth.user
 			opts.Password = auth.pass
 			opts.AuthTimeout = auth.timeout
+			opts.AuthCallout = auth.callout
+			opts.JWT = auth.jwt
 			// Check for multiple users defined
 			if auth.users != nil {
 				if auth.user != "" {
@@ -211,6 +310,16 @@ func ProcessConfigFile(configFile string) (*Options, error) {
 			if err := parseCluster(cm, opts); err != nil {
 				return nil, err
 			}
+		case "leafnodes", "leaf":
+			lm := v.(map[string]interface{})
+			if err := parseLeafNodes(lm, opts); err != nil {
+				return nil, err
+			}
+		case "websocket":
+			wm := v.(map[string]interface{})
+			if err := parseWebsocket(wm, opts); err != nil {
+				return nil, err
+			}
 		case "logfile", "log_file":
 			opts.LogFile = v.(string)
 		case "syslog":
@@ -225,6 +334,8 @@ func ProcessConfigFile(configFile string) (*Options, error) {
 			opts.MaxControlLine = int(v.(int64))
 		case "max_payload":
 			opts.MaxPayload = int(v.(int64))
+		case "max_pending":
+			opts.MaxPending = v.(int64)
 		case "max_connections", "max_conn":
 			opts.MaxConn = int(v.(int64))
 		case "ping_interval":
@@ -249,13 +360,171 @@ func ProcessConfigFile(configFile string) (*Options, error) {
 				return nil, err
 			}
 			opts.TLSTimeout = tc.Timeout
+			opts.TLSMap = tc.Map
 		case "write_deadline":
 			opts.WriteDeadline = time.Duration(v.(int64)) * time.Second
+		case "lame_duck_duration":
+			opts.LameDuckDuration = time.Duration(v.(int64)) * time.Second
+		case "system_user":
+			opts.SystemUser = v.(string)
+		case "accounts":
+			accounts, users, err := parseAccounts(v)
+			if err != nil {
+				return nil, err
+			}
+			opts.Accounts = accounts
+			accountUsers = users
+		case "mappings":
+			mappings, err := parseMappings(v)
+			if err != nil {
+				return nil, err
+			}
+			opts.Mappings = mappings
+		case "queue_policies":
+			qm, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Expected queue_policies to be a map/struct, got %v", v)
+			}
+			opts.QueuePolicies = make(map[string]string, len(qm))
+			for queue, p := range qm {
+				opts.QueuePolicies[queue], _ = p.(string)
+			}
+		case "trace_subjects":
+			subjects, err := parseSubjects(v)
+			if err != nil {
+				return nil, err
+			}
+			opts.TraceSubjects = subjects
+		case "accept":
+			ao, err := parseAccept(v)
+			if err != nil {
+				return nil, err
+			}
+			opts.ClientAccept = ao
+		case "listeners":
+			listeners, err := parseListeners(v)
+			if err != nil {
+				return nil, err
+			}
+			opts.Listeners = listeners
+		case "http_accept", "monitor_accept":
+			ao, err := parseAccept(v)
+			if err != nil {
+				return nil, err
+			}
+			opts.HTTPAccept = ao
+		case "audit":
+			ao, err := parseAudit(v)
+			if err != nil {
+				return nil, err
+			}
+			opts.Audit = ao
+		}
+	}
+
+	// Users bound to accounts are added to the users array.
+	if accountUsers != nil {
+		if opts.Username != "" {
+			return nil, fmt.Errorf("Can not have a single user/pass and account users")
 		}
+		opts.Users = append(opts.Users, accountUsers...)
+	}
+	if err := validateAccounts(opts); err != nil {
+		return nil, err
+	}
+	if err := validateMappings(opts); err != nil {
+		return nil, err
+	}
+	if err := validateQueuePolicies(opts); err != nil {
+		return nil, err
+	}
+	if err := validateTraceSubjects(opts); err != nil {
+		return nil, err
+	}
+	if err := validateAccept(opts); err != nil {
+		return nil, err
+	}
+	if err := validateListeners(opts); err != nil {
+		return nil, err
+	}
+	if err := validateAudit(opts); err != nil {
+		return nil, err
+	}
+	if opts.SystemUser != "" && !hasUser(opts.Users, opts.SystemUser) {
+		return nil, fmt.Errorf("System user %q is not a configured user", opts.SystemUser)
+	}
+	if err := validateAuthCallout(opts); err != nil {
+		return nil, err
+	}
+	if err := validateTLSMap(opts); err != nil {
+		return nil, err
+	}
+	if err := validateJWT(opts); err != nil {
+		return nil, err
 	}
 	return opts, nil
 }
 
+// validateUsers checks that the users have a password or a valid
+// public key, but not both.
+func validateUsers(users []*User) error {
+	for _, u := range users {
+		if u.Nkey == "" {
+			if u.Password == "" {
+				return fmt.Errorf("User entry requires a user and a password")
+			}
+			continue
+		}
+		if u.Password != "" {
+			return fmt.Errorf("User %q can not have both a password and an nkey", u.Nkey)
+		}
+		if _, err := DecodeNkey(u.Nkey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTLSMap checks the mapping of certificates to users, which
+// are the only ones without a password.
+func validateTLSMap(opts *Options) error {
+	if opts.TLSMap && opts.Users == nil {
+		return fmt.Errorf("TLS verify_and_map requires users")
+	}
+	if !opts.TLSMap {
+		if err := validateUsers(opts.Users); err != nil {
+			return err
+		}
+	}
+	for _, lo := range opts.Listeners {
+		if err := validateUsers(lo.Users); err != nil {
+			return err
+		}
+	}
+	if opts.Cluster.Users != nil {
+		if !opts.Cluster.TLSMap {
+			return fmt.Errorf("Cluster authorization allows multiple users only with verify_and_map")
+		}
+		if opts.Cluster.Username != "" {
+			return fmt.Errorf("Can not have a single user/pass and a users array")
+		}
+	}
+	if opts.Cluster.TLSMap && opts.Cluster.Users == nil {
+		return fmt.Errorf("Cluster TLS verify_and_map requires users")
+	}
+	return nil
+}
+
+// hasUser returns true if a user with the given name is in the list.
+func hasUser(users []*User, name string) bool {
+	for _, u := range users {
+		if u.Username == name {
+			return true
+		}
+	}
+	return false
+}
+
 // hostPort is simple struct to hold parsed listen/addr strings.
 type hostPort struct {
 	host string
@@ -304,9 +573,9 @@ func parseCluster(cm map[string]interface{}, opts *Options) error {
 			if err != nil {
 				return err
 			}
-			if auth.users != nil {
-				return fmt.Errorf("Cluster authorization does not allow multiple users")
-			}
+			// Multiple users are the identities of the peers
+			// with verify_and_map, see validateTLSMap.
+			opts.Cluster.Users = auth.users
 			opts.Cluster.Username = auth.user
 			opts.Cluster.Password = auth.pass
 			opts.Cluster.AuthTimeout = auth.timeout
@@ -336,15 +605,186 @@ func parseCluster(cm map[string]interface{}, opts *Options) error {
 			opts.Cluster.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
 			opts.Cluster.TLSConfig.RootCAs = opts.Cluster.TLSConfig.ClientCAs
 			opts.Cluster.TLSTimeout = tc.Timeout
+			opts.Cluster.TLSMap = tc.Map
 		case "no_advertise":
 			opts.Cluster.NoAdvertise = mv.(bool)
 		case "connect_retries":
 			opts.Cluster.ConnectRetries = int(mv.(int64))
+		case "accept":
+			ao, err := parseAccept(mv)
+			if err != nil {
+				return err
+			}
+			opts.ClusterAccept = ao
+		}
+	}
+	return nil
+}
+
+// parseLeafNodes will parse the leaf nodes config.
+func parseLeafNodes(lm map[string]interface{}, opts *Options) error {
+	for mk, mv := range lm {
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				return err
+			}
+			opts.LeafNode.Host = hp.host
+			opts.LeafNode.Port = hp.port
+		case "port":
+			opts.LeafNode.Port = int(mv.(int64))
+		case "host", "net":
+			opts.LeafNode.Host = mv.(string)
+		case "remotes":
+			ra := mv.([]interface{})
+			opts.LeafNode.Remotes = make([]*RemoteLeafOpts, 0, len(ra))
+			for _, r := range ra {
+				remote, err := parseRemoteLeaf(r)
+				if err != nil {
+					return err
+				}
+				opts.LeafNode.Remotes = append(opts.LeafNode.Remotes, remote)
+			}
+		case "tls":
+			tlsm := mv.(map[string]interface{})
+			tc, err := parseTLS(tlsm)
+			if err != nil {
+				return err
+			}
+			if opts.LeafNode.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				return err
+			}
+			// As for routes, the same config is used to accept leaf
+			// nodes and to connect to the remotes.
+			opts.LeafNode.TLSConfig.RootCAs = opts.LeafNode.TLSConfig.ClientCAs
+			opts.LeafNode.TLSTimeout = tc.Timeout
 		}
 	}
 	return nil
 }
 
+// parseRemoteLeaf parses a remote given either as an
+// URL, or as a map with the url and the local account.
+func parseRemoteLeaf(v interface{}) (*RemoteLeafOpts, error) {
+	remote := &RemoteLeafOpts{}
+	var rawURL string
+	switch r := v.(type) {
+	case string:
+		rawURL = r
+	case map[string]interface{}:
+		for k, v := range r {
+			switch strings.ToLower(k) {
+			case "url":
+				rawURL = v.(string)
+			case "account":
+				remote.Account = v.(string)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("error parsing leaf node remote [%v]", v)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("error parsing leaf node remote url [%q]", rawURL)
+	}
+	remote.URL = u
+	return remote, nil
+}
+
+// parseWebsocket will parse the websocket config.
+func parseWebsocket(wm map[string]interface{}, opts *Options) error {
+	for mk, mv := range wm {
+		switch strings.ToLower(mk) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				return err
+			}
+			opts.Websocket.Host = hp.host
+			opts.Websocket.Port = hp.port
+		case "port":
+			opts.Websocket.Port = int(mv.(int64))
+		case "host", "net":
+			opts.Websocket.Host = mv.(string)
+		case "tls":
+			tlsm := mv.(map[string]interface{})
+			tc, err := parseTLS(tlsm)
+			if err != nil {
+				return err
+			}
+			if opts.Websocket.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				return err
+			}
+			opts.Websocket.TLSTimeout = tc.Timeout
+		}
+	}
+	return nil
+}
+
+// Helper function to parse the additional client endpoints, e.g.
+//   listeners = [
+//     {listen: "10.0.0.1:4222", tls {...}}
+//     {unix: "/var/run/gnatsd.sock", no_auth: true}
+//   ]
+func parseListeners(v interface{}) ([]*ListenerOpts, error) {
+	la, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected listeners to be an array, got %v", v)
+	}
+	listeners := make([]*ListenerOpts, 0, len(la))
+	for _, l := range la {
+		lm, ok := l.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Expected listener to be a map/struct, got %v", l)
+		}
+		lo := &ListenerOpts{}
+		for mk, mv := range lm {
+			switch strings.ToLower(mk) {
+			case "listen":
+				hp, err := parseListen(mv)
+				if err != nil {
+					return nil, err
+				}
+				lo.Host = hp.host
+				lo.Port = hp.port
+			case "port":
+				lo.Port = int(mv.(int64))
+			case "host", "net":
+				lo.Host = mv.(string)
+			case "unix":
+				lo.Unix = mv.(string)
+			case "no_auth":
+				lo.NoAuth = mv.(bool)
+			case "authorization":
+				am := mv.(map[string]interface{})
+				auth, err := parseAuthorization(am)
+				if err != nil {
+					return nil, err
+				}
+				lo.Username = auth.user
+				lo.Password = auth.pass
+				lo.Users = auth.users
+				lo.AuthTimeout = auth.timeout
+			case "tls":
+				tlsm := mv.(map[string]interface{})
+				tc, err := parseTLS(tlsm)
+				if err != nil {
+					return nil, err
+				}
+				if lo.TLSConfig, err = GenTLSConfig(tc); err != nil {
+					return nil, err
+				}
+				lo.TLSTimeout = tc.Timeout
+			default:
+				return nil, fmt.Errorf("Unknown field %q in listener", mk)
+			}
+		}
+		listeners = append(listeners, lo)
+	}
+	return listeners, nil
+}
+
 // Helper function to parse Authorization configs.
 func parseAuthorization(am map[string]interface{}) (*authorization, error) {
 	auth := &authorization{}
@@ -379,6 +819,26 @@ func parseAuthorization(am map[string]interface{}) (*authorization, error) {
 				return nil, err
 			}
 			auth.defaultPermissions = permissions
+		case "callout":
+			cm, ok := mv.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Expected callout to be a map/struct, got %+v", mv)
+			}
+			callout, err := parseAuthCallout(cm)
+			if err != nil {
+				return nil, err
+			}
+			auth.callout = callout
+		case "jwt":
+			jm, ok := mv.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Expected jwt to be a map/struct, got %+v", mv)
+			}
+			jo, err := parseJWTOpts(jm)
+			if err != nil {
+				return nil, err
+			}
+			auth.jwt = jo
 		}
 
 		// Now check for permission defaults with multiple users, etc.
@@ -394,6 +854,78 @@ func parseAuthorization(am map[string]interface{}) (*authorization, error) {
 	return auth, nil
 }
 
+// Helper function to parse the auth callout, e.g.
+//   callout {
+//     url: "http://127.0.0.1:9090/auth"
+//     timeout: 1
+//     ttl: 60
+//   }
+func parseAuthCallout(cm map[string]interface{}) (*AuthCalloutOpts, error) {
+	ac := &AuthCalloutOpts{}
+	for mk, mv := range cm {
+		switch strings.ToLower(mk) {
+		case "subject":
+			ac.Subject = mv.(string)
+		case "url":
+			ac.URL = mv.(string)
+		case "timeout", "ttl":
+			var secs float64
+			switch v := mv.(type) {
+			case int64:
+				secs = float64(v)
+			case float64:
+				secs = v
+			default:
+				return nil, fmt.Errorf("Expected callout %s to be a number of seconds, got %v", mk, mv)
+			}
+			if strings.ToLower(mk) == "timeout" {
+				ac.Timeout = secondsToDuration(secs)
+			} else {
+				ac.TTL = secondsToDuration(secs)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown field %q in auth callout", mk)
+		}
+	}
+	return ac, nil
+}
+
+// Helper function to parse the JWT authentication, e.g.
+//   jwt {
+//     operators: ["<operator public key>"]
+//     accounts_dir: "/etc/nats/accounts"
+//     revocations_dir: "/etc/nats/revocations"
+//   }
+func parseJWTOpts(jm map[string]interface{}) (*JWTOpts, error) {
+	jo := &JWTOpts{}
+	for mk, mv := range jm {
+		switch strings.ToLower(mk) {
+		case "operator", "operators":
+			switch v := mv.(type) {
+			case string:
+				jo.Operators = append(jo.Operators, v)
+			case []interface{}:
+				for _, op := range v {
+					key, ok := op.(string)
+					if !ok {
+						return nil, fmt.Errorf("Expected jwt operator to be a string, got %v", op)
+					}
+					jo.Operators = append(jo.Operators, key)
+				}
+			default:
+				return nil, fmt.Errorf("Expected jwt operators to be an array, got %v", mv)
+			}
+		case "accounts_dir":
+			jo.AccountsDir = mv.(string)
+		case "revocations_dir":
+			jo.RevocationsDir = mv.(string)
+		default:
+			return nil, fmt.Errorf("Unknown field %q in jwt", mk)
+		}
+	}
+	return jo, nil
+}
+
 // Helper function to parse multiple users array with optional permissions.
 func parseUsers(mv interface{}) ([]*User, error) {
 	// Make sure we have an array
@@ -415,6 +947,12 @@ func parseUsers(mv interface{}) ([]*User, error) {
 				user.Username = v.(string)
 			case "pass", "password":
 				user.Password = v.(string)
+			case "nkey":
+				nkey, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("Expected user nkey to be a string, got %v", v)
+				}
+				user.Nkey = nkey
 			case "permission", "permissions", "authroization":
 				pm, ok := v.(map[string]interface{})
 				if !ok {
@@ -425,10 +963,22 @@ func parseUsers(mv interface{}) ([]*User, error) {
 					return nil, err
 				}
 				user.Permissions = permissions
+			case "limits":
+				lm, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("Expected user limits to be a map/struct, got %+v", v)
+				}
+				limits, err := parseUserLimits(lm)
+				if err != nil {
+					return nil, err
+				}
+				user.Limits = limits
 			}
 		}
-		// Check to make sure we have at least username and password
-		if user.Username == "" || user.Password == "" {
+		// Check to make sure we have at least a username or a public
+		// key, the password is checked by validateUsers since mapped
+		// users have none.
+		if user.Username == "" && user.Nkey == "" {
 			return nil, fmt.Errorf("User entry requires a user and a password")
 		}
 		users = append(users, user)
@@ -436,23 +986,315 @@ func parseUsers(mv interface{}) ([]*User, error) {
 	return users, nil
 }
 
+// parseAccounts parses the accounts map, returning the accounts and
+// the users bound to them.
+func parseAccounts(v interface{}) ([]*AccountOpts, []*User, error) {
+	am, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("Expected accounts to be a map/struct, got %v", v)
+	}
+	// Keep a stable order, so that reloads do not see spurious changes.
+	names := make([]string, 0, len(am))
+	for name := range am {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var accounts []*AccountOpts
+	var users []*User
+	for _, name := range names {
+		mv := am[name]
+		acc := &AccountOpts{Name: name}
+		m, ok := mv.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("Expected account %q to be a map/struct, got %v", name, mv)
+		}
+		for k, v := range m {
+			switch strings.ToLower(k) {
+			case "users":
+				accUsers, err := parseUsers(v)
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, u := range accUsers {
+					u.Account = name
+				}
+				users = append(users, accUsers...)
+			case "exports":
+				exports, err := parseExports(v)
+				if err != nil {
+					return nil, nil, err
+				}
+				acc.Exports = exports
+			case "imports":
+				imports, err := parseImports(v)
+				if err != nil {
+					return nil, nil, err
+				}
+				acc.Imports = imports
+			default:
+				return nil, nil, fmt.Errorf("Unknown field %s parsing account %q", k, name)
+			}
+		}
+		accounts = append(accounts, acc)
+	}
+	return accounts, users, nil
+}
+
+// Helper function to parse account exports, e.g.
+//   exports = [ {stream: "public.>"}, {service: "help"} ]
+func parseExports(v interface{}) ([]*Export, error) {
+	ev, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected exports to be an array, got %v", v)
+	}
+	var exports []*Export
+	for _, e := range ev {
+		em, ok := e.(map[string]interface{})
+		if !ok || len(em) != 1 {
+			return nil, fmt.Errorf("Expected export entry to be a stream or a service, got %v", e)
+		}
+		for k, v := range em {
+			subject, ok := v.(string)
+			if !ok || !IsValidSubject(subject) {
+				return nil, fmt.Errorf("Export subject %v is not a valid subject", v)
+			}
+			switch strings.ToLower(k) {
+			case "stream":
+				exports = append(exports, &Export{Subject: subject})
+			case "service":
+				exports = append(exports, &Export{Subject: subject, Service: true})
+			default:
+				return nil, fmt.Errorf("Unknown export type %s", k)
+			}
+		}
+	}
+	return exports, nil
+}
+
+// Helper function to parse account imports, e.g.
+//   imports = [ {stream: {account: acme, subject: "public.>"}} ]
+func parseImports(v interface{}) ([]*Import, error) {
+	iv, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected imports to be an array, got %v", v)
+	}
+	var imports []*Import
+	for _, i := range iv {
+		im, ok := i.(map[string]interface{})
+		if !ok || len(im) != 1 {
+			return nil, fmt.Errorf("Expected import entry to be a stream or a service, got %v", i)
+		}
+		for k, v := range im {
+			imp := &Import{}
+			switch strings.ToLower(k) {
+			case "stream":
+			case "service":
+				imp.Service = true
+			default:
+				return nil, fmt.Errorf("Unknown import type %s", k)
+			}
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Expected %s import to be a map/struct, got %v", k, v)
+			}
+			for mk, mv := range m {
+				switch strings.ToLower(mk) {
+				case "account":
+					imp.Account, _ = mv.(string)
+				case "subject":
+					imp.Subject, _ = mv.(string)
+				default:
+					return nil, fmt.Errorf("Unknown field %s parsing import", mk)
+				}
+			}
+			if imp.Account == "" || !IsValidSubject(imp.Subject) {
+				return nil, fmt.Errorf("Import requires an account and a valid subject, got %v", v)
+			}
+			imports = append(imports, imp)
+		}
+	}
+	return imports, nil
+}
+
+// Helper function to parse subject mappings, e.g.
+//   mappings = {
+//     "orders.*.new": "orders.new.$1"
+//     "api.>": [ {destination: "api.v2.>", weight: 10} ]
+//   }
+func parseMappings(v interface{}) ([]*SubjectMapping, error) {
+	mm, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected mappings to be a map/struct, got %v", v)
+	}
+	// Keep a stable order, so that reloads do not see spurious changes.
+	sources := make([]string, 0, len(mm))
+	for src := range mm {
+		sources = append(sources, src)
+	}
+	sort.Strings(sources)
+
+	var mappings []*SubjectMapping
+	for _, src := range sources {
+		sm := &SubjectMapping{Source: src}
+		switch mv := mm[src].(type) {
+		case string:
+			sm.Destinations = []*MapDestination{{Subject: mv, Weight: 100}}
+		case []interface{}:
+			for _, dv := range mv {
+				dm, ok := dv.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("Expected destination of mapping %q to be a map/struct, got %v", src, dv)
+				}
+				d := &MapDestination{Weight: 100}
+				for k, v := range dm {
+					switch strings.ToLower(k) {
+					case "destination", "subject":
+						d.Subject, _ = v.(string)
+					case "weight":
+						w, _ := v.(int64)
+						d.Weight = int(w)
+					default:
+						return nil, fmt.Errorf("Unknown field %s parsing mapping %q", k, src)
+					}
+				}
+				sm.Destinations = append(sm.Destinations, d)
+			}
+		default:
+			return nil, fmt.Errorf("Expected mapping %q to be a subject or an array, got %v", src, mv)
+		}
+		mappings = append(mappings, sm)
+	}
+	return mappings, nil
+}
+
+// Helper function to parse the connection filters of a listener, e.g.
+//   accept {
+//     allow: ["10.0.0.0/8"]
+//     deny: ["10.1.2.3"]
+//     rate: 5
+//     burst: 20
+//   }
+func parseAccept(v interface{}) (*AcceptOpts, error) {
+	am, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected accept to be a map/struct, got %v", v)
+	}
+	ao := &AcceptOpts{}
+	for mk, mv := range am {
+		switch strings.ToLower(mk) {
+		case "allow":
+			addrs, err := parseAddrs(mv)
+			if err != nil {
+				return nil, err
+			}
+			ao.Allow = addrs
+		case "deny":
+			addrs, err := parseAddrs(mv)
+			if err != nil {
+				return nil, err
+			}
+			ao.Deny = addrs
+		case "rate":
+			switch r := mv.(type) {
+			case int64:
+				ao.Rate = float64(r)
+			case float64:
+				ao.Rate = r
+			default:
+				return nil, fmt.Errorf("Expected accept rate to be a number, got %v", mv)
+			}
+		case "burst":
+			b, ok := mv.(int64)
+			if !ok {
+				return nil, fmt.Errorf("Expected accept burst to be an integer, got %v", mv)
+			}
+			ao.Burst = int(b)
+		default:
+			return nil, fmt.Errorf("Unknown field %q in accept", mk)
+		}
+	}
+	return ao, nil
+}
+
+// parseAudit parses the audit block, the window and the ban are in
+// seconds.
+func parseAudit(v interface{}) (*AuditOpts, error) {
+	am, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected audit to be a map/struct, got %v", v)
+	}
+	ao := &AuditOpts{}
+	for mk, mv := range am {
+		switch strings.ToLower(mk) {
+		case "file":
+			f, ok := mv.(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected audit file to be a string, got %v", mv)
+			}
+			ao.File = f
+		case "max_violations", "window", "ban":
+			n, ok := mv.(int64)
+			if !ok {
+				return nil, fmt.Errorf("Expected audit %s to be an integer, got %v", mk, mv)
+			}
+			switch strings.ToLower(mk) {
+			case "max_violations":
+				ao.MaxViolations = int(n)
+			case "window":
+				ao.Window = time.Duration(n) * time.Second
+			case "ban":
+				ao.Ban = time.Duration(n) * time.Second
+			}
+		default:
+			return nil, fmt.Errorf("Unknown field %q in audit", mk)
+		}
+	}
+	return ao, nil
+}
+
+// Helper function to parse an address or an array of addresses.
+func parseAddrs(v interface{}) ([]string, error) {
+	switch av := v.(type) {
+	case string:
+		return []string{av}, nil
+	case []interface{}:
+		addrs := make([]string, 0, len(av))
+		for _, a := range av {
+			addr, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("Address in accept array cannot be cast to string")
+			}
+			addrs = append(addrs, addr)
+		}
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("Expected an address or an array of addresses, got %v", v)
+}
+
 // Helper function to parse user/account permissions
 func parseUserPermissions(pm map[string]interface{}) (*Permissions, error) {
 	p := &Permissions{}
 	for k, v := range pm {
 		switch strings.ToLower(k) {
 		case "pub", "publish":
-			subjects, err := parseSubjects(v)
+			allow, deny, err := parseSubjectPermission(v, false)
 			if err != nil {
 				return nil, err
 			}
-			p.Publish = subjects
+			p.Publish, p.PublishDeny = allow, deny
 		case "sub", "subscribe":
-			subjects, err := parseSubjects(v)
+			allow, deny, err := parseSubjectPermission(v, true)
+			if err != nil {
+				return nil, err
+			}
+			p.Subscribe, p.SubscribeDeny = allow, deny
+		case "allow_responses":
+			rp, err := parseResponsePermission(v)
 			if err != nil {
 				return nil, err
 			}
-			p.Subscribe = subjects
+			p.AllowResponses = rp
 		default:
 			return nil, fmt.Errorf("Unknown field %s parsing permissions", k)
 		}
@@ -460,6 +1302,113 @@ func parseUserPermissions(pm map[string]interface{}) (*Permissions, error) {
 	return p, nil
 }
 
+// Helper function to parse the allowed and denied subjects of a
+// permission, e.g.
+//   subscribe = ["foo", "jobs workers"]
+//   publish = {allow: "foo.>", deny: ["foo.secret"]}
+// Everything but the denied subjects is allowed if there is no allow.
+// Subscribe subjects can be restricted to a queue, after the subject.
+func parseSubjectPermission(v interface{}, queues bool) ([]string, []string, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		allow, err := parsePermSubjects(v, queues)
+		return allow, nil, err
+	}
+	var allow, deny []string
+	for k, v := range m {
+		subjects, err := parsePermSubjects(v, queues)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch strings.ToLower(k) {
+		case "allow":
+			allow = subjects
+		case "deny":
+			deny = subjects
+		default:
+			return nil, nil, fmt.Errorf("Unknown field %s parsing permissions", k)
+		}
+	}
+	if allow == nil {
+		allow = []string{">"}
+	}
+	return allow, deny, nil
+}
+
+// Helper function to parse the subjects of a permission, with their queue.
+func parsePermSubjects(v interface{}, queues bool) ([]string, error) {
+	subjects, err := parseSubjects(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range subjects {
+		subject, queue := splitPermSubject(s)
+		if !IsValidSubject(subject) {
+			return nil, fmt.Errorf("Subject %q is not a valid subject", s)
+		}
+		if queue != "" && (!queues || strings.Contains(queue, " ")) {
+			return nil, fmt.Errorf("Subject %q can not have a queue", s)
+		}
+	}
+	return subjects, nil
+}
+
+// Helper function to parse the permission to publish responses, e.g.
+//   allow_responses = true
+//   allow_responses = {max: 5, expires: 60}
+func parseResponsePermission(v interface{}) (*ResponsePermission, error) {
+	switch v := v.(type) {
+	case bool:
+		if !v {
+			return nil, nil
+		}
+		return &ResponsePermission{}, nil
+	case map[string]interface{}:
+		rp := &ResponsePermission{}
+		for k, mv := range v {
+			n, ok := mv.(int64)
+			if !ok || n < 0 {
+				return nil, fmt.Errorf("Expected allow_responses %s to be a positive integer, got %v", k, mv)
+			}
+			switch strings.ToLower(k) {
+			case "max", "max_msgs":
+				rp.MaxMsgs = int(n)
+			case "expires", "ttl":
+				rp.Expires = time.Duration(n) * time.Second
+			default:
+				return nil, fmt.Errorf("Unknown field %s parsing allow_responses", k)
+			}
+		}
+		return rp, nil
+	}
+	return nil, fmt.Errorf("Expected allow_responses to be a boolean or a map/struct, got %v", v)
+}
+
+// Helper function to parse user limits, e.g.
+//   limits = {max_subscriptions: 100, max_msgs_per_sec: 1000}
+func parseUserLimits(lm map[string]interface{}) (*UserLimits, error) {
+	l := &UserLimits{}
+	for k, v := range lm {
+		n, ok := v.(int64)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("Expected limit %s to be a positive integer, got %v", k, v)
+		}
+		switch strings.ToLower(k) {
+		case "max_subs", "max_subscriptions":
+			l.MaxSubs = int(n)
+		case "max_pending", "max_pending_size":
+			l.MaxPending = int(n)
+		case "max_msgs_per_sec", "msg_rate":
+			l.MaxMsgsPerSec = n
+		case "max_bytes_per_sec", "byte_rate":
+			l.MaxBytesPerSec = n
+		default:
+			return nil, fmt.Errorf("Unknown field %s parsing limits", k)
+		}
+	}
+	return l, nil
+}
+
 // Helper function to parse subject singeltons and/or arrays
 func parseSubjects(v interface{}) ([]string, error) {
 	var subjects []string
@@ -552,6 +1501,12 @@ func parseTLS(tlsm map[string]interface{}) (*TLSConfigOpts, error) {
 				return nil, fmt.Errorf("error parsing tls config, expected 'verify' to be a boolean")
 			}
 			tc.Verify = verify
+		case "verify_and_map":
+			verifyAndMap, ok := mv.(bool)
+			if !ok {
+				return nil, fmt.Errorf("error parsing tls config, expected 'verify_and_map' to be a boolean")
+			}
+			tc.Map = verifyAndMap
 		case "cipher_suites":
 			ra := mv.([]interface{})
 			if len(ra) == 0 {
@@ -592,6 +1547,12 @@ func parseTLS(tlsm map[string]interface{}) (*TLSConfigOpts, error) {
 		}
 	}
 
+	// Certificates are always verified to be mapped, whatever the order
+	// of the fields.
+	if tc.Map {
+		tc.Verify = true
+	}
+
 	// If cipher suites were not specified then use the defaults
 	if tc.Ciphers == nil {
 		tc.Ciphers = defaultCipherSuites()
@@ -843,6 +1804,14 @@ func processOptions(opts *Options) {
 	if opts.AuthTimeout == 0 {
 		opts.AuthTimeout = float64(AUTH_TIMEOUT) / float64(time.Second)
 	}
+	for _, lo := range opts.Listeners {
+		if lo.TLSTimeout == 0 {
+			lo.TLSTimeout = opts.TLSTimeout
+		}
+		if lo.AuthTimeout == 0 {
+			lo.AuthTimeout = opts.AuthTimeout
+		}
+	}
 	if opts.Cluster.Host == "" {
 		opts.Cluster.Host = DEFAULT_HOST
 	}
@@ -858,7 +1827,13 @@ func processOptions(opts *Options) {
 	if opts.MaxPayload == 0 {
 		opts.MaxPayload = MAX_PAYLOAD_SIZE
 	}
+	if opts.MaxPending == 0 {
+		opts.MaxPending = MAX_PENDING_SIZE
+	}
 	if opts.WriteDeadline == time.Duration(0) {
 		opts.WriteDeadline = DEFAULT_FLUSH_DEADLINE
 	}
+	if opts.LameDuckDuration == time.Duration(0) {
+		opts.LameDuckDuration = DEFAULT_LAME_DUCK_DURATION
+	}
 }
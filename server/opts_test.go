@@ -22,12 +22,14 @@ func TestDefaultOptions(t *testing.T) {
 		AuthTimeout:    float64(AUTH_TIMEOUT) / float64(time.Second),
 		MaxControlLine: MAX_CONTROL_LINE_SIZE,
 		MaxPayload:     MAX_PAYLOAD_SIZE,
+		MaxPending:     MAX_PENDING_SIZE,
 		Cluster: ClusterOpts{
 			Host:        DEFAULT_HOST,
 			AuthTimeout: float64(AUTH_TIMEOUT) / float64(time.Second),
 			TLSTimeout:  float64(TLS_TIMEOUT) / float64(time.Second),
 		},
-		WriteDeadline: DEFAULT_FLUSH_DEADLINE,
+		WriteDeadline:    DEFAULT_FLUSH_DEADLINE,
+		LameDuckDuration: DEFAULT_LAME_DUCK_DURATION,
 	}
 
 	opts := &Options{}
@@ -67,6 +69,7 @@ func TestConfigFile(t *testing.T) {
 		RemoteSyslog:   "udp://foo.com:33",
 		MaxControlLine: 2048,
 		MaxPayload:     65536,
+		MaxPending:     10000000,
 		MaxConn:        100,
 		PingInterval:   60 * time.Second,
 		MaxPingsOut:    3,
@@ -221,6 +224,7 @@ func TestMergeOverrides(t *testing.T) {
 		RemoteSyslog:   "udp://foo.com:33",
 		MaxControlLine: 2048,
 		MaxPayload:     65536,
+		MaxPending:     10000000,
 		MaxConn:        100,
 		PingInterval:   60 * time.Second,
 		MaxPingsOut:    3,
@@ -605,3 +609,172 @@ func TestAuthorizationConfig(t *testing.T) {
 		t.Fatalf("Expected Susan's subscribe permissions to be 'PUBLIC.>', got %q\n", subPerm)
 	}
 }
+
+func TestAuthCalloutConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/auth_callout.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := &AuthCalloutOpts{
+		URL:     "http://127.0.0.1:9090/auth",
+		Timeout: 1500 * time.Millisecond,
+		TTL:     time.Minute,
+	}
+	if !reflect.DeepEqual(opts.AuthCallout, expected) {
+		t.Fatalf("Unexpected auth callout: %+v", opts.AuthCallout)
+	}
+
+	for _, o := range []*Options{
+		{AuthCallout: &AuthCalloutOpts{URL: "ftp://127.0.0.1/auth"}},
+		{AuthCallout: &AuthCalloutOpts{URL: "http://127.0.0.1/auth", Subject: "_SYS.AUTH"}},
+		{AuthCallout: &AuthCalloutOpts{URL: "http://127.0.0.1/auth", Timeout: -1}},
+		{AuthCallout: &AuthCalloutOpts{}},
+		{AuthCallout: &AuthCalloutOpts{Subject: "auth"}, SystemUser: "admin"},
+		{AuthCallout: &AuthCalloutOpts{Subject: "_SYS.AUTH.*"}, SystemUser: "admin"},
+	} {
+		if err := validateAuthCallout(o); err == nil {
+			t.Fatalf("Expected an error for %+v", o.AuthCallout)
+		}
+	}
+	if err := validateAuthCallout(&Options{AuthCallout: &AuthCalloutOpts{}, SystemUser: "admin"}); err != nil {
+		t.Fatalf("Expected the default subject to be valid: %v", err)
+	}
+}
+
+func TestTLSMapConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/tls_map.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if !opts.TLSMap || !opts.Cluster.TLSMap {
+		t.Fatalf("Expected clients and routes to be mapped, got %v and %v",
+			opts.TLSMap, opts.Cluster.TLSMap)
+	}
+	if opts.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatal("Expected the client certificates to be verified")
+	}
+	if len(opts.Users) != 2 || opts.Users[0].Username != "CN=nats-client" ||
+		opts.Users[0].Permissions == nil {
+		t.Fatalf("Unexpected users: %+v", opts.Users)
+	}
+	if len(opts.Cluster.Users) != 2 || opts.Cluster.Users[1].Username != "CN=srvb" {
+		t.Fatalf("Unexpected route users: %+v", opts.Cluster.Users)
+	}
+
+	// Mapped certificates are verified whatever the order of the fields.
+	for i := 0; i < 20; i++ {
+		tc, err := parseTLS(map[string]interface{}{"verify": false, "verify_and_map": true})
+		if err != nil {
+			t.Fatalf("Received an error parsing the tls config: %v", err)
+		}
+		if !tc.Verify || !tc.Map {
+			t.Fatalf("Expected the certificates to be verified and mapped, got %+v", tc)
+		}
+	}
+
+	users := []*User{{Username: "CN=alice"}}
+	for _, o := range []*Options{
+		{TLSMap: true},
+		{Users: users},
+		{Listeners: []*ListenerOpts{{Users: users}}},
+		{Cluster: ClusterOpts{Users: users}},
+		{Cluster: ClusterOpts{TLSMap: true}},
+		{Cluster: ClusterOpts{TLSMap: true, Users: users, Username: "derek"}},
+	} {
+		if err := validateTLSMap(o); err == nil {
+			t.Fatalf("Expected an error for %+v", o)
+		}
+	}
+}
+
+func TestNkeyUsersConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/nkeys.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if len(opts.Users) != 2 {
+		t.Fatalf("Expected 2 users, got %d", len(opts.Users))
+	}
+	nkeyUser := opts.Users[0]
+	if nkeyUser.Nkey != "Ahg8I6NBzNAkG4xDxi7TbJbgVdMiK-mchzTqAMqfL-E" ||
+		nkeyUser.Password != "" || nkeyUser.Permissions == nil {
+		t.Fatalf("Unexpected nkey user: %+v", nkeyUser)
+	}
+
+	for _, u := range []*User{
+		{Nkey: "not-a-key"},
+		{Nkey: "Ahg8I6NBzNAkG4xDxi7TbJbgVdMiK-mchzTqAMqfL-E", Password: "porkchop"},
+		{Username: "derek"},
+	} {
+		if err := validateUsers([]*User{u}); err == nil {
+			t.Fatalf("Expected an error for %+v", u)
+		}
+	}
+
+	users := []interface{}{map[string]interface{}{"nkey": int64(42)}}
+	if _, err := parseUsers(users); err == nil {
+		t.Fatal("Expected an error for a nkey that is not a string")
+	}
+}
+
+func TestJWTConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/jwt.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := &JWTOpts{
+		Operators:   []string{"Ahg8I6NBzNAkG4xDxi7TbJbgVdMiK-mchzTqAMqfL-E"},
+		AccountsDir: "./configs",
+	}
+	if !reflect.DeepEqual(opts.JWT, expected) {
+		t.Fatalf("Unexpected jwt: %+v", opts.JWT)
+	}
+
+	for _, jo := range []*JWTOpts{
+		{},
+		{Operators: []string{"not-a-key"}},
+		{Operators: expected.Operators, RevocationsDir: "./configs/missing"},
+		{Operators: expected.Operators, AccountsDir: "./configs/jwt.conf"},
+	} {
+		if err := validateJWT(&Options{JWT: jo}); err == nil {
+			t.Fatalf("Expected an error for %+v", jo)
+		}
+	}
+}
+
+func TestPermissionsConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/permissions.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := []*Permissions{
+		{
+			Publish:       []string{"orders.>"},
+			PublishDeny:   []string{"orders.secret.>"},
+			Subscribe:     []string{">"},
+			SubscribeDeny: []string{"orders.secret.>"},
+		},
+		{
+			Publish:        []string{"jobs.status"},
+			Subscribe:      []string{"jobs workers", "jobs.status"},
+			AllowResponses: &ResponsePermission{MaxMsgs: 5, Expires: time.Minute},
+		},
+	}
+	for i, u := range opts.Users {
+		if !reflect.DeepEqual(u.Permissions, expected[i]) {
+			t.Fatalf("Unexpected permissions of %s: %+v", u.Username, u.Permissions)
+		}
+	}
+
+	for _, pm := range []map[string]interface{}{
+		{"publish": "jobs workers"},
+		{"subscribe": "jobs a b"},
+		{"subscribe": map[string]interface{}{"except": "foo"}},
+		{"allow_responses": "yes"},
+		{"allow_responses": map[string]interface{}{"max": int64(-1)}},
+	} {
+		if _, err := parseUserPermissions(pm); err == nil {
+			t.Fatalf("Expected an error for %+v", pm)
+		}
+	}
+}
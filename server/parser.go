@@ -10,8 +10,12 @@ type pubArg struct {
 	subject []byte
 	reply   []byte
 	sid     []byte
+	hdb     []byte
 	szb     []byte
+	hdr     int
 	size    int
+	dropped bool // The message exceeds a limit of the client and is dropped.
+	traced  bool // The subject of the message is traced.
 }
 
 type parseState struct {
@@ -79,6 +83,17 @@ const (
 	OP_INF
 	OP_INFO
 	INFO_ARG
+	OP_H
+	OP_HP
+	OP_HPU
+	OP_HPUB
+	OP_HPUB_SPC
+	HPUB_ARG
+	OP_HM
+	OP_HMS
+	OP_HMSG
+	OP_HMSG_SPC
+	HMSG_ARG
 )
 
 func (c *client) parse(buf []byte) error {
@@ -86,8 +101,8 @@ func (c *client) parse(buf []byte) error {
 	var b byte
 
 	mcl := MAX_CONTROL_LINE_SIZE
-	if c.srv != nil && c.srv.opts != nil {
-		mcl = c.srv.opts.MaxControlLine
+	if c.srv != nil && c.srv.getOpts() != nil {
+		mcl = c.srv.getOpts().MaxControlLine
 	}
 
 	// snapshot this, and reset when we receive a
@@ -120,6 +135,8 @@ func (c *client) parse(buf []byte) error {
 				c.state = OP_C
 			case 'I', 'i':
 				c.state = OP_I
+			case 'H', 'h':
+				c.state = OP_H
 			case '+':
 				c.state = OP_PLUS
 			case '-':
@@ -186,6 +203,74 @@ func (c *client) parse(buf []byte) error {
 					c.argBuf = append(c.argBuf, b)
 				}
 			}
+		case OP_H:
+			switch b {
+			case 'P', 'p':
+				c.state = OP_HP
+			case 'M', 'm':
+				if c.typ == CLIENT {
+					goto parseErr
+				} else {
+					c.state = OP_HM
+				}
+			default:
+				goto parseErr
+			}
+		case OP_HP:
+			switch b {
+			case 'U', 'u':
+				c.state = OP_HPU
+			default:
+				goto parseErr
+			}
+		case OP_HPU:
+			switch b {
+			case 'B', 'b':
+				c.state = OP_HPUB
+			default:
+				goto parseErr
+			}
+		case OP_HPUB:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_HPUB_SPC
+			default:
+				goto parseErr
+			}
+		case OP_HPUB_SPC:
+			switch b {
+			case ' ', '\t':
+				continue
+			default:
+				c.state = HPUB_ARG
+				c.as = i
+			}
+		case HPUB_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				if err := c.processHeaderPub(arg); err != nil {
+					return err
+				}
+				c.drop, c.as, c.state = OP_START, i+1, MSG_PAYLOAD
+				// If we don't have a saved buffer then jump ahead with
+				// the index. If this overruns what is left we fall out
+				// and process split buffer.
+				if c.msgBuf == nil {
+					i = c.as + c.pa.size - LEN_CR_LF
+				}
+			default:
+				if c.argBuf != nil {
+					c.argBuf = append(c.argBuf, b)
+				}
+			}
 		case MSG_PAYLOAD:
 			if c.msgBuf != nil {
 				// copy as much as we can to the buffer and skip ahead.
@@ -504,6 +589,60 @@ func (c *client) parse(buf []byte) error {
 				}
 				c.drop, c.as, c.state = 0, i+1, MSG_PAYLOAD
 
+				// jump ahead with the index. If this overruns
+				// what is left we fall out and process split
+				// buffer.
+				i = c.as + c.pa.size - 1
+			default:
+				if c.argBuf != nil {
+					c.argBuf = append(c.argBuf, b)
+				}
+			}
+		case OP_HM:
+			switch b {
+			case 'S', 's':
+				c.state = OP_HMS
+			default:
+				goto parseErr
+			}
+		case OP_HMS:
+			switch b {
+			case 'G', 'g':
+				c.state = OP_HMSG
+			default:
+				goto parseErr
+			}
+		case OP_HMSG:
+			switch b {
+			case ' ', '\t':
+				c.state = OP_HMSG_SPC
+			default:
+				goto parseErr
+			}
+		case OP_HMSG_SPC:
+			switch b {
+			case ' ', '\t':
+				continue
+			default:
+				c.state = HMSG_ARG
+				c.as = i
+			}
+		case HMSG_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				if err := c.processHeaderMsgArgs(arg); err != nil {
+					return err
+				}
+				c.drop, c.as, c.state = 0, i+1, MSG_PAYLOAD
+
 				// jump ahead with the index. If this overruns
 				// what is left we fall out and process split
 				// buffer.
@@ -645,7 +784,8 @@ func (c *client) parse(buf []byte) error {
 	// Check for split buffer scenarios for any ARG state.
 	if c.state == SUB_ARG || c.state == UNSUB_ARG || c.state == PUB_ARG ||
 		c.state == MSG_ARG || c.state == MINUS_ERR_ARG ||
-		c.state == CONNECT_ARG || c.state == INFO_ARG {
+		c.state == CONNECT_ARG || c.state == INFO_ARG ||
+		c.state == HPUB_ARG || c.state == HMSG_ARG {
 		// Setup a holder buffer to deal with split buffer scenario.
 		if c.argBuf == nil {
 			c.argBuf = c.scratch[:0]
@@ -722,6 +862,7 @@ func (c *client) clonePubArg() {
 	c.argBuf = append(c.argBuf, c.pa.subject...)
 	c.argBuf = append(c.argBuf, c.pa.reply...)
 	c.argBuf = append(c.argBuf, c.pa.sid...)
+	c.argBuf = append(c.argBuf, c.pa.hdb...)
 	c.argBuf = append(c.argBuf, c.pa.szb...)
 
 	c.pa.subject = c.argBuf[:len(c.pa.subject)]
@@ -734,5 +875,9 @@ func (c *client) clonePubArg() {
 		c.pa.sid = c.argBuf[len(c.pa.subject)+len(c.pa.reply) : len(c.pa.subject)+len(c.pa.reply)+len(c.pa.sid)]
 	}
 
-	c.pa.szb = c.argBuf[len(c.pa.subject)+len(c.pa.reply)+len(c.pa.sid):]
+	if c.pa.hdb != nil {
+		c.pa.hdb = c.argBuf[len(c.pa.subject)+len(c.pa.reply)+len(c.pa.sid) : len(c.pa.subject)+len(c.pa.reply)+len(c.pa.sid)+len(c.pa.hdb)]
+	}
+
+	c.pa.szb = c.argBuf[len(c.pa.subject)+len(c.pa.reply)+len(c.pa.sid)+len(c.pa.hdb):]
 }
@@ -201,6 +201,75 @@ func TestParsePub(t *testing.T) {
 	}
 }
 
+func TestParseHeaderPub(t *testing.T) {
+	c := dummyClient()
+	c.headers = true
+
+	hpub := []byte("HPUB foo 12 17\r\nNATS/1.0\r\n\r\nhello\r")
+	err := c.parse(hpub)
+	if err != nil || c.state != MSG_END {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(c.pa.subject, []byte("foo")) {
+		t.Fatalf("Did not parse subject correctly: 'foo' vs '%s'\n", string(c.pa.subject))
+	}
+	if c.pa.reply != nil {
+		t.Fatalf("Did not parse reply correctly: 'nil' vs '%s'\n", string(c.pa.reply))
+	}
+	if c.pa.hdr != 12 {
+		t.Fatalf("Did not parse header size correctly: 12 vs %d\n", c.pa.hdr)
+	}
+	if c.pa.size != 17 {
+		t.Fatalf("Did not parse msg size correctly: 17 vs %d\n", c.pa.size)
+	}
+
+	// Clear snapshots
+	c.argBuf, c.msgBuf, c.state = nil, nil, OP_START
+
+	hpub = []byte("HPUB foo.bar INBOX.22 12 23\r\nNATS/1.0\r\n\r\nhello world\r")
+	err = c.parse(hpub)
+	if err != nil || c.state != MSG_END {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(c.pa.reply, []byte("INBOX.22")) {
+		t.Fatalf("Did not parse reply correctly: 'INBOX.22' vs '%s'\n", string(c.pa.reply))
+	}
+	if c.pa.hdr != 12 || c.pa.size != 23 {
+		t.Fatalf("Did not parse sizes correctly: 12/23 vs %d/%d\n", c.pa.hdr, c.pa.size)
+	}
+
+	// Header larger than the message is an error.
+	c.argBuf, c.msgBuf, c.state = nil, nil, OP_START
+	if err := c.parse([]byte("HPUB foo 22 12\r\n")); err == nil {
+		t.Fatalf("Expected an error for bad header size\n")
+	}
+}
+
+func TestParseHeaderMsg(t *testing.T) {
+	c := dummyRouteClient()
+
+	hmsg := []byte("HMSG foo RSID:1:2 INBOX.22 12 17\r\nNATS/1.0\r\n\r\nhello\r")
+	err := c.parse(hmsg)
+	if err != nil || c.state != MSG_END {
+		t.Fatalf("Unexpected: %d : %v\n", c.state, err)
+	}
+	if !bytes.Equal(c.pa.sid, []byte("RSID:1:2")) {
+		t.Fatalf("Did not parse sid correctly: 'RSID:1:2' vs '%s'\n", c.pa.sid)
+	}
+	if !bytes.Equal(c.pa.reply, []byte("INBOX.22")) {
+		t.Fatalf("Did not parse reply correctly: 'INBOX.22' vs '%s'\n", c.pa.reply)
+	}
+	if c.pa.hdr != 12 || c.pa.size != 17 {
+		t.Fatalf("Did not parse sizes correctly: 12/17 vs %d/%d\n", c.pa.hdr, c.pa.size)
+	}
+
+	// Clients are not allowed to send HMSG.
+	c = dummyClient()
+	if err := c.parse([]byte("HMSG foo 1 12 17\r\n")); err == nil {
+		t.Fatalf("Expected an error for HMSG from a client\n")
+	}
+}
+
 func testPubArg(c *client, t *testing.T) {
 	if !bytes.Equal(c.pa.subject, []byte("foo")) {
 		t.Fatalf("Mismatched subject: '%s'\n", c.pa.subject)
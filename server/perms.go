@@ -0,0 +1,212 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"strings"
+	"time"
+)
+
+// ResponsePermission allows a client to publish to the reply subjects
+// of the requests it receives, up to MaxMsgs times within Expires, even
+// if its permissions do not.
+type ResponsePermission struct {
+	MaxMsgs int           `json:"max"`
+	Expires time.Duration `json:"ttl"`
+}
+
+// Number of reply subjects a client can be allowed to publish to before
+// the expired ones are pruned.
+const maxResponsesSize = 1024
+
+// permissions are the compiled Permissions of a client. The denied
+// subjects are checked after the allowed ones. Subscribe permissions with
+// a queue, e.g. "foo workers", only allow queue subscriptions in a
+// matching queue.
+type permissions struct {
+	sub     *Sublist
+	pub     *Sublist
+	subDeny *Sublist
+	pubDeny *Sublist
+	pcache  map[string]bool
+	// Messages on subjects denied to subscriptions with wildcards
+	// are not delivered, protected by the client lock.
+	dcache map[string]bool
+	// Reply subjects allowed, protected by the client lock.
+	resp    *ResponsePermission
+	replies map[string]*allowedResponse
+}
+
+// allowedResponse is a reply subject a client can publish to.
+type allowedResponse struct {
+	n       int
+	expires time.Time
+}
+
+// splitPermSubject returns the subject and the queue of a permission,
+// e.g. "foo workers".
+func splitPermSubject(s string) (string, string) {
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 0:
+		return "", ""
+	case 1:
+		return fields[0], ""
+	}
+	return fields[0], strings.Join(fields[1:], " ")
+}
+
+// newPermSublist returns the subjects of the permissions, nil if none.
+func newPermSublist(subjects []string) *Sublist {
+	if len(subjects) == 0 {
+		return nil
+	}
+	sl := NewSublist()
+	for _, s := range subjects {
+		subject, queue := splitPermSubject(s)
+		sub := &subscription{subject: []byte(subject)}
+		if queue != "" {
+			sub.queue = []byte(queue)
+		}
+		sl.Insert(sub)
+	}
+	return sl
+}
+
+// newPermissions compiles the permissions of a user.
+func newPermissions(p *Permissions) *permissions {
+	perms := &permissions{
+		sub:     newPermSublist(p.Subscribe),
+		pub:     newPermSublist(p.Publish),
+		subDeny: newPermSublist(p.SubscribeDeny),
+		pubDeny: newPermSublist(p.PublishDeny),
+		pcache:  make(map[string]bool),
+	}
+	// Pre-allocate the allowed ones to simplify checks later.
+	if perms.sub == nil {
+		perms.sub = NewSublist()
+	}
+	if perms.pub == nil {
+		perms.pub = NewSublist()
+	}
+	if perms.subDeny != nil {
+		perms.dcache = make(map[string]bool)
+	}
+	if rp := p.AllowResponses; rp != nil {
+		resp := *rp
+		if resp.MaxMsgs == 0 {
+			resp.MaxMsgs = DEFAULT_ALLOW_RESPONSES_MAX_MSGS
+		}
+		if resp.Expires == 0 {
+			resp.Expires = DEFAULT_ALLOW_RESPONSES_EXPIRATION
+		}
+		perms.resp = &resp
+		perms.replies = make(map[string]*allowedResponse)
+	}
+	return perms
+}
+
+// matchPerm returns true if the subject, in the queue if any, matches
+// the permissions.
+func matchPerm(sl *Sublist, subject, queue []byte) bool {
+	if sl == nil {
+		return false
+	}
+	r := sl.Match(string(subject))
+	if len(r.psubs) > 0 {
+		return true
+	}
+	if queue == nil {
+		return false
+	}
+	for _, qsubs := range r.qsubs {
+		if len(qsubs) > 0 && matchLiteral(string(queue), string(qsubs[0].queue)) {
+			return true
+		}
+	}
+	return false
+}
+
+// canSubscribe returns true if the subscription to the subject, in the
+// queue if any, is allowed and not denied.
+func (p *permissions) canSubscribe(subject, queue []byte) bool {
+	return matchPerm(p.sub, subject, queue) && !matchPerm(p.subDeny, subject, queue)
+}
+
+// canPublish returns true if publishing to the subject is allowed and
+// not denied. Only called from the readLoop.
+func (p *permissions) canPublish(subject string) bool {
+	allowed, ok := p.pcache[subject]
+	if ok {
+		return allowed
+	}
+	allowed = matchPerm(p.pub, []byte(subject), nil) && !matchPerm(p.pubDeny, []byte(subject), nil)
+	p.pcache[subject] = allowed
+	// Prune if needed. Keeps us from unbounded growth.
+	if len(p.pcache) > maxPermCacheSize {
+		r := 0
+		for subject := range p.pcache {
+			delete(p.pcache, subject)
+			r++
+			if r > pruneSize {
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+// canDeliver returns true if the messages on the subject can be
+// delivered, they may match a subscription with wildcards on denied
+// subjects. Client lock should be held.
+func (p *permissions) canDeliver(subject []byte) bool {
+	if p.subDeny == nil {
+		return true
+	}
+	denied, ok := p.dcache[string(subject)]
+	if !ok {
+		denied = matchPerm(p.subDeny, subject, nil)
+		if len(p.dcache) > maxPermCacheSize {
+			for s := range p.dcache {
+				delete(p.dcache, s)
+			}
+		}
+		p.dcache[string(subject)] = denied
+	}
+	return !denied
+}
+
+// addResponse allows publishing to the reply subject of a request the
+// client receives. Client lock should be held.
+func (p *permissions) addResponse(reply []byte) {
+	now := time.Now()
+	if len(p.replies) >= maxResponsesSize {
+		for r, ar := range p.replies {
+			if now.After(ar.expires) {
+				delete(p.replies, r)
+			}
+		}
+		if len(p.replies) >= maxResponsesSize {
+			return
+		}
+	}
+	p.replies[string(reply)] = &allowedResponse{expires: now.Add(p.resp.Expires)}
+}
+
+// useResponse returns true if the client can publish to the reply
+// subject, and counts the response. Client lock should be held.
+func (p *permissions) useResponse(subject string) bool {
+	ar, ok := p.replies[subject]
+	if !ok {
+		return false
+	}
+	if time.Now().After(ar.expires) {
+		delete(p.replies, subject)
+		return false
+	}
+	ar.n++
+	if ar.n >= p.resp.MaxMsgs {
+		delete(p.replies, subject)
+	}
+	return true
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// queuePolicy selects the member of a queue group a message is
+// delivered to. The policy of a group is configured on the server
+// for its queue name, or signalled by its members in their SUB with
+// a suffix to the queue name, e.g. "SUB foo workers:round_robin 1".
+type queuePolicy uint8
+
+const (
+	// The member did not signal a policy.
+	queueUnset queuePolicy = iota
+	// A member picked at random.
+	queueRandom
+	// Members in turn.
+	queueRoundRobin
+	// The member with the least bytes waiting to be written.
+	queueLeastPending
+	// A member connected to this server, if any, the default.
+	queuePreferLocal
+	// The same member for a given subject.
+	queueSticky
+)
+
+var queuePolicies = map[string]queuePolicy{
+	"random":        queueRandom,
+	"round_robin":   queueRoundRobin,
+	"least_pending": queueLeastPending,
+	"prefer_local":  queuePreferLocal,
+	"sticky":        queueSticky,
+}
+
+func (p queuePolicy) String() string {
+	for name, qp := range queuePolicies {
+		if qp == p {
+			return name
+		}
+	}
+	return ""
+}
+
+// splitQueuePolicy splits the policy signalled in the queue name of a
+// SUB. Suffixes that are not a known policy are part of the name.
+func splitQueuePolicy(queue []byte) ([]byte, queuePolicy) {
+	i := bytes.LastIndexByte(queue, ':')
+	if i <= 0 {
+		return queue, queueUnset
+	}
+	p, ok := queuePolicies[string(queue[i+1:])]
+	if !ok {
+		return queue, queueUnset
+	}
+	return queue[:i], p
+}
+
+// queueArg returns the queue name sent in the SUB protocols to routes
+// and leaf nodes, with the policy signalled by the subscriber.
+func (sub *subscription) queueArg() []byte {
+	if sub.policy == queueUnset {
+		return sub.queue
+	}
+	return []byte(fmt.Sprintf("%s:%s", sub.queue, sub.policy))
+}
+
+// validateQueuePolicies checks the policies configured for queue groups.
+func validateQueuePolicies(opts *Options) error {
+	for queue, name := range opts.QueuePolicies {
+		if _, ok := queuePolicies[name]; !ok {
+			return fmt.Errorf("Unknown policy %q for queue group %q", name, queue)
+		}
+	}
+	return nil
+}
+
+// configureQueuePolicies sets the policies configured for queue groups.
+func (s *Server) configureQueuePolicies() {
+	policies := make(map[string]queuePolicy)
+	for queue, name := range s.getOpts().QueuePolicies {
+		if p, ok := queuePolicies[name]; ok {
+			policies[queue] = p
+		} else {
+			Errorf("Unknown policy %q for queue group %q", name, queue)
+		}
+	}
+	s.queuePolicies.Store(policies)
+}
+
+// memberPolicy returns the policy of the queue group of the member:
+// the one configured for the queue name, else the one it signalled.
+func (s *Server) memberPolicy(sub *subscription) queuePolicy {
+	policies, _ := s.queuePolicies.Load().(map[string]queuePolicy)
+	if p, ok := policies[string(sub.queue)]; ok {
+		return p
+	}
+	return sub.policy
+}
+
+// groupPolicy returns the policy of a queue group: the one configured
+// for the queue name, else the first one signalled by a member. Local
+// members are preferred by default.
+func (s *Server) groupPolicy(qsubs []*subscription) queuePolicy {
+	if p := s.memberPolicy(qsubs[0]); p != queueUnset {
+		return p
+	}
+	for _, sub := range qsubs[1:] {
+		if sub.policy != queueUnset {
+			return sub.policy
+		}
+	}
+	return queuePreferLocal
+}
+
+// pickQueueSub returns the member of the queue group the message
+// being processed is delivered to.
+func (c *client) pickQueueSub(qsubs []*subscription) *subscription {
+	// Check to see if we have our own rand yet. Global rand
+	// has contention with lots of clients, etc.
+	if c.cache.prand == nil {
+		c.cache.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	switch c.srv.groupPolicy(qsubs) {
+	case queueRoundRobin:
+		if qturn := qsubs[0].qturn; qturn != nil {
+			n := atomic.AddUint64(qturn, 1) - 1
+			return qsubs[n%uint64(len(qsubs))]
+		}
+	case queueLeastPending:
+		// Start at a random member so that idle members share the load.
+		// Remote members are as loaded as their route or leaf node.
+		var least *subscription
+		var pb int64
+		start := c.cache.prand.Intn(len(qsubs))
+		for i := range qsubs {
+			sub := qsubs[(start+i)%len(qsubs)]
+			sub.client.mu.Lock()
+			sp := sub.client.out.pb
+			sub.client.mu.Unlock()
+			if least == nil || sp < pb {
+				least, pb = sub, sp
+			}
+		}
+		return least
+	case queuePreferLocal:
+		var local []*subscription
+		for _, sub := range qsubs {
+			if sub.client.typ != ROUTER && sub.client.typ != LEAF {
+				local = append(local, sub)
+			}
+		}
+		if len(local) > 0 {
+			return local[c.cache.prand.Intn(len(local))]
+		}
+	case queueSticky:
+		h := fnv.New32a()
+		h.Write(c.pa.subject)
+		return qsubs[h.Sum32()%uint32(len(qsubs))]
+	}
+	return qsubs[c.cache.prand.Intn(len(qsubs))]
+}
+
+// How long the queue group of a member that left is remembered, so
+// that the messages in flight to it are delivered to another member.
+const departedTTL = 5 * time.Second
+
+// departedMember is a queue group member that left.
+type departedMember struct {
+	queue   []byte
+	expires time.Time
+}
+
+// addDeparted remembers the queue group of a member that left, by the
+// sid other servers use to deliver messages to it.
+func (a *Account) addDeparted(sub *subscription) {
+	now := time.Now()
+	a.mu.Lock()
+	if now.After(a.nextDepartedPrune) {
+		for rsid, dm := range a.departed {
+			if now.After(dm.expires) {
+				delete(a.departed, rsid)
+			}
+		}
+		a.nextDepartedPrune = now.Add(departedTTL)
+	}
+	a.departed[leafSid(sub)] = departedMember{queue: sub.queue, expires: now.Add(departedTTL)}
+	a.mu.Unlock()
+}
+
+// departedQueue returns the queue group of the member that left.
+func (a *Account) departedQueue(rsid []byte) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if dm, ok := a.departed[string(rsid)]; ok && time.Now().Before(dm.expires) {
+		return dm.queue
+	}
+	return nil
+}
+
+// replacementQueueSub returns another member of the queue group for the
+// message being processed, sent by a route or leaf node to a member that
+// has left. Members reached through routes are only used for messages
+// from leaf nodes, so that messages are not routed twice.
+func (c *client) replacementQueueSub(acc *Account, r *SublistResult) *subscription {
+	_, rsid := routeSidAccount(c.pa.sid)
+	queue := acc.departedQueue(rsid)
+	if queue == nil {
+		return nil
+	}
+	for _, qsubs := range r.qsubs {
+		if len(qsubs) == 0 || !bytes.Equal(qsubs[0].queue, queue) {
+			continue
+		}
+		var members []*subscription
+		for _, sub := range qsubs {
+			if sub.client != c && (c.typ != ROUTER || sub.client.typ != ROUTER) {
+				members = append(members, sub)
+			}
+		}
+		if len(members) > 0 {
+			return c.pickQueueSub(members)
+		}
+	}
+	return nil
+}
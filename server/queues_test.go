@@ -0,0 +1,144 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQueuePolicyConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/queues.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := map[string]string{"workers": "round_robin", "orders.eu": "sticky"}
+	if !reflect.DeepEqual(opts.QueuePolicies, expected) {
+		t.Fatalf("Unexpected queue policies: %v", opts.QueuePolicies)
+	}
+
+	f, err := ioutil.TempFile("", "gnatsd_queues_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("queue_policies { workers: fastest }\n")
+	f.Close()
+	if _, err := ProcessConfigFile(f.Name()); err == nil || !strings.Contains(err.Error(), "fastest") {
+		t.Fatalf("Expected an error for an unknown policy, got %v", err)
+	}
+}
+
+func TestSplitQueuePolicy(t *testing.T) {
+	cases := []struct {
+		arg, queue string
+		policy     queuePolicy
+	}{
+		{"workers", "workers", queueUnset},
+		{"workers:round_robin", "workers", queueRoundRobin},
+		{"workers:least_pending", "workers", queueLeastPending},
+		{"a:b:sticky", "a:b", queueSticky},
+		{"workers:fastest", "workers:fastest", queueUnset},
+		{":random", ":random", queueUnset},
+	}
+	for _, c := range cases {
+		queue, policy := splitQueuePolicy([]byte(c.arg))
+		if string(queue) != c.queue || policy != c.policy {
+			t.Fatalf("Expected %q to be split in %q and %v, got %q and %v",
+				c.arg, c.queue, c.policy, queue, policy)
+		}
+		sub := &subscription{queue: queue, policy: policy}
+		if c.policy != queueUnset && string(sub.queueArg()) != c.arg {
+			t.Fatalf("Expected queue argument %q, got %q", c.arg, sub.queueArg())
+		}
+	}
+}
+
+func newQueueGroup(s *Server, queue string, typs ...int) []*subscription {
+	var qsubs []*subscription
+	sl := NewSublist()
+	for _, typ := range typs {
+		sub := &subscription{
+			client:  &client{srv: s, typ: typ},
+			acc:     s.gacc,
+			subject: []byte("foo"),
+			queue:   []byte(queue),
+		}
+		sl.Insert(sub)
+		qsubs = append(qsubs, sub)
+	}
+	return qsubs
+}
+
+func TestPickQueueSub(t *testing.T) {
+	s := New(&Options{QueuePolicies: map[string]string{"workers": "round_robin"}})
+	c := &client{srv: s, typ: CLIENT}
+	c.pa.subject = []byte("foo")
+
+	// Configured on the server.
+	qsubs := newQueueGroup(s, "workers", CLIENT, CLIENT, ROUTER)
+	for i := 0; i < 6; i++ {
+		if sub := c.pickQueueSub(qsubs); sub != qsubs[i%3] {
+			t.Fatalf("Expected member %d in turn", i%3)
+		}
+	}
+
+	// Signalled by a member.
+	qsubs = newQueueGroup(s, "local", ROUTER, CLIENT, LEAF)
+	qsubs[2].policy = queuePreferLocal
+	for i := 0; i < 10; i++ {
+		if sub := c.pickQueueSub(qsubs); sub != qsubs[1] {
+			t.Fatal("Expected the local member")
+		}
+	}
+
+	qsubs = newQueueGroup(s, "pending", CLIENT, CLIENT, CLIENT)
+	qsubs[0].policy = queueLeastPending
+	qsubs[0].client.out.pb = 100
+	qsubs[1].client.out.pb = 10
+	qsubs[2].client.out.pb = 1000
+	for i := 0; i < 10; i++ {
+		if sub := c.pickQueueSub(qsubs); sub != qsubs[1] {
+			t.Fatal("Expected the member with the least pending bytes")
+		}
+	}
+
+	qsubs = newQueueGroup(s, "sticky", CLIENT, CLIENT, CLIENT, CLIENT)
+	qsubs[0].policy = queueSticky
+	picked := make(map[string]*subscription)
+	for i := 0; i < 100; i++ {
+		for _, subject := range []string{"foo.a", "foo.b", "foo.c"} {
+			c.pa.subject = []byte(subject)
+			sub := c.pickQueueSub(qsubs)
+			if p, ok := picked[subject]; ok && p != sub {
+				t.Fatalf("Expected the same member for %q", subject)
+			}
+			picked[subject] = sub
+		}
+	}
+}
+
+func TestQueueTurnsReleased(t *testing.T) {
+	sl := NewSublist()
+	newSub := func() *subscription {
+		return &subscription{subject: []byte("foo"), queue: []byte("workers")}
+	}
+	a, b := newSub(), newSub()
+	sl.Insert(a)
+	sl.Insert(b)
+	if a.qturn == nil || a.qturn != b.qturn {
+		t.Fatal("Expected the members to share the turns of the group")
+	}
+	sl.Remove(a)
+	sl.Remove(b)
+
+	// The turns go away with the last member.
+	c := newSub()
+	sl.Insert(c)
+	if c.qturn == a.qturn {
+		t.Fatal("Expected new turns for a new group")
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrNoConfigFile is returned when a reload is requested for a server
+// that was not started from a configuration file.
+var ErrNoConfigFile = errors.New("no configuration file to reload")
+
+// AuthConfigurer sets up client and route authentication from the given
+// options. It is called again on configuration reload so that user and
+// permission changes apply to the running server.
+type AuthConfigurer func(s *Server, opts *Options)
+
+// SetAuthConfigurer sets the function used to rebuild the authentication
+// methods on configuration reload.
+func (s *Server) SetAuthConfigurer(f AuthConfigurer) {
+	s.mu.Lock()
+	s.configureAuth = f
+	s.mu.Unlock()
+}
+
+// How a changed option is applied to the running server.
+type reloadAction int
+
+const (
+	// The new value is picked up the next time it is used.
+	reloadNone reloadAction = iota
+	reloadLogger
+	reloadAuth
+	reloadMaxPayload
+	reloadMaxPending
+	reloadRoutes
+	reloadMappings
+	reloadQueuePolicies
+	reloadMsgTraces
+	reloadAccept
+	reloadAudit
+)
+
+// Options that can be changed without a restart. Any other change in
+// the configuration file rejects the reload as a whole.
+var reloadableOptions = map[string]reloadAction{
+	"Trace":          reloadLogger,
+	"Debug":          reloadLogger,
+	"Logtime":        reloadLogger,
+	"LogFile":        reloadLogger,
+	"Syslog":         reloadLogger,
+	"RemoteSyslog":   reloadLogger,
+	"Username":       reloadAuth,
+	"Password":       reloadAuth,
+	"Authorization":  reloadAuth,
+	"Users":          reloadAuth,
+	"AuthCallout":    reloadAuth,
+	"JWT":            reloadAuth,
+	"TLSMap":         reloadAuth,
+	"AuthTimeout":    reloadNone,
+	"MaxPayload":     reloadMaxPayload,
+	"MaxPending":     reloadMaxPending,
+	"MaxControlLine": reloadNone,
+	"MaxConn":        reloadNone,
+	"PingInterval":   reloadNone,
+	"MaxPingsOut":    reloadNone,
+	"WriteDeadline":  reloadNone,
+	"Routes":         reloadRoutes,
+	"Mappings":       reloadMappings,
+	"QueuePolicies":  reloadQueuePolicies,
+	"TraceSubjects":  reloadMsgTraces,
+	"ClientAccept":   reloadAccept,
+	"ClusterAccept":  reloadAccept,
+	"HTTPAccept":     reloadAccept,
+	"Audit":          reloadAudit,
+
+	"LameDuckDuration": reloadNone,
+}
+
+// Reload reads the configuration file again and applies the settings
+// that changed since it was last read. Only the settings that changed
+// in the file are applied, so command line flags overriding unchanged
+// settings stay in effect. If any changed setting can not be applied
+// to a running server, nothing is changed and an error is returned.
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	curOpts := s.getOpts()
+	if curOpts.ConfigFile == "" {
+		return ErrNoConfigFile
+	}
+	fileOpts, err := ProcessConfigFile(curOpts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	oldFileOpts := s.configOpts
+	if oldFileOpts == nil {
+		oldFileOpts = &Options{}
+	}
+	changed, err := diffOptions(oldFileOpts, fileOpts)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		Noticef("Configuration reloaded, no changes")
+		return nil
+	}
+
+	// Build the new options from the running ones.
+	newOpts := *curOpts
+	nv := reflect.ValueOf(&newOpts).Elem()
+	fv := reflect.ValueOf(fileOpts).Elem()
+	actions := make(map[reloadAction]bool)
+	for _, name := range changed {
+		nv.FieldByName(name).Set(fv.FieldByName(name))
+		actions[reloadableOptions[name]] = true
+	}
+	if actions[reloadRoutes] {
+		routes, err := RemoveSelfReference(newOpts.Cluster.Port, newOpts.Routes)
+		if err != nil {
+			return err
+		}
+		newOpts.Routes = routes
+	}
+	processOptions(&newOpts)
+
+	s.optsMu.Lock()
+	s.opts = &newOpts
+	s.configOpts = fileOpts
+	s.optsMu.Unlock()
+
+	if actions[reloadLogger] {
+		if newOpts.NoLog {
+			s.setLogFlags(newOpts.Debug, newOpts.Trace)
+		} else {
+			s.ConfigureLogger()
+		}
+	}
+	if actions[reloadAuth] {
+		s.reloadAuthorization()
+	}
+	if actions[reloadMaxPayload] {
+		s.reloadMaxPayload()
+	}
+	if actions[reloadMaxPending] {
+		s.reloadMaxPending()
+	}
+	if actions[reloadRoutes] {
+		s.reloadRoutes(curOpts.Routes, newOpts.Routes)
+	}
+	if actions[reloadMappings] {
+		s.configureMappings()
+	}
+	if actions[reloadQueuePolicies] {
+		s.configureQueuePolicies()
+	}
+	if actions[reloadMsgTraces] {
+		s.configureMsgTraces()
+	}
+	if actions[reloadAccept] {
+		s.configureAccept()
+	}
+	if actions[reloadAudit] {
+		s.configureAudit()
+	}
+
+	Noticef("Configuration reloaded, changed: %s", strings.Join(changed, ", "))
+	return nil
+}
+
+// diffOptions returns the names of the options that differ, or an
+// error for the first one that can not be changed on reload.
+func diffOptions(oldOpts, newOpts *Options) ([]string, error) {
+	var changed []string
+	ov := reflect.ValueOf(oldOpts).Elem()
+	nv := reflect.ValueOf(newOpts).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+		if optionEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if _, ok := reloadableOptions[name]; !ok {
+			return nil, fmt.Errorf("config option %q can not be changed on reload", name)
+		}
+		changed = append(changed, name)
+	}
+	return changed, nil
+}
+
+// optionEqual compares option values. TLS configurations are rebuilt on
+// every parse, so they are compared on their settings only.
+func optionEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case *tls.Config:
+		return tlsConfigEqual(av, b.(*tls.Config))
+	case ClusterOpts:
+		bv := b.(ClusterOpts)
+		if !tlsConfigEqual(av.TLSConfig, bv.TLSConfig) {
+			return false
+		}
+		av.TLSConfig, bv.TLSConfig = nil, nil
+		return reflect.DeepEqual(av, bv)
+	case []*ListenerOpts:
+		bv := b.([]*ListenerOpts)
+		if len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			al, bl := *av[i], *bv[i]
+			if !tlsConfigEqual(al.TLSConfig, bl.TLSConfig) {
+				return false
+			}
+			al.TLSConfig, bl.TLSConfig = nil, nil
+			if !reflect.DeepEqual(al, bl) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func tlsConfigEqual(a, b *tls.Config) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.ClientAuth != b.ClientAuth ||
+		a.MinVersion != b.MinVersion ||
+		a.InsecureSkipVerify != b.InsecureSkipVerify ||
+		!reflect.DeepEqual(a.CipherSuites, b.CipherSuites) ||
+		!reflect.DeepEqual(a.CurvePreferences, b.CurvePreferences) ||
+		len(a.Certificates) != len(b.Certificates) {
+		return false
+	}
+	for i := range a.Certificates {
+		if !reflect.DeepEqual(a.Certificates[i].Certificate, b.Certificates[i].Certificate) {
+			return false
+		}
+	}
+	if (a.ClientCAs == nil) != (b.ClientCAs == nil) {
+		return false
+	}
+	return a.ClientCAs == nil || a.ClientCAs.Equal(b.ClientCAs)
+}
+
+// setLogFlags updates the debug and trace flags without
+// replacing the logger.
+func (s *Server) setLogFlags(debugFlag, traceFlag bool) {
+	log.Lock()
+	l := log.logger
+	log.Unlock()
+	s.SetLogger(l, debugFlag, traceFlag)
+}
+
+// reloadAuthorization rebuilds the authentication methods and checks
+// every connected client against them. Clients that no longer pass are
+// disconnected, subscriptions no longer permitted are removed.
+func (s *Server) reloadAuthorization() {
+	s.mu.Lock()
+	configureAuth := s.configureAuth
+	s.mu.Unlock()
+	if configureAuth == nil {
+		Errorf("Authorization changed on reload, but no authentication configurer is set")
+		return
+	}
+	s.loadRevocations()
+	s.startRevocationsLoop()
+	configureAuth(s, s.getOpts())
+	s.recheckClientAuth()
+}
+
+// recheckClientAuth authorizes the connected clients again, the ones
+// no longer authorized are disconnected. Leaf nodes accepted by this
+// server are authorized as users, so they are checked as well.
+func (s *Server) recheckClientAuth() {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients)+len(s.leafs))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	for _, l := range s.leafs {
+		if l.leaf.remote == nil {
+			clients = append(clients, l)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		if !s.checkClientAuth(c) || c.accountChanged() {
+			c.authWithdrawn()
+			continue
+		}
+		c.removeUnauthorizedSubs()
+	}
+}
+
+// accountChanged returns true if the user of the client
+// is now bound to another account.
+func (c *client) accountChanged() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flags.isSet(accountChanged)
+}
+
+// removeUnauthorizedSubs removes the subscriptions the client is
+// no longer allowed to have after a permissions change.
+func (c *client) removeUnauthorizedSubs() {
+	c.mu.Lock()
+	if c.perms == nil {
+		c.mu.Unlock()
+		return
+	}
+	var removed []*subscription
+	for _, sub := range c.subs {
+		if !c.perms.canSubscribe(sub.subject, sub.queue) {
+			removed = append(removed, sub)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, sub := range removed {
+		c.sendErr(fmt.Sprintf("Permissions Violation for Subscription to %q", sub.subject))
+		c.mu.Lock()
+		sub.max = 0
+		c.mu.Unlock()
+		c.unsubscribe(sub)
+		c.srv.broadcastUnSubscribe(sub)
+	}
+}
+
+// reloadMaxPayload updates the max payload advertised to and
+// enforced on clients.
+func (s *Server) reloadMaxPayload() {
+	mpay := s.getOpts().MaxPayload
+
+	s.mu.Lock()
+	s.info.MaxPayload = mpay
+	s.generateServerInfoJSON()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		atomic.StoreInt32(&c.mpay, int32(mpay))
+	}
+	s.sendAsyncInfoToClients()
+}
+
+// reloadMaxPending applies the new limit of pending bytes to the
+// connected clients, routes and leaf nodes.
+func (s *Server) reloadMaxPending() {
+	mp := s.getOpts().MaxPending
+
+	s.mu.Lock()
+	conns := make([]*client, 0, len(s.clients)+len(s.routes)+len(s.leafs))
+	for _, c := range s.clients {
+		conns = append(conns, c)
+	}
+	for _, r := range s.routes {
+		conns = append(conns, r)
+	}
+	for _, l := range s.leafs {
+		conns = append(conns, l)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		c.out.mp = mp
+		c.mu.Unlock()
+	}
+}
+
+// reloadRoutes connects to the routes added to the configuration and
+// closes the explicit routes that were removed from it.
+func (s *Server) reloadRoutes(oldRoutes, newRoutes []*url.URL) {
+	if s.getOpts().Cluster.Port == 0 {
+		return
+	}
+	oldURLs := make(map[string]bool, len(oldRoutes))
+	for _, u := range oldRoutes {
+		oldURLs[u.String()] = true
+	}
+	newURLs := make(map[string]bool, len(newRoutes))
+	for _, u := range newRoutes {
+		newURLs[u.String()] = true
+	}
+
+	s.mu.Lock()
+	var removed []*client
+	for _, r := range s.routes {
+		r.mu.Lock()
+		if r.route.url != nil && r.route.didSolicit &&
+			oldURLs[r.route.url.String()] && !newURLs[r.route.url.String()] {
+			// Make sure it is not reconnected once closed.
+			r.route.routeType = Implicit
+			r.route.retry = false
+			removed = append(removed, r)
+		}
+		r.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	for _, r := range removed {
+		r.Noticef("Removing route, no longer configured")
+		r.closeConnection()
+	}
+
+	for _, u := range newRoutes {
+		if !oldURLs[u.String()] {
+			rURL := u
+			s.startGoRoutine(func() { s.connectToRoute(rURL, true) })
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffOptionsSameFile(t *testing.T) {
+	for _, conf := range []string{"./configs/test.conf", "./configs/tls.conf", "./configs/srv_a.conf"} {
+		o1, err := ProcessConfigFile(conf)
+		if err != nil {
+			t.Fatalf("Received an error reading config file: %v", err)
+		}
+		o2, _ := ProcessConfigFile(conf)
+		changed, err := diffOptions(o1, o2)
+		if err != nil || len(changed) != 0 {
+			t.Fatalf("Expected no changes for %q, got %v, %v", conf, changed, err)
+		}
+	}
+}
+
+func TestDiffOptions(t *testing.T) {
+	o1, _ := ProcessConfigFile("./configs/test.conf")
+	o2, _ := ProcessConfigFile("./configs/test.conf")
+
+	o2.Debug = !o2.Debug
+	o2.MaxPayload = o1.MaxPayload + 1
+	changed, err := diffOptions(o1, o2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(changed, []string{"Debug", "MaxPayload"}) {
+		t.Fatalf("Unexpected changes: %v", changed)
+	}
+
+	o2.Port = o1.Port + 1
+	if _, err := diffOptions(o1, o2); err == nil {
+		t.Fatal("Expected an error for a port change")
+	}
+}
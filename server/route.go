@@ -3,7 +3,6 @@
 package server
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
@@ -47,6 +46,7 @@ type connectInfo struct {
 	Pass     string `json:"pass,omitempty"`
 	TLS      bool   `json:"tls_required"`
 	Name     string `json:"name"`
+	Headers  bool   `json:"headers"`
 }
 
 // Route protocol constants
@@ -69,6 +69,7 @@ func (c *client) sendConnect(tlsRequired bool) {
 		Pass:     pass,
 		TLS:      tlsRequired,
 		Name:     c.srv.info.ID,
+		Headers:  true,
 	}
 	b, err := json.Marshal(cinfo)
 	if err != nil {
@@ -117,6 +118,8 @@ func (c *client) processRouteInfo(info *Info) {
 	// Copy over important information.
 	c.route.authRequired = info.AuthRequired
 	c.route.tlsRequired = info.TLSRequired
+	// Routes that do not know about headers get plain MSGs.
+	c.headers = info.Headers
 
 	// If we do not know this route's URL, construct one on the fly
 	// from the information provided.
@@ -176,9 +179,6 @@ func (s *Server) sendAsyncInfoToClients() {
 		return
 	}
 
-	// Capture under lock
-	proto := s.infoJSON
-
 	// Make a copy of ALL clients so we can release server lock while
 	// sending the protocol to clients. We could check the conditions
 	// (proto support, first PONG sent) here and so have potentially
@@ -186,12 +186,14 @@ func (s *Server) sendAsyncInfoToClients() {
 	// client's lock here, which we don't want since we would still
 	// need it in the second loop.
 	clients := make([]*client, 0, len(s.clients))
+	protos := make([][]byte, 0, len(s.clients))
 	for _, c := range s.clients {
 		clients = append(clients, c)
+		protos = append(protos, s.clientInfoJSON(c))
 	}
 	s.mu.Unlock()
 
-	for _, c := range clients {
+	for i, c := range clients {
 		c.mu.Lock()
 		// If server did not yet receive the CONNECT protocol, check later
 		// when sending the first PONG.
@@ -202,7 +204,7 @@ func (s *Server) sendAsyncInfoToClients() {
 			if c.flags.isSet(firstPongSent) {
 				// sendInfo takes care of checking if the connection is still
 				// valid or not, so don't duplicate tests here.
-				c.sendInfo(proto)
+				c.sendInfo(protos[i])
 			} else {
 				// Otherwise, notify that INFO has changed and check later.
 				c.flags.set(infoUpdated)
@@ -241,7 +243,7 @@ func (s *Server) processImplicitRoute(info *Info) {
 		return
 	}
 	if info.AuthRequired {
-		r.User = url.UserPassword(s.opts.Cluster.Username, s.opts.Cluster.Password)
+		r.User = url.UserPassword(s.getOpts().Cluster.Username, s.getOpts().Cluster.Password)
 	}
 	s.startGoRoutine(func() { s.connectToRoute(r, false) })
 }
@@ -251,7 +253,7 @@ func (s *Server) processImplicitRoute(info *Info) {
 // Server lock is assumed to be held by caller.
 func (s *Server) hasThisRouteConfigured(info *Info) bool {
 	urlToCheckExplicit := strings.ToLower(net.JoinHostPort(info.Host, strconv.Itoa(info.Port)))
-	for _, ri := range s.opts.Routes {
+	for _, ri := range s.getOpts().Routes {
 		if strings.ToLower(ri.Host) == urlToCheckExplicit {
 			return true
 		}
@@ -283,8 +285,7 @@ func (s *Server) forwardNewRouteInfoToKnownServers(info *Info) {
 // and large subscription space. Plus buffering in place not a good idea.
 func (s *Server) sendLocalSubsToRoute(route *client) {
 	b := bytes.Buffer{}
-	s.mu.Lock()
-	for _, client := range s.clients {
+	addSubs := func(client *client) {
 		client.mu.Lock()
 		subs := make([]*subscription, 0, len(client.subs))
 		for _, sub := range client.subs {
@@ -293,10 +294,22 @@ func (s *Server) sendLocalSubsToRoute(route *client) {
 		client.mu.Unlock()
 		for _, sub := range subs {
 			rsid := routeSid(sub)
-			proto := fmt.Sprintf(subProto, sub.subject, sub.queue, rsid)
+			proto := fmt.Sprintf(subProto, sub.subject, sub.queueArg(), rsid)
 			b.WriteString(proto)
 		}
 	}
+	s.mu.Lock()
+	for _, client := range s.clients {
+		addSubs(client)
+	}
+	// Subscriptions of leaf nodes are reachable through this server.
+	for _, leaf := range s.leafs {
+		addSubs(leaf)
+	}
+	// The system client answers requests from the whole cluster.
+	if s.sys != nil {
+		addSubs(s.sys.client)
+	}
 	s.mu.Unlock()
 
 	route.mu.Lock()
@@ -309,13 +322,13 @@ func (s *Server) sendLocalSubsToRoute(route *client) {
 func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	didSolicit := rURL != nil
 	r := &route{didSolicit: didSolicit}
-	for _, route := range s.opts.Routes {
+	for _, route := range s.getOpts().Routes {
 		if rURL != nil && (strings.ToLower(rURL.Host) == strings.ToLower(route.Host)) {
 			r.routeType = Explicit
 		}
 	}
 
-	c := &client{srv: s, nc: conn, opts: clientOpts{}, typ: ROUTER, route: r}
+	c := &client{srv: s, nc: conn, opts: clientOpts{}, typ: ROUTER, route: r, acc: s.gacc}
 
 	// Grab server variables
 	s.mu.Lock()
@@ -341,7 +354,7 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	// Check for TLS
 	if tlsRequired {
 		// Copy off the config to add in ServerName if we
-		tlsConfig := util.CloneTLSConfig(s.opts.Cluster.TLSConfig)
+		tlsConfig := util.CloneTLSConfig(s.getOpts().Cluster.TLSConfig)
 
 		// If we solicited, we will act like the client, otherwise the server.
 		if didSolicit {
@@ -358,7 +371,7 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 		conn := c.nc.(*tls.Conn)
 
 		// Setup the timeout
-		ttl := secondsToDuration(s.opts.Cluster.TLSTimeout)
+		ttl := secondsToDuration(s.getOpts().Cluster.TLSTimeout)
 		time.AfterFunc(ttl, func() { tlsTimeout(c, conn) })
 		conn.SetReadDeadline(time.Now().Add(ttl))
 
@@ -380,9 +393,6 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 			c.mu.Unlock()
 			return nil
 		}
-
-		// Rewrap bw
-		c.bw = bufio.NewWriterSize(c.nc, startBufSize)
 	}
 
 	// Do final client initialization
@@ -400,8 +410,9 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	s.grTmpClients[c.cid] = c
 	s.grMu.Unlock()
 
-	// Spin up the read loop.
+	// Spin up the read and write loops.
 	s.startGoRoutine(func() { c.readLoop() })
+	s.startGoRoutine(func() { c.writeLoop() })
 
 	if tlsRequired {
 		c.Debugf("TLS handshake complete")
@@ -420,7 +431,7 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 
 	// Check for Auth required state for incoming connections.
 	if authRequired && !didSolicit {
-		ttl := secondsToDuration(s.opts.Cluster.AuthTimeout)
+		ttl := secondsToDuration(s.getOpts().Cluster.AuthTimeout)
 		c.setAuthTimer(ttl)
 	}
 
@@ -456,6 +467,7 @@ const (
 var qrsidRe = regexp.MustCompile(`QRSID:(\d+):([^\s]+)`)
 
 func (s *Server) routeSidQueueSubscriber(rsid []byte) (*subscription, bool) {
+	_, rsid = routeSidAccount(rsid)
 	if !bytes.HasPrefix(rsid, []byte(QRSID)) {
 		return nil, false
 	}
@@ -465,8 +477,17 @@ func (s *Server) routeSidQueueSubscriber(rsid []byte) (*subscription, bool) {
 	}
 	cid := uint64(parseInt64(matches[RSID_CID_INDEX]))
 
+	// Queue subscriptions of routes are only sent to leaf nodes, and
+	// those of leaf nodes to routes and other leaf nodes, the message
+	// is then delivered through them.
 	s.mu.Lock()
 	client := s.clients[cid]
+	if client == nil {
+		client = s.routes[cid]
+	}
+	if client == nil {
+		client = s.leafs[cid]
+	}
 	s.mu.Unlock()
 
 	if client == nil {
@@ -483,12 +504,14 @@ func (s *Server) routeSidQueueSubscriber(rsid []byte) (*subscription, bool) {
 	return nil, true
 }
 
+// routeSid returns the sid used for the subscription on routes. It is
+// prefixed with '$' and the account name for accounts other than the
+// global one, e.g. "$acme:RSID:12:1".
 func routeSid(sub *subscription) string {
-	var qi string
-	if len(sub.queue) > 0 {
-		qi = "Q"
+	if sub.acc != nil && !sub.acc.isGlobal() {
+		return fmt.Sprintf("$%s:%s", sub.acc.Name, leafSid(sub))
 	}
-	return fmt.Sprintf("%s%s:%d:%s", qi, RSID, sub.client.cid, sub.sid)
+	return leafSid(sub)
 }
 
 func (s *Server) addRoute(c *client, info *Info) (bool, bool) {
@@ -527,6 +550,10 @@ func (s *Server) addRoute(c *client, info *Info) (bool, bool) {
 	}
 	s.mu.Unlock()
 
+	if !exists {
+		s.sendRouteEvent(EventRouteConnect, c)
+	}
+
 	if exists && c.route.didSolicit {
 		// upgrade to solicited?
 		remote.mu.Lock()
@@ -552,30 +579,28 @@ func (s *Server) broadcastInterestToRoutes(proto string) {
 		// FIXME(dlc) - Make same logic as deliverMsg
 		route.mu.Lock()
 		route.sendProto(protoAsBytes, true)
-		route.mu.Unlock()
 		route.traceOutOp("", arg)
+		route.mu.Unlock()
 	}
 	s.mu.Unlock()
 }
 
-// broadcastSubscribe will forward a client subscription
-// to all active routes.
+// broadcastSubscribe will forward a subscription to the leaf nodes
+// and, unless it is a subscription of a route, to all active routes.
 func (s *Server) broadcastSubscribe(sub *subscription) {
-	if s.numRoutes() == 0 {
+	subProtoFor := func(rsid string) string {
+		return fmt.Sprintf(subProto, sub.subject, sub.queueArg(), rsid)
+	}
+	s.broadcastInterestToLeafs(sub, subProtoFor)
+	if sub.client.typ == ROUTER || s.numRoutes() == 0 {
 		return
 	}
-	rsid := routeSid(sub)
-	proto := fmt.Sprintf(subProto, sub.subject, sub.queue, rsid)
-	s.broadcastInterestToRoutes(proto)
+	s.broadcastInterestToRoutes(subProtoFor(routeSid(sub)))
 }
 
-// broadcastUnSubscribe will forward a client unsubscribe
-// action to all active routes.
+// broadcastUnSubscribe will forward an unsubscribe action to the leaf
+// nodes and, unless it is a subscription of a route, to all active routes.
 func (s *Server) broadcastUnSubscribe(sub *subscription) {
-	if s.numRoutes() == 0 {
-		return
-	}
-	rsid := routeSid(sub)
 	maxStr := _EMPTY_
 	sub.client.mu.Lock()
 	// Set max if we have it set and have not tripped auto-unsubscribe
@@ -583,20 +608,27 @@ func (s *Server) broadcastUnSubscribe(sub *subscription) {
 		maxStr = fmt.Sprintf(" %d", sub.max)
 	}
 	sub.client.mu.Unlock()
-	proto := fmt.Sprintf(unsubProto, rsid, maxStr)
-	s.broadcastInterestToRoutes(proto)
+	unsubProtoFor := func(rsid string) string {
+		return fmt.Sprintf(unsubProto, rsid, maxStr)
+	}
+	s.broadcastInterestToLeafs(sub, unsubProtoFor)
+	if sub.client.typ == ROUTER || s.numRoutes() == 0 {
+		return
+	}
+	s.broadcastInterestToRoutes(unsubProtoFor(routeSid(sub)))
 }
 
 func (s *Server) routeAcceptLoop(ch chan struct{}) {
-	hp := net.JoinHostPort(s.opts.Cluster.Host, strconv.Itoa(s.opts.Cluster.Port))
+	hp := net.JoinHostPort(s.getOpts().Cluster.Host, strconv.Itoa(s.getOpts().Cluster.Port))
 	Noticef("Listening for route connections on %s", hp)
-	l, e := net.Listen("tcp", hp)
+	l, e := s.listen("tcp", hp)
 	if e != nil {
 		// We need to close this channel to avoid a deadlock
 		close(ch)
-		Fatalf("Error listening on router port: %d - %v", s.opts.Cluster.Port, e)
+		Fatalf("Error listening on router port: %d - %v", s.getOpts().Cluster.Port, e)
 		return
 	}
+	l = &gatedListener{Listener: l, name: acceptCluster, gate: &s.clusterGate}
 
 	// Setup state that can enable shutdown
 	s.mu.Lock()
@@ -649,21 +681,22 @@ func (s *Server) StartRouting(clientListenReady chan struct{}) {
 	clientConnectURLs := s.getClientConnectURLs()
 
 	// Check for TLSConfig
-	tlsReq := s.opts.Cluster.TLSConfig != nil
+	tlsReq := s.getOpts().Cluster.TLSConfig != nil
 	info := Info{
 		ID:                s.info.ID,
 		Version:           s.info.Version,
-		Host:              s.opts.Cluster.Host,
-		Port:              s.opts.Cluster.Port,
+		Host:              s.getOpts().Cluster.Host,
+		Port:              s.getOpts().Cluster.Port,
 		AuthRequired:      false,
 		TLSRequired:       tlsReq,
 		SSLRequired:       tlsReq,
 		TLSVerify:         tlsReq,
 		MaxPayload:        s.info.MaxPayload,
+		Headers:           true,
 		ClientConnectURLs: clientConnectURLs,
 	}
 	// Check for Auth items
-	if s.opts.Cluster.Username != "" {
+	if s.getOpts().Cluster.Username != "" || s.getOpts().Cluster.TLSMap {
 		info.AuthRequired = true
 	}
 	s.routeInfo = info
@@ -696,11 +729,11 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver bool) {
 		if err != nil {
 			Debugf("Error trying to connect to route: %v", err)
 			if !tryForEver {
-				if s.opts.Cluster.ConnectRetries <= 0 {
+				if s.getOpts().Cluster.ConnectRetries <= 0 {
 					return
 				}
 				attempts++
-				if attempts > s.opts.Cluster.ConnectRetries {
+				if attempts > s.getOpts().Cluster.ConnectRetries {
 					return
 				}
 			}
@@ -725,7 +758,7 @@ func (c *client) isSolicitedRoute() bool {
 }
 
 func (s *Server) solicitRoutes() {
-	for _, r := range s.opts.Routes {
+	for _, r := range s.getOpts().Routes {
 		route := r
 		s.startGoRoutine(func() { s.connectToRoute(route, true) })
 	}
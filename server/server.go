@@ -3,7 +3,6 @@
 package server
 
 import (
-	"bufio"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
@@ -16,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// Allow dynamic profiling.
@@ -37,9 +37,12 @@ type Info struct {
 	TLSRequired       bool     `json:"tls_required"`
 	TLSVerify         bool     `json:"tls_verify"`
 	MaxPayload        int      `json:"max_payload"`
+	Headers           bool     `json:"headers"`
 	IP                string   `json:"ip,omitempty"`
 	ClientConnectURLs []string `json:"connect_urls,omitempty"` // Contains URLs a client can connect to.
 	ServerRank        int      `json:"server_rank"`            // lowest rank wins leader election.
+	LameDuckMode      bool     `json:"ldm,omitempty"`
+	Nonce             string   `json:"nonce,omitempty"` // Signed by the clients with a public key, set per client.
 
 	// Used internally for quick look-ups.
 	clientConnectURLs map[string]struct{}
@@ -53,13 +56,32 @@ type Server struct {
 	mu            sync.Mutex
 	info          Info
 	infoJSON      []byte
+	wsInfo        Info
+	wsInfoJSON    []byte
+	listeners     []*clientListener // additional client endpoints
 	sl            *Sublist
+	gacc          *Account
+	accounts      map[string]*Account
+	mappings      atomic.Value // compiled subject mappings
+	queuePolicies atomic.Value // policies configured for queue groups
+	msgTraces     atomic.Value // subjects the messages of are traced
+	msgTracesMu   sync.Mutex   // serializes changes of the trace subjects
+	clientGate    connGate     // filters the client connections
+	clusterGate   connGate     // filters the route connections
+	httpGate      connGate     // filters the monitoring connections
+	audit         *auditor     // audit log of the violations, nil if disabled
+	auditMu       sync.Mutex
+	optsMu        sync.RWMutex
 	opts          *Options
+	configOpts    *Options   // options as last read from the config file
+	reloadMu      sync.Mutex // serializes configuration reloads
+	configureAuth AuthConfigurer
 	cAuth         Auth
 	rAuth         Auth
 	trace         bool
 	debug         bool
 	running       bool
+	ldm           bool
 	listener      net.Listener
 	clients       map[uint64]*client
 	routes        map[uint64]*client
@@ -70,6 +92,10 @@ type Server struct {
 	http          net.Listener
 	httpReqStats  map[string]uint64
 	routeListener net.Listener
+	wsListener    net.Listener
+	leafListener  net.Listener
+	leafInfoJSON  []byte
+	leafs         map[uint64]*client
 	routeInfo     Info
 	routeInfoJSON []byte
 	rcQuit        chan bool
@@ -79,6 +105,15 @@ type Server struct {
 	grWG          sync.WaitGroup // to wait on various go routines
 	cproto        int64          // number of clients supporting async INFO
 	icli          iCli           // in-process internal clients
+	sys           *sysEvents     // publishes the _SYS events, nil when disabled
+	socketsMu     sync.Mutex
+	sockets       map[string]net.Listener // listening sockets passed on upgrade
+	inherited     map[string]net.Listener // sockets inherited from the previous process
+	upgradeReady  *os.File                // tells the previous process this one is ready
+	upgrading     bool
+	revoked       map[string]bool // public keys and JWT IDs revoked
+	revokedStamp  string          // content of the revocations directory, see loadRevocations
+	revokedLoop   bool            // the revocations directory is watched
 }
 
 // Make sure all are 64bits for atomic use
@@ -109,6 +144,7 @@ func New(opts *Options) *Server {
 		SSLRequired:       tlsReq,
 		TLSVerify:         verify,
 		MaxPayload:        opts.MaxPayload,
+		Headers:           true,
 		clientConnectURLs: make(map[string]struct{}),
 	}
 
@@ -137,21 +173,56 @@ func New(opts *Options) *Server {
 	s.routes = make(map[uint64]*client)
 	s.remotes = make(map[string]*client)
 
+	// For tracking leaf nodes
+	s.leafs = make(map[uint64]*client)
+
 	// Used to kick out all of the route
 	// connect Go routines.
 	s.rcQuit = make(chan bool)
+	s.sockets = make(map[string]net.Listener)
+	s.inherited = make(map[string]net.Listener)
+	s.inheritListeners()
+	s.initListeners()
 	s.generateServerInfoJSON()
+	s.configureAccounts()
+	s.configureMappings()
+	s.configureQueuePolicies()
+	s.configureMsgTraces()
+	s.configureAccept()
+	s.configureAudit()
+	s.initEvents()
 	s.handleSignals()
 
+	// Snapshot the configuration file so that a reload can tell
+	// which settings have changed.
+	if opts.ConfigFile != "" {
+		fileOpts, err := ProcessConfigFile(opts.ConfigFile)
+		if err != nil {
+			Errorf("Error processing configuration file: %v", err)
+		} else {
+			s.configOpts = fileOpts
+		}
+	}
+
 	return s
 }
 
+// getOpts returns the current options. Options are replaced as a
+// whole on configuration reload, so the returned value must not
+// be modified.
+func (s *Server) getOpts() *Options {
+	s.optsMu.RLock()
+	opts := s.opts
+	s.optsMu.RUnlock()
+	return opts
+}
+
 // SetClientAuthMethod sets the authentication method for clients.
 func (s *Server) SetClientAuthMethod(authMethod Auth) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.info.AuthRequired = true
+	s.info.AuthRequired = authMethod != nil
 	s.cAuth = authMethod
 
 	s.generateServerInfoJSON()
@@ -172,6 +243,46 @@ func (s *Server) generateServerInfoJSON() {
 		return
 	}
 	s.infoJSON = []byte(fmt.Sprintf("INFO %s %s", b, CR_LF))
+
+	// Websocket clients get their TLS from the websocket
+	// listener, never from an upgrade of the connection.
+	wsInfo := s.info
+	wsInfo.TLSRequired = false
+	wsInfo.SSLRequired = false
+	wsInfo.TLSVerify = false
+	b, err = json.Marshal(wsInfo)
+	if err != nil {
+		Fatalf("Error marshalling INFO JSON: %+v\n", err)
+		return
+	}
+	s.wsInfo = wsInfo
+	s.wsInfoJSON = []byte(fmt.Sprintf("INFO %s %s", b, CR_LF))
+
+	s.generateListenerInfoJSON()
+}
+
+// clientInfoJSON returns the INFO protocol to send to
+// the client. Server lock should be held.
+func (s *Server) clientInfoJSON(c *client) []byte {
+	if c.ws {
+		return s.wsInfoJSON
+	}
+	if c.lsn != nil {
+		return c.lsn.infoJSON
+	}
+	return s.infoJSON
+}
+
+// clientInfo returns the INFO sent to the client. Server lock
+// should be held.
+func (s *Server) clientInfo(c *client) Info {
+	if c.ws {
+		return s.wsInfo
+	}
+	if c.lsn != nil {
+		return c.lsn.info
+	}
+	return s.info
 }
 
 // PrintAndDie is exported for access in other packages.
@@ -212,9 +323,16 @@ func (s *Server) isRunning() bool {
 	return s.running
 }
 
+// Protected check on lame duck mode
+func (s *Server) isLameDuckMode() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ldm
+}
+
 func (s *Server) logPid() {
 	pidStr := strconv.Itoa(os.Getpid())
-	err := ioutil.WriteFile(s.opts.PidFile, []byte(pidStr), 0660)
+	err := ioutil.WriteFile(s.getOpts().PidFile, []byte(pidStr), 0660)
 	if err != nil {
 		PrintAndDie(fmt.Sprintf("Could not write pidfile: %v\n", err))
 	}
@@ -236,37 +354,56 @@ func (s *Server) Start() {
 	s.grMu.Unlock()
 
 	// Log the pid to a file
-	if s.opts.PidFile != _EMPTY_ {
+	if s.getOpts().PidFile != _EMPTY_ {
 		s.logPid()
 	}
 
+	// Publish the system events if a system user is configured.
+	if s.sys != nil {
+		s.startGoRoutine(func() { s.eventsLoop() })
+	}
+
+	// Watch the revocation lists of the JWTs.
+	s.loadRevocations()
+	s.startRevocationsLoop()
+
 	// Start up the http server if needed.
-	if s.opts.HTTPPort != 0 {
+	if s.getOpts().HTTPPort != 0 {
 		s.StartHTTPMonitoring()
 	}
 
 	// Start up the https server if needed.
-	if s.opts.HTTPSPort != 0 {
-		if s.opts.TLSConfig == nil {
+	if s.getOpts().HTTPSPort != 0 {
+		if s.getOpts().TLSConfig == nil {
 			Fatalf("TLS cert and key required for HTTPS")
 			return
 		}
 		s.StartHTTPSMonitoring()
 	}
 
+	// Start up the websocket listener if needed.
+	if s.getOpts().Websocket.Port != 0 {
+		s.startWebsocketServer()
+	}
+
+	// Start up leaf nodes if needed.
+	if s.getOpts().LeafNode.Port != 0 || len(s.getOpts().LeafNode.Remotes) > 0 {
+		s.startLeafNodes()
+	}
+
 	// The Routing routine needs to wait for the client listen
 	// port to be opened and potential ephemeral port selected.
 	clientListenReady := make(chan struct{})
 
 	// Start up routing as well if needed.
-	if s.opts.Cluster.Port != 0 {
+	if s.getOpts().Cluster.Port != 0 {
 		s.startGoRoutine(func() {
 			s.StartRouting(clientListenReady)
 		})
 	}
 
 	// Pprof http endpoint for the profiler.
-	if s.opts.ProfPort != 0 {
+	if s.getOpts().ProfPort != 0 {
 		s.StartProfiler()
 	}
 
@@ -303,7 +440,12 @@ func (s *Server) Start() {
 				Errorf("InternalClient ['%s'] failed to Start(): %s", ic.Name(), err)
 			}
 		}
-	}(s.info, *s.opts)
+	}(s.info, *s.getOpts())
+
+	// Tell the process this one was upgraded from when it is ready.
+	if s.upgradeReady != nil {
+		go s.notifyUpgradeReady(clientListenReady)
+	}
 
 	// Wait for clients.
 	s.AcceptLoop(clientListenReady)
@@ -312,7 +454,7 @@ func (s *Server) Start() {
 // InternalCliRegisterCallback is public only for testing.
 func (s *Server) InternalCliRegisterCallback(srv net.Conn) {
 	s.startGoRoutine(func() {
-		s.createClient(srv)
+		s.createClient(srv, nil)
 		s.grWG.Done()
 	})
 }
@@ -357,6 +499,10 @@ func (s *Server) Shutdown() {
 	for i, r := range s.routes {
 		conns[i] = r
 	}
+	// Copy off the leaf nodes
+	for i, l := range s.leafs {
+		conns[i] = l
+	}
 
 	// Number of done channel responses we expect.
 	doneExpected := 0
@@ -368,6 +514,15 @@ func (s *Server) Shutdown() {
 		s.listener = nil
 	}
 
+	// Kick the AcceptLoop of the additional client endpoints
+	for _, lsn := range s.listeners {
+		if lsn.l != nil {
+			doneExpected++
+			lsn.l.Close()
+			lsn.l = nil
+		}
+	}
+
 	// Kick route AcceptLoop()
 	if s.routeListener != nil {
 		doneExpected++
@@ -375,6 +530,13 @@ func (s *Server) Shutdown() {
 		s.routeListener = nil
 	}
 
+	// Kick leaf node AcceptLoop()
+	if s.leafListener != nil {
+		doneExpected++
+		s.leafListener.Close()
+		s.leafListener = nil
+	}
+
 	// Kick HTTP monitoring if its running
 	if s.http != nil {
 		doneExpected++
@@ -382,6 +544,13 @@ func (s *Server) Shutdown() {
 		s.http = nil
 	}
 
+	// Kick the websocket server if its running
+	if s.wsListener != nil {
+		doneExpected++
+		s.wsListener.Close()
+		s.wsListener = nil
+	}
+
 	// Release the solicited routes connect go routines.
 	close(s.rcQuit)
 
@@ -400,6 +569,86 @@ func (s *Server) Shutdown() {
 
 	// Wait for go routines to be done.
 	s.grWG.Wait()
+
+	if a := s.auditor(); a != nil {
+		a.close()
+	}
+}
+
+// Minimum time between two batches of client closes in lame duck mode.
+const lameDuckMinInterval = 10 * time.Millisecond
+
+// LameDuckShutdown stops accepting new clients, advertises the lame duck
+// mode to the clients that support async INFO, and then closes the existing
+// clients gradually over the configured lame duck duration, so that they do
+// not all reconnect elsewhere at once. The routes and internal clients are
+// closed last by a regular Shutdown.
+func (s *Server) LameDuckShutdown() {
+	s.mu.Lock()
+	if !s.running || s.ldm {
+		s.mu.Unlock()
+		return
+	}
+	Noticef("Entering lame duck mode, stop accepting new clients")
+	s.ldm = true
+	s.info.LameDuckMode = true
+	s.generateServerInfoJSON()
+
+	// Kick client AcceptLoop(), it will be waited on by Shutdown().
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for _, lsn := range s.listeners {
+		if lsn.l != nil {
+			lsn.l.Close()
+		}
+	}
+	// The websocket server refuses upgrades in lame duck mode,
+	// it is closed by Shutdown().
+
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		if c.typ == CLIENT {
+			clients = append(clients, c)
+		}
+	}
+	s.mu.Unlock()
+
+	s.sendAsyncInfoToClients()
+
+	if numClients := len(clients); numClients > 0 {
+		dur := s.getOpts().LameDuckDuration
+		Noticef("Closing %d existing clients over %v", numClients, dur)
+
+		// Close one client per interval, or batches of them
+		// if there are too many for the duration.
+		interval := dur / time.Duration(numClients)
+		batch := 1
+		if interval < lameDuckMinInterval {
+			interval = lameDuckMinInterval
+			batch = numClients / int(dur/lameDuckMinInterval+1)
+			if batch < 1 {
+				batch = 1
+			}
+		}
+		t := time.NewTimer(interval)
+		defer t.Stop()
+		for i, c := range clients {
+			c.closeConnection()
+			if (i+1)%batch != 0 || i == numClients-1 {
+				continue
+			}
+			t.Reset(interval)
+			select {
+			case <-t.C:
+			case <-s.rcQuit:
+				// Shutdown() was called in the meantime.
+				return
+			}
+		}
+	}
+
+	s.Shutdown()
 }
 
 // AcceptLoop is exported for easier testing.
@@ -412,16 +661,17 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 		}
 	}()
 
-	hp := net.JoinHostPort(s.opts.Host, strconv.Itoa(s.opts.Port))
+	hp := net.JoinHostPort(s.getOpts().Host, strconv.Itoa(s.getOpts().Port))
 	Noticef("Listening for client connections on %s", hp)
-	l, e := net.Listen("tcp", hp)
+	l, e := s.listen("tcp", hp)
 	if e != nil {
 		Fatalf("Error listening on port: %s, %q", hp, e)
 		return
 	}
+	l = &gatedListener{Listener: l, name: acceptClient, gate: &s.clientGate}
 
 	// Alert of TLS enabled.
-	if s.opts.TLSConfig != nil {
+	if s.getOpts().TLSConfig != nil {
 		Noticef("TLS required for client connections")
 	}
 
@@ -434,7 +684,7 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 
 	// If server was started with RANDOM_PORT (-1), opts.Port would be equal
 	// to 0 at the beginning this function. So we need to get the actual port
-	if s.opts.Port == 0 {
+	if s.getOpts().Port == 0 {
 		// Write resolved port back to options.
 		_, port, err := net.SplitHostPort(l.Addr().String())
 		if err != nil {
@@ -448,14 +698,27 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 			s.mu.Unlock()
 			return
 		}
+		s.optsMu.Lock()
 		s.opts.Port = portNum
+		s.optsMu.Unlock()
 	}
 	s.mu.Unlock()
 
+	// Listen on the additional client endpoints.
+	s.startListeners()
+
 	// Let the caller know that we are ready
 	close(clr)
 	clr = nil
 
+	s.acceptClients(l, nil)
+	Noticef("Server Exiting..")
+	s.done <- true
+}
+
+// acceptClients accepts the client connections on the main
+// endpoint, or on an additional one, until the server is shutdown.
+func (s *Server) acceptClients(l net.Listener, lsn *clientListener) {
 	tmpDelay := ACCEPT_MIN_SLEEP
 
 	for s.isRunning() {
@@ -469,6 +732,8 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 				if tmpDelay > ACCEPT_MAX_SLEEP {
 					tmpDelay = ACCEPT_MAX_SLEEP
 				}
+			} else if s.isLameDuckMode() {
+				break
 			} else if s.isRunning() {
 				Noticef("Accept error: %v", err)
 			}
@@ -476,18 +741,16 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
 		s.startGoRoutine(func() {
-			s.createClient(conn)
+			s.createClient(conn, lsn)
 			s.grWG.Done()
 		})
 	}
-	Noticef("Server Exiting..")
-	s.done <- true
 }
 
 // StartProfiler is called to enable dynamic profiling.
 func (s *Server) StartProfiler() {
-	Noticef("Starting profiling on http port %d", s.opts.ProfPort)
-	hp := net.JoinHostPort(s.opts.Host, strconv.Itoa(s.opts.ProfPort))
+	Noticef("Starting profiling on http port %d", s.getOpts().ProfPort)
+	hp := net.JoinHostPort(s.getOpts().Host, strconv.Itoa(s.getOpts().ProfPort))
 	go func() {
 		err := http.ListenAndServe(hp, nil)
 		if err != nil {
@@ -514,6 +777,7 @@ const (
 	RoutezPath  = "/routez"
 	SubszPath   = "/subsz"
 	StackszPath = "/stacksz"
+	MetricsPath = "/metrics"
 )
 
 // Start the monitoring server
@@ -521,33 +785,37 @@ func (s *Server) startMonitoring(secure bool) {
 
 	// Used to track HTTP requests
 	s.httpReqStats = map[string]uint64{
-		RootPath:   0,
-		VarzPath:   0,
-		ConnzPath:  0,
-		RoutezPath: 0,
-		SubszPath:  0,
+		RootPath:    0,
+		VarzPath:    0,
+		ConnzPath:   0,
+		RoutezPath:  0,
+		SubszPath:   0,
+		MetricsPath: 0,
 	}
 
 	var hp string
 	var err error
 
 	if secure {
-		hp = net.JoinHostPort(s.opts.HTTPHost, strconv.Itoa(s.opts.HTTPSPort))
+		hp = net.JoinHostPort(s.getOpts().HTTPHost, strconv.Itoa(s.getOpts().HTTPSPort))
 		Noticef("Starting https monitor on %s", hp)
-		config := util.CloneTLSConfig(s.opts.TLSConfig)
+		config := util.CloneTLSConfig(s.getOpts().TLSConfig)
 		config.ClientAuth = tls.NoClientCert
-		s.http, err = tls.Listen("tcp", hp, config)
+		if s.http, err = s.listen("tcp", hp); err == nil {
+			s.http = tls.NewListener(s.http, config)
+		}
 
 	} else {
-		hp = net.JoinHostPort(s.opts.HTTPHost, strconv.Itoa(s.opts.HTTPPort))
+		hp = net.JoinHostPort(s.getOpts().HTTPHost, strconv.Itoa(s.getOpts().HTTPPort))
 		Noticef("Starting http monitor on %s", hp)
-		s.http, err = net.Listen("tcp", hp)
+		s.http, err = s.listen("tcp", hp)
 	}
 
 	if err != nil {
 		Fatalf("Can't listen to the monitor port: %v", err)
 		return
 	}
+	s.http = &gatedListener{Listener: s.http, name: acceptHTTP, gate: &s.httpGate}
 
 	mux := http.NewServeMux()
 
@@ -565,6 +833,8 @@ func (s *Server) startMonitoring(secure bool) {
 	mux.HandleFunc("/subscriptionsz", s.HandleSubsz)
 	// Stacksz
 	mux.HandleFunc(StackszPath, s.HandleStacksz)
+	// Metrics
+	mux.HandleFunc(MetricsPath, s.HandleMetrics)
 
 	srv := &http.Server{
 		Addr:           hp,
@@ -581,19 +851,35 @@ func (s *Server) startMonitoring(secure bool) {
 	}()
 }
 
-func (s *Server) createClient(conn net.Conn) *client {
-	c := &client{srv: s, nc: conn, opts: defaultOpts, mpay: s.info.MaxPayload, start: time.Now()}
+// createClient creates the client of a connection accepted on
+// the additional endpoint, or on the main one if nil.
+func (s *Server) createClient(conn net.Conn, lsn *clientListener) *client {
+	c := &client{srv: s, nc: conn, opts: defaultOpts, start: time.Now(), lsn: lsn}
 
 	_, isInternal := conn.(LocalInternalClient)
 	if isInternal {
 		c.typ = INTERNALCLI
 	}
+	_, c.ws = conn.(*wsConn)
 
 	// Grab JSON info string
 	s.mu.Lock()
-	info := s.infoJSON
+	info := s.clientInfoJSON(c)
 	authRequired := s.info.AuthRequired
-	tlsRequired := s.info.TLSRequired
+	tlsRequired := s.info.TLSRequired && !c.ws
+	opts := s.getOpts()
+	tlsConfig, tlsWait, authTimeout := opts.TLSConfig, opts.TLSTimeout, opts.AuthTimeout
+	if lsn != nil {
+		authRequired = s.listenerAuthRequired(lsn)
+		tlsRequired = lsn.opts.TLSConfig != nil
+		tlsConfig, tlsWait, authTimeout = lsn.opts.TLSConfig, lsn.opts.TLSTimeout, lsn.opts.AuthTimeout
+		lsn.total++
+	}
+	if !isInternal && authRequired && s.nonceRequired(lsn) {
+		c.nonce = generateNonce()
+		info = s.clientInfoWithNonce(c)
+	}
+	c.mpay = int32(s.info.MaxPayload)
 	s.totalClients++
 	s.mu.Unlock()
 
@@ -607,11 +893,13 @@ func (s *Server) createClient(conn net.Conn) *client {
 
 	// Check for Auth
 	if !isInternal && authRequired {
-		c.setAuthTimer(secondsToDuration(s.opts.AuthTimeout))
+		c.setAuthTimer(secondsToDuration(authTimeout))
 	}
 
-	// Send our information.
+	// Send our information. It must be written before
+	// the TLS handshake, so do not wait for the writeLoop.
 	c.sendInfo(info)
+	c.flushOutbound()
 
 	// Unlock to register
 	c.mu.Unlock()
@@ -628,7 +916,7 @@ func (s *Server) createClient(conn net.Conn) *client {
 	}
 	// If there is a max connections specified, check that adding
 	// this new client would not push us over the max
-	if s.opts.MaxConn > 0 && len(s.clients) >= s.opts.MaxConn {
+	if s.getOpts().MaxConn > 0 && len(s.clients) >= s.getOpts().MaxConn {
 		s.mu.Unlock()
 		c.maxConnExceeded()
 		return nil
@@ -642,11 +930,11 @@ func (s *Server) createClient(conn net.Conn) *client {
 	// Check for TLS
 	if !isInternal && tlsRequired {
 		c.Debugf("Starting TLS client connection handshake")
-		c.nc = tls.Server(c.nc, s.opts.TLSConfig)
+		c.nc = tls.Server(c.nc, tlsConfig)
 		conn := c.nc.(*tls.Conn)
 
 		// Setup the timeout
-		ttl := secondsToDuration(s.opts.TLSTimeout)
+		ttl := secondsToDuration(tlsWait)
 		time.AfterFunc(ttl, func() { tlsTimeout(c, conn) })
 		conn.SetReadDeadline(time.Now().Add(ttl))
 
@@ -671,11 +959,6 @@ func (s *Server) createClient(conn net.Conn) *client {
 		return c
 	}
 
-	if !isInternal && tlsRequired {
-		// Rewrap bw
-		c.bw = bufio.NewWriterSize(c.nc, startBufSize)
-	}
-
 	// Do final client initialization
 
 	// Set the Ping timer
@@ -683,8 +966,9 @@ func (s *Server) createClient(conn net.Conn) *client {
 		c.setPingTimer()
 	}
 
-	// Spin up the read loop.
+	// Spin up the read and write loops.
 	s.startGoRoutine(func() { c.readLoop() })
+	s.startGoRoutine(func() { c.writeLoop() })
 
 	if !isInternal && tlsRequired {
 		c.Debugf("TLS handshake complete")
@@ -707,7 +991,7 @@ func (s *Server) updateServerINFO(urls []string) bool {
 	defer s.mu.Unlock()
 
 	// Feature disabled, do not update.
-	if s.opts.Cluster.NoAdvertise {
+	if s.getOpts().Cluster.NoAdvertise {
 		return false
 	}
 
@@ -795,10 +1079,14 @@ func tlsCipher(cs uint16) string {
 }
 
 func (s *Server) checkClientAuth(c *client) bool {
-	if s.cAuth == nil {
+	cAuth, ok := s.clientAuth(c)
+	if !ok {
+		return false
+	}
+	if cAuth == nil {
 		return true
 	}
-	return s.cAuth.Check(c)
+	return cAuth.Check(c)
 }
 
 func (s *Server) checkRouterAuth(c *client) bool {
@@ -815,6 +1103,9 @@ func (s *Server) checkAuth(c *client) bool {
 		return s.checkClientAuth(c)
 	case ROUTER:
 		return s.checkRouterAuth(c)
+	case LEAF:
+		// Leaf nodes are authorized as users of the server.
+		return s.checkClientAuth(c)
 	case INTERNALCLI:
 		return true
 	default:
@@ -846,7 +1137,10 @@ func (s *Server) removeClient(c *client) {
 			s.cproto--
 		}
 	case ROUTER:
-		delete(s.routes, cid)
+		if _, ok := s.routes[cid]; ok {
+			delete(s.routes, cid)
+			defer s.sendRouteEvent(EventRouteDisconnect, c)
+		}
 		if r != nil {
 			rc, ok := s.remotes[rID]
 			// Only delete it if it is us..
@@ -854,6 +1148,8 @@ func (s *Server) removeClient(c *client) {
 				delete(s.remotes, rID)
 			}
 		}
+	case LEAF:
+		delete(s.leafs, cid)
 	}
 	s.mu.Unlock()
 }
@@ -885,9 +1181,10 @@ func (s *Server) NumClients() int {
 
 // NumSubscriptions will report how many subscriptions are active.
 func (s *Server) NumSubscriptions() uint32 {
-	s.mu.Lock()
-	subs := s.sl.Count()
-	s.mu.Unlock()
+	var subs uint32
+	for _, acc := range s.accounts {
+		subs += acc.sl.Count()
+	}
 	return subs
 }
 
@@ -908,7 +1205,7 @@ func (s *Server) ReadyForConnections(dur time.Duration) bool {
 	end := time.Now().Add(dur)
 	for time.Now().Before(end) {
 		s.mu.Lock()
-		ok := s.listener != nil && (s.opts.Cluster.Port == 0 || s.routeListener != nil)
+		ok := s.listener != nil && (s.getOpts().Cluster.Port == 0 || s.routeListener != nil)
 		s.mu.Unlock()
 		if ok {
 			return true
@@ -941,10 +1238,10 @@ func (s *Server) getClientConnectURLs() []string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	sPort := strconv.Itoa(s.opts.Port)
+	sPort := strconv.Itoa(s.getOpts().Port)
 	urls := make([]string, 0, 1)
 
-	ipAddr, err := net.ResolveIPAddr("ip", s.opts.Host)
+	ipAddr, err := net.ResolveIPAddr("ip", s.getOpts().Host)
 	// If the host is "any" (0.0.0.0 or ::), get specific IPs from available
 	// interfaces.
 	if err == nil && ipAddr.IP.IsUnspecified() {
@@ -975,10 +1272,10 @@ func (s *Server) getClientConnectURLs() []string {
 		// and not add any address in the array in the loop above, and we
 		// ended-up returning 0.0.0.0, which is problematic for Windows clients.
 		// Check for 0.0.0.0 or :: specifically, and ignore if that's the case.
-		if s.opts.Host == "0.0.0.0" || s.opts.Host == "::" {
-			Errorf("Address %q can not be resolved properly", s.opts.Host)
+		if s.getOpts().Host == "0.0.0.0" || s.getOpts().Host == "::" {
+			Errorf("Address %q can not be resolved properly", s.getOpts().Host)
 		} else {
-			urls = append(urls, net.JoinHostPort(s.opts.Host, sPort))
+			urls = append(urls, net.JoinHostPort(s.getOpts().Host, sPort))
 		}
 	}
 	return urls
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -316,15 +317,70 @@ func TestWriteDeadline(t *testing.T) {
 	}
 	// Flush sender connection to ensure that all data has been sent.
 	sender.Flush()
-	// At this point server should have closed connection c.
+	// The writeLoop of connection c hits the deadline and closes it.
+	checkConnClosed(t, c)
+	// It is not a slow consumer, the queue was under max_pending.
+	if sc := atomic.LoadInt64(&s.slowConsumers); sc != 0 {
+		t.Fatalf("Expected no slow consumer, got %d", sc)
+	}
+}
 
+// checkConnClosed writes to the connection until the
+// server is seen to have closed it.
+func checkConnClosed(t *testing.T, c net.Conn) {
 	// On certain platforms, it may take more than one call before
 	// getting the error.
-	for i := 0; i < 100; i++ {
+	end := time.Now().Add(2 * time.Second)
+	for time.Now().Before(end) {
 		if _, err := c.Write([]byte("PUB bar 5\r\nhello\r\n")); err != nil {
 			// ok
 			return
 		}
+		time.Sleep(10 * time.Millisecond)
 	}
 	t.Fatal("Connection should have been closed")
 }
+
+func TestMaxPendingSlowConsumer(t *testing.T) {
+	opts := DefaultOptions
+	opts.MaxPending = 100000
+	// Make sure that the queue size is what closes the connection.
+	opts.WriteDeadline = 10 * time.Second
+	s := RunServer(&opts)
+	defer s.Shutdown()
+
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port), 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("CONNECT {}\r\nPING\r\nSUB foo 1\r\n")); err != nil {
+		t.Fatalf("Error sending protocols to server: %v", err)
+	}
+	c.(*net.TCPConn).SetReadBuffer(10)
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	sender, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer sender.Close()
+
+	// The messages are queued faster than they can be written.
+	payload := make([]byte, 60000)
+	for i := 0; i < 200; i++ {
+		if err := sender.Publish("foo", payload); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+	}
+	sender.Flush()
+	checkConnClosed(t, c)
+
+	if sc := atomic.LoadInt64(&s.slowConsumers); sc != 1 {
+		t.Fatalf("Expected 1 slow consumer, got %d", sc)
+	}
+	// The publisher is not affected.
+	if err := sender.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+}
@@ -4,19 +4,63 @@
 package server
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
+// Signals sent to a running server by the commands of --signal. The
+// upgrade uses SIGTTIN: the kernel only sends it on its own to a process
+// in the background reading from its terminal, which the server never
+// does, so it is not raised by accident.
+var signalCommands = map[string]syscall.Signal{
+	"quit":    syscall.SIGINT,
+	"reopen":  syscall.SIGUSR1,
+	"ldm":     syscall.SIGUSR2,
+	"reload":  syscall.SIGHUP,
+	"upgrade": syscall.SIGTTIN,
+}
+
+// ProcessSignal sends the signal of the command, e.g. "reload=1234", to
+// the server process. The pid is read from the pid file if not given.
+func ProcessSignal(command, pidFile string) error {
+	name, pidStr := command, ""
+	if i := strings.IndexByte(command, '='); i >= 0 {
+		name, pidStr = command[:i], command[i+1:]
+	}
+	sig, ok := signalCommands[name]
+	if !ok {
+		return fmt.Errorf("Unknown signal %q", name)
+	}
+	if pidStr == "" {
+		if pidFile == "" {
+			return fmt.Errorf("No pid given for signal %q, and no pid file", name)
+		}
+		b, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read pid file: %v", err)
+		}
+		pidStr = strings.TrimSpace(string(b))
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("Invalid pid %q", pidStr)
+	}
+	return syscall.Kill(pid, sig)
+}
+
 // Signal Handling
 func (s *Server) handleSignals() {
-	if s.opts.NoSigs {
+	if s.getOpts().NoSigs {
 		return
 	}
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGUSR1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGTTIN)
 
 	go func() {
 		for sig := range c {
@@ -28,6 +72,30 @@ func (s *Server) handleSignals() {
 			case syscall.SIGUSR1:
 				// File log re-open for rotating file logs.
 				s.ReOpenLogFile()
+			case syscall.SIGUSR2:
+				// Lame duck mode, the process exits once all
+				// clients have been closed.
+				go func() {
+					s.LameDuckShutdown()
+					os.Exit(0)
+				}()
+			case syscall.SIGTTIN:
+				// Upgrade, a new process started from the executable
+				// takes over the listening sockets, then this one exits
+				// in lame duck mode.
+				go func() {
+					if err := s.Upgrade(); err != nil {
+						Errorf("Failed to upgrade: %v", err)
+						return
+					}
+					s.LameDuckShutdown()
+					os.Exit(0)
+				}()
+			case syscall.SIGHUP:
+				// Configuration reload.
+				if err := s.Reload(); err != nil {
+					Errorf("Failed to reload server configuration: %v", err)
+				}
 			}
 		}
 	}()
@@ -0,0 +1,45 @@
+// +build !windows
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProcessSignal(t *testing.T) {
+	for _, cmd := range []string{"stop=1", "reload", "reload=abc", "reload=-1"} {
+		if err := ProcessSignal(cmd, ""); err == nil {
+			t.Fatalf("Expected an error for %q", cmd)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "gnatsd_pid")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	defer signal.Stop(c)
+	if err := ProcessSignal("reopen", f.Name()); err != nil {
+		t.Fatalf("Error sending the signal: %v", err)
+	}
+	select {
+	case sig := <-c:
+		if sig != syscall.SIGUSR1 {
+			t.Fatalf("Expected SIGUSR1, got %v", sig)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Signal not received")
+	}
+}
@@ -3,13 +3,19 @@
 package server
 
 import (
+	"errors"
 	"os"
 	"os/signal"
 )
 
+// ProcessSignal is not supported on Windows.
+func ProcessSignal(command, pidFile string) error {
+	return errors.New("Signals are not supported on Windows")
+}
+
 // Signal Handling
 func (s *Server) handleSignals() {
-	if s.opts.NoSigs {
+	if s.getOpts().NoSigs {
 		return
 	}
 	c := make(chan os.Signal, 1)
@@ -14,6 +14,7 @@ func TestSplitBufferSubOp(t *testing.T) {
 	defer trash.Close()
 
 	s := &Server{sl: NewSublist()}
+	s.gacc = newAccount(globalAccount, s.sl)
 	c := &client{srv: s, subs: make(map[string]*subscription), nc: cli}
 
 	subop := []byte("SUB foo 1\r\n")
@@ -50,6 +51,7 @@ func TestSplitBufferSubOp(t *testing.T) {
 
 func TestSplitBufferUnsubOp(t *testing.T) {
 	s := &Server{sl: NewSublist()}
+	s.gacc = newAccount(globalAccount, s.sl)
 	c := &client{srv: s, subs: make(map[string]*subscription)}
 
 	subop := []byte("SUB foo 1024\r\n")
@@ -135,10 +135,13 @@ func (s *Sublist) Insert(sub *subscription) error {
 	if sub.queue == nil {
 		n.psubs = append(n.psubs, sub)
 	} else {
-		// This is a queue subscription
+		// This is a queue subscription, the members of the
+		// group share the turns, released with the group.
 		if i := findQSliceForSub(sub, n.qsubs); i >= 0 {
+			sub.qturn = n.qsubs[i][0].qturn
 			n.qsubs[i] = append(n.qsubs[i], sub)
 		} else {
+			sub.qturn = new(uint64)
 			n.qsubs = append(n.qsubs, []*subscription{sub})
 		}
 	}
@@ -252,7 +255,8 @@ func addNodeToResults(n *node, results *SublistResult) {
 		if i := findQSliceForSub(qr[0], results.qsubs); i >= 0 {
 			results.qsubs[i] = append(results.qsubs[i], qr...)
 		} else {
-			results.qsubs = append(results.qsubs, qr)
+			// Copy since the node's list is modified in place on remove.
+			results.qsubs = append(results.qsubs, append([]*subscription(nil), qr...))
 		}
 	}
 }
@@ -638,3 +642,29 @@ func matchLiteral(literal, subject string) bool {
 	// Make sure we have processed all of the literal's chars..
 	return li >= ll
 }
+
+// subjectIsSubsetMatch returns true if every subject matched by
+// subject is also matched by test.
+func subjectIsSubsetMatch(subject, test string) bool {
+	stokens := strings.Split(subject, tsep)
+	ttokens := strings.Split(test, tsep)
+	for i, t := range ttokens {
+		if i >= len(stokens) {
+			return false
+		}
+		if t == string(fwc) {
+			return true
+		}
+		st := stokens[i]
+		if t == string(pwc) {
+			if st == string(fwc) {
+				return false
+			}
+			continue
+		}
+		if st != t {
+			return false
+		}
+	}
+	return len(stokens) == len(ttokens)
+}
@@ -355,6 +355,23 @@ func TestSublistBasicQueueResults(t *testing.T) {
 	verifyQLen(r.qsubs, 0, t)
 }
 
+func TestSublistQueueResultsNotModified(t *testing.T) {
+	s := NewSublist()
+	sub1 := newQSub("foo", "bar")
+	sub2 := newQSub("foo", "bar")
+	s.Insert(sub1)
+	s.Insert(sub2)
+
+	// A result held while members are removed is left untouched.
+	r := s.Match("foo")
+	verifyQLen(r.qsubs, 1, t)
+	verifyLen(r.qsubs[0], 2, t)
+	s.Remove(sub1)
+	verifyLen(r.qsubs[0], 2, t)
+	verifyMember(r.qsubs[0], sub1, t)
+	verifyMember(r.qsubs[0], sub2, t)
+}
+
 func checkBool(b, expected bool, t *testing.T) {
 	if b != expected {
 		dbg.PrintStack()
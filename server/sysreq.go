@@ -0,0 +1,218 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The system user can request the monitoring information of a server
+// on _SYS.REQ.SERVER.<server id>.<request>, or of all the servers of
+// the cluster on _SYS.REQ.SERVER.PING. The responses are the JSON
+// structures returned by the monitoring endpoints.
+const (
+	sysRequestPrefix = "_SYS.REQ."
+	sysRequestSubj   = "_SYS.REQ.SERVER.%s.%s"
+
+	// SysServerPing is answered by every server of the cluster with its Varz.
+	SysServerPing = "_SYS.REQ.SERVER.PING"
+
+	// The responses to the requests of a server, such as the auth
+	// callout, are received on _SYS.REPLY.<server id>.<token>.
+	sysReplyPrefix = "_SYS.REPLY."
+	sysReplySubj   = "_SYS.REPLY.%s.%s"
+)
+
+// ErrRequestTimeout is returned when the response to a request of
+// the server does not arrive in time.
+var ErrRequestTimeout = errors.New("request timeout")
+
+// Requests a server answers on its own request subjects.
+const (
+	ReqVarz   = "VARZ"
+	ReqConnz  = "CONNZ"
+	ReqRoutez = "ROUTEZ"
+	ReqSubsz  = "SUBSZ"
+	ReqTrace  = "TRACE"
+)
+
+// SysErrorResponse is the response to a request that can not be served.
+type SysErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// SysRequestSubject returns the subject the server with
+// the given id answers the given request on.
+func SysRequestSubject(serverID, req string) string {
+	return fmt.Sprintf(sysRequestSubj, serverID, req)
+}
+
+// isSysRequest returns true if the client is the system user
+// publishing a request to the servers, or a response to theirs.
+func (c *client) isSysRequest(subject []byte) bool {
+	c.mu.Lock()
+	sys := c.flags.isSet(systemUser)
+	c.mu.Unlock()
+	return sys && (bytes.HasPrefix(subject, []byte(sysRequestPrefix)) ||
+		bytes.HasPrefix(subject, []byte(sysReplyPrefix)))
+}
+
+// addSysSubscriptions subscribes the system client to the request
+// subjects. They are sent to the routes with the other local
+// subscriptions, so that requests reach the server from anywhere
+// in the cluster.
+func (s *Server) addSysSubscriptions() {
+	c := s.sys.client
+	subjects := []string{
+		SysRequestSubject(s.sys.id, "*"),
+		SysServerPing,
+		fmt.Sprintf(sysReplySubj, s.sys.id, "*"),
+	}
+	for i, subject := range subjects {
+		sub := &subscription{
+			client:  c,
+			acc:     c.acc,
+			subject: []byte(subject),
+			sid:     []byte(fmt.Sprintf("%d", i+1)),
+		}
+		c.subs[string(sub.sid)] = sub
+		if err := c.acc.sl.Insert(sub); err != nil {
+			Errorf("Error subscribing to system requests on %q: %v", subject, err)
+		}
+	}
+}
+
+// queueSysRequest hands a request delivered to the system client
+// over to the eventsLoop, and a response to the request of the server
+// waiting for it. Requests without a reply subject, or published by
+// the system client itself, are ignored.
+func (c *client) queueSysRequest(sub *subscription, msg []byte) {
+	s := sub.client.srv
+	if c.typ == SYSTEM || s == nil || s.sys == nil {
+		return
+	}
+	data := append([]byte(nil), msg[:len(msg)-LEN_CR_LF]...)
+	if bytes.HasPrefix(c.pa.subject, []byte(sysReplyPrefix)) {
+		s.sys.mu.Lock()
+		ch := s.sys.replies[string(c.pa.subject)]
+		s.sys.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- data:
+			default:
+			}
+		}
+		return
+	}
+	if len(c.pa.reply) == 0 {
+		return
+	}
+	m := &sysMsg{
+		subject: string(c.pa.subject),
+		reply:   string(c.pa.reply),
+		data:    data,
+	}
+	select {
+	case s.sys.recvq <- m:
+	default:
+		Debugf("System requests queue is full, dropping request on %q", m.subject)
+	}
+}
+
+// Request publishes a request with the system client and returns the
+// first response, received on a reply subject of the server. Responses
+// are only accepted from the system user and from the routes.
+func (s *Server) Request(subject string, data []byte, timeout time.Duration) ([]byte, error) {
+	if s.sys == nil {
+		return nil, errors.New("system events are not enabled")
+	}
+	reply := fmt.Sprintf(sysReplySubj, s.sys.id, genID())
+	ch := make(chan []byte, 1)
+	s.sys.mu.Lock()
+	s.sys.replies[reply] = ch
+	s.sys.mu.Unlock()
+	defer func() {
+		s.sys.mu.Lock()
+		delete(s.sys.replies, reply)
+		s.sys.mu.Unlock()
+	}()
+
+	select {
+	case s.sys.sendq <- &sysMsg{subject: subject, reply: reply, data: data}:
+	default:
+		return nil, errors.New("system events queue is full")
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-t.C:
+		return nil, ErrRequestTimeout
+	case <-s.rcQuit:
+		return nil, errors.New("server is shutting down")
+	}
+}
+
+// processSysRequest publishes the response to a request.
+// Only called from the eventsLoop.
+func (s *Server) processSysRequest(m *sysMsg) {
+	var resp interface{}
+	var err error
+
+	req := ReqVarz
+	if m.subject != SysServerPing {
+		req = m.subject[len(SysRequestSubject(s.sys.id, "")):]
+	}
+	switch req {
+	case ReqVarz:
+		resp = s.Varz()
+	case ReqConnz:
+		opts := &ConnzOptions{}
+		if err = unmarshalSysRequest(m.data, opts); err == nil {
+			resp, err = s.Connz(opts)
+		}
+	case ReqRoutez:
+		opts := &RoutezOptions{}
+		if err = unmarshalSysRequest(m.data, opts); err == nil {
+			resp = s.Routez(opts)
+		}
+	case ReqSubsz:
+		resp = s.Subsz()
+	case ReqTrace:
+		treq := &TraceRequest{}
+		if err = unmarshalSysRequest(m.data, treq); err == nil {
+			if err = s.updateMsgTraces(treq); err == nil {
+				resp = &TraceResponse{Server: s.sys.id, Subjects: s.traceSubjects()}
+			}
+		}
+	default:
+		err = fmt.Errorf("Unknown request %q", req)
+	}
+	if err != nil {
+		resp = &SysErrorResponse{Error: err.Error()}
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		Errorf("Error marshalling response to %s request: %v", req, err)
+		return
+	}
+	s.sys.client.publishInternal(m.reply, "", b)
+}
+
+// unmarshalSysRequest reads the options of a request, an
+// empty request uses the default options.
+func unmarshalSysRequest(data []byte, v interface{}) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Invalid request: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// On upgrade the server starts a new process from its executable, with
+// the same arguments, which inherits the listening sockets: both accept
+// connections on the same ports until the previous process has drained
+// its clients in lame duck mode and exited, so the ports never close.
+
+// upgradeEnv passes the inherited file descriptors to the new process.
+const upgradeEnv = "GNATSD_UPGRADE_FDS"
+
+// How long the new process has to accept connections before the
+// upgrade is abandoned.
+const upgradeTimeout = 10 * time.Second
+
+// upgradeFds are the file descriptors inherited by the new process: the
+// pipe to tell it is ready, and the listening sockets by address.
+type upgradeFds struct {
+	Ready     int            `json:"ready"`
+	Listeners map[string]int `json:"listeners"`
+}
+
+// listenerFiler is implemented by the TCP and Unix listeners.
+type listenerFiler interface {
+	File() (*os.File, error)
+}
+
+// inheritListeners picks up the listening sockets and the ready pipe
+// passed by the previous process. Lock should be held.
+func (s *Server) inheritListeners() {
+	env := os.Getenv(upgradeEnv)
+	if env == "" {
+		return
+	}
+	// Processes started by this one do not inherit the same sockets.
+	os.Unsetenv(upgradeEnv)
+
+	var fds upgradeFds
+	if err := json.Unmarshal([]byte(env), &fds); err != nil {
+		Errorf("Error parsing the inherited sockets %q: %v", env, err)
+		return
+	}
+	s.upgradeReady = os.NewFile(uintptr(fds.Ready), "upgrade-ready")
+	for key, fd := range fds.Listeners {
+		f := os.NewFile(uintptr(fd), key)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			Errorf("Error inheriting the socket of %s: %v", key, err)
+			continue
+		}
+		s.inherited[key] = l
+	}
+}
+
+// listen returns the socket inherited from the previous process for the
+// address, else a new one. Sockets on a fixed address are passed on to
+// the new process on upgrade.
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	key := network + ":" + addr
+	s.socketsMu.Lock()
+	defer s.socketsMu.Unlock()
+	l, ok := s.inherited[key]
+	if ok {
+		delete(s.inherited, key)
+		Debugf("Using the inherited socket of %s", addr)
+	} else {
+		if network == "unix" {
+			// Remove the socket left over by a previous run.
+			if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(addr)
+			}
+		}
+		var err error
+		if l, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasSuffix(addr, ":0") {
+		s.sockets[key] = l
+	}
+	return l, nil
+}
+
+// notifyUpgradeReady tells the previous process that this one accepts
+// connections, and closes the inherited sockets it does not listen on.
+func (s *Server) notifyUpgradeReady(clientListenReady chan struct{}) {
+	<-clientListenReady
+	ready := s.ReadyForConnections(upgradeTimeout)
+
+	s.socketsMu.Lock()
+	for key, l := range s.inherited {
+		Noticef("Closing the inherited socket of %s, no longer configured", key)
+		l.Close()
+		delete(s.inherited, key)
+	}
+	s.socketsMu.Unlock()
+
+	if ready {
+		s.upgradeReady.Write([]byte{'+'})
+	}
+	s.upgradeReady.Close()
+}
+
+// Upgrade starts a new process from the executable of the server, which
+// inherits the listening sockets. It returns once the new process accepts
+// connections, the server should then be shut down in lame duck mode.
+func (s *Server) Upgrade() error {
+	if !s.isRunning() || s.isLameDuckMode() {
+		return errors.New("server is shutting down")
+	}
+	s.socketsMu.Lock()
+	defer s.socketsMu.Unlock()
+	if s.upgrading {
+		return errors.New("upgrade already in progress")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("can not find the server executable: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	keys := make([]string, 0, len(s.sockets))
+	for key := range s.sockets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	files := []*os.File{w}
+	fds := upgradeFds{Ready: 3, Listeners: make(map[string]int, len(keys))}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, key := range keys {
+		lf, ok := s.sockets[key].(listenerFiler)
+		if !ok {
+			continue
+		}
+		f, err := lf.File()
+		if err != nil {
+			return fmt.Errorf("can not pass the socket of %s: %v", key, err)
+		}
+		// Extra files are numbered from 3 in the new process.
+		fds.Listeners[key] = 3 + len(files)
+		files = append(files, f)
+	}
+	env, err := json.Marshal(fds)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, upgradeEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeEnv+"="+string(env))
+	cmd.ExtraFiles = files
+	Noticef("Upgrading, starting %s", exe)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("can not start the new process: %v", err)
+	}
+	// Only the new process holds the write end of the pipe, reading it
+	// fails if the new process exits before it is ready.
+	w.Close()
+
+	readyCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := r.Read(buf)
+		readyCh <- err
+	}()
+	select {
+	case err = <-readyCh:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timeout")
+	}
+	pid := cmd.Process.Pid
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("new process %d not ready: %v", pid, err)
+	}
+	cmd.Process.Release()
+	Noticef("New process %d is ready", pid)
+
+	// The socket files now belong to the new process.
+	for _, l := range s.sockets {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	s.upgrading = true
+	return nil
+}
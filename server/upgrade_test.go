@@ -0,0 +1,109 @@
+//go:build !windows
+// +build !windows
+
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func upgradeTestOptions() *Options {
+	return &Options{
+		Host:             "127.0.0.1",
+		Port:             4296,
+		LameDuckDuration: 50 * time.Millisecond,
+		NoLog:            true,
+		NoSigs:           true,
+	}
+}
+
+// upgradeServerID connects and returns the id of the server in the INFO.
+func upgradeServerID(t *testing.T, addr string) (net.Conn, string) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to %s: %v", addr, err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		t.Fatalf("Expected an INFO, got %q, %v", line, err)
+	}
+	var info Info
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		t.Fatalf("Error unmarshalling the INFO: %v", err)
+	}
+	return c, info.ID
+}
+
+// TestUpgradeProcess is the new process started by TestUpgrade, it exits
+// once the test has connected to it.
+func TestUpgradeProcess(t *testing.T) {
+	if os.Getenv(upgradeEnv) == "" {
+		t.Skip("Only run by TestUpgrade")
+	}
+	s := RunServer(upgradeTestOptions())
+	defer s.Shutdown()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		s.mu.Lock()
+		done := s.totalClients > 0 && len(s.clients) == 0
+		s.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	opts := upgradeTestOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+	addr := net.JoinHostPort(opts.Host, "4296")
+
+	c, id := upgradeServerID(t, addr)
+	defer c.Close()
+	if id != s.ID() {
+		t.Fatalf("Expected server %s, got %s", s.ID(), id)
+	}
+
+	// The output of the new process is not the one of this test.
+	args, stdout, stderr := os.Args, os.Stdout, os.Stderr
+	defer func() { os.Args, os.Stdout, os.Stderr = args, stdout, stderr }()
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Error opening %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+	os.Stdout, os.Stderr = devNull, devNull
+
+	// The server keeps running if the new process exits before it is ready.
+	os.Args = []string{args[0], "-test.run=^$"}
+	if err := s.Upgrade(); err == nil {
+		t.Fatal("Expected the upgrade to fail")
+	}
+	if !s.isRunning() || s.isLameDuckMode() {
+		t.Fatal("Expected the server to keep running")
+	}
+
+	os.Args = []string{args[0], "-test.run=^TestUpgradeProcess$"}
+	if err := s.Upgrade(); err != nil {
+		t.Fatalf("Error upgrading: %v", err)
+	}
+	s.LameDuckShutdown()
+	checkConnClosed(t, c)
+
+	// New clients are accepted by the new process.
+	nc, newID := upgradeServerID(t, addr)
+	nc.Close()
+	if newID == id {
+		t.Fatal("Expected the new process to accept the clients")
+	}
+}
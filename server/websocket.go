@@ -0,0 +1,345 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Websocket clients connect with an HTTP request that is upgraded to
+// the websocket protocol (RFC 6455). The NATS protocol is then carried
+// in the payload of the frames, and the connection is handed to
+// createClient like any other client connection.
+
+const (
+	// Appended to the client key to compute the accept key.
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// Time given to a client to send its upgrade request.
+	wsHandshakeTimeout = 2 * time.Second
+
+	wsFinalBit = 1 << 7
+	wsMaskBit  = 1 << 7
+
+	wsContinuationFrame = 0
+	wsTextFrame         = 1
+	wsBinaryFrame       = 2
+	wsCloseFrame        = 8
+	wsPingFrame         = 9
+	wsPongFrame         = 10
+
+	wsMaxControlPayload = 125
+	wsCloseNormal       = 1000
+	wsCloseProtocol     = 1002
+)
+
+var (
+	errWSUnmaskedFrame  = errors.New("websocket frame from client is not masked")
+	errWSBadControl     = errors.New("websocket control frame is invalid")
+	errWSUnknownOpcode  = errors.New("websocket frame has an unknown opcode")
+	errWSBadFrameLength = errors.New("websocket frame length is invalid")
+)
+
+// wsConn carries a client connection over websocket frames. Read returns
+// the payload of the data frames sent by the client and answers its
+// control frames, Write sends the data in a binary frame.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// Read state, only used by the readLoop.
+	rem    uint64  // Payload bytes left in the current frame.
+	mask   [4]byte // Mask of the current frame.
+	maskp  int     // Position in the mask.
+	closed bool    // The client sent a close frame.
+
+	// Serializes the frames written by the writeLoop
+	// and the control frames sent by the readLoop.
+	wmu sync.Mutex
+}
+
+func (w *wsConn) Read(p []byte) (int, error) {
+	for w.rem == 0 {
+		if w.closed {
+			return 0, io.EOF
+		}
+		if err := w.readFrameHeader(); err != nil {
+			if err != io.EOF {
+				w.writeClose(wsCloseProtocol)
+			}
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > w.rem {
+		p = p[:w.rem]
+	}
+	n, err := w.br.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= w.mask[w.maskp&3]
+		w.maskp++
+	}
+	w.rem -= uint64(n)
+	return n, err
+}
+
+// readFrameHeader reads the header of the next data frame, control
+// frames are handled as they are read.
+func (w *wsConn) readFrameHeader() error {
+	for {
+		var h [2]byte
+		if _, err := io.ReadFull(w.br, h[:]); err != nil {
+			return err
+		}
+		final := h[0]&wsFinalBit != 0
+		opcode := h[0] & 0xf
+		if h[1]&wsMaskBit == 0 {
+			return errWSUnmaskedFrame
+		}
+		size := uint64(h[1] &^ wsMaskBit)
+		switch size {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(w.br, b[:]); err != nil {
+				return err
+			}
+			size = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(w.br, b[:]); err != nil {
+				return err
+			}
+			size = binary.BigEndian.Uint64(b[:])
+			if size>>63 != 0 {
+				return errWSBadFrameLength
+			}
+		}
+		if _, err := io.ReadFull(w.br, w.mask[:]); err != nil {
+			return err
+		}
+		w.maskp = 0
+
+		switch opcode {
+		case wsContinuationFrame, wsTextFrame, wsBinaryFrame:
+			w.rem = size
+			return nil
+		case wsCloseFrame, wsPingFrame, wsPongFrame:
+			if !final || size > wsMaxControlPayload {
+				return errWSBadControl
+			}
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(w.br, payload); err != nil {
+				return err
+			}
+			for i := range payload {
+				payload[i] ^= w.mask[i&3]
+			}
+			switch opcode {
+			case wsCloseFrame:
+				w.closed = true
+				w.writeClose(wsCloseNormal)
+				return io.EOF
+			case wsPingFrame:
+				w.wmu.Lock()
+				w.writeFrame(wsPongFrame, payload)
+				w.wmu.Unlock()
+			}
+		default:
+			return errWSUnknownOpcode
+		}
+	}
+}
+
+func (w *wsConn) Write(p []byte) (int, error) {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	return w.writeFrame(wsBinaryFrame, p)
+}
+
+// writeFrame sends the payload in a single frame. Frames sent
+// by the server are not masked. Write lock should be held.
+func (w *wsConn) writeFrame(opcode byte, p []byte) (int, error) {
+	var h [10]byte
+	h[0] = wsFinalBit | opcode
+	n := 2
+	switch l := len(p); {
+	case l <= 125:
+		h[1] = byte(l)
+	case l <= 65535:
+		h[1] = 126
+		binary.BigEndian.PutUint16(h[2:], uint16(l))
+		n = 4
+	default:
+		h[1] = 127
+		binary.BigEndian.PutUint64(h[2:], uint64(l))
+		n = 10
+	}
+	bufs := net.Buffers{h[:n], p}
+	if _, err := bufs.WriteTo(w.Conn); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeClose sends a close frame with the given status, unless a
+// frame is being written, in which case the connection is just closed.
+func (w *wsConn) writeClose(status uint16) {
+	if !w.wmu.TryLock() {
+		return
+	}
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], status)
+	w.writeFrame(wsCloseFrame, b[:])
+	w.wmu.Unlock()
+}
+
+// Close sends a close frame to the client before closing the connection.
+func (w *wsConn) Close() error {
+	w.writeClose(wsCloseNormal)
+	return w.Conn.Close()
+}
+
+// wsAcceptKey returns the key sent back to the client
+// to acknowledge the upgrade of the connection.
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains returns true if the comma separated
+// list of the header contains the token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsHijackedError is an upgrade failing once the connection is
+// hijacked, no HTTP response can be sent to the client anymore.
+type wsHijackedError struct {
+	err error
+}
+
+func (e *wsHijackedError) Error() string {
+	return e.err.Error()
+}
+
+// wsUpgrade checks the upgrade request, hijacks the connection
+// and sends the handshake response.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != "GET" {
+		return nil, errors.New("request method must be GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		return nil, errors.New("not a websocket upgrade request")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		return nil, errors.New("missing websocket key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can not be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Clear the deadlines set by the HTTP server.
+	conn.SetDeadline(time.Time{})
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n"
+	if headerContains(r.Header, "Sec-Websocket-Protocol", "nats") {
+		resp += "Sec-WebSocket-Protocol: nats\r\n"
+	}
+	if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+		conn.Close()
+		return nil, &wsHijackedError{err}
+	}
+	return &wsConn{Conn: conn, br: brw.Reader}, nil
+}
+
+// startWebsocketServer starts the listener accepting the websocket clients.
+func (s *Server) startWebsocketServer() {
+	wo := s.getOpts().Websocket
+	hp := net.JoinHostPort(wo.Host, strconv.Itoa(wo.Port))
+	Noticef("Listening for websocket clients on %s", hp)
+	l, err := s.listen("tcp", hp)
+	if err != nil {
+		Fatalf("Error listening on websocket port: %s, %q", hp, err)
+		return
+	}
+	l = &gatedListener{Listener: l, name: acceptClient, gate: &s.clientGate}
+	if wo.TLSConfig != nil {
+		Noticef("TLS required for websocket clients")
+		l = tls.NewListener(l, wo.TLSConfig)
+	}
+
+	s.mu.Lock()
+	s.wsListener = l
+	s.mu.Unlock()
+
+	// The TLS handshake happens on the first read of the request.
+	timeout := wsHandshakeTimeout
+	if wo.TLSConfig != nil {
+		timeout += secondsToDuration(wo.TLSTimeout)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleWebsocket)
+	srv := &http.Server{
+		Addr:           hp,
+		Handler:        mux,
+		ReadTimeout:    timeout,
+		WriteTimeout:   timeout,
+		MaxHeaderBytes: 1 << 20,
+	}
+	go func() {
+		srv.Serve(l)
+		s.done <- true
+	}()
+}
+
+// handleWebsocket upgrades the request and creates the client.
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	if !s.isRunning() || s.isLameDuckMode() {
+		http.Error(w, "Server is not accepting clients", http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := wsUpgrade(w, r)
+	if err != nil {
+		Debugf("Websocket upgrade of %s failed: %v", r.RemoteAddr, err)
+		if _, ok := err.(*wsHijackedError); !ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	s.startGoRoutine(func() {
+		s.createClient(conn, nil)
+		s.grWG.Done()
+	})
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebsocketConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/websocket.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.Websocket.Host != "127.0.0.1" || opts.Websocket.Port != 8080 {
+		t.Fatalf("Unexpected websocket options: %+v", opts.Websocket)
+	}
+	if opts.Websocket.TLSConfig != nil {
+		t.Fatal("Expected no TLS for the websocket listener")
+	}
+}
+
+// maskedFrame returns a frame as sent by a client.
+func maskedFrame(opcode byte, p []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	f := append([]byte{wsFinalBit | opcode, wsMaskBit | byte(len(p))}, mask...)
+	for i, b := range p {
+		f = append(f, b^mask[i&3])
+	}
+	return f
+}
+
+func TestWebsocketFrames(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	ws := &wsConn{Conn: srv, br: bufio.NewReader(srv)}
+
+	go func() {
+		cli.Write(maskedFrame(wsBinaryFrame, []byte("PING\r\n")))
+		cli.Write(maskedFrame(wsPingFrame, []byte("hi")))
+		cli.Write(maskedFrame(wsTextFrame, []byte("PONG\r\n")))
+		cli.Write(maskedFrame(wsCloseFrame, nil))
+	}()
+
+	buf := make([]byte, 64)
+	n, err := ws.Read(buf)
+	if err != nil || string(buf[:n]) != "PING\r\n" {
+		t.Fatalf("Unexpected read: %q, %v", buf[:n], err)
+	}
+	// The ping is answered before the next data frame is returned.
+	done := make(chan []byte)
+	go func() {
+		b := make([]byte, 4)
+		io.ReadFull(cli, b)
+		done <- b
+	}()
+	n, err = ws.Read(buf)
+	if err != nil || string(buf[:n]) != "PONG\r\n" {
+		t.Fatalf("Unexpected read: %q, %v", buf[:n], err)
+	}
+	if pong := <-done; pong[0] != wsFinalBit|wsPongFrame || string(pong[2:]) != "hi" {
+		t.Fatalf("Unexpected pong frame: %v", pong)
+	}
+	go io.Copy(io.Discard, cli)
+	if _, err := ws.Read(buf); err != io.EOF {
+		t.Fatalf("Expected EOF after a close frame, got %v", err)
+	}
+
+	// Frames from clients must be masked.
+	cli2, srv2 := net.Pipe()
+	defer cli2.Close()
+	go func() {
+		cli2.Write([]byte{wsFinalBit | wsBinaryFrame, 2, 'o', 'k'})
+		io.Copy(io.Discard, cli2)
+	}()
+	ws = &wsConn{Conn: srv2, br: bufio.NewReader(srv2)}
+	if _, err := ws.Read(buf); err != errWSUnmaskedFrame {
+		t.Fatalf("Expected an unmasked frame error, got %v", err)
+	}
+}
+
+// hijackRecorder records the HTTP response, and hands over a connection
+// the client already closed when hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cli, srv := net.Pipe()
+	cli.Close()
+	return srv, bufio.NewReadWriter(bufio.NewReader(srv), bufio.NewWriter(srv)), nil
+}
+
+func TestWebsocketUpgradeFailures(t *testing.T) {
+	s := New(&Options{})
+	s.running = true
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-Websocket-Version", "13")
+		r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return r
+	}
+
+	// Rejected before the hijack with an HTTP error.
+	r := newRequest()
+	r.Header.Del("Sec-Websocket-Key")
+	w := &hijackRecorder{httptest.NewRecorder()}
+	s.handleWebsocket(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Failing to send the handshake response, once hijacked.
+	w = &hijackRecorder{httptest.NewRecorder()}
+	s.handleWebsocket(w, newRequest())
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("Unexpected response on the hijacked connection: %d %q", w.Code, w.Body)
+	}
+}
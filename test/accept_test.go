@@ -0,0 +1,71 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+// expectRejected checks that the connection is closed without an INFO.
+func expectRejected(t *testing.T, c net.Conn) {
+	buf := make([]byte, 512)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := c.Read(buf)
+	if err == nil || n > 0 {
+		t.Fatalf("Expected the connection to be rejected, got %q, %v", buf[:n], err)
+	}
+	// Not answered is not rejected, the server must close it.
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestAcceptFilters(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/accept.conf")
+	defer s.Shutdown()
+
+	// Two client connections from localhost are accepted at once.
+	for i := 0; i < 2; i++ {
+		c := createClientConn(t, opts.Host, opts.Port)
+		defer c.Close()
+		checkInfoMsg(t, c)
+	}
+	c := createClientConn(t, opts.Host, opts.Port)
+	defer c.Close()
+	expectRejected(t, c)
+
+	// Routes from localhost are denied.
+	rc := createRouteConn(t, opts.Cluster.Host, opts.Cluster.Port)
+	defer rc.Close()
+	expectRejected(t, rc)
+
+	resetPreviousHTTPConnections()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/varz", opts.HTTPPort))
+	if err != nil {
+		t.Fatalf("Expected no error: Got %v\n", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Got an error reading the body: %v\n", err)
+	}
+	v := server.Varz{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("Got an error unmarshalling the body: %v\n", err)
+	}
+	if v.Rejected["client"].RateLimited != 1 || v.Rejected["cluster"].Denied != 1 ||
+		v.Rejected["http"] != (server.RejectStats{}) {
+		t.Fatalf("Unexpected rejected connections in varz: %+v", v.Rejected)
+	}
+	if v.TotalConnections != 2 {
+		t.Fatalf("Expected rejected connections not to be counted, got %d", v.TotalConnections)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+func setupAccountConn(t *testing.T, opts *server.Options, user, pass string) (net.Conn, sendFun, expectFun) {
+	c := createClientConn(t, opts.Host, opts.Port)
+	checkInfoMsg(t, c)
+	cs := fmt.Sprintf("CONNECT {\"verbose\":false,\"pedantic\":false,\"user\":%q,\"pass\":%q}\r\n", user, pass)
+	sendProto(t, c, cs)
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+	send("PING\r\n")
+	expect(pongRe)
+	return c, send, expect
+}
+
+func TestAccountsIsolation(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/srv_a_accounts.conf")
+	defer s.Shutdown()
+
+	ac, aSend, aExpect := setupAccountConn(t, opts, "alice", "foo")
+	defer ac.Close()
+	bc, bSend, bExpect := setupAccountConn(t, opts, "bob", "bar")
+	defer bc.Close()
+	cc, cSend, cExpect := setupAccountConn(t, opts, "carol", "baz")
+	defer cc.Close()
+
+	aSend("SUB foo 1\r\nPING\r\n")
+	aExpect(pongRe)
+	cSend("SUB foo 1\r\nPING\r\n")
+	cExpect(pongRe)
+
+	// Same subject in another account is not delivered.
+	bSend("PUB foo 2\r\nok\r\nPING\r\n")
+	bExpect(pongRe)
+	expectNothing(t, ac)
+	expectNothing(t, cc)
+
+	aSend("PUB foo 2\r\nok\r\nPING\r\n")
+	matches := expectMsgsCommand(t, aExpect)(1)
+	checkMsg(t, matches[0], "foo", "1", "", "2", "ok")
+	expectNothing(t, cc)
+}
+
+func TestAccountsStreamImport(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/srv_a_accounts.conf")
+	defer s.Shutdown()
+
+	ac, aSend, aExpect := setupAccountConn(t, opts, "alice", "foo")
+	defer ac.Close()
+	bc, bSend, bExpect := setupAccountConn(t, opts, "bob", "bar")
+	defer bc.Close()
+
+	bSend("SUB public.news 1\r\nSUB private.news 2\r\nPING\r\n")
+	bExpect(pongRe)
+	aSend("SUB public.news 1\r\nPING\r\n")
+	aExpect(pongRe)
+
+	aSend("PUB public.news 2\r\nok\r\nPUB private.news 2\r\nok\r\nPING\r\n")
+	matches := expectMsgsCommand(t, bExpect)(1)
+	checkMsg(t, matches[0], "public.news", "1", "", "2", "ok")
+	matches = expectMsgsCommand(t, aExpect)(1)
+	checkMsg(t, matches[0], "public.news", "1", "", "2", "ok")
+
+	// Imports are one way.
+	bSend("PUB public.news 2\r\nok\r\nPING\r\n")
+	matches = expectMsgsCommand(t, bExpect)(1)
+	checkMsg(t, matches[0], "public.news", "1", "", "2", "ok")
+	expectNothing(t, ac)
+}
+
+func TestAccountsServiceImport(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/srv_a_accounts.conf")
+	defer s.Shutdown()
+
+	ac, aSend, aExpect := setupAccountConn(t, opts, "alice", "foo")
+	defer ac.Close()
+	bc, bSend, bExpect := setupAccountConn(t, opts, "bob", "bar")
+	defer bc.Close()
+
+	aSend("SUB help.me 1\r\nPING\r\n")
+	aExpect(pongRe)
+
+	bSend("SUB _INBOX.22 1\r\nPUB help.me _INBOX.22 3\r\nask\r\nPING\r\n")
+	bExpect(pongRe)
+
+	matches := expectMsgsCommand(t, aExpect)(1)
+	checkMsg(t, matches[0], "help.me", "1", "_INBOX.22", "3", "ask")
+
+	aSend("PUB _INBOX.22 3\r\nyes\r\nPING\r\n")
+	aExpect(pongRe)
+	matches = expectMsgsCommand(t, bExpect)(1)
+	checkMsg(t, matches[0], "_INBOX.22", "1", "", "3", "yes")
+
+	// Only one response is routed back.
+	aSend("PUB _INBOX.22 3\r\nyes\r\nPING\r\n")
+	aExpect(pongRe)
+	expectNothing(t, bc)
+}
+
+func TestAccountsAcrossRoutes(t *testing.T) {
+	srvA, optsA := RunServerWithConfig("./configs/srv_a_accounts.conf")
+	defer srvA.Shutdown()
+	srvB, optsB := RunServerWithConfig("./configs/srv_b_accounts.conf")
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	// Each server has the two import subscriptions.
+	if err := checkExpectedSubs(2, srvA, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ac, aSend, aExpect := setupAccountConn(t, optsA, "alice", "foo")
+	defer ac.Close()
+	bc, bSend, bExpect := setupAccountConn(t, optsB, "bob", "bar")
+	defer bc.Close()
+	cc, cSend, cExpect := setupAccountConn(t, optsB, "carol", "baz")
+	defer cc.Close()
+
+	aSend("SUB help.me 1\r\nPING\r\n")
+	aExpect(pongRe)
+	bSend("SUB public.news 1\r\nSUB foo 2\r\nSUB _INBOX.22 3\r\nPING\r\n")
+	bExpect(pongRe)
+	cSend("SUB foo 1\r\nPING\r\n")
+	cExpect(pongRe)
+	if err := checkExpectedSubs(7, srvA, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Streams are imported from the remote account.
+	aSend("PUB public.news 2\r\nok\r\nPUB foo 2\r\nok\r\nPING\r\n")
+	aExpect(pongRe)
+	matches := expectMsgsCommand(t, bExpect)(1)
+	checkMsg(t, matches[0], "public.news", "1", "", "2", "ok")
+	expectNothing(t, cc)
+
+	// Requests and responses cross the route.
+	bSend("PUB help.me _INBOX.22 3\r\nask\r\nPING\r\n")
+	bExpect(pongRe)
+	matches = expectMsgsCommand(t, aExpect)(1)
+	checkMsg(t, matches[0], "help.me", "1", "_INBOX.22", "3", "ask")
+
+	aSend("PUB _INBOX.22 3\r\nyes\r\nPING\r\n")
+	aExpect(pongRe)
+	matches = expectMsgsCommand(t, bExpect)(1)
+	checkMsg(t, matches[0], "_INBOX.22", "3", "", "3", "yes")
+}
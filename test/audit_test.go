@@ -0,0 +1,180 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/glycerine/hnatsd/auth"
+	"github.com/glycerine/hnatsd/server"
+)
+
+const (
+	AUDIT_PORT    = 4301
+	AUDIT_WS_PORT = 4311
+)
+
+var tooManyRe = regexp.MustCompile(`\-ERR\s+'Too Many Violations'\r\n`)
+
+// runAuditServer runs a server closing the connections after 3
+// violations, and banning their source IP for a second. It accepts
+// websocket clients too.
+func runAuditServer(t *testing.T) (*server.Server, string) {
+	f, err := ioutil.TempFile("", "hnatsd_audit")
+	if err != nil {
+		t.Fatalf("Error creating the audit log: %v", err)
+	}
+	f.Close()
+
+	opts := DefaultTestOptions
+	opts.Host = "127.0.0.1"
+	opts.Port = AUDIT_PORT
+	opts.Websocket = server.WebsocketOpts{Host: "127.0.0.1", Port: AUDIT_WS_PORT}
+	opts.Users = []*server.User{{
+		Username:    "alice",
+		Password:    DefaultPass,
+		Permissions: &server.Permissions{Publish: []string{"foo"}},
+	}}
+	opts.Audit = &server.AuditOpts{File: f.Name(), MaxViolations: 3, Window: time.Minute, Ban: time.Second}
+	return RunServerWithAuth(&opts, auth.NewUsers(opts.Users)), f.Name()
+}
+
+// readAudit returns the types of the events in the audit log.
+func readAudit(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error opening the audit log: %v", err)
+	}
+	defer f.Close()
+	var types []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev server.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("Error unmarshalling the audit event %q: %v", scanner.Text(), err)
+		}
+		if ev.IP != "127.0.0.1" {
+			t.Fatalf("Unexpected source IP in %+v", ev)
+		}
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+// expectClosed reads until the connection is closed and returns
+// what was received.
+func expectClosed(t *testing.T, c net.Conn) []byte {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+	return buf
+}
+
+func checkAuditTypes(t *testing.T, types []string, expected ...string) {
+	if len(types) != len(expected) {
+		t.Fatalf("Expected audit events %v, got %v", expected, types)
+	}
+	for i := range types {
+		if types[i] != expected[i] {
+			t.Fatalf("Expected audit events %v, got %v", expected, types)
+		}
+	}
+}
+
+func TestAuditPermissionViolations(t *testing.T) {
+	s, path := runAuditServer(t)
+	defer os.Remove(path)
+	defer s.Shutdown()
+
+	c := createClientConn(t, "127.0.0.1", AUDIT_PORT)
+	defer c.Close()
+	checkInfoMsg(t, c)
+	doAuthConnect(t, c, "", "alice", DefaultPass)
+	expectResult(t, c, okRe)
+	sendProto(t, c, "PUB bar 2\r\nok\r\n")
+	expectResult(t, c, permErrRe)
+	sendProto(t, c, "SUB bar 1\r\n")
+	expectResult(t, c, permErrRe)
+
+	// The third violation closes the connection and bans the source.
+	sendProto(t, c, "PUB baz 2\r\nok\r\n")
+	if buf := expectClosed(t, c); !tooManyRe.Match(buf) {
+		t.Fatalf("Expected %q, got %q", tooManyRe, buf)
+	}
+	c2 := createClientConn(t, "127.0.0.1", AUDIT_PORT)
+	defer c2.Close()
+	expectRejected(t, c2)
+
+	time.Sleep(1100 * time.Millisecond)
+	c3 := createClientConn(t, "127.0.0.1", AUDIT_PORT)
+	defer c3.Close()
+	checkInfoMsg(t, c3)
+
+	checkAuditTypes(t, readAudit(t, path),
+		server.AuditPublishViolation, server.AuditSubscribeViolation, server.AuditPublishViolation,
+		server.AuditEscalation, server.AuditBan)
+}
+
+func TestAuditAuthFailures(t *testing.T) {
+	s, path := runAuditServer(t)
+	defer os.Remove(path)
+	defer s.Shutdown()
+
+	// Failures are counted across the connections from a source.
+	for i := 0; i < 3; i++ {
+		c := createClientConn(t, "127.0.0.1", AUDIT_PORT)
+		checkInfoMsg(t, c)
+		doAuthConnect(t, c, "", "alice", "wrong")
+		buf := expectClosed(t, c)
+		if !errRe.Match(buf) || (i == 2) != tooManyRe.Match(buf) {
+			t.Fatalf("Unexpected response to connection %d: %q", i, buf)
+		}
+		c.Close()
+	}
+	c := createClientConn(t, "127.0.0.1", AUDIT_PORT)
+	defer c.Close()
+	expectRejected(t, c)
+
+	checkAuditTypes(t, readAudit(t, path),
+		server.AuditAuthFailure, server.AuditAuthFailure, server.AuditAuthFailure,
+		server.AuditEscalation, server.AuditBan)
+	if n := s.Varz().Rejected["client"].Banned; n != 1 {
+		t.Fatalf("Expected 1 banned connection, got %d", n)
+	}
+}
+
+func TestAuditBanWebsocket(t *testing.T) {
+	s, path := runAuditServer(t)
+	defer os.Remove(path)
+	defer s.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		c := createClientConn(t, "127.0.0.1", AUDIT_PORT)
+		checkInfoMsg(t, c)
+		doAuthConnect(t, c, "", "alice", "wrong")
+		expectClosed(t, c)
+		c.Close()
+	}
+
+	// The banned source is refused on the websocket listener too.
+	c := createClientConn(t, "127.0.0.1", AUDIT_WS_PORT)
+	defer c.Close()
+	expectRejected(t, c)
+	if n := s.Varz().Rejected["client"].Banned; n != 1 {
+		t.Fatalf("Expected 1 banned connection, got %d", n)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	wc := createWebsocketConn(t, "127.0.0.1", AUDIT_WS_PORT)
+	defer wc.Close()
+	checkInfoMsg(t, wc)
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/glycerine/go-nats"
+	"github.com/glycerine/hnatsd/auth"
+	"github.com/glycerine/hnatsd/server"
+)
+
+// calloutService answers the auth callout requests: carol is allowed to
+// publish on foo, dave is put in an unknown account, others are denied.
+func calloutService(t *testing.T, data []byte) []byte {
+	var req auth.CalloutRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatalf("Error unmarshalling the callout request: %v", err)
+	}
+	resp := auth.CalloutResponse{Error: "unknown user"}
+	switch {
+	case req.User == "carol" && req.Pass == "secret":
+		resp = auth.CalloutResponse{
+			Allow:       true,
+			Account:     "ops",
+			Permissions: &server.Permissions{Publish: []string{"foo"}, Subscribe: []string{"foo"}},
+		}
+	case req.User == "dave":
+		resp = auth.CalloutResponse{Allow: true, Account: "nowhere"}
+	}
+	b, _ := json.Marshal(resp)
+	return b
+}
+
+func TestAuthCalloutSubject(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/auth_callout.conf")
+	defer s.Shutdown()
+	url := fmt.Sprintf("nats://%%s:%%s@%s:%d", opts.Host, opts.Port)
+
+	// The auth service is the system user, checked locally.
+	svc, err := nats.Connect(fmt.Sprintf(url, "admin", "sys"))
+	if err != nil {
+		t.Fatalf("Could not connect the auth service: %v", err)
+	}
+	defer svc.Close()
+	var requests int32
+	sub, err := svc.Subscribe(server.DEFAULT_AUTH_CALLOUT_SUBJECT, func(m *nats.Msg) {
+		atomic.AddInt32(&requests, 1)
+		svc.Publish(m.Reply, calloutService(t, m.Data))
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	svc.Flush()
+
+	nc, err := nats.Connect(fmt.Sprintf(url, "carol", "secret"))
+	if err != nil {
+		t.Fatalf("Expected carol to be allowed: %v", err)
+	}
+	defer nc.Close()
+
+	// The permissions of the auth service apply.
+	errCh := make(chan error, 1)
+	nc.SetErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		errCh <- err
+	})
+	nc.Publish("bar", []byte("hello"))
+	nc.Flush()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a permissions violation publishing on bar")
+	}
+
+	// The decision is cached.
+	nc2, err := nats.Connect(fmt.Sprintf(url, "carol", "secret"))
+	if err != nil {
+		t.Fatalf("Expected carol to be allowed: %v", err)
+	}
+	nc2.Close()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected 1 callout request, got %d", n)
+	}
+
+	for _, user := range []string{"mallory", "dave", "admin"} {
+		if nc, err := nats.Connect(fmt.Sprintf(url, user, "nope")); err == nil {
+			nc.Close()
+			t.Fatalf("Expected %s to be denied", user)
+		}
+	}
+	// Local users are never asked to the auth service.
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("Expected 3 callout requests, got %d", n)
+	}
+
+	// Clients are denied when the auth service does not answer.
+	sub.Unsubscribe()
+	svc.Flush()
+	start := time.Now()
+	if nc, err := nats.Connect(fmt.Sprintf(url, "carol", "other")); err == nil {
+		nc.Close()
+		t.Fatal("Expected carol to be denied without the auth service")
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Fatalf("Expected the callout to wait for the timeout, took %v", d)
+	}
+}
+
+func TestAuthCalloutHTTP(t *testing.T) {
+	var requests int32
+	var delay atomic.Value
+	delay.Store(time.Duration(0))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(delay.Load().(time.Duration))
+		var data json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(calloutService(t, data))
+	}))
+	defer ts.Close()
+
+	opts := DefaultTestOptions
+	opts.Port = 4298
+	opts.Accounts = []*server.AccountOpts{{Name: "ops"}}
+	opts.AuthCallout = &server.AuthCalloutOpts{URL: ts.URL, Timeout: 250 * time.Millisecond, TTL: time.Minute}
+	s := RunServer(&opts)
+	defer s.Shutdown()
+	s.SetClientAuthMethod(auth.NewCallout(s, &opts, nil))
+	url := fmt.Sprintf("nats://%%s:%%s@%s:%d", opts.Host, opts.Port)
+
+	for i := 0; i < 2; i++ {
+		nc, err := nats.Connect(fmt.Sprintf(url, "carol", "secret"))
+		if err != nil {
+			t.Fatalf("Expected carol to be allowed: %v", err)
+		}
+		nc.Close()
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("Expected 1 callout request, got %d", n)
+	}
+	if nc, err := nats.Connect(fmt.Sprintf(url, "mallory", "secret")); err == nil {
+		nc.Close()
+		t.Fatal("Expected mallory to be denied")
+	}
+
+	// Clients are denied when the auth service is too slow.
+	delay.Store(time.Second)
+	if nc, err := nats.Connect(fmt.Sprintf(url, "carol", "other")); err == nil {
+		nc.Close()
+		t.Fatal("Expected carol to be denied when the auth service times out")
+	}
+}
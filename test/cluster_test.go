@@ -5,7 +5,9 @@ package test
 import (
 	"errors"
 	"fmt"
+	"net"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -442,3 +444,192 @@ func TestAutoUnsubscribePropagation(t *testing.T) {
 		t.Fatalf("Expected no subscriptions on remote server, got %d\n", subs)
 	}
 }
+
+func runQueueServers(t *testing.T) []*server.Server {
+	srvA, _ := RunServerWithConfig("./configs/srv_qa.conf")
+	srvB, _ := RunServerWithConfig("./configs/srv_qb.conf")
+	srvC, _ := RunServerWithConfig("./configs/srv_qc.conf")
+	servers := []*server.Server{srvA, srvB, srvC}
+	checkClusterFormed(t, servers...)
+	return servers
+}
+
+// queueMsgs returns the payloads of the messages received so far, after
+// giving them time to be routed.
+func queueMsgs(t *testing.T, c net.Conn) []string {
+	time.Sleep(250 * time.Millisecond)
+	sendProto(t, c, "PING\r\n")
+	var buf []byte
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	for !pongRe.Match(buf) {
+		b := make([]byte, 32768)
+		n, err := c.Read(b)
+		if err != nil {
+			t.Fatalf("Error reading from conn: %v\n", err)
+		}
+		buf = append(buf, b[:n]...)
+	}
+	var payloads []string
+	for _, m := range msgRe.FindAllSubmatch(buf, -1) {
+		payloads = append(payloads, string(m[msgIndex]))
+	}
+	return payloads
+}
+
+// checkOnce checks that each message was received by exactly one member.
+func checkOnce(t *testing.T, sent int, received ...[]string) {
+	seen := make(map[string]bool)
+	for _, payloads := range received {
+		for _, p := range payloads {
+			if seen[p] {
+				t.Fatalf("Message %q was delivered twice", p)
+			}
+			seen[p] = true
+		}
+	}
+	if len(seen) != sent {
+		t.Fatalf("Expected %d messages to be delivered, got %d", sent, len(seen))
+	}
+}
+
+func TestClusterQueueSubsPreferLocal(t *testing.T) {
+	servers := runQueueServers(t)
+	for _, s := range servers {
+		defer s.Shutdown()
+	}
+
+	// One member of the queue group on each server.
+	var conns []net.Conn
+	for _, s := range servers {
+		c := createClientConn(t, "127.0.0.1", s.Addr().(*net.TCPAddr).Port)
+		defer c.Close()
+		send, expect := setupConn(t, c)
+		send("SUB foo bar 1\r\nPING\r\n")
+		expect(pongRe)
+		conns = append(conns, c)
+	}
+	if err := checkExpectedSubs(3, servers...); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Each member only gets the messages published on its own server.
+	for i, c := range conns {
+		for j := 0; j < 20; j++ {
+			sendProto(t, c, fmt.Sprintf("PUB foo 4\r\n%d%03d\r\n", i, j))
+		}
+	}
+	var received [][]string
+	for i, c := range conns {
+		payloads := queueMsgs(t, c)
+		for _, p := range payloads {
+			if p[0] != byte('0'+i) {
+				t.Fatalf("Expected member %d to only get local messages, got %q", i, p)
+			}
+		}
+		received = append(received, payloads)
+	}
+	checkOnce(t, 60, received...)
+}
+
+func TestClusterQueueSubsRemoteFallback(t *testing.T) {
+	servers := runQueueServers(t)
+	for _, s := range servers {
+		defer s.Shutdown()
+	}
+
+	// Two members of the queue group on B and C, none on A, and
+	// a plain subscriber on C.
+	var members []net.Conn
+	for _, s := range servers[1:] {
+		for i := 0; i < 2; i++ {
+			c := createClientConn(t, "127.0.0.1", s.Addr().(*net.TCPAddr).Port)
+			defer c.Close()
+			send, expect := setupConn(t, c)
+			send("SUB foo bar 1\r\nPING\r\n")
+			expect(pongRe)
+			members = append(members, c)
+		}
+	}
+	plain := createClientConn(t, "127.0.0.1", servers[2].Addr().(*net.TCPAddr).Port)
+	defer plain.Close()
+	plainSend, plainExpect := setupConn(t, plain)
+	plainSend("SUB foo 1\r\nPING\r\n")
+	plainExpect(pongRe)
+	if err := checkExpectedSubs(5, servers...); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	pub := createClientConn(t, "127.0.0.1", servers[0].Addr().(*net.TCPAddr).Port)
+	defer pub.Close()
+	pubSend, pubExpect := setupConn(t, pub)
+	for i := 0; i < 100; i++ {
+		pubSend(fmt.Sprintf("PUB foo 3\r\n%03d\r\n", i))
+	}
+	pubSend("PING\r\n")
+	pubExpect(pongRe)
+
+	var received [][]string
+	servedB, servedC := 0, 0
+	for i, c := range members {
+		payloads := queueMsgs(t, c)
+		if i < 2 {
+			servedB += len(payloads)
+		} else {
+			servedC += len(payloads)
+		}
+		received = append(received, payloads)
+	}
+	checkOnce(t, 100, received...)
+	if servedB == 0 || servedC == 0 {
+		t.Fatalf("Expected remote members on both servers to be used, got %d and %d", servedB, servedC)
+	}
+	checkOnce(t, 100, queueMsgs(t, plain))
+}
+
+func TestClusterQueueSubDeparted(t *testing.T) {
+	s, opts := runRouteServer(t)
+	defer s.Shutdown()
+
+	client := createClientConn(t, opts.Host, opts.Port)
+	defer client.Close()
+	clientSend, clientExpect := setupConn(t, client)
+	clientExpectMsgs := expectMsgsCommand(t, clientExpect)
+
+	route := createRouteConn(t, opts.Cluster.Host, opts.Cluster.Port)
+	defer route.Close()
+	expectAuthRequired(t, route)
+	routeSend, routeExpect := setupRouteEx(t, route, opts, "ROUTER:xyz")
+	routeSend("INFO {\"server_id\":\"ROUTER:xyz\"}\r\n")
+
+	clientSend("SUB foo bar 1\r\nSUB foo bar 2\r\nPING\r\n")
+	clientExpect(pongRe)
+
+	// Collect the sids the route uses to deliver to the two members.
+	var rsids []string
+	for len(rsids) < 2 {
+		buf := routeExpect(subRe)
+		for _, m := range subRe.FindAllSubmatch(buf, -1) {
+			rsids = append(rsids, string(m[5]))
+		}
+	}
+
+	// The first member leaves while a message is routed to it.
+	clientSend("UNSUB 1\r\nPING\r\n")
+	clientExpect(pongRe)
+	routeExpect(unsubRe)
+	for _, rsid := range rsids {
+		if strings.HasSuffix(rsid, ":1") {
+			routeSend(fmt.Sprintf("MSG foo %s 2\r\nok\r\n", rsid))
+		}
+	}
+
+	// The remaining member gets it.
+	matches := clientExpectMsgs(1)
+	checkMsg(t, matches[0], "foo", "2", "", "2", "ok")
+
+	// Messages to unknown members are still dropped.
+	routeSend("MSG foo QRSID:99:1 2\r\nok\r\nPING\r\n")
+	routeExpect(pongRe)
+	expectNothing(t, client)
+}
@@ -4,6 +4,7 @@ package test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/glycerine/hnatsd/server"
 )
@@ -51,3 +52,24 @@ func TestBasicTLSClusterPubSub(t *testing.T) {
 	matches := expectMsgs(1)
 	checkMsg(t, matches[0], "foo", "22", "", "2", "ok")
 }
+
+func TestTLSMapClusterRoutes(t *testing.T) {
+	srvA, _ := RunServerWithConfig("./configs/srv_a_tls_map.conf")
+	defer srvA.Shutdown()
+	srvB, _ := RunServerWithConfig("./configs/srv_b_tls_map.conf")
+	defer srvB.Shutdown()
+
+	// The certificate of the route maps to a cluster user.
+	checkClusterFormed(t, srvA, srvB)
+
+	// A route with a certificate which is not a user is rejected.
+	srvC, _ := RunServerWithConfig("./configs/srv_c_tls_map.conf")
+	defer srvC.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	if n := srvC.NumRoutes(); n != 0 {
+		t.Fatalf("Expected the unmapped route to be rejected, got %d routes", n)
+	}
+	if n := srvA.NumRoutes(); n != 1 {
+		t.Fatalf("Expected 1 route, got %d", n)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/glycerine/go-nats"
+	"github.com/glycerine/hnatsd/server"
+)
+
+func eventsURL(opts *server.Options, user, pass string) string {
+	return fmt.Sprintf("nats://%s:%s@%s:%d/", user, pass, opts.Host, opts.Port)
+}
+
+func subscribeEvents(t *testing.T, opts *server.Options) (*nats.Conn, *nats.Subscription) {
+	nc, err := nats.Connect(eventsURL(opts, "admin", "sys"))
+	if err != nil {
+		t.Fatalf("Could not connect the system user: %v", err)
+	}
+	sub, err := nc.SubscribeSync("_SYS.>")
+	if err != nil {
+		t.Fatalf("Error subscribing to system events: %v", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	return nc, sub
+}
+
+func checkNextEvent(t *testing.T, sub *nats.Subscription, subject string, ev interface{}) {
+	m, err := sub.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatalf("Did not receive event on %q: %v", subject, err)
+	}
+	if m.Subject != subject {
+		t.Fatalf("Expected event on %q, got %q: %s", subject, m.Subject, m.Data)
+	}
+	if err := json.Unmarshal(m.Data, ev); err != nil {
+		t.Fatalf("Error unmarshalling event: %v", err)
+	}
+}
+
+// waitForEvent skips the events on other subjects, the
+// routes of a cluster can be connected more than once.
+func waitForEvent(t *testing.T, sub *nats.Subscription, subject string, ev interface{}) {
+	timeout := time.Now().Add(2 * time.Second)
+	for time.Now().Before(timeout) {
+		m, err := sub.NextMsg(time.Until(timeout))
+		if err != nil {
+			break
+		}
+		if m.Subject == subject {
+			if err := json.Unmarshal(m.Data, ev); err != nil {
+				t.Fatalf("Error unmarshalling event: %v", err)
+			}
+			return
+		}
+	}
+	t.Fatalf("Did not receive event on %q", subject)
+}
+
+func TestSystemClientEvents(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/srv_a_events.conf")
+	defer s.Shutdown()
+
+	nc, sub := subscribeEvents(t, opts)
+	defer nc.Close()
+
+	anc, err := nats.Connect(eventsURL(opts, "alice", "foo"), nats.Name("events"))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	var ev server.ClientEvent
+	checkNextEvent(t, sub, server.SysEventSubject(s.ID(), server.EventClientConnect), &ev)
+	if ev.Type != server.EventClientConnect || ev.Server != s.ID() {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	if ev.Client.AuthorizedUser != "alice" || ev.Client.Name != "events" || ev.Client.IP == "" {
+		t.Fatalf("Unexpected client in event: %+v", ev.Client)
+	}
+	cid := ev.Client.Cid
+
+	anc.Close()
+	ev = server.ClientEvent{}
+	checkNextEvent(t, sub, server.SysEventSubject(s.ID(), server.EventClientDisconnect), &ev)
+	if ev.Client.Cid != cid || ev.Client.AuthorizedUser != "alice" {
+		t.Fatalf("Unexpected client in event: %+v", ev.Client)
+	}
+
+	if _, err := nats.Connect(eventsURL(opts, "alice", "bad")); err == nil {
+		t.Fatal("Expected the connection to fail")
+	}
+	ev = server.ClientEvent{}
+	checkNextEvent(t, sub, server.SysEventSubject(s.ID(), server.EventClientAuthError), &ev)
+	if ev.Client.AuthorizedUser != "alice" {
+		t.Fatalf("Unexpected client in event: %+v", ev.Client)
+	}
+	// A failed authorization is not reported as a disconnect.
+	if m, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected event on %q", m.Subject)
+	}
+}
+
+func TestSystemSubjectsRestricted(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/srv_a_events.conf")
+	defer s.Shutdown()
+
+	c, send, expect := setupAccountConn(t, opts, "alice", "foo")
+	defer c.Close()
+
+	send("SUB _SYS.> 1\r\n")
+	expect(permErrRe)
+
+	// Wildcard subscriptions do not receive the events.
+	send("SUB > 2\r\nPING\r\n")
+	expect(pongRe)
+	nc, err := nats.Connect(eventsURL(opts, "admin", "sys"))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	nc.Close()
+	expectNothing(t, c)
+
+	// Nor can they be published by clients.
+	send("PUB _SYS.SERVER.x.CLIENT.CONNECT 2\r\nok\r\n")
+	expect(permErrRe)
+}
+
+func TestSystemRouteEvents(t *testing.T) {
+	srvA, optsA := RunServerWithConfig("./configs/srv_a_events.conf")
+	defer srvA.Shutdown()
+
+	nc, sub := subscribeEvents(t, optsA)
+	defer nc.Close()
+
+	srvB, optsB := RunServerWithConfig("./configs/srv_b_events.conf")
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	var rev server.RouteEvent
+	waitForEvent(t, sub, server.SysEventSubject(srvA.ID(), server.EventRouteConnect), &rev)
+	if rev.Route.RemoteID != srvB.ID() {
+		t.Fatalf("Unexpected route in event: %+v", rev.Route)
+	}
+	// The system user's subscription and the request and reply
+	// subscriptions of the servers are propagated through the route.
+	if err := checkExpectedSubs(7, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Events of the other server are received through the route.
+	bnc, err := nats.Connect(eventsURL(optsB, "alice", "foo"))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	var ev server.ClientEvent
+	waitForEvent(t, sub, server.SysEventSubject(srvB.ID(), server.EventClientConnect), &ev)
+	if ev.Server != srvB.ID() || ev.Client.AuthorizedUser != "alice" {
+		t.Fatalf("Unexpected event: %+v", ev)
+	}
+	bnc.Close()
+	waitForEvent(t, sub, server.SysEventSubject(srvB.ID(), server.EventClientDisconnect), &ev)
+
+	srvB.Shutdown()
+	rev = server.RouteEvent{}
+	waitForEvent(t, sub, server.SysEventSubject(srvA.ID(), server.EventRouteDisconnect), &rev)
+	if rev.Route.RemoteID != srvB.ID() {
+		t.Fatalf("Unexpected route in event: %+v", rev.Route)
+	}
+}
+
+func sysRequest(t *testing.T, nc *nats.Conn, subject, data string, v interface{}) {
+	m, err := nc.Request(subject, []byte(data), 2*time.Second)
+	if err != nil {
+		t.Fatalf("Error on request to %q: %v", subject, err)
+	}
+	if err := json.Unmarshal(m.Data, v); err != nil {
+		t.Fatalf("Error unmarshalling response: %v", err)
+	}
+}
+
+func TestSystemMonitoringRequests(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/srv_a_events.conf")
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(eventsURL(opts, "admin", "sys"))
+	if err != nil {
+		t.Fatalf("Could not connect the system user: %v", err)
+	}
+	defer nc.Close()
+	anc, err := nats.Connect(eventsURL(opts, "alice", "foo"))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer anc.Close()
+	for _, subj := range []string{"foo", "bar"} {
+		if _, err := anc.SubscribeSync(subj); err != nil {
+			t.Fatalf("Error subscribing: %v", err)
+		}
+	}
+	anc.Flush()
+
+	var v server.Varz
+	sysRequest(t, nc, server.SysRequestSubject(s.ID(), server.ReqVarz), "", &v)
+	if v.ID != s.ID() || v.Connections != 2 {
+		t.Fatalf("Unexpected varz: %+v", v)
+	}
+
+	var c server.Connz
+	sysRequest(t, nc, server.SysRequestSubject(s.ID(), server.ReqConnz),
+		`{"sort":"subs","auth":true,"subscriptions":true,"limit":1}`, &c)
+	if c.Total != 2 || len(c.Conns) != 1 {
+		t.Fatalf("Unexpected connz: %+v", c)
+	}
+	if ci := c.Conns[0]; ci.AuthorizedUser != "alice" || len(ci.Subs) != 2 {
+		t.Fatalf("Unexpected connection: %+v", ci)
+	}
+
+	var r server.Routez
+	sysRequest(t, nc, server.SysRequestSubject(s.ID(), server.ReqRoutez), "", &r)
+	if r.NumRoutes != 0 {
+		t.Fatalf("Unexpected routez: %+v", r)
+	}
+
+	var sz server.Subsz
+	sysRequest(t, nc, server.SysRequestSubject(s.ID(), server.ReqSubsz), "", &sz)
+	if sz.SublistStats == nil || sz.NumSubs == 0 {
+		t.Fatalf("Unexpected subsz: %+v", sz)
+	}
+
+	var e server.SysErrorResponse
+	sysRequest(t, nc, server.SysRequestSubject(s.ID(), server.ReqConnz), `{"sort":"foo"}`, &e)
+	if e.Error == "" {
+		t.Fatal("Expected an error for an invalid sort option")
+	}
+	e = server.SysErrorResponse{}
+	sysRequest(t, nc, server.SysRequestSubject(s.ID(), "FOO"), "", &e)
+	if e.Error == "" {
+		t.Fatal("Expected an error for an unknown request")
+	}
+
+	// Other users can not send requests to the server.
+	if _, err := anc.Request(server.SysRequestSubject(s.ID(), server.ReqVarz), nil, 250*time.Millisecond); err == nil {
+		t.Fatal("Expected the request to fail")
+	}
+}
+
+func TestSystemClusterPing(t *testing.T) {
+	srvA, optsA := RunServerWithConfig("./configs/srv_a_events.conf")
+	defer srvA.Shutdown()
+	srvB, optsB := RunServerWithConfig("./configs/srv_b_events.conf")
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+	if err := checkExpectedSubs(6, srvA, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	nc, err := nats.Connect(eventsURL(optsA, "admin", "sys"))
+	if err != nil {
+		t.Fatalf("Could not connect the system user: %v", err)
+	}
+	defer nc.Close()
+
+	// A server is reached through the route.
+	var v server.Varz
+	sysRequest(t, nc, server.SysRequestSubject(srvB.ID(), server.ReqVarz), "", &v)
+	if v.ID != srvB.ID() || v.Port != optsB.Port {
+		t.Fatalf("Unexpected varz: %+v", v)
+	}
+
+	// Every server answers the ping.
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	if err := nc.PublishRequest(server.SysServerPing, inbox, nil); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		m, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Expected a response from every server: %v", err)
+		}
+		v := server.Varz{}
+		if err := json.Unmarshal(m.Data, &v); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		ids[v.ID] = true
+	}
+	if !ids[srvA.ID()] || !ids[srvB.ID()] {
+		t.Fatalf("Unexpected servers answering: %v", ids)
+	}
+	if m, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected response: %s", m.Data)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+var hmsgRe = regexp.MustCompile(`HMSG\s+([^\s]+)\s+([^\s]+)\s+(([^\s]+)[^\S\r\n]+)?(\d+)\s+(\d+)\r\n`)
+
+const hdrPayload = "NATS/1.0\r\nTrace-Id: 22\r\n\r\n"
+
+func setupHeadersConn(t tLogger, c net.Conn) (sendFun, expectFun) {
+	checkInfoMsg(t, c)
+	sendProto(t, c, "CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true}\r\n")
+	return sendCommand(t, c), expectCommand(t, c)
+}
+
+func TestHeadersAdvertisedInInfo(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	c := createClientConn(t, "localhost", PROTO_TEST_PORT)
+	defer c.Close()
+
+	info := checkInfoMsg(t, c)
+	if !info.Headers {
+		t.Fatalf("Expected server to advertise headers support")
+	}
+}
+
+func TestHeadersPubSub(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	pc := createClientConn(t, "localhost", PROTO_TEST_PORT)
+	defer pc.Close()
+	pubSend, pubExpect := setupHeadersConn(t, pc)
+
+	hc := createClientConn(t, "localhost", PROTO_TEST_PORT)
+	defer hc.Close()
+	hSend, hExpect := setupHeadersConn(t, hc)
+
+	lc := createClientConn(t, "localhost", PROTO_TEST_PORT)
+	defer lc.Close()
+	lSend, lExpect := setupConn(t, lc)
+	expectMsgs := expectMsgsCommand(t, lExpect)
+
+	hSend("SUB foo 1\r\nPING\r\n")
+	hExpect(pongRe)
+	lSend("SUB foo 2\r\nPING\r\n")
+	lExpect(pongRe)
+
+	total := len(hdrPayload) + len("hello")
+	pubSend(fmt.Sprintf("HPUB foo bar %d %d\r\n%shello\r\nPING\r\n", len(hdrPayload), total, hdrPayload))
+	pubExpect(pongRe)
+
+	// Header aware subscriber gets the full message.
+	buf := hExpect(hmsgRe)
+	m := hmsgRe.FindAllSubmatch(buf, -1)[0]
+	if string(m[1]) != "foo" || string(m[2]) != "1" || string(m[4]) != "bar" {
+		t.Fatalf("Unexpected HMSG: %q", buf)
+	}
+	if string(m[5]) != fmt.Sprintf("%d", len(hdrPayload)) || string(m[6]) != fmt.Sprintf("%d", total) {
+		t.Fatalf("Unexpected HMSG sizes: %q", buf)
+	}
+
+	// Legacy subscriber only gets the payload.
+	matches := expectMsgs(1)
+	checkMsg(t, matches[0], "foo", "2", "bar", "5", "hello")
+}
+
+func TestHeadersRequireNegotiation(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	c := createClientConn(t, "localhost", PROTO_TEST_PORT)
+	defer c.Close()
+	send, expect := setupConn(t, c)
+
+	send(fmt.Sprintf("HPUB foo %d %d\r\n%s\r\n", len(hdrPayload), len(hdrPayload), hdrPayload))
+	expect(errRe)
+}
+
+func TestHeadersForwardedToRoutes(t *testing.T) {
+	s, opts := runRouteServer(t)
+	defer s.Shutdown()
+
+	client := createClientConn(t, opts.Host, opts.Port)
+	defer client.Close()
+	clientSend, clientExpect := setupHeadersConn(t, client)
+
+	route := acceptRouteConn(t, opts.Routes[0].Host, server.DEFAULT_ROUTE_CONNECT)
+	defer route.Close()
+
+	routeSend, routeExpect := setupRouteEx(t, route, opts, "ROUTER:HDR")
+
+	// Eat the CONNECT and INFO protos
+	buf := routeExpect(connectRe)
+	if !infoRe.Match(buf) {
+		routeExpect(infoRe)
+	}
+
+	// Tell the server this route understands headers.
+	routeSend("INFO {\"server_id\":\"ROUTER:HDR\",\"headers\":true}\r\n")
+	routeSend("SUB foo RSID:2:22\r\n")
+	routeSend("PING\r\n")
+	routeExpect(pongRe)
+
+	total := len(hdrPayload) + len("ok")
+	clientSend(fmt.Sprintf("HPUB foo %d %d\r\n%sok\r\nPING\r\n", len(hdrPayload), total, hdrPayload))
+	clientExpect(pongRe)
+
+	buf = routeExpect(hmsgRe)
+	m := hmsgRe.FindAllSubmatch(buf, -1)[0]
+	if string(m[1]) != "foo" || string(m[2]) != "RSID:2:22" {
+		t.Fatalf("Unexpected HMSG: %q", buf)
+	}
+
+	// Headers coming in from the route are delivered as HMSG.
+	clientSend("SUB bar 1\r\nPING\r\n")
+	clientExpect(pongRe)
+	routeSend(fmt.Sprintf("HMSG bar 1 %d %d\r\n%sok\r\n", len(hdrPayload), total, hdrPayload))
+	buf = clientExpect(hmsgRe)
+	m = hmsgRe.FindAllSubmatch(buf, -1)[0]
+	if string(m[1]) != "bar" || string(m[2]) != "1" {
+		t.Fatalf("Unexpected HMSG: %q", buf)
+	}
+}
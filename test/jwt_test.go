@@ -0,0 +1,248 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/glycerine/hnatsd/auth"
+	"github.com/glycerine/hnatsd/server"
+)
+
+const JWT_PORT = 4300
+
+var expiredErrRe = regexp.MustCompile(`\A\-ERR\s+'User Authentication Expired'\r\n`)
+
+func newJWTKey(t *testing.T) (ed25519.PrivateKey, string) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating a key: %v", err)
+	}
+	return key, base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+func encodeJWT(t *testing.T, cl *auth.Claims, key ed25519.PrivateKey) string {
+	token, err := auth.EncodeJWT(cl, key)
+	if err != nil {
+		t.Fatalf("Error encoding the JWT: %v", err)
+	}
+	return token
+}
+
+type jwtTestServer struct {
+	*server.Server
+	operator       ed25519.PrivateKey
+	accountsDir    string
+	revocationsDir string
+}
+
+func runJWTServer(t *testing.T) *jwtTestServer {
+	operator, operatorPub := newJWTKey(t)
+	dir, err := ioutil.TempDir("", "hnatsd_jwt")
+	if err != nil {
+		t.Fatalf("Error creating the JWT directories: %v", err)
+	}
+	js := &jwtTestServer{
+		operator:       operator,
+		accountsDir:    filepath.Join(dir, "accounts"),
+		revocationsDir: filepath.Join(dir, "revocations"),
+	}
+	os.Mkdir(js.accountsDir, 0700)
+	os.Mkdir(js.revocationsDir, 0700)
+
+	opts := DefaultTestOptions
+	opts.Port = JWT_PORT
+	opts.Accounts = []*server.AccountOpts{{Name: "acme"}}
+	opts.JWT = &server.JWTOpts{
+		Operators:      []string{operatorPub},
+		AccountsDir:    js.accountsDir,
+		RevocationsDir: js.revocationsDir,
+	}
+	js.Server = RunServerWithAuth(&opts, nil)
+	js.SetClientAuthMethod(auth.NewJWT(js.Server, &opts, nil))
+	return js
+}
+
+func (js *jwtTestServer) Shutdown() {
+	js.Server.Shutdown()
+	os.RemoveAll(filepath.Dir(js.accountsDir))
+}
+
+// doJWTConnect sends the JWT and the signature of the nonce by the key.
+func doJWTConnect(t *testing.T, c net.Conn, token string, key ed25519.PrivateKey) {
+	info := checkInfoMsg(t, c)
+	sig := base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(info.Nonce)))
+	cs := fmt.Sprintf("CONNECT {\"verbose\":false,\"jwt\":\"%s\",\"sig\":\"%s\"}\r\nPING\r\n", token, sig)
+	sendProto(t, c, cs)
+}
+
+// expectErrWithin waits longer than expectResult for the error.
+func expectErrWithin(t *testing.T, c net.Conn, d time.Duration, re *regexp.Regexp) {
+	buf := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(d))
+	n, err := c.Read(buf)
+	if !re.Match(buf[:n]) {
+		t.Fatalf("Expected %q, got %q, %v", re, buf[:n], err)
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	s := runJWTServer(t)
+	defer s.Shutdown()
+
+	user, userPub := newJWTKey(t)
+	token := encodeJWT(t, &auth.Claims{
+		Subject:     userPub,
+		Type:        auth.UserClaim,
+		Permissions: &server.Permissions{Publish: []string{"foo"}},
+	}, s.operator)
+
+	c := createClientConn(t, "localhost", JWT_PORT)
+	defer c.Close()
+	doJWTConnect(t, c, token, user)
+	expectResult(t, c, pongRe)
+	sendProto(t, c, "PUB bar 2\r\nok\r\n")
+	expectResult(t, c, permErrRe)
+
+	// The client must hold the key of the user.
+	other, _ := newJWTKey(t)
+	c2 := createClientConn(t, "localhost", JWT_PORT)
+	defer c2.Close()
+	doJWTConnect(t, c2, token, other)
+	expectResult(t, c2, errRe)
+
+	// The JWT must be signed by a trusted operator.
+	untrusted := encodeJWT(t, &auth.Claims{Subject: userPub, Type: auth.UserClaim}, other)
+	c3 := createClientConn(t, "localhost", JWT_PORT)
+	defer c3.Close()
+	doJWTConnect(t, c3, untrusted, user)
+	expectResult(t, c3, errRe)
+}
+
+func TestJWTAccount(t *testing.T) {
+	s := runJWTServer(t)
+	defer s.Shutdown()
+
+	account, accountPub := newJWTKey(t)
+	accountJWT := encodeJWT(t, &auth.Claims{
+		Subject:     accountPub,
+		Type:        auth.AccountClaim,
+		Account:     "acme",
+		Permissions: &server.Permissions{Publish: []string{"foo"}},
+	}, s.operator)
+	user, userPub := newJWTKey(t)
+	token := encodeJWT(t, &auth.Claims{Subject: userPub, Type: auth.UserClaim}, account)
+
+	// Users of an account are trusted once its JWT is provisioned.
+	c := createClientConn(t, "localhost", JWT_PORT)
+	defer c.Close()
+	doJWTConnect(t, c, token, user)
+	expectResult(t, c, errRe)
+
+	path := filepath.Join(s.accountsDir, accountPub+".jwt")
+	if err := ioutil.WriteFile(path, []byte(accountJWT), 0600); err != nil {
+		t.Fatalf("Error writing the account JWT: %v", err)
+	}
+	c2 := createClientConn(t, "localhost", JWT_PORT)
+	defer c2.Close()
+	doJWTConnect(t, c2, token, user)
+	expectResult(t, c2, pongRe)
+
+	// The permissions of the account apply to its users.
+	sendProto(t, c2, "PUB bar 2\r\nok\r\n")
+	expectResult(t, c2, permErrRe)
+}
+
+func TestJWTExpiration(t *testing.T) {
+	s := runJWTServer(t)
+	defer s.Shutdown()
+
+	user, userPub := newJWTKey(t)
+	expires := time.Now().Add(time.Second).Unix() + 1
+	token := encodeJWT(t, &auth.Claims{Subject: userPub, Type: auth.UserClaim, Expires: expires}, s.operator)
+
+	c := createClientConn(t, "localhost", JWT_PORT)
+	defer c.Close()
+	doJWTConnect(t, c, token, user)
+	expectResult(t, c, pongRe)
+	expectErrWithin(t, c, 3*time.Second, expiredErrRe)
+
+	// An expired JWT is rejected.
+	c2 := createClientConn(t, "localhost", JWT_PORT)
+	defer c2.Close()
+	doJWTConnect(t, c2, token, user)
+	expectResult(t, c2, errRe)
+}
+
+func TestJWTRevocation(t *testing.T) {
+	s := runJWTServer(t)
+	defer s.Shutdown()
+
+	user, userPub := newJWTKey(t)
+	token := encodeJWT(t, &auth.Claims{ID: "jwt-1", Subject: userPub, Type: auth.UserClaim}, s.operator)
+
+	c := createClientConn(t, "localhost", JWT_PORT)
+	defer c.Close()
+	doJWTConnect(t, c, token, user)
+	expectResult(t, c, pongRe)
+
+	list := "# Revoked JWT IDs\njwt-1\n"
+	if err := ioutil.WriteFile(filepath.Join(s.revocationsDir, "revoked"), []byte(list), 0600); err != nil {
+		t.Fatalf("Error writing the revocation list: %v", err)
+	}
+	expectErrWithin(t, c, 5*time.Second, errRe)
+
+	c2 := createClientConn(t, "localhost", JWT_PORT)
+	defer c2.Close()
+	doJWTConnect(t, c2, token, user)
+	expectResult(t, c2, errRe)
+}
+
+func TestJWTReloadRevocationsDir(t *testing.T) {
+	operator, operatorPub := newJWTKey(t)
+	dir, err := ioutil.TempDir("", "hnatsd_jwt")
+	if err != nil {
+		t.Fatalf("Error creating the JWT directories: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	revocationsDir := filepath.Join(dir, "revocations")
+	os.Mkdir(revocationsDir, 0700)
+
+	file := filepath.Join(dir, "hnatsd.conf")
+	writeConf := func(extra string) {
+		conf := fmt.Sprintf("listen: 127.0.0.1:%d\nauthorization {\n  jwt {\n    operators: [%q]\n    %s\n  }\n}\n", JWT_PORT, operatorPub, extra)
+		if err := ioutil.WriteFile(file, []byte(conf), 0600); err != nil {
+			t.Fatalf("Unable to write config file: %v", err)
+		}
+	}
+	writeConf("")
+	s, _ := RunServerWithConfig(file)
+	defer s.Shutdown()
+
+	user, userPub := newJWTKey(t)
+	token := encodeJWT(t, &auth.Claims{ID: "jwt-1", Subject: userPub, Type: auth.UserClaim}, operator)
+
+	c := createClientConn(t, "127.0.0.1", JWT_PORT)
+	defer c.Close()
+	doJWTConnect(t, c, token, user)
+	expectResult(t, c, pongRe)
+
+	// The revocations directory added on reload is watched.
+	writeConf(fmt.Sprintf("revocations_dir: %q", revocationsDir))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error reloading the config: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(revocationsDir, "revoked"), []byte("jwt-1\n"), 0600); err != nil {
+		t.Fatalf("Error writing the revocation list: %v", err)
+	}
+	expectErrWithin(t, c, 5*time.Second, errRe)
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+const LAME_DUCK_PORT = 10722
+
+func runLameDuckServer(dur time.Duration) *server.Server {
+	opts := DefaultTestOptions
+	opts.Port = LAME_DUCK_PORT
+	opts.LameDuckDuration = dur
+	return RunServer(&opts)
+}
+
+func TestLameDuckMode(t *testing.T) {
+	s := runLameDuckServer(500 * time.Millisecond)
+	defer s.Shutdown()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		c := createClientConn(t, "127.0.0.1", LAME_DUCK_PORT)
+		defer c.Close()
+		send, expect := setupConnWithProto(t, c, server.ClientProtoInfo)
+		send("PING\r\n")
+		expect(pongRe)
+		conns = append(conns, c)
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		s.LameDuckShutdown()
+		close(done)
+	}()
+
+	// Clients are told about the lame duck mode.
+	for _, c := range conns {
+		if info := checkInfoMsg(t, c); !info.LameDuckMode {
+			t.Fatalf("Expected lame duck mode in INFO, got %+v", info)
+		}
+	}
+
+	// New clients are no longer accepted.
+	addr := fmt.Sprintf("127.0.0.1:%d", LAME_DUCK_PORT)
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		c.Close()
+		t.Fatal("Expected new connections to be refused")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lame duck shutdown did not complete")
+	}
+	// Clients are closed one interval apart.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("Expected clients to be closed gradually, took %v", elapsed)
+	}
+	for _, c := range conns {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 64)); err == nil {
+			t.Fatal("Expected client connection to be closed")
+		}
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Fatalf("Expected no clients, got %d", n)
+	}
+}
+
+func TestLameDuckModeNoClients(t *testing.T) {
+	s := runLameDuckServer(time.Minute)
+	defer s.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		s.LameDuckShutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lame duck shutdown did not complete")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/glycerine/go-nats"
+	"github.com/glycerine/hnatsd/server"
+)
+
+// Helper function to check that the servers have the expected number of leaf nodes
+func checkLeafNodes(t *testing.T, expected int, servers ...*server.Server) {
+	var err string
+	maxTime := time.Now().Add(5 * time.Second)
+	for time.Now().Before(maxTime) {
+		err = ""
+		for _, s := range servers {
+			if n := s.NumLeafNodes(); n != expected {
+				err = fmt.Sprintf("Expected %d leaf nodes for server %q, got %d", expected, s.ID(), n)
+				break
+			}
+		}
+		if err == "" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s", err)
+}
+
+func leafConnect(t *testing.T, opts *server.Options, user, pass string) *nats.Conn {
+	url := fmt.Sprintf("nats://%s:%d/", opts.Host, opts.Port)
+	if user != "" {
+		url = fmt.Sprintf("nats://%s:%s@%s:%d/", user, pass, opts.Host, opts.Port)
+	}
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	return nc
+}
+
+func leafSubscribe(t *testing.T, nc *nats.Conn, subject, queue string) *nats.Subscription {
+	var sub *nats.Subscription
+	var err error
+	if queue != "" {
+		sub, err = nc.QueueSubscribeSync(subject, queue)
+	} else {
+		sub, err = nc.SubscribeSync(subject)
+	}
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	return sub
+}
+
+func checkLeafMsg(t *testing.T, sub *nats.Subscription, data string) {
+	m, err := sub.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatalf("Did not receive %q: %v", data, err)
+	}
+	if string(m.Data) != data {
+		t.Fatalf("Expected %q, got %q", data, m.Data)
+	}
+}
+
+func checkNoLeafMsg(t *testing.T, sub *nats.Subscription) {
+	if m, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected message %q", m.Data)
+	}
+}
+
+func TestLeafNodeMessages(t *testing.T) {
+	hub, hubOpts := RunServerWithConfig("./configs/leaf_hub_a.conf")
+	defer hub.Shutdown()
+	spoke, spokeOpts := RunServerWithConfig("./configs/leaf_spoke.conf")
+	defer spoke.Shutdown()
+	checkLeafNodes(t, 1, hub, spoke)
+
+	hnc := leafConnect(t, hubOpts, "alice", "foo")
+	defer hnc.Close()
+	snc := leafConnect(t, spokeOpts, "", "")
+	defer snc.Close()
+
+	// The interest of each side is sent over the link.
+	ssub := leafSubscribe(t, snc, "spoke.>", "")
+	hsub := leafSubscribe(t, hnc, "hub", "")
+	if err := checkExpectedSubs(2, hub, spoke); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	hnc.Publish("spoke.a", []byte("from hub"))
+	checkLeafMsg(t, ssub, "from hub")
+	snc.Publish("hub", []byte("from spoke"))
+	checkLeafMsg(t, hsub, "from spoke")
+
+	// Messages are not sent back to where they came from.
+	hsub2 := leafSubscribe(t, hnc, "spoke.a", "")
+	if err := checkExpectedSubs(3, hub, spoke); err != nil {
+		t.Fatalf("%v", err)
+	}
+	hnc.Publish("spoke.a", []byte("once"))
+	checkLeafMsg(t, ssub, "once")
+	checkLeafMsg(t, hsub2, "once")
+	checkNoLeafMsg(t, ssub)
+	checkNoLeafMsg(t, hsub2)
+
+	// Unsubscribes are sent too.
+	hsub.Unsubscribe()
+	hsub2.Unsubscribe()
+	if err := checkExpectedSubs(1, hub, spoke); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The spoke reconnects to the hub and sends its interest again.
+	hnc.Close()
+	hub.Shutdown()
+	checkLeafNodes(t, 0, spoke)
+	hub, _ = RunServerWithConfig("./configs/leaf_hub_a.conf")
+	defer hub.Shutdown()
+	checkLeafNodes(t, 1, hub, spoke)
+	if err := checkExpectedSubs(1, hub); err != nil {
+		t.Fatalf("%v", err)
+	}
+	hnc = leafConnect(t, hubOpts, "alice", "foo")
+	defer hnc.Close()
+	hnc.Publish("spoke.b", []byte("again"))
+	checkLeafMsg(t, ssub, "again")
+}
+
+func TestLeafNodeMultiHop(t *testing.T) {
+	srvA, optsA := RunServerWithConfig("./configs/leaf_hub_a.conf")
+	defer srvA.Shutdown()
+	srvB, optsB := RunServerWithConfig("./configs/leaf_hub_b.conf")
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+	spoke, spokeOpts := RunServerWithConfig("./configs/leaf_spoke.conf")
+	defer spoke.Shutdown()
+	checkLeafNodes(t, 1, srvA, spoke)
+
+	bnc := leafConnect(t, optsB, "alice", "foo")
+	defer bnc.Close()
+	snc := leafConnect(t, spokeOpts, "", "")
+	defer snc.Close()
+	anc := leafConnect(t, optsA, "alice", "foo")
+	defer anc.Close()
+
+	// The spoke reaches B through A, and B reaches the spoke.
+	bsub := leafSubscribe(t, bnc, "b", "")
+	ssub := leafSubscribe(t, snc, "s", "")
+	if err := checkExpectedSubs(2, srvA, srvB, spoke); err != nil {
+		t.Fatalf("%v", err)
+	}
+	snc.Publish("b", []byte("spoke to b"))
+	checkLeafMsg(t, bsub, "spoke to b")
+	bnc.Publish("s", []byte("b to spoke"))
+	checkLeafMsg(t, ssub, "b to spoke")
+	checkNoLeafMsg(t, bsub)
+	checkNoLeafMsg(t, ssub)
+
+	// A queue group spread over the three servers gets each message once.
+	qsubs := []*nats.Subscription{
+		leafSubscribe(t, anc, "q", "workers"),
+		leafSubscribe(t, bnc, "q", "workers"),
+		leafSubscribe(t, snc, "q", "workers"),
+	}
+	if err := checkExpectedSubs(5, srvA, srvB, spoke); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, nc := range []*nats.Conn{anc, bnc, snc} {
+		for i := 0; i < 30; i++ {
+			nc.Publish("q", []byte("work"))
+		}
+		nc.Flush()
+	}
+	received := 0
+	for _, sub := range qsubs {
+		for {
+			if _, err := sub.NextMsg(250 * time.Millisecond); err != nil {
+				break
+			}
+			received++
+		}
+	}
+	if received != 90 {
+		t.Fatalf("Expected 90 messages in the queue group, got %d", received)
+	}
+}
+
+func TestLeafNodeAuthorization(t *testing.T) {
+	hub, _ := RunServerWithConfig("./configs/leaf_hub_a.conf")
+	defer hub.Shutdown()
+	spoke, _ := RunServerWithConfig("./configs/leaf_spoke_badauth.conf")
+	defer spoke.Shutdown()
+
+	time.Sleep(250 * time.Millisecond)
+	if n := hub.NumLeafNodes(); n != 0 {
+		t.Fatalf("Expected no leaf node, got %d", n)
+	}
+	if n := spoke.NumLeafNodes(); n != 0 {
+		t.Fatalf("Expected no leaf node, got %d", n)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+func checkConnzLimits(t *testing.T, opts *server.Options) *server.LimitStats {
+	resetPreviousHTTPConnections()
+	url := fmt.Sprintf("http://%s:%d/connz", opts.HTTPHost, opts.HTTPPort)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Expected no error: Got %v\n", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Got an error reading the body: %v\n", err)
+	}
+	c := server.Connz{}
+	if err := json.Unmarshal(body, &c); err != nil {
+		t.Fatalf("Got an error unmarshalling the body: %v\n", err)
+	}
+	if len(c.Conns) != 1 || c.Conns[0].Limits == nil {
+		t.Fatalf("Expected one connection with limits, got %+v", c.Conns)
+	}
+	return c.Conns[0].Limits
+}
+
+func TestLimitsMaxSubscriptions(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/limits.conf")
+	defer s.Shutdown()
+
+	c, send, expect := setupAccountConn(t, opts, "alice", "foo")
+	defer c.Close()
+
+	send("SUB foo 1\r\nSUB bar 2\r\nPING\r\n")
+	expect(pongRe)
+	send("SUB baz 3\r\n")
+	expect(regexp.MustCompile(`\A-ERR 'Maximum Subscriptions Exceeded'\r\n`))
+
+	// Room is made by unsubscribing.
+	send("UNSUB 1\r\nSUB baz 3\r\nPING\r\n")
+	expect(pongRe)
+
+	if l := checkConnzLimits(t, opts); l.MaxSubs != 2 || l.SubsDenied != 1 {
+		t.Fatalf("Unexpected limits in connz: %+v", l)
+	}
+}
+
+func TestLimitsMaxPending(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/limits.conf")
+	defer s.Shutdown()
+
+	c, send, expect := setupAccountConn(t, opts, "bob", "bar")
+	defer c.Close()
+
+	// Each message is 17 bytes, only two fit before the flush.
+	send("SUB foo 1\r\nPING\r\n")
+	expect(pongRe)
+	send("PUB foo 2\r\nok\r\nPUB foo 2\r\nok\r\nPUB foo 2\r\nok\r\nPUB foo 2\r\nok\r\nPING\r\n")
+	expect(regexp.MustCompile(`\A(MSG foo 1 2\r\nok\r\n){2}-ERR 'Maximum Pending Bytes Exceeded'\r\nPONG\r\n`))
+
+	// Delivery resumes after the flush.
+	send("PUB foo 2\r\nok\r\nPING\r\n")
+	expect(regexp.MustCompile(`\AMSG foo 1 2\r\nok\r\nPONG\r\n`))
+
+	if l := checkConnzLimits(t, opts); l.MaxPending != 40 || l.PendingDropped != 2 {
+		t.Fatalf("Unexpected limits in connz: %+v", l)
+	}
+}
+
+func TestLimitsMsgRate(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/limits.conf")
+	defer s.Shutdown()
+
+	c, send, expect := setupAccountConn(t, opts, "carol", "baz")
+	defer c.Close()
+
+	send("SUB foo 1\r\nPING\r\n")
+	expect(pongRe)
+	send("PUB foo 2\r\nok\r\nPUB foo 2\r\nok\r\nPUB foo 2\r\nok\r\n")
+	expect(regexp.MustCompile(`-ERR 'Maximum Message Rate Exceeded'\r\n`))
+	send("PING\r\n")
+	expect(pongRe)
+
+	if l := checkConnzLimits(t, opts); l.MaxMsgsPerSec != 2 || l.MsgRateDropped != 1 {
+		t.Fatalf("Unexpected limits in connz: %+v", l)
+	}
+}
+
+func TestLimitsByteRate(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/limits.conf")
+	defer s.Shutdown()
+
+	c, send, expect := setupAccountConn(t, opts, "dave", "qux")
+	defer c.Close()
+
+	send("SUB foo 1\r\nPING\r\n")
+	expect(pongRe)
+	send("PUB foo 8\r\nabcdefgh\r\n")
+	matches := expectMsgsCommand(t, expect)(1)
+	checkMsg(t, matches[0], "foo", "1", "", "8", "abcdefgh")
+
+	send("PUB foo 8\r\nabcdefgh\r\n")
+	expect(regexp.MustCompile(`\A-ERR 'Maximum Byte Rate Exceeded'\r\n`))
+	send("PING\r\n")
+	expect(pongRe)
+
+	if l := checkConnzLimits(t, opts); l.MaxBytesPerSec != 10 || l.ByteRateDropped != 1 {
+		t.Fatalf("Unexpected limits in connz: %+v", l)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glycerine/go-nats"
+	"github.com/glycerine/hnatsd/server"
+)
+
+func TestSubjectMappings(t *testing.T) {
+	srvA, optsA := RunServerWithConfig("./configs/mappings_a.conf")
+	defer srvA.Shutdown()
+	srvB, optsB := RunServerWithConfig("./configs/mappings_b.conf")
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	anc := leafConnect(t, optsA, "", "")
+	defer anc.Close()
+	bnc := leafConnect(t, optsB, "", "")
+	defer bnc.Close()
+
+	// Subjects are mapped once, by the server the message is published
+	// to, the mappings of B would otherwise swap the tokens back.
+	orders := leafSubscribe(t, bnc, "orders.>", "")
+	v1 := leafSubscribe(t, bnc, "api.v1.>", "")
+	v2 := leafSubscribe(t, bnc, "api.v2.>", "")
+	if err := checkExpectedSubs(3, srvA, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+	anc.Publish("orders.42.new", []byte("order"))
+	m, err := orders.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatalf("Did not receive the order: %v", err)
+	}
+	if m.Subject != "orders.new.42" {
+		t.Fatalf("Expected the order on %q, got %q", "orders.new.42", m.Subject)
+	}
+	checkNoLeafMsg(t, orders)
+
+	// The requests are split between the two versions.
+	for i := 0; i < 100; i++ {
+		anc.Publish("api.get", []byte("req"))
+	}
+	anc.Flush()
+	counts := make(map[string]int)
+	for _, sub := range []*nats.Subscription{v1, v2} {
+		for {
+			m, err := sub.NextMsg(250 * time.Millisecond)
+			if err != nil {
+				break
+			}
+			counts[m.Subject]++
+		}
+	}
+	if len(counts) != 2 || counts["api.v1.get"]+counts["api.v2.get"] != 100 {
+		t.Fatalf("Unexpected split of the requests: %v", counts)
+	}
+
+	// The active mappings are listed in /varz.
+	resetPreviousHTTPConnections()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/varz", optsA.HTTPPort))
+	if err != nil {
+		t.Fatalf("Expected no error: Got %v\n", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Got an error reading the body: %v\n", err)
+	}
+	v := server.Varz{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("Got an error unmarshalling the body: %v\n", err)
+	}
+	if len(v.Mappings) != 2 || v.Mappings[0].Source != "api.>" ||
+		len(v.Mappings[0].Destinations) != 2 || v.Mappings[0].Destinations[1].Weight != 20 {
+		t.Fatalf("Unexpected mappings in varz: %s", body)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/glycerine/go-nats"
+	"github.com/glycerine/hnatsd/server"
+)
+
+// nextTraceEvents returns the trace events received within the timeout.
+func nextTraceEvents(t *testing.T, sub *nats.Subscription, timeout time.Duration) []*server.MsgTraceEvent {
+	var events []*server.MsgTraceEvent
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			return events
+		}
+		ev := &server.MsgTraceEvent{}
+		if err := json.Unmarshal(m.Data, ev); err != nil {
+			t.Fatalf("Error unmarshalling event: %v", err)
+		}
+		events = append(events, ev)
+	}
+}
+
+func findTraceEvent(events []*server.MsgTraceEvent, serverID, hop string) *server.MsgTraceEvent {
+	for _, ev := range events {
+		if ev.Server == serverID && ev.Hop == hop {
+			return ev
+		}
+	}
+	return nil
+}
+
+func TestMsgTraceEvents(t *testing.T) {
+	srvA, optsA := RunServerWithConfig("./configs/srv_a_events.conf")
+	defer srvA.Shutdown()
+	srvB, optsB := RunServerWithConfig("./configs/srv_b_events.conf")
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	nc, err := nats.Connect(eventsURL(optsA, "admin", "sys"))
+	if err != nil {
+		t.Fatalf("Could not connect the system user: %v", err)
+	}
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(server.SysEventSubject("*", server.EventMsgTrace))
+	if err != nil {
+		t.Fatalf("Error subscribing to trace events: %v", err)
+	}
+	nc.Flush()
+
+	// Trace the orders on both servers.
+	for _, s := range []*server.Server{srvA, srvB} {
+		var resp server.TraceResponse
+		sysRequest(t, nc, server.SysRequestSubject(s.ID(), server.ReqTrace), `{"add":["orders.>"]}`, &resp)
+		if resp.Server != s.ID() || len(resp.Subjects) != 1 || resp.Subjects[0] != "orders.>" {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+	}
+
+	bnc, err := nats.Connect(eventsURL(optsB, "alice", "foo"))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer bnc.Close()
+	if _, err := bnc.SubscribeSync("orders.new"); err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	if _, err := bnc.SubscribeSync("other"); err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	bnc.Flush()
+	if err := checkExpectedSubs(9, srvA); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	anc, err := nats.Connect(eventsURL(optsA, "alice", "foo"))
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer anc.Close()
+	anc.Publish("other", []byte("hello"))
+	anc.Publish("orders.new", []byte("hello"))
+	anc.Flush()
+
+	events := nextTraceEvents(t, sub, 500*time.Millisecond)
+	for _, ev := range events {
+		if ev.Subject != "orders.new" || ev.Size != 5 {
+			t.Fatalf("Unexpected trace event: %+v", ev)
+		}
+	}
+	if ev := findTraceEvent(events, srvA.ID(), server.TraceIngress); ev == nil || ev.Kind != "client" {
+		t.Fatalf("Expected an ingress event from a client on A, got %+v", events)
+	}
+	if ev := findTraceEvent(events, srvA.ID(), server.TraceMatch); ev == nil || ev.Subs != 1 {
+		t.Fatalf("Expected a match event on A, got %+v", events)
+	}
+	if ev := findTraceEvent(events, srvA.ID(), server.TraceRoute); ev == nil || ev.Route != srvB.ID() {
+		t.Fatalf("Expected a route event on A, got %+v", events)
+	}
+	if ev := findTraceEvent(events, srvB.ID(), server.TraceIngress); ev == nil || ev.Kind != "route" {
+		t.Fatalf("Expected an ingress event from the route on B, got %+v", events)
+	}
+	if ev := findTraceEvent(events, srvB.ID(), server.TraceDeliver); ev == nil || ev.To == 0 {
+		t.Fatalf("Expected a deliver event on B, got %+v", events)
+	}
+
+	// Messages without interest are dropped.
+	anc.Publish("orders.old", []byte("hello"))
+	anc.Flush()
+	events = nextTraceEvents(t, sub, 250*time.Millisecond)
+	if ev := findTraceEvent(events, srvA.ID(), server.TraceDrop); ev == nil || ev.Reason != "no_interest" {
+		t.Fatalf("Expected a drop event on A, got %+v", events)
+	}
+
+	// No more events once the subjects are removed.
+	for _, s := range []*server.Server{srvA, srvB} {
+		var resp server.TraceResponse
+		sysRequest(t, nc, server.SysRequestSubject(s.ID(), server.ReqTrace), `{"remove":["orders.>"]}`, &resp)
+		if len(resp.Subjects) != 0 {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+	}
+	anc.Publish("orders.new", []byte("hello"))
+	anc.Flush()
+	if events := nextTraceEvents(t, sub, 250*time.Millisecond); len(events) != 0 {
+		t.Fatalf("Expected no trace events, got %+v", events)
+	}
+
+	var e server.SysErrorResponse
+	sysRequest(t, nc, server.SysRequestSubject(srvA.ID(), server.ReqTrace), `{"add":["_SYS.>"]}`, &e)
+	if e.Error == "" {
+		t.Fatal("Expected an error tracing system subjects")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/glycerine/hnatsd/auth"
+	"github.com/glycerine/hnatsd/server"
+)
+
+const NKEY_PORT = 4299
+
+func runNkeyServer(t *testing.T) (*server.Server, ed25519.PrivateKey) {
+	seed := make([]byte, ed25519.SeedSize)
+	copy(seed, "hnatsd nkey test seed")
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := base64.RawURLEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+
+	opts := DefaultTestOptions
+	opts.Port = NKEY_PORT
+	opts.Users = []*server.User{
+		{Nkey: pub, Permissions: &server.Permissions{Publish: []string{"foo"}}},
+		{Username: "derek", Password: "porkchop"},
+	}
+	return RunServerWithAuth(&opts, auth.NewUsers(opts.Users)), priv
+}
+
+// doNkeyConnect signs the nonce of the INFO with the key.
+func doNkeyConnect(t *testing.T, c net.Conn, key ed25519.PrivateKey, nonce string) {
+	pub := base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	sig := base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(nonce)))
+	cs := fmt.Sprintf("CONNECT {\"verbose\":false,\"nkey\":\"%s\",\"sig\":\"%s\"}\r\n", pub, sig)
+	sendProto(t, c, cs)
+}
+
+func TestNkeyAuth(t *testing.T) {
+	s, key := runNkeyServer(t)
+	defer s.Shutdown()
+
+	c := createClientConn(t, "localhost", NKEY_PORT)
+	defer c.Close()
+	info := checkInfoMsg(t, c)
+	if !info.AuthRequired || info.Nonce == "" {
+		t.Fatalf("Expected a nonce to sign, got %+v", info)
+	}
+	doNkeyConnect(t, c, key, info.Nonce)
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+	send("PING\r\n")
+	expect(pongRe)
+
+	// The permissions of the user apply.
+	send("PUB bar 2\r\nok\r\n")
+	expect(permErrRe)
+
+	// Each client signs its own nonce.
+	c2 := createClientConn(t, "localhost", NKEY_PORT)
+	defer c2.Close()
+	info2 := checkInfoMsg(t, c2)
+	if info2.Nonce == info.Nonce {
+		t.Fatalf("Expected a new nonce, got %q", info2.Nonce)
+	}
+	doNkeyConnect(t, c2, key, info.Nonce)
+	expectResult(t, c2, errRe)
+
+	// The users with a password still authenticate.
+	c3 := createClientConn(t, "localhost", NKEY_PORT)
+	defer c3.Close()
+	checkInfoMsg(t, c3)
+	doAuthConnect(t, c3, "", "derek", "porkchop")
+	expectResult(t, c3, okRe)
+}
+
+func TestNkeyAuthUnknownKey(t *testing.T) {
+	s, _ := runNkeyServer(t)
+	defer s.Shutdown()
+
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating a key: %v", err)
+	}
+	c := createClientConn(t, "localhost", NKEY_PORT)
+	defer c.Close()
+	info := checkInfoMsg(t, c)
+	doNkeyConnect(t, c, other, info.Nonce)
+	expectResult(t, c, errRe)
+
+	// A user without a password is not one with an empty password.
+	c2 := createClientConn(t, "localhost", NKEY_PORT)
+	defer c2.Close()
+	checkInfoMsg(t, c2)
+	doAuthConnect(t, c2, "", "", "")
+	expectResult(t, c2, errRe)
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/glycerine/hnatsd/auth"
+	"github.com/glycerine/hnatsd/server"
+)
+
+const NO_RESPONDERS_PORT = 4302
+
+var noRespondersRe = regexp.MustCompile(`NATS/1.0 503\r\n\r\n`)
+
+func setupNoRespondersConn(t tLogger, c net.Conn) (sendFun, expectFun) {
+	checkInfoMsg(t, c)
+	sendProto(t, c, "CONNECT {\"verbose\":false,\"pedantic\":false,\"headers\":true,\"no_responders\":true}\r\n")
+	return sendCommand(t, c), expectCommand(t, c)
+}
+
+func checkNoResponders(t *testing.T, buf []byte, reply, sid string) {
+	m := hmsgRe.FindAllSubmatch(buf, -1)
+	if len(m) != 1 || string(m[0][1]) != reply || string(m[0][2]) != sid ||
+		string(m[0][5]) != "16" || string(m[0][6]) != "16" {
+		t.Fatalf("Expected a no responders status, got %q", buf)
+	}
+	if !noRespondersRe.Match(buf) {
+		t.Fatalf("Expected a 503 status, got %q", buf)
+	}
+}
+
+func TestNoResponders(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	c := createClientConn(t, "localhost", PROTO_TEST_PORT)
+	defer c.Close()
+	send, expect := setupNoRespondersConn(t, c)
+
+	send("SUB inbox 1\r\nPUB foo inbox 2\r\nok\r\nPING\r\n")
+	checkNoResponders(t, expect(pongRe), "inbox", "1")
+
+	// Messages without a reply subject are still dropped silently.
+	send("PUB foo 2\r\nok\r\nPING\r\n")
+	expect(pongRe)
+	expectNothing(t, c)
+
+	// The request is delivered when there is interest.
+	send("SUB foo 2\r\nPUB foo inbox 2\r\nok\r\nPING\r\n")
+	matches := msgRe.FindAllSubmatch(expect(pongRe), -1)
+	if len(matches) != 1 {
+		t.Fatalf("Expected one message, got %d", len(matches))
+	}
+	checkMsg(t, matches[0], "foo", "2", "inbox", "2", "ok")
+
+	// Clients that did not opt in are not told.
+	lc := createClientConn(t, "localhost", PROTO_TEST_PORT)
+	defer lc.Close()
+	lsend, lexpect := setupHeadersConn(t, lc)
+	lsend("SUB inbox 1\r\nPUB bar inbox 2\r\nok\r\nPING\r\n")
+	lexpect(pongRe)
+	expectNothing(t, lc)
+}
+
+func TestNoRespondersDeniedReply(t *testing.T) {
+	opts := DefaultTestOptions
+	opts.Port = NO_RESPONDERS_PORT
+	opts.Users = []*server.User{{
+		Username: "alice",
+		Password: DefaultPass,
+		Permissions: &server.Permissions{
+			Publish:       []string{">"},
+			Subscribe:     []string{">"},
+			SubscribeDeny: []string{"inbox.secret"},
+		},
+	}}
+	s := RunServerWithAuth(&opts, auth.NewUsers(opts.Users))
+	defer s.Shutdown()
+
+	c := createClientConn(t, "localhost", NO_RESPONDERS_PORT)
+	defer c.Close()
+	checkInfoMsg(t, c)
+	sendProto(t, c, "CONNECT {\"verbose\":false,\"headers\":true,\"no_responders\":true,\"user\":\"alice\",\"pass\":\"foo\"}\r\n")
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+
+	// The status is not delivered on a denied reply subject.
+	send("SUB inbox.* 1\r\nPUB foo inbox.secret 2\r\nok\r\nPING\r\n")
+	if buf := expect(pongRe); hmsgRe.Match(buf) {
+		t.Fatalf("Expected no status on the denied reply, got %q", buf)
+	}
+
+	send("PUB foo inbox.ok 2\r\nok\r\nPING\r\n")
+	checkNoResponders(t, expect(pongRe), "inbox.ok", "1")
+}
+
+func TestNoRespondersRequiresHeaders(t *testing.T) {
+	s := runProtoServer()
+	defer s.Shutdown()
+
+	c := createClientConn(t, "localhost", PROTO_TEST_PORT)
+	defer c.Close()
+	checkInfoMsg(t, c)
+	sendProto(t, c, "CONNECT {\"verbose\":false,\"pedantic\":false,\"no_responders\":true}\r\n")
+	expectResult(t, c, errRe)
+}
+
+func TestNoRespondersInterestOverRoutes(t *testing.T) {
+	srvA, optsA := RunServerWithConfig("./configs/srv_a.conf")
+	defer srvA.Shutdown()
+	srvB, optsB := RunServerWithConfig("./configs/srv_b.conf")
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	ca := createClientConn(t, optsA.Host, optsA.Port)
+	defer ca.Close()
+	sendA, expectA := setupNoRespondersConn(t, ca)
+	cb := createClientConn(t, optsB.Host, optsB.Port)
+	defer cb.Close()
+	sendB, expectB := setupConn(t, cb)
+
+	sendA("SUB inbox 1\r\nPING\r\n")
+	expectA(pongRe)
+	sendB("SUB foo 1\r\nPING\r\n")
+	expectB(pongRe)
+	if err := checkExpectedSubs(2, srvA, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The responder on B has interest, the request is routed.
+	sendA("PUB foo inbox 2\r\nok\r\nPING\r\n")
+	expectA(pongRe)
+	matches := msgRe.FindAllSubmatch(expectB(msgRe), -1)
+	checkMsg(t, matches[0], "foo", "1", "inbox", "2", "ok")
+	expectNothing(t, ca)
+
+	// Once it is gone, the publisher is told right away.
+	sendB("UNSUB 1\r\nPING\r\n")
+	expectB(pongRe)
+	if err := checkExpectedSubs(1, srvA, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+	sendA("PUB foo inbox 2\r\nok\r\nPING\r\n")
+	checkNoResponders(t, expectA(pongRe), "inbox", "1")
+}
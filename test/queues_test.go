@@ -0,0 +1,115 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glycerine/go-nats"
+	"github.com/glycerine/hnatsd/server"
+)
+
+// countQueueMsgs returns the number of messages received by each member.
+func countQueueMsgs(qsubs ...*nats.Subscription) []int {
+	counts := make([]int, len(qsubs))
+	for i, sub := range qsubs {
+		for {
+			if _, err := sub.NextMsg(250 * time.Millisecond); err != nil {
+				break
+			}
+			counts[i]++
+		}
+	}
+	return counts
+}
+
+func TestQueuePolicyRoundRobin(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/queues.conf")
+	defer s.Shutdown()
+
+	nc := leafConnect(t, opts, "", "")
+	defer nc.Close()
+	qsubs := []*nats.Subscription{
+		leafSubscribe(t, nc, "foo", "workers"),
+		leafSubscribe(t, nc, "foo", "workers"),
+	}
+	for i := 0; i < 10; i++ {
+		nc.Publish("foo", []byte("work"))
+	}
+	nc.Flush()
+	if counts := countQueueMsgs(qsubs...); counts[0] != 5 || counts[1] != 5 {
+		t.Fatalf("Expected the messages to be delivered in turn, got %v", counts)
+	}
+
+	// The messages delivered to each member are in /connz.
+	resetPreviousHTTPConnections()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/connz?subs=1", opts.HTTPPort))
+	if err != nil {
+		t.Fatalf("Expected no error: Got %v\n", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Got an error reading the body: %v\n", err)
+	}
+	c := server.Connz{}
+	if err := json.Unmarshal(body, &c); err != nil {
+		t.Fatalf("Got an error unmarshalling the body: %v\n", err)
+	}
+	if len(c.Conns) != 1 || len(c.Conns[0].QueueSubs) != 2 {
+		t.Fatalf("Unexpected connections: %s", body)
+	}
+	for _, qs := range c.Conns[0].QueueSubs {
+		if qs.Subject != "foo" || qs.Queue != "workers" || qs.Policy != "round_robin" || qs.Delivered != 5 {
+			t.Fatalf("Unexpected queue subscription: %+v", qs)
+		}
+	}
+}
+
+func TestQueuePolicySignalled(t *testing.T) {
+	srvA, optsA := RunServerWithConfig("./configs/srv_a.conf")
+	defer srvA.Shutdown()
+	srvB, optsB := RunServerWithConfig("./configs/srv_b.conf")
+	defer srvB.Shutdown()
+	checkClusterFormed(t, srvA, srvB)
+
+	anc := leafConnect(t, optsA, "", "")
+	defer anc.Close()
+	bnc := leafConnect(t, optsB, "", "")
+	defer bnc.Close()
+
+	// The member on B signals the policy, it is carried over the route
+	// and the members on A are preferred for the messages published on A.
+	bsub := leafSubscribe(t, bnc, "foo", "workers:prefer_local")
+	asub := leafSubscribe(t, anc, "foo", "workers")
+	if err := checkExpectedSubs(2, srvA, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i < 20; i++ {
+		anc.Publish("foo", []byte("work"))
+		bnc.Publish("foo", []byte("work"))
+	}
+	anc.Flush()
+	bnc.Flush()
+	if counts := countQueueMsgs(asub, bsub); counts[0] != 20 || counts[1] != 20 {
+		t.Fatalf("Expected the local members to get the messages, got %v", counts)
+	}
+
+	// Remote members are used when there is no local one.
+	asub.Unsubscribe()
+	if err := checkExpectedSubs(1, srvA, srvB); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i < 20; i++ {
+		anc.Publish("foo", []byte("work"))
+	}
+	anc.Flush()
+	if counts := countQueueMsgs(bsub); counts[0] != 20 {
+		t.Fatalf("Expected the remote member to get the messages, got %v", counts)
+	}
+}
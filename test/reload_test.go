@@ -0,0 +1,333 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+const (
+	RELOAD_PORT      = 10622
+	RELOAD_LEAF_PORT = 4312
+)
+
+const reloadBaseConfig = `
+listen: 127.0.0.1:%d
+
+authorization {
+  users = [
+    {user: alice, password: foo}
+    %s
+  ]
+}
+%s
+`
+
+func writeReloadConfig(t *testing.T, file, users, extra string) {
+	conf := fmt.Sprintf(reloadBaseConfig, RELOAD_PORT, users, extra)
+	if err := ioutil.WriteFile(file, []byte(conf), 0600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+}
+
+func runReloadServer(t *testing.T, users, extra string) (*server.Server, string) {
+	file, err := ioutil.TempFile("", "gnatsd_reload_")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %v", err)
+	}
+	file.Close()
+	writeReloadConfig(t, file.Name(), users, extra)
+	s, _ := RunServerWithConfig(file.Name())
+	return s, file.Name()
+}
+
+func TestReloadNoConfigFile(t *testing.T) {
+	s := RunDefaultServer()
+	defer s.Shutdown()
+
+	if err := s.Reload(); err != server.ErrNoConfigFile {
+		t.Fatalf("Expected %v, got %v", server.ErrNoConfigFile, err)
+	}
+}
+
+func TestReloadRemovedUser(t *testing.T) {
+	s, file := runReloadServer(t, "{user: bob, password: bar}", "")
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	c := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c.Close()
+	expectAuthRequired(t, c)
+	doAuthConnect(t, c, "", "bob", "bar")
+	expectResult(t, c, okRe)
+
+	writeReloadConfig(t, file, "", "")
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	expectResult(t, c, errRe)
+
+	// New connections for bob are rejected as well.
+	c2 := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c2.Close()
+	expectAuthRequired(t, c2)
+	doAuthConnect(t, c2, "", "bob", "bar")
+	expectResult(t, c2, errRe)
+
+	// Alice is unaffected.
+	c3 := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c3.Close()
+	expectAuthRequired(t, c3)
+	doAuthConnect(t, c3, "", "alice", "foo")
+	expectResult(t, c3, okRe)
+}
+
+func TestReloadRemovedLeafUser(t *testing.T) {
+	leafnodes := fmt.Sprintf("leafnodes {\n  listen: 127.0.0.1:%d\n}", RELOAD_LEAF_PORT)
+	s, file := runReloadServer(t, "{user: bob, password: bar}", leafnodes)
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	leaf := createClientConn(t, "127.0.0.1", RELOAD_LEAF_PORT)
+	defer leaf.Close()
+	checkInfoMsg(t, leaf)
+	sendProto(t, leaf, "CONNECT {\"verbose\":false,\"user\":\"bob\",\"pass\":\"bar\",\"name\":\"spoke\"}\r\nPING\r\n")
+	expectResult(t, leaf, pongRe)
+	checkLeafNodes(t, 1, s)
+
+	// The leaf node authorized as the removed user is disconnected.
+	writeReloadConfig(t, file, "", leafnodes)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if buf := expectClosed(t, leaf); !errRe.Match(buf) {
+		t.Fatalf("Expected %q, got %q", errRe, buf)
+	}
+	checkLeafNodes(t, 0, s)
+}
+
+func TestReloadRemovedUserNotAudited(t *testing.T) {
+	audit := "audit {\n  max_violations: 2\n  ban: 60\n}"
+	s, file := runReloadServer(t, "{user: bob, password: bar}", audit)
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	// More connections of the removed user than the violations
+	// escalated, all from the same source.
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+		defer c.Close()
+		expectAuthRequired(t, c)
+		doAuthConnect(t, c, "", "bob", "bar")
+		expectResult(t, c, okRe)
+		conns = append(conns, c)
+	}
+
+	writeReloadConfig(t, file, "", audit)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	for _, c := range conns {
+		if buf := expectClosed(t, c); !errRe.Match(buf) || tooManyRe.Match(buf) {
+			t.Fatalf("Unexpected response to the removed user: %q", buf)
+		}
+	}
+
+	// The source is not banned.
+	c := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c.Close()
+	expectAuthRequired(t, c)
+	doAuthConnect(t, c, "", "alice", "foo")
+	expectResult(t, c, okRe)
+	if n := s.Varz().Rejected["client"].Banned; n != 0 {
+		t.Fatalf("Expected no banned connection, got %d", n)
+	}
+}
+
+func TestReloadPermissions(t *testing.T) {
+	s, file := runReloadServer(t, "{user: bob, password: bar}", "")
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	c := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c.Close()
+	expectAuthRequired(t, c)
+	doAuthConnect(t, c, "", "bob", "bar")
+	expectResult(t, c, okRe)
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+	send("SUB foo 1\r\nSUB bar 2\r\nPING\r\n")
+	expect(pongRe)
+
+	writeReloadConfig(t, file, "{user: bob, password: bar, permissions: {publish: \">\", subscribe: \"bar\"}}", "")
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	expect(errRe)
+
+	// The connection stays up, only foo is gone.
+	send("PUB foo 2\r\nok\r\nPUB bar 2\r\nok\r\nPING\r\n")
+	buf := expect(pongRe)
+	matches := msgRe.FindAllSubmatch(buf, -1)
+	if len(matches) != 1 {
+		t.Fatalf("Expected one message, got %q", buf)
+	}
+	checkMsg(t, matches[0], "bar", "2", "", "2", "ok")
+}
+
+func TestReloadMaxPayload(t *testing.T) {
+	s, file := runReloadServer(t, "", "")
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	c := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c.Close()
+	expectAuthRequired(t, c)
+	doAuthConnect(t, c, "", "alice", "foo")
+	expectResult(t, c, okRe)
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+
+	writeReloadConfig(t, file, "", "max_payload: 4")
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	send("PUB foo 5\r\nhello\r\n")
+	expect(errRe)
+
+	// New connections are told about the new limit.
+	c2 := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c2.Close()
+	if info := checkInfoMsg(t, c2); info.MaxPayload != 4 {
+		t.Fatalf("Expected max_payload of 4, got %d", info.MaxPayload)
+	}
+}
+
+func TestReloadMaxPending(t *testing.T) {
+	leafnodes := fmt.Sprintf("leafnodes {\n  listen: 127.0.0.1:%d\n}", RELOAD_LEAF_PORT)
+	s, file := runReloadServer(t, "", leafnodes)
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	sub := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer sub.Close()
+	expectAuthRequired(t, sub)
+	doAuthConnect(t, sub, "", "alice", "foo")
+	expectResult(t, sub, okRe)
+	sendProto(t, sub, "SUB foo 1\r\nPING\r\n")
+	expectResult(t, sub, okRe)
+
+	leaf := createClientConn(t, "127.0.0.1", RELOAD_LEAF_PORT)
+	defer leaf.Close()
+	checkInfoMsg(t, leaf)
+	sendProto(t, leaf, "CONNECT {\"verbose\":false,\"user\":\"alice\",\"pass\":\"foo\",\"name\":\"spoke\"}\r\nSUB foo 1\r\nPING\r\n")
+	expectResult(t, leaf, pongRe)
+	checkLeafNodes(t, 1, s)
+
+	// The connected clients and leaf nodes get the new limit, a
+	// message over it makes them slow consumers.
+	writeReloadConfig(t, file, "", "max_pending: 10\n"+leafnodes)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	pub := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer pub.Close()
+	expectAuthRequired(t, pub)
+	doAuthConnect(t, pub, "", "alice", "foo")
+	expectResult(t, pub, okRe)
+	sendProto(t, pub, "PUB foo 20\r\n0123456789abcdefghij\r\n")
+	expectResult(t, pub, okRe)
+	expectClosed(t, sub)
+	expectClosed(t, leaf)
+	checkLeafNodes(t, 0, s)
+}
+
+func TestReloadRejectsUnsupportedChange(t *testing.T) {
+	s, file := runReloadServer(t, "", "")
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	// A listen change can not be applied, so the max_payload
+	// change in the same file must not be applied either.
+	conf := fmt.Sprintf(reloadBaseConfig, RELOAD_PORT+1, "", "max_payload: 4")
+	if err := ioutil.WriteFile(file, []byte(conf), 0600); err != nil {
+		t.Fatalf("Unable to write config file: %v", err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Fatal("Expected reload to fail")
+	}
+
+	c := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c.Close()
+	if info := checkInfoMsg(t, c); info.MaxPayload == 4 {
+		t.Fatal("Expected max_payload to be unchanged")
+	}
+}
+
+func TestReloadMappings(t *testing.T) {
+	s, file := runReloadServer(t, "", `mappings { foo: bar }`)
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	c := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c.Close()
+	expectAuthRequired(t, c)
+	doAuthConnect(t, c, "", "alice", "foo")
+	expectResult(t, c, okRe)
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+	send("SUB bar 1\r\nSUB baz 2\r\nPUB foo 2\r\nok\r\nPING\r\n")
+	matches := msgRe.FindAllSubmatch(expect(pongRe), -1)
+	if len(matches) != 1 {
+		t.Fatalf("Expected one message, got %d", len(matches))
+	}
+	checkMsg(t, matches[0], "bar", "1", "", "2", "ok")
+
+	writeReloadConfig(t, file, "", `mappings { foo: baz }`)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	send("PUB foo 2\r\nok\r\nPING\r\n")
+	matches = msgRe.FindAllSubmatch(expect(pongRe), -1)
+	if len(matches) != 1 {
+		t.Fatalf("Expected one message, got %d", len(matches))
+	}
+	checkMsg(t, matches[0], "baz", "2", "", "2", "ok")
+
+	// Without the mappings, the subject is kept.
+	writeReloadConfig(t, file, "", "")
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	send("SUB foo 3\r\nPUB foo 2\r\nok\r\nPING\r\n")
+	matches = msgRe.FindAllSubmatch(expect(pongRe), -1)
+	if len(matches) != 1 {
+		t.Fatalf("Expected one message, got %d", len(matches))
+	}
+	checkMsg(t, matches[0], "foo", "3", "", "2", "ok")
+}
+
+func TestReloadAccept(t *testing.T) {
+	s, file := runReloadServer(t, "", "")
+	defer os.Remove(file)
+	defer s.Shutdown()
+
+	c := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer c.Close()
+	checkInfoMsg(t, c)
+
+	writeReloadConfig(t, file, "", `accept { deny: "127.0.0.0/8" }`)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	// Connected clients stay, new ones are rejected.
+	c.Write([]byte("CONNECT {\"user\":\"alice\",\"pass\":\"foo\"}\r\nPING\r\n"))
+	expectResult(t, c, pongRe)
+	nc := createClientConn(t, "127.0.0.1", RELOAD_PORT)
+	defer nc.Close()
+	expectRejected(t, nc)
+}
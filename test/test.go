@@ -64,19 +64,15 @@ func LoadConfig(configFile string) (opts *server.Options) {
 // RunServerWithConfig starts a new Go routine based server with a configuration file.
 func RunServerWithConfig(configFile string) (srv *server.Server, opts *server.Options) {
 	opts = LoadConfig(configFile)
+	opts.ConfigFile = configFile
 
-	// Check for auth
-	var a server.Auth
-	if opts.Authorization != "" {
-		a = &auth.Token{Token: opts.Authorization}
-	}
-	if opts.Username != "" {
-		a = &auth.Plain{Username: opts.Username, Password: opts.Password}
-	}
-	if opts.Users != nil {
-		a = auth.NewMultiUser(opts.Users)
+	srv = server.New(opts)
+	if srv == nil {
+		panic("No NATS Server object returned.")
 	}
-	srv = RunServerWithAuth(opts, a)
+	auth.Configure(srv, opts)
+	srv.SetAuthConfigurer(auth.Configure)
+	startServer(srv)
 	return
 }
 
@@ -93,15 +89,19 @@ func RunServerWithAuth(opts *server.Options, auth server.Auth) *server.Server {
 	if auth != nil {
 		s.SetClientAuthMethod(auth)
 	}
+	startServer(s)
+	return s
+}
 
-	// Run server in Go routine.
+// startServer runs the server in a Go routine, and waits for it to
+// accept connections.
+func startServer(s *server.Server) {
 	go s.Start()
 
 	// Wait for accept loop(s) to be started
 	if !s.ReadyForConnections(10 * time.Second) {
 		panic("Unable to start NATS Server in Go Routine")
 	}
-	return s
 }
 
 func stackFatalf(t tLogger, f string, args ...interface{}) {
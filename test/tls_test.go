@@ -14,6 +14,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/glycerine/hnatsd/auth"
 	"github.com/glycerine/hnatsd/server"
 	"github.com/glycerine/nats"
 )
@@ -106,6 +107,32 @@ func TestTLSClientCertificate(t *testing.T) {
 	defer nc.Close()
 }
 
+func TestTLSMapClientCertificate(t *testing.T) {
+	srv, opts := RunServerWithConfig("./configs/tls_map.conf")
+	defer srv.Shutdown()
+
+	nurl := fmt.Sprintf("tls://%s:%d", opts.Host, opts.Port)
+	certOpts := []nats.Option{
+		nats.ClientCert("./configs/certs/client-cert.pem", "./configs/certs/client-key.pem"),
+		nats.RootCAs("./configs/certs/ca.pem"),
+	}
+
+	// The subject of the certificate is the user, no password needed.
+	nc, err := nats.Connect(nurl, certOpts...)
+	if err != nil {
+		t.Fatalf("Got an error on Connect with a mapped certificate: %+v\n", err)
+	}
+	nc.Close()
+
+	// A certificate which is not a user is rejected.
+	srv.SetClientAuthMethod(auth.NewTLSMap([]*server.User{{Username: "CN=someone-else"}}))
+	nc, err = nats.Connect(nurl, certOpts...)
+	if err == nil {
+		nc.Close()
+		t.Fatal("Expected failure to connect with an unmapped certificate")
+	}
+}
+
 func TestTLSVerifyClientCertificate(t *testing.T) {
 	srv, opts := RunServerWithConfig("./configs/tlsverify_noca.conf")
 	defer srv.Shutdown()
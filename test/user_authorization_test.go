@@ -88,3 +88,97 @@ func TestUserAuthorizationProto(t *testing.T) {
 
 	c.Close()
 }
+
+func TestUserAuthorizationDeny(t *testing.T) {
+	srv, opts := RunServerWithConfig("./configs/permissions.conf")
+	defer srv.Shutdown()
+
+	c := createClientConn(t, opts.Host, opts.Port)
+	defer c.Close()
+	expectAuthRequired(t, c)
+	doAuthConnect(t, c, "", "alice", DefaultPass)
+	expectResult(t, c, okRe)
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+
+	send("PUB orders.new 2\r\nok\r\n")
+	expect(okRe)
+	send("PUB orders.secret.plans 2\r\nok\r\n")
+	expect(permErrRe)
+	send("SUB orders.secret.plans 1\r\n")
+	expect(permErrRe)
+
+	// Messages on denied subjects are not delivered to wildcards.
+	send("SUB orders.> 2\r\n")
+	expect(okRe)
+	pc := createClientConn(t, opts.Host, opts.Port)
+	defer pc.Close()
+	checkInfoMsg(t, pc)
+	doAuthConnect(t, pc, "", "client", DefaultPass)
+	expectResult(t, pc, okRe)
+	sendProto(t, pc, "PUB orders.secret.plans 2\r\nno\r\nPUB orders.new 2\r\nok\r\n")
+	expectResult(t, pc, okRe)
+	send("PING\r\n")
+	matches := expectMsgsCommand(t, expect)(1)
+	checkMsg(t, matches[0], "orders.new", "2", "", "2", "ok")
+}
+
+func TestUserAuthorizationQueue(t *testing.T) {
+	srv, opts := RunServerWithConfig("./configs/permissions.conf")
+	defer srv.Shutdown()
+
+	c := createClientConn(t, opts.Host, opts.Port)
+	defer c.Close()
+	expectAuthRequired(t, c)
+	doAuthConnect(t, c, "", "worker", DefaultPass)
+	expectResult(t, c, okRe)
+	send, expect := sendCommand(t, c), expectCommand(t, c)
+
+	send("SUB jobs 1\r\n")
+	expect(permErrRe)
+	send("SUB jobs others 1\r\n")
+	expect(permErrRe)
+	send("SUB jobs workers 1\r\n")
+	expect(okRe)
+}
+
+func TestUserAuthorizationAllowResponses(t *testing.T) {
+	srv, opts := RunServerWithConfig("./configs/permissions.conf")
+	defer srv.Shutdown()
+
+	wc := createClientConn(t, opts.Host, opts.Port)
+	defer wc.Close()
+	expectAuthRequired(t, wc)
+	doAuthConnect(t, wc, "", "worker", DefaultPass)
+	expectResult(t, wc, okRe)
+	wsend, wexpect := sendCommand(t, wc), expectCommand(t, wc)
+	wsend("SUB jobs workers 1\r\n")
+	wexpect(okRe)
+
+	cc := createClientConn(t, opts.Host, opts.Port)
+	defer cc.Close()
+	checkInfoMsg(t, cc)
+	doAuthConnect(t, cc, "", "client", DefaultPass)
+	expectResult(t, cc, okRe)
+	csend, cexpect := sendCommand(t, cc), expectCommand(t, cc)
+	csend("SUB _INBOX.r1 1\r\n")
+	cexpect(okRe)
+
+	// The worker can not publish to the reply subject before the request.
+	wsend("PUB _INBOX.r1 2\r\nno\r\n")
+	wexpect(permErrRe)
+
+	csend("PUB jobs _INBOX.r1 2\r\ngo\r\n")
+	cexpect(okRe)
+	matches := expectMsgsCommand(t, wexpect)(1)
+	checkMsg(t, matches[0], "jobs", "1", "_INBOX.r1", "2", "go")
+
+	// Once, by default.
+	wsend("PUB _INBOX.r1 3\r\nack\r\n")
+	wexpect(okRe)
+	wsend("PUB _INBOX.r1 4\r\nmore\r\n")
+	wexpect(permErrRe)
+
+	csend("PING\r\n")
+	matches = expectMsgsCommand(t, cexpect)(1)
+	checkMsg(t, matches[0], "_INBOX.r1", "1", "", "3", "ack")
+}
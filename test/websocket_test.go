@@ -0,0 +1,268 @@
+// Copyright 2017 Apcera Inc. All rights reserved.
+
+package test
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glycerine/hnatsd/server"
+)
+
+// wsTestConn is a websocket client connection. It sends the
+// protocol in masked binary frames and returns the payload of
+// the frames sent by the server.
+type wsTestConn struct {
+	net.Conn
+	br  *bufio.Reader
+	rem int
+}
+
+func (c *wsTestConn) Read(p []byte) (int, error) {
+	for c.rem == 0 {
+		var h [2]byte
+		if _, err := io.ReadFull(c.br, h[:]); err != nil {
+			return 0, err
+		}
+		if h[1]&0x80 != 0 {
+			return 0, fmt.Errorf("frame from server is masked")
+		}
+		size := int(h[1])
+		switch size {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(c.br, b[:]); err != nil {
+				return 0, err
+			}
+			size = int(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(c.br, b[:]); err != nil {
+				return 0, err
+			}
+			size = int(binary.BigEndian.Uint64(b[:]))
+		}
+		if op := h[0] & 0xf; op == 8 {
+			return 0, io.EOF
+		} else if op != 2 {
+			return 0, fmt.Errorf("unexpected opcode %d", op)
+		}
+		c.rem = size
+	}
+	if len(p) > c.rem {
+		p = p[:c.rem]
+	}
+	n, err := c.br.Read(p)
+	c.rem -= n
+	return n, err
+}
+
+func (c *wsTestConn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write(wsFrame(2, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// wsFrame returns a masked frame with the given opcode and payload.
+func wsFrame(opcode byte, p []byte) []byte {
+	f := []byte{0x80 | opcode}
+	switch {
+	case len(p) <= 125:
+		f = append(f, 0x80|byte(len(p)))
+	case len(p) <= 65535:
+		f = append(f, 0x80|126, byte(len(p)>>8), byte(len(p)))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(len(p)))
+		f = append(append(f, 0x80|127), b[:]...)
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	f = append(f, mask...)
+	for i, b := range p {
+		f = append(f, b^mask[i&3])
+	}
+	return f
+}
+
+func createWebsocketConn(t tLogger, host string, port int) net.Conn {
+	nc := createClientConn(t, host, port)
+	key := make([]byte, 16)
+	rand.Read(key)
+	k := base64.StdEncoding.EncodeToString(key)
+	req := "GET / HTTP/1.1\r\n" +
+		"Host: " + net.JoinHostPort(host, fmt.Sprintf("%d", port)) + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + k + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: nats\r\n\r\n"
+	if _, err := nc.Write([]byte(req)); err != nil {
+		stackFatalf(t, "Error sending the upgrade request: %v", err)
+	}
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		stackFatalf(t, "Error reading the upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		stackFatalf(t, "Expected status 101, got %d", resp.StatusCode)
+	}
+	h := sha1.Sum([]byte(k + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != base64.StdEncoding.EncodeToString(h[:]) {
+		stackFatalf(t, "Unexpected accept key %q", accept)
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "nats" {
+		stackFatalf(t, "Unexpected protocol %q", p)
+	}
+	return &wsTestConn{Conn: nc, br: br}
+}
+
+func setupWebsocketConn(t *testing.T, opts *server.Options, user, pass string) (net.Conn, sendFun, expectFun) {
+	c := createWebsocketConn(t, opts.Websocket.Host, opts.Websocket.Port)
+	if info := checkInfoMsg(t, c); !info.AuthRequired {
+		t.Fatalf("Expected server to require authorization: %+v", info)
+	}
+	cs := fmt.Sprintf("CONNECT {\"verbose\":false,\"pedantic\":false,\"user\":%q,\"pass\":%q}\r\n", user, pass)
+	sendProto(t, c, cs)
+	return c, sendCommand(t, c), expectCommand(t, c)
+}
+
+func TestWebsocketPubSub(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/websocket.conf")
+	defer s.Shutdown()
+
+	wc, wsend, wexpect := setupWebsocketConn(t, opts, "alice", "foo")
+	defer wc.Close()
+	c, send, expect := setupAccountConn(t, opts, "alice", "foo")
+	defer c.Close()
+
+	wsend("SUB foo 1\r\nPING\r\n")
+	wexpect(pongRe)
+	send("SUB bar 2\r\nPING\r\n")
+	expect(pongRe)
+
+	// From a client to a websocket client.
+	send("PUB foo 5\r\nhello\r\n")
+	matches := expectMsgsCommand(t, wexpect)(1)
+	checkMsg(t, matches[0], "foo", "1", "", "5", "hello")
+
+	// And back.
+	wsend("PUB bar 2\r\nok\r\n")
+	matches = expectMsgsCommand(t, expect)(1)
+	checkMsg(t, matches[0], "bar", "2", "", "2", "ok")
+
+	// A large payload spans frames of extended length.
+	payload := make([]byte, 70000)
+	for i := range payload {
+		payload[i] = 'a'
+	}
+	wsend(fmt.Sprintf("PUB bar %d\r\n%s\r\nPING\r\n", len(payload), payload))
+	wexpect(pongRe)
+
+	// Control frames are answered between the data frames.
+	ws := wc.(*wsTestConn)
+	if _, err := ws.Conn.Write(wsFrame(9, []byte("hi"))); err != nil {
+		t.Fatalf("Error sending ping: %v", err)
+	}
+	var h [4]byte
+	ws.Conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(ws.br, h[:]); err != nil {
+		t.Fatalf("Error reading pong: %v", err)
+	}
+	if h[0] != 0x8a || h[1] != 2 || string(h[2:]) != "hi" {
+		t.Fatalf("Unexpected pong frame: %v", h)
+	}
+
+	// The websocket client is listed in connz.
+	resetPreviousHTTPConnections()
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/connz", opts.HTTPHost, opts.HTTPPort))
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	defer resp.Body.Close()
+	var connz server.Connz
+	if err := json.NewDecoder(resp.Body).Decode(&connz); err != nil {
+		t.Fatalf("Error decoding connz: %v", err)
+	}
+	if connz.NumConns != 2 {
+		t.Fatalf("Expected 2 connections, got %d", connz.NumConns)
+	}
+	found := 0
+	for _, ci := range connz.Conns {
+		if ci.Websocket {
+			found++
+			if ci.IP != "127.0.0.1" || ci.NumSubs != 1 || ci.InMsgs != 2 {
+				t.Fatalf("Unexpected websocket connection: %+v", ci)
+			}
+		}
+	}
+	if found != 1 {
+		t.Fatalf("Expected 1 websocket connection, got %d", found)
+	}
+}
+
+func TestWebsocketAuthorization(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/websocket.conf")
+	defer s.Shutdown()
+
+	c, _, expect := setupWebsocketConn(t, opts, "alice", "bad")
+	defer c.Close()
+	expect(errRe)
+
+	bc, send, expect := setupWebsocketConn(t, opts, "bob", "bar")
+	defer bc.Close()
+	send("SUB bar 1\r\n")
+	expect(permErrRe)
+	send("PUB bar 2\r\nok\r\n")
+	expect(permErrRe)
+	send("SUB foo 1\r\nPUB foo 2\r\nok\r\n")
+	matches := expectMsgsCommand(t, expect)(1)
+	checkMsg(t, matches[0], "foo", "1", "", "2", "ok")
+}
+
+func TestWebsocketAcceptFilters(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/websocket_accept.conf")
+	defer s.Shutdown()
+
+	// The client connection filters apply to websocket clients.
+	c := createWebsocketConn(t, opts.Websocket.Host, opts.Websocket.Port)
+	defer c.Close()
+	checkInfoMsg(t, c)
+	rc := createClientConn(t, opts.Websocket.Host, opts.Websocket.Port)
+	defer rc.Close()
+	expectRejected(t, rc)
+
+	if n := s.Varz().Rejected["client"].RateLimited; n != 1 {
+		t.Fatalf("Expected 1 rate limited connection, got %d", n)
+	}
+}
+
+func TestWebsocketBadUpgrade(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/websocket.conf")
+	defer s.Shutdown()
+
+	resetPreviousHTTPConnections()
+	resp, err := http.Get(fmt.Sprintf("http://%s:%d/", opts.Websocket.Host, opts.Websocket.Port))
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", resp.StatusCode)
+	}
+	if n := s.NumClients(); n != 0 {
+		t.Fatalf("Expected no clients, got %d", n)
+	}
+}